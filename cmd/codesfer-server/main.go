@@ -1,7 +1,36 @@
 package main
 
-import "codesfer/internal/server"
+import (
+	"codesfer/internal/server"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gnitoahc/go-dotenv"
+)
+
+var (
+	port = flag.Int("port", 3000, "The server port")
+)
 
 func main() {
-	server.Serve()
+	dotenv.Load(".env")
+	flag.Parse()
+
+	cfg, err := server.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv, err := server.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go srv.Janitor(context.Background(), time.Minute)
+
+	log.Printf("Starting server on port %d", *port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), srv))
 }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"codesfer/internal/cli"
+	"codesfer/pkg/api"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -22,12 +25,13 @@ var pushCmd = &cobra.Command{
 	},
 }
 
+var listCmdOrg string
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all your code snippets.",
-	Long:  `List all your code snippets. This command allows you to list your code snippets.`,
+	Long:  `List all your code snippets. This command allows you to list your code snippets, or those of an organization with --org.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		cli.List()
+		cli.List(listCmdOrg)
 	},
 }
 
@@ -49,12 +53,23 @@ var removeCmd = &cobra.Command{
 	},
 }
 
+var moveCmd = &cobra.Command{
+	Use:   "mv [code] [new/path]",
+	Short: "Rename a code snippet.",
+	Long:  `Rename a code snippet. This command moves a code snippet to a new path without uploading it again.`,
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.Move(args[0], args[1])
+	},
+}
+
+var loginCmdFlags cli.LoginFlags
 var loginCmd = &cobra.Command{
 	Use:   "login",
 	Short: "Login to Codesfer.",
-	Long:  `Login to Codesfer. This command allows you to login to Codesfer.`,
+	Long:  `Login to Codesfer. This command allows you to login to Codesfer. Use --sso to log in through your organization's identity provider, --device on shared or headless machines, --ssh with a registered ssh key, --email with --password-stdin in scripts, or set CODESFER_TOKEN to skip logging in.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		cli.Login()
+		cli.Login(loginCmdFlags)
 	},
 }
 
@@ -67,12 +82,24 @@ var logoutCmd = &cobra.Command{
 	},
 }
 
+var registerCmdFlags cli.RegisterFlags
 var registerCmd = &cobra.Command{
 	Use:   "register",
 	Short: "Register to Codesfer.",
 	Long:  `Register to Codesfer. This command allows you to register to Codesfer.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		cli.Register()
+		cli.Register(registerCmdFlags)
+	},
+}
+
+var approveCmdFlags cli.ApproveFlags
+var approveCmd = &cobra.Command{
+	Use:   "approve <code>",
+	Short: "Approve a device login.",
+	Long:  `Approve a device login. Logs in the machine that ran 'codesfer login --device' and shows this code, as your account.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.Approve(args[0], approveCmdFlags)
 	},
 }
 
@@ -85,6 +112,355 @@ var accountCmd = &cobra.Command{
 	},
 }
 
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage personal access tokens.",
+	Long:  `Manage personal access tokens. Tokens authenticate scripts and CI pipelines with a limited set of scopes instead of a full session.`,
+}
+
+var tokenCreateCmdFlags cli.TokenFlags
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a personal access token.",
+	Long:  `Create a personal access token. The token is printed once, store it in your CI secrets.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.TokenCreate(tokenCreateCmdFlags)
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List your personal access tokens.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.TokenList()
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke [id1] [id2] ...",
+	Short: "Revoke personal access tokens.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.TokenRevoke(args)
+	},
+}
+
+var accountRevokeAllOthers bool
+var accountRevokeCmd = &cobra.Command{
+	Use:   "revoke [n]",
+	Short: "Revoke a session.",
+	Long:  `Revoke a session. The number is the one shown by 'codesfer account'; use --all-others to sign out every other device.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if accountRevokeAllOthers {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		n := ""
+		if len(args) > 0 {
+			n = args[0]
+		}
+		cli.AccountRevoke(n, accountRevokeAllOthers)
+	},
+}
+
+var accountPasswdCmd = &cobra.Command{
+	Use:   "passwd",
+	Short: "Change your password.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.AccountPasswd()
+	},
+}
+
+var accountResetCmdFlags cli.ResetFlags
+var accountResetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "Reset a forgotten password.",
+	Long:  `Reset a forgotten password. Without --code a reset code is sent to your email; run again with --code to choose a new password.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.AccountReset(accountResetCmdFlags)
+	},
+}
+
+var accountVerifyCmdFlags cli.VerifyFlags
+var accountVerifyCmd = &cobra.Command{
+	Use:   "verify [code]",
+	Short: "Verify your email address.",
+	Long:  `Verify your email address with the code sent after registering. Use --resend to get a new code.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if accountVerifyCmdFlags.Resend {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		code := ""
+		if len(args) > 0 {
+			code = args[0]
+		}
+		cli.AccountVerify(accountVerifyCmdFlags, code)
+	},
+}
+
+var accountUsageOrg string
+var accountUsageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Show your storage usage.",
+	Long:  `Show the bytes and code snippets you store against your quota. Use --org for an organization you are a member of.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.AccountUsage(accountUsageOrg)
+	},
+}
+
+var accountDeleteCmdFlags cli.DeleteFlags
+var accountDeleteCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Delete your account.",
+	Long:  `Delete your account. This removes your account, sessions, access tokens and all of your code snippets.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.AccountDelete(accountDeleteCmdFlags)
+	},
+}
+
+var accountTwoFactorCmd = &cobra.Command{
+	Use:   "2fa",
+	Short: "Manage two-factor authentication.",
+	Long:  `Manage two-factor authentication. Once enabled, logging in asks for a code from your authenticator app or a recovery code.`,
+}
+
+var accountTwoFactorEnableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Enable two-factor authentication.",
+	Long:  `Enable two-factor authentication. Prints a QR code for your authenticator app, asks for a first code and prints your recovery codes.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.AccountTwoFactorEnable()
+	},
+}
+
+var accountTwoFactorDisableCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Disable two-factor authentication.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.AccountTwoFactorDisable()
+	},
+}
+
+var accountSSHKeyCmd = &cobra.Command{
+	Use:   "ssh-key",
+	Short: "Manage the ssh keys you can log in with.",
+	Long:  `Manage the ssh keys you can log in with using 'codesfer login --ssh'.`,
+}
+
+var accountSSHKeyAddName string
+var accountSSHKeyAddCmd = &cobra.Command{
+	Use:   "add [public key file]",
+	Short: "Add an ssh public key.",
+	Long:  `Add an ssh public key. Defaults to the first of ~/.ssh/id_ed25519.pub, id_ecdsa.pub and id_rsa.pub; use - to read it from stdin.`,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := ""
+		if len(args) > 0 {
+			path = args[0]
+		}
+		cli.AccountSSHKeyAdd(path, accountSSHKeyAddName)
+	},
+}
+
+var accountSSHKeyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List your ssh keys.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.AccountSSHKeyList()
+	},
+}
+
+var accountSSHKeyRemoveCmd = &cobra.Command{
+	Use:   "remove <id>",
+	Short: "Remove an ssh key.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.AccountSSHKeyRemove(args[0])
+	},
+}
+
+var shareCmdTo []string
+var shareCmd = &cobra.Command{
+	Use:   "share <code> --to <username1,username2>",
+	Short: "Share a code snippet with other users.",
+	Long:  `Share a code snippet with other users. The snippet shows up in their inbox and they can pull it even while it is private.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.Share(args[0], shareCmdTo)
+	},
+}
+
+var chmodCmd = &cobra.Command{
+	Use:   "chmod <code> <private|unlisted|public>",
+	Short: "Change who can pull a code snippet.",
+	Long:  `Change who can pull a code snippet. Private snippets can only be pulled by you, your organization and the users they are shared with, unlisted ones by anyone with the code, public ones are also listed on your profile.`,
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.Chmod(args[0], args[1])
+	},
+}
+
+var linkCmdFlags cli.LinkFlags
+var linkCmd = &cobra.Command{
+	Use:   "link <code> [--expires 24h] [--max-downloads 3]",
+	Short: "Create a link that lets anyone download a code snippet.",
+	Long:  `Create a signed link that lets anyone, even without an account, download a code snippet until it expires, also a private one. Open it with curl or 'codesfer pull <link>'. A password protected snippet still needs its password.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.Link(args[0], linkCmdFlags)
+	},
+}
+
+var linkRevokeCmd = &cobra.Command{
+	Use:   "revoke <code>",
+	Short: "Revoke every link to a code snippet.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.LinkRevoke(args[0])
+	},
+}
+
+var profileCmd = &cobra.Command{
+	Use:   "profile <username>",
+	Short: "List the public code snippets of a user or organization.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.Profile(args[0])
+	},
+}
+
+var inboxCmd = &cobra.Command{
+	Use:   "inbox",
+	Short: "List the code snippets shared with you.",
+	Long:  `List the code snippets shared with you, newest first. Unread ones are marked with *, pulling a snippet marks it read.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.Inbox()
+	},
+}
+
+var inboxReadAll bool
+var inboxReadCmd = &cobra.Command{
+	Use:   "read [code1] [code2] ...",
+	Short: "Mark code snippets in your inbox as read.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if inboxReadAll {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.MinimumNArgs(1)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.InboxRead(args)
+	},
+}
+
+var orgCmd = &cobra.Command{
+	Use:   "org",
+	Short: "Manage organizations.",
+	Long:  `Manage organizations. Members of an organization share the code snippets pushed with 'codesfer push --org'. Owners manage members, writers push, move and remove snippets, readers list and pull them.`,
+}
+
+var orgCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create an organization.",
+	Long:  `Create an organization. You become its first owner; the name shares the namespace of usernames.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.OrgCreate(args[0])
+	},
+}
+
+var orgListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List your organizations.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.OrgList()
+	},
+}
+
+var orgMembersCmd = &cobra.Command{
+	Use:   "members <org>",
+	Short: "List the members of an organization.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.OrgMembers(args[0])
+	},
+}
+
+var orgInviteCmdRole string
+var orgInviteCmd = &cobra.Command{
+	Use:   "invite <org> <username1> [username2] ...",
+	Short: "Invite members to an organization.",
+	Long:  `Invite members to an organization, or change the role of existing ones. Invitees join once they run 'codesfer org accept <org>'. Only owners can invite.`,
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.OrgInvite(args[0], orgInviteCmdRole, args[1:])
+	},
+}
+
+var orgInvitesCmd = &cobra.Command{
+	Use:   "invites",
+	Short: "List your invitations to organizations.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.OrgInvites()
+	},
+}
+
+var orgAcceptCmd = &cobra.Command{
+	Use:   "accept <org>",
+	Short: "Join an organization you were invited to.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.OrgAnswer(args[0], false)
+	},
+}
+
+var orgDeclineCmd = &cobra.Command{
+	Use:   "decline <org>",
+	Short: "Decline an invitation to an organization.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.OrgAnswer(args[0], true)
+	},
+}
+
+var orgRemoveCmd = &cobra.Command{
+	Use:   "remove <org> <username1> [username2] ...",
+	Short: "Remove members from an organization.",
+	Long:  `Remove members from an organization or withdraw their invitations. Owners can remove anyone, other members can remove themselves to leave.`,
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.OrgRemove(args[0], args[1:])
+	},
+}
+
+var orgDeleteCmdYes bool
+var orgDeleteCmd = &cobra.Command{
+	Use:   "delete <org>",
+	Short: "Delete an organization.",
+	Long:  `Delete an organization. This removes the organization and all of its code snippets.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.OrgDelete(args[0], orgDeleteCmdYes)
+	},
+}
+
 var configCmd = &cobra.Command{
 	Use:   "config",
 	Short: "Configure Codesfer settings.",
@@ -110,7 +486,7 @@ var configGetCmd = &cobra.Command{
 }
 
 func main() {
-	rootCmd.AddCommand(pushCmd, listCmd, pullCmd, removeCmd, loginCmd, logoutCmd, registerCmd, accountCmd)
+	rootCmd.AddCommand(pushCmd, listCmd, pullCmd, removeCmd, moveCmd, loginCmd, logoutCmd, registerCmd, approveCmd, accountCmd)
 
 	// =============
 	// pushCmd flags
@@ -128,6 +504,22 @@ func main() {
 	pushCmd.Flags().StringVarP(
 		&pushCmdFlags.Key, "key", "k", "", "Key to get faster access to the code snippet",
 	)
+	pushCmd.Flags().StringVar(
+		&pushCmdFlags.Org, "org", "", "Push to an organization you are a writer or owner of",
+	)
+	pushCmd.Flags().StringSliceVar(
+		&pushCmdFlags.To, "to", nil, "Comma-separated usernames to share the code snippet with",
+	)
+	pushCmd.Flags().StringVar(
+		&pushCmdFlags.Visibility, "visibility", "", "Who can pull the code snippet: private (default), unlisted or public",
+	)
+
+	// =============
+	// listCmd flags
+	// =============
+	listCmd.Flags().StringVar(
+		&listCmdOrg, "org", "", "List the code snippets of an organization",
+	)
 
 	// =============
 	// pullCmd flags
@@ -139,11 +531,152 @@ func main() {
 		&pullCmdFlags.Pass, "pass", "p", "", "Password for the code snippet if it is encrypted",
 	)
 
+	// ==============================
+	// loginCmd and registerCmd flags
+	// ==============================
+	loginCmd.Flags().StringVar(
+		&loginCmdFlags.Email, "email", "", "Account email, prompted for if empty",
+	)
+	loginCmd.Flags().BoolVar(
+		&loginCmdFlags.PasswordStdin, "password-stdin", false, "Read the password from the first line of stdin",
+	)
+	loginCmd.Flags().StringVar(
+		&loginCmdFlags.OTP, "otp", "", "Two-factor code, prompted for if needed",
+	)
+	loginCmd.Flags().BoolVar(
+		&loginCmdFlags.SSO, "sso", false, "Log in through your organization's identity provider",
+	)
+	loginCmd.Flags().BoolVar(
+		&loginCmdFlags.Device, "device", false, "Log in by approving a code from a machine that is already logged in",
+	)
+	loginCmd.Flags().BoolVar(
+		&loginCmdFlags.SSH, "ssh", false, "Log in with an ssh key from ssh-agent or ~/.ssh",
+	)
+	loginCmd.Flags().StringVarP(
+		&loginCmdFlags.Identity, "identity", "i", "", "With --ssh, the private key file to use",
+	)
+	loginCmd.MarkFlagsMutuallyExclusive("sso", "device", "ssh")
+	loginCmd.Flags().BoolVar(
+		&loginCmdFlags.NoBrowser, "no-browser", false, "With --sso, print the login URL instead of opening a browser",
+	)
+	registerCmd.Flags().StringVar(
+		&registerCmdFlags.Email, "email", "", "Account email, prompted for if empty",
+	)
+	registerCmd.Flags().StringVar(
+		&registerCmdFlags.Username, "username", "", "Username, prompted for if empty",
+	)
+	registerCmd.Flags().BoolVar(
+		&registerCmdFlags.PasswordStdin, "password-stdin", false, "Read the password from the first line of stdin",
+	)
+
+	// ================
+	// approveCmd flags
+	// ================
+	approveCmd.Flags().BoolVar(
+		&approveCmdFlags.Deny, "deny", false, "Deny the login instead",
+	)
+	approveCmd.Flags().BoolVarP(
+		&approveCmdFlags.Yes, "yes", "y", false, "Do not ask for confirmation",
+	)
+
+	// ======================
+	// accountCmd subcommands
+	// ======================
+	accountRevokeCmd.Flags().BoolVar(
+		&accountRevokeAllOthers, "all-others", false, "Revoke every session except the current one",
+	)
+	accountResetCmd.Flags().StringVar(
+		&accountResetCmdFlags.Email, "email", "", "Account email to send the reset code to",
+	)
+	accountResetCmd.Flags().StringVar(
+		&accountResetCmdFlags.Code, "code", "", "Reset code from the email",
+	)
+	accountResetCmd.Flags().BoolVar(
+		&accountResetCmdFlags.PasswordStdin, "password-stdin", false, "Read the new password from the first line of stdin",
+	)
+	accountDeleteCmd.Flags().BoolVarP(
+		&accountDeleteCmdFlags.Yes, "yes", "y", false, "Do not ask for confirmation",
+	)
+	accountDeleteCmd.Flags().BoolVar(
+		&accountDeleteCmdFlags.PasswordStdin, "password-stdin", false, "Read the password from the first line of stdin",
+	)
+	accountVerifyCmd.Flags().BoolVar(
+		&accountVerifyCmdFlags.Resend, "resend", false, "Send a new verification code",
+	)
+	accountVerifyCmd.Flags().StringVar(
+		&accountVerifyCmdFlags.Email, "email", "", "Account email for --resend, defaults to the logged in account",
+	)
+	accountTwoFactorCmd.AddCommand(accountTwoFactorEnableCmd, accountTwoFactorDisableCmd)
+	accountSSHKeyAddCmd.Flags().StringVar(
+		&accountSSHKeyAddName, "name", "", "Name of the key, defaults to its comment",
+	)
+	accountSSHKeyCmd.AddCommand(accountSSHKeyAddCmd, accountSSHKeyListCmd, accountSSHKeyRemoveCmd)
+	accountUsageCmd.Flags().StringVar(
+		&accountUsageOrg, "org", "", "Show the usage of an organization",
+	)
+	accountCmd.AddCommand(accountRevokeCmd, accountPasswdCmd, accountResetCmd, accountDeleteCmd, accountVerifyCmd, accountTwoFactorCmd, accountSSHKeyCmd, accountUsageCmd)
+
+	// ====================
+	// tokenCmd subcommands
+	// ====================
+	tokenCreateCmd.Flags().StringVar(
+		&tokenCreateCmdFlags.Name, "name", "", "Name to recognize the token by",
+	)
+	tokenCreateCmd.Flags().StringSliceVar(
+		&tokenCreateCmdFlags.Scopes, "scope", nil, "Comma-separated scopes: "+strings.Join(api.Scopes, ", "),
+	)
+	tokenCreateCmd.Flags().StringVar(
+		&tokenCreateCmdFlags.Expires, "expires", "", "Lifetime of the token, e.g. '30d' or '12h' (never expires if empty)",
+	)
+	tokenCreateCmd.MarkFlagRequired("name")
+	tokenCreateCmd.MarkFlagRequired("scope")
+	tokenCmd.AddCommand(tokenCreateCmd, tokenListCmd, tokenRevokeCmd)
+	rootCmd.AddCommand(tokenCmd)
+
+	// ===========================
+	// shareCmd and inboxCmd flags
+	// ===========================
+	shareCmd.Flags().StringSliceVar(
+		&shareCmdTo, "to", nil, "Comma-separated usernames to share the code snippet with",
+	)
+	shareCmd.MarkFlagRequired("to")
+	inboxReadCmd.Flags().BoolVar(
+		&inboxReadAll, "all", false, "Mark everything in your inbox as read",
+	)
+	inboxCmd.AddCommand(inboxReadCmd)
+	rootCmd.AddCommand(shareCmd, inboxCmd, chmodCmd, profileCmd)
+
+	// =============
+	// linkCmd flags
+	// =============
+	linkCmd.Flags().StringVar(
+		&linkCmdFlags.Expires, "expires", "24h", "How long the link works, e.g. 1h or 7d, at most 30d",
+	)
+	linkCmd.Flags().IntVar(
+		&linkCmdFlags.MaxDownloads, "max-downloads", 0, "How many times the link can be used, unlimited if 0",
+	)
+	linkCmd.AddCommand(linkRevokeCmd)
+	rootCmd.AddCommand(linkCmd)
+
+	// ==================
+	// orgCmd subcommands
+	// ==================
+	orgInviteCmd.Flags().StringVar(
+		&orgInviteCmdRole, "role", api.RoleReader, "Role of the members: "+strings.Join(api.Roles, ", "),
+	)
+	orgDeleteCmd.Flags().BoolVarP(
+		&orgDeleteCmdYes, "yes", "y", false, "Do not ask for confirmation",
+	)
+	orgCmd.AddCommand(orgCreateCmd, orgListCmd, orgMembersCmd, orgInviteCmd, orgInvitesCmd, orgAcceptCmd, orgDeclineCmd, orgRemoveCmd, orgDeleteCmd)
+	rootCmd.AddCommand(orgCmd)
+
 	// =====================
 	// configCmd subcommands
 	// =====================
 	configCmd.AddCommand(configSetCmd, configGetCmd)
 	rootCmd.AddCommand(configCmd)
 
-	rootCmd.Execute()
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
@@ -1,9 +1,15 @@
 package cli
 
 import (
+	"bufio"
 	"codesfer/internal/client"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -14,10 +20,19 @@ import (
 func Account() {
 	account, err := client.AccountInfo(client.ReadSessionID())
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	if account.Verified {
+		fmt.Printf("Email: %s\n", account.Email)
+	} else {
+		fmt.Printf("Email: %s (unverified, see `codesfer account verify --resend`)\n", account.Email)
 	}
-	fmt.Printf("Email: %s\n", account.Email)
 	fmt.Printf("Username: %s\n", account.Username)
+	if account.TwoFactor {
+		fmt.Println("Two-factor authentication: enabled")
+	} else {
+		fmt.Println("Two-factor authentication: disabled, see `codesfer account 2fa enable`")
+	}
 	for i, session := range account.Sessions {
 		if session.Current {
 			fmt.Printf("%s", "\033[36m") // cyan
@@ -32,6 +47,49 @@ func Account() {
 	}
 }
 
+// AccountRevoke revokes the session shown as [n] by `codesfer account`, or all
+// sessions but the current one with allOthers.
+func AccountRevoke(n string, allOthers bool) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	if allOthers {
+		if err := client.RevokeOtherSessions(sessionID); err != nil {
+			fatal(err)
+		}
+		fmt.Println("All other sessions revoked.")
+		return
+	}
+
+	// Indexes refer to the listing order, resolve them to session ids first
+	idx, err := strconv.Atoi(n)
+	if err != nil {
+		log.Fatalf("Invalid session number %q, see `codesfer account`.", n)
+	}
+	account, err := client.AccountInfo(sessionID)
+	if err != nil {
+		fatal(err)
+	}
+	if idx < 0 || idx >= len(account.Sessions) {
+		log.Fatalf("No session [%d], see `codesfer account`.", idx)
+	}
+	session := account.Sessions[idx]
+
+	if err := client.RevokeSession(sessionID, session.ID); err != nil {
+		fatal(err)
+	}
+	if session.Current && !client.UsingEnvToken() {
+		if err := client.RemoveSessionID(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Current session revoked, you are logged out.")
+		return
+	}
+	fmt.Printf("Session [%d] (%s, %s) revoked.\n", idx, session.Location, session.Agent)
+}
+
 // formatLastSeen formats the last seen timestamp based on its relation to the current date.
 func formatLastSeen(lastSeen string) string {
 	t, err := time.Parse(time.RFC3339, lastSeen)
@@ -52,38 +110,99 @@ func formatLastSeen(lastSeen string) string {
 	}
 }
 
+type LoginFlags struct {
+	Email         string
+	PasswordStdin bool
+	OTP           string // Two-factor code, prompted for if needed and empty
+	SSO           bool   // Log in through the server's identity provider
+	NoBrowser     bool   // With SSO, only print the login URL
+	Device        bool   // Log in by approving a code from another machine
+	SSH           bool   // Log in with an ssh key
+	Identity      string // With SSH, the private key file instead of ssh-agent and ~/.ssh
+}
+
 // Login authenticates the user and stores the session locally.
-func Login() {
+// Without flags it prompts on the terminal; --email and --password-stdin make it scriptable.
+func Login(flags LoginFlags) {
+	if client.UsingEnvToken() {
+		log.Fatalf("%s is set, unset it to log in with a different account.", client.TokenEnv)
+	}
 	session := client.ReadSessionID()
 	if session != "" {
-		fmt.Println("You are already logged in. Logout first to sign in to different account.")
+		log.Fatal("You are already logged in. Logout first to sign in to different account.")
+	}
+
+	if flags.SSO || flags.Device || flags.SSH {
+		var sessionID string
+		switch {
+		case flags.SSO:
+			sessionID = loginSSO(flags.NoBrowser)
+		case flags.Device:
+			sessionID = loginDevice()
+		default:
+			var err error
+			if sessionID, err = client.LoginSSH(sshSigners(flags.Identity)); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := client.WriteSessionID(sessionID); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Login successful.")
 		return
 	}
 
-	var email string
-	var password string
+	email := flags.Email
+	if email == "" {
+		email = prompt("Email: ")
+	}
+	password := readPassword("Password: ", flags.PasswordStdin)
 
-	fmt.Print("Email: ")
-	fmt.Scanln(&email)
-	fmt.Print("Password: ")
-	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	sessionID, err := client.Login(email, password)
+	var twoFactor *client.TwoFactorRequired
+	if errors.As(err, &twoFactor) {
+		code := flags.OTP
+		if code == "" {
+			code = prompt("Two-factor code (or a recovery code): ")
+		}
+		sessionID, err = client.LoginTwoFactor(twoFactor.Challenge, code)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println() // move to next line after input
-	password = string(bytePassword)
 
-	sessionID, err := client.Login(email, password)
-	if err != nil {
+	if err := client.WriteSessionID(sessionID); err != nil {
 		log.Fatal(err)
 	}
+	fmt.Println("Login successful.")
+}
 
-	fmt.Printf("Login successful. Session ID: %s\n", sessionID)
-	client.WriteSessionID(sessionID)
+// fatal reports err and exits. When the server rejected the session, the stale
+// session is dropped and the user is asked to log in again. A rejected token from
+// the environment leaves the saved session alone, it was not used.
+func fatal(err error) {
+	if !errors.Is(err, client.ErrSessionExpired) {
+		log.Fatal(err)
+	}
+	if client.UsingEnvToken() {
+		log.Fatalf("The token in %s was rejected, it expired or was revoked.", client.TokenEnv)
+	}
+	if err := client.RemoveSessionID(); err != nil {
+		log.Println("Failed to remove local session:", err)
+	}
+	fmt.Println("Your session has expired, please log in again.")
+	if term.IsTerminal(int(syscall.Stdin)) {
+		Login(LoginFlags{})
+		fmt.Println("Run the command again to continue.")
+	}
+	os.Exit(1)
 }
 
 // Logout removes the remote and local sessions.
 func Logout() {
+	if client.UsingEnvToken() {
+		log.Fatalf("%s is set, unset it to log out.", client.TokenEnv)
+	}
 	sessionID := client.ReadSessionID()
 	err := client.Logout(sessionID)
 	if err != nil {
@@ -96,65 +215,220 @@ func Logout() {
 	fmt.Println("Logout successful.")
 }
 
+type RegisterFlags struct {
+	Email         string
+	Username      string
+	PasswordStdin bool
+}
+
 // Register signs up a new account with email/password/username.
-func Register() {
+// Missing values are prompted for on the terminal.
+func Register(flags RegisterFlags) {
 	session := client.ReadSessionID()
 	if session != "" {
-		fmt.Println("You are logged in. Logout first to register for an account.")
-		return
+		log.Fatal("You are logged in. Logout first to register for an account.")
 	}
 
-	var email string
-	var password string
-	var confirmPassword string
-	var username string
+	email := flags.Email
+	if email == "" {
+		email = prompt("Email: ")
+	}
 
-	fmt.Print("Email: ")
-	fmt.Scanln(&email)
+	password := readNewPassword("Password: ", flags.PasswordStdin)
 
-	fmt.Print("Password: ")
-	bytePass, err := term.ReadPassword(int(syscall.Stdin))
-	if err != nil {
-		log.Fatal(err)
+	username := flags.Username
+	if username != "" {
+		if ok, err := client.UsernameAvailable(username); err != nil || !ok {
+			log.Fatalf("Username %s is not available.", username)
+		}
 	}
-	fmt.Println() // move to next line after input
-	password = string(bytePass)
+	for username == "" {
+		candidate := prompt(fmt.Sprintf("Username (%sOnly single word is allowed%s): ", "\033[36m", "\033[0m")) // cyan
 
-	fmt.Print("Confirm your password again: ")
-	confirmBytePass, err := term.ReadPassword(int(syscall.Stdin))
-	if err != nil {
+		fmt.Printf("Checking username: {%s} availability...\n", candidate)
+		if candidate == "" {
+			fmt.Println("Username cannot be empty. Please try again.")
+			continue
+		}
+
+		ok, err := client.UsernameAvailable(candidate)
+		if err != nil || !ok {
+			fmt.Println("Username is not available. Please try again.")
+			continue
+		}
+		username = candidate
+	}
+
+	if err := client.Register(email, password, username); err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println() // move to next line after input
-	confirmPassword = string(confirmBytePass)
+	fmt.Println("Registration successful. Please login to continue.")
+	fmt.Println("A verification code was sent to your email, run `codesfer account verify <code>` to confirm it.")
+}
+
+type VerifyFlags struct {
+	Resend bool
+	Email  string
+}
 
-	if password != confirmPassword {
-		fmt.Println("Passwords do not match. Please try again.")
+// AccountVerify confirms the account email with the code from the verification
+// email, or asks for a new code with --resend.
+func AccountVerify(flags VerifyFlags, code string) {
+	if flags.Resend {
+		email := flags.Email
+		if email == "" {
+			if sessionID := client.ReadSessionID(); sessionID != "" {
+				if account, err := client.AccountInfo(sessionID); err == nil {
+					email = account.Email
+				}
+			}
+		}
+		if email == "" {
+			email = prompt("Email: ")
+		}
+		if err := client.ResendVerification(email); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("If %s is awaiting verification, a new code is on its way.\n", email)
 		return
 	}
 
-	usernameOk := false
-	for !usernameOk {
-		fmt.Printf("Username (%sOnly single word is allowed%s): ", "\033[36m", "\033[0m") // cyan
-		fmt.Scanln(&username)
+	if err := client.VerifyEmail(code); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Email verified.")
+}
 
-		fmt.Printf("Checking username: {%s} availability...\n", username)
-		if username == "" {
-			fmt.Println("Username cannot be empty. Please try again.")
-			continue
+// readNewPassword reads a password to be set, asking twice on the terminal
+func readNewPassword(label string, fromStdin bool) string {
+	password := readPassword(label, fromStdin)
+	if !fromStdin {
+		confirmPassword := readPassword("Confirm your password again: ", false)
+		if password != confirmPassword {
+			log.Fatal("Passwords do not match. Please try again.")
 		}
+	}
+	return password
+}
+
+// AccountPasswd changes the password of the logged-in user.
+func AccountPasswd() {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	oldPassword := readPassword("Current password: ", false)
+	newPassword := readNewPassword("New password: ", false)
+	if err := client.ChangePassword(sessionID, oldPassword, newPassword); err != nil {
+		fatal(err)
+	}
+	fmt.Println("Password changed. Your other sessions were signed out.")
+}
+
+type ResetFlags struct {
+	Email         string
+	Code          string
+	PasswordStdin bool
+}
 
-		usernameOk, err = client.UsernameAvailable(username)
-		if err != nil {
+// AccountReset requests a password reset code by email, or sets a new
+// password with a code received that way.
+func AccountReset(flags ResetFlags) {
+	if flags.Code == "" {
+		email := flags.Email
+		if email == "" {
+			email = prompt("Email: ")
+		}
+		if err := client.RequestPasswordReset(email); err != nil {
 			log.Fatal(err)
 		}
-		if !usernameOk {
-			fmt.Println("Username is not available. Please try again.")
+		fmt.Printf("If %s has an account, a reset code is on its way.\n", email)
+		fmt.Println("Run `codesfer account reset --code <code>` to choose a new password.")
+		return
+	}
+
+	password := readNewPassword("New password: ", flags.PasswordStdin)
+	if err := client.ResetPassword(flags.Code, password); err != nil {
+		log.Fatal(err)
+	}
+	// Every session was signed out, including the local one
+	if !client.UsingEnvToken() {
+		if err := client.RemoveSessionID(); err != nil {
+			log.Println("Failed to remove local session:", err)
 		}
 	}
+	fmt.Println("Password reset. Please login to continue.")
+}
 
-	if err := client.Register(email, password, username); err != nil {
+type DeleteFlags struct {
+	Yes           bool
+	PasswordStdin bool
+}
+
+// AccountDelete deletes the logged-in user's account and all of their code snippets.
+func AccountDelete(flags DeleteFlags) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+	account, err := client.AccountInfo(sessionID)
+	if err != nil {
+		fatal(err)
+	}
+
+	if !flags.Yes {
+		fmt.Printf("This deletes %s (%s) and all of its code snippets. It cannot be undone.\n", account.Username, account.Email)
+		if prompt("Type your username to confirm: ") != account.Username {
+			log.Fatal("Username does not match, account not deleted.")
+		}
+	}
+	password := readPassword("Password: ", flags.PasswordStdin)
+
+	if err := client.DeleteAccount(sessionID, password); err != nil {
+		fatal(err)
+	}
+	if !client.UsingEnvToken() {
+		if err := client.RemoveSessionID(); err != nil {
+			log.Println("Failed to remove local session:", err)
+		}
+	}
+	fmt.Println("Account deleted.")
+}
+
+// prompt asks for a line on the terminal, it fails instead of blocking when there is no terminal
+func prompt(label string) string {
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		log.Fatalf("Cannot prompt for %q without a terminal, pass it as a flag.", strings.TrimSuffix(label, ": "))
+	}
+	var value string
+	fmt.Print(label)
+	fmt.Scanln(&value)
+	return value
+}
+
+// readPassword reads a password from stdin when fromStdin is set (first line, for pipelines),
+// otherwise from the terminal without echo.
+func readPassword(label string, fromStdin bool) string {
+	if fromStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal(err)
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if password == "" {
+			log.Fatal("Empty password on stdin.")
+		}
+		return password
+	}
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		log.Fatal("Cannot prompt for a password without a terminal, use --password-stdin.")
+	}
+	fmt.Print(label)
+	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Registration successful. Please login to continue.")
+	fmt.Println() // move to next line after input
+	return string(bytePassword)
 }
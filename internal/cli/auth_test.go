@@ -0,0 +1,241 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"codesfer/pkg/api"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// helperEnv selects the command run by TestHelperProcess in a child process.
+// The commands end in log.Fatal and os.Exit, which only a child can survive.
+const helperEnv = "CODESFER_CLI_HELPER"
+
+var helperCommands = map[string]func(){
+	"login":          func() { Login(LoginFlags{}) },
+	"login-stdin":    func() { Login(LoginFlags{Email: "ada@example.com", PasswordStdin: true}) },
+	"register-stdin": func() { Register(RegisterFlags{Email: "ada@example.com", Username: "ada", PasswordStdin: true}) },
+	"account":        func() { Account() },
+}
+
+func TestHelperProcess(t *testing.T) {
+	command, ok := helperCommands[os.Getenv(helperEnv)]
+	if !ok {
+		t.Skip("only runs as a child of the other tests")
+	}
+	command()
+	os.Exit(0)
+}
+
+// fakeAuth serves the /auth routes used by login, register and account.
+// Only the password "secret" and the token "good" are accepted.
+type fakeAuth struct {
+	mu        sync.Mutex
+	passwords []string // passwords received by login and register
+}
+
+func (f *fakeAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method + " " + r.URL.Path {
+	case "POST /auth/login", "POST /auth/register":
+		var data api.RegisterRequest
+		json.NewDecoder(r.Body).Decode(&data)
+		f.mu.Lock()
+		f.passwords = append(f.passwords, data.Password)
+		f.mu.Unlock()
+		if data.Password != "secret" {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/auth/register" {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("X-Session-ID", "good")
+	case "GET /auth/username":
+		w.WriteHeader(http.StatusOK)
+	case "GET /auth/me":
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(api.AccountResponse{Email: "ada@example.com", Username: "ada", Verified: true})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAuth) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.passwords...)
+}
+
+// cliHome is a home directory whose base_url points at a fakeAuth server
+type cliHome struct {
+	dir  string
+	auth *fakeAuth
+}
+
+func newCLIHome(t *testing.T) *cliHome {
+	t.Helper()
+	f := &fakeAuth{}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".codesfer"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".codesfer", "base_url"), []byte(ts.URL), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &cliHome{dir: dir, auth: f}
+}
+
+func (h *cliHome) session(t *testing.T) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(h.dir, ".codesfer", "session"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func (h *cliHome) saveSession(t *testing.T, sessionID string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(h.dir, ".codesfer", "session"), []byte(sessionID), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// run runs command in a child process with stdin, without a terminal, and
+// returns its exit code and output
+func (h *cliHome) run(t *testing.T, command, stdin string, env ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), helperEnv+"="+command, "HOME="+h.dir, client.TokenEnv+"=")
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), string(out)
+	}
+	if err != nil {
+		t.Fatalf("run %s: %v", command, err)
+	}
+	return 0, string(out)
+}
+
+func TestLoginPasswordStdin(t *testing.T) {
+	h := newCLIHome(t)
+
+	if code, out := h.run(t, "login-stdin", "wrong\n"); code != 1 || !strings.Contains(out, "invalid credentials") {
+		t.Fatalf("wrong password: exit %d, %s", code, out)
+	}
+	if session := h.session(t); session != "" {
+		t.Fatalf("failed login saved session %q", session)
+	}
+	if code, out := h.run(t, "login-stdin", "\n"); code != 1 || !strings.Contains(out, "Empty password on stdin") {
+		t.Fatalf("empty password: exit %d, %s", code, out)
+	}
+
+	// Only the first line is the password, the trailing newline is not part of it
+	if code, out := h.run(t, "login-stdin", "secret\r\nignored\n"); code != 0 || !strings.Contains(out, "Login successful") {
+		t.Fatalf("login: exit %d, %s", code, out)
+	}
+	if session := h.session(t); session != "good" {
+		t.Fatalf("saved session: got %q", session)
+	}
+	if got := h.auth.received(); len(got) != 2 || got[0] != "wrong" || got[1] != "secret" {
+		t.Fatalf("passwords sent: %q", got)
+	}
+
+	if code, out := h.run(t, "login-stdin", "secret\n"); code != 1 || !strings.Contains(out, "already logged in") {
+		t.Fatalf("second login: exit %d, %s", code, out)
+	}
+}
+
+func TestLoginFailsWithoutTerminal(t *testing.T) {
+	h := newCLIHome(t)
+
+	// The child's stdin is a pipe, prompting would block a script forever
+	code, out := h.run(t, "login", "ada@example.com\nsecret\n")
+	if code != 1 || !strings.Contains(out, "without a terminal") {
+		t.Fatalf("login without a terminal: exit %d, %s", code, out)
+	}
+	if got := h.auth.received(); len(got) != 0 {
+		t.Fatalf("login reached the server: %q", got)
+	}
+}
+
+func TestLoginRefusedWithEnvToken(t *testing.T) {
+	h := newCLIHome(t)
+
+	code, out := h.run(t, "login-stdin", "secret\n", client.TokenEnv+"=good")
+	if code != 1 || !strings.Contains(out, client.TokenEnv+" is set") {
+		t.Fatalf("login with env token: exit %d, %s", code, out)
+	}
+	if got := h.auth.received(); len(got) != 0 {
+		t.Fatalf("login reached the server: %q", got)
+	}
+}
+
+func TestRegisterPasswordStdin(t *testing.T) {
+	h := newCLIHome(t)
+
+	if code, out := h.run(t, "register-stdin", "secret\n"); code != 0 || !strings.Contains(out, "Registration successful") {
+		t.Fatalf("register: exit %d, %s", code, out)
+	}
+	if got := h.auth.received(); len(got) != 1 || got[0] != "secret" {
+		t.Fatalf("passwords sent: %q", got)
+	}
+	if code, out := h.run(t, "register-stdin", ""); code != 1 || !strings.Contains(out, "Empty password on stdin") {
+		t.Fatalf("register without password: exit %d, %s", code, out)
+	}
+}
+
+func TestEnvTokenOverridesSavedSession(t *testing.T) {
+	h := newCLIHome(t)
+	h.saveSession(t, "stale")
+
+	if code, out := h.run(t, "account", "", client.TokenEnv+"=good"); code != 0 || !strings.Contains(out, "Username: ada") {
+		t.Fatalf("account with env token: exit %d, %s", code, out)
+	}
+	if session := h.session(t); session != "stale" {
+		t.Fatalf("saved session changed to %q", session)
+	}
+}
+
+func TestFatalOnRejectedSession(t *testing.T) {
+	h := newCLIHome(t)
+	h.saveSession(t, "good")
+
+	// A rejected env token was not the saved session, which stays
+	code, out := h.run(t, "account", "", client.TokenEnv+"=revoked")
+	if code != 1 || !strings.Contains(out, "The token in "+client.TokenEnv+" was rejected") {
+		t.Fatalf("rejected env token: exit %d, %s", code, out)
+	}
+	if session := h.session(t); session != "good" {
+		t.Fatalf("saved session after a rejected env token: got %q", session)
+	}
+
+	// A rejected saved session is dropped, without a terminal there is no new login
+	h.saveSession(t, "expired")
+	code, out = h.run(t, "account", "")
+	if code != 1 || !strings.Contains(out, "Your session has expired") {
+		t.Fatalf("rejected session: exit %d, %s", code, out)
+	}
+	if session := h.session(t); session != "" {
+		t.Fatalf("rejected session kept: %q", session)
+	}
+}
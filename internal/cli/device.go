@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// loginDevice logs in by having the user approve a code from a machine that is
+// already logged in, so no password is typed on this one.
+func loginDevice() string {
+	code, err := client.RequestDeviceCode()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("To log this machine in, run on a machine where you are logged in:")
+	fmt.Printf("\n  codesfer approve %s\n\n", code.UserCode)
+	fmt.Printf("or open %s\n", code.VerificationURIComplete)
+	fmt.Println("Waiting for approval...")
+
+	interval := time.Duration(code.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		sessionID, err := client.PollDeviceToken(code.DeviceCode)
+		switch {
+		case errors.Is(err, client.ErrAuthorizationPending):
+			continue
+		case errors.Is(err, client.ErrSlowDown):
+			interval += 5 * time.Second // RFC 8628 section 3.5
+			continue
+		case err != nil:
+			log.Fatal(err)
+		}
+		return sessionID
+	}
+	log.Fatal("The code expired before it was approved, please try again.")
+	return ""
+}
+
+type ApproveFlags struct {
+	Deny bool
+	Yes  bool
+}
+
+// Approve logs in the device showing code, as the current user, after showing
+// where the request came from.
+func Approve(code string, flags ApproveFlags) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	info, err := client.DeviceRequest(sessionID, code)
+	if err != nil {
+		fatal(err)
+	}
+	if !flags.Deny && !flags.Yes {
+		fmt.Printf("Device login %s requested %s from %s (%s).\n",
+			info.UserCode, formatLastSeen(info.CreatedAt), info.Location, info.Agent)
+		fmt.Println("Only approve codes you started yourself, the device gets full access to your account.")
+		if answer := prompt("Approve? [y/N]: "); !strings.EqualFold(answer, "y") && !strings.EqualFold(answer, "yes") {
+			flags.Deny = true
+		}
+	}
+
+	if err := client.ApproveDevice(sessionID, info.UserCode, flags.Deny); err != nil {
+		fatal(err)
+	}
+	if flags.Deny {
+		fmt.Printf("Device login %s denied.\n", info.UserCode)
+		return
+	}
+	fmt.Printf("Device login %s approved.\n", info.UserCode)
+}
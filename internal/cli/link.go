@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"fmt"
+	"log"
+)
+
+type LinkFlags struct {
+	Expires      string
+	MaxDownloads int
+}
+
+// Link prints a signed URL that lets anyone download a code snippet until it expires.
+func Link(key string, flags LinkFlags) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	expires, err := parseDuration(flags.Expires)
+	if err != nil || expires <= 0 {
+		log.Fatalf("Invalid expiry %q", flags.Expires)
+	}
+
+	link, err := client.Link(sessionID, key, expires, flags.MaxDownloads)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Println(link.URL)
+	if link.MaxDownloads > 0 {
+		fmt.Printf("Expires: %s, Max downloads: %d\n", link.ExpiresAt, link.MaxDownloads)
+	} else {
+		fmt.Printf("Expires: %s\n", link.ExpiresAt)
+	}
+	if link.Protected {
+		fmt.Println("The code snippet is password protected, send the password separately.")
+	}
+}
+
+// LinkRevoke invalidates every link to a code snippet.
+func LinkRevoke(key string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	if err := client.RevokeLinks(sessionID, key); err != nil {
+		fatal(err)
+	}
+	fmt.Println("All links to the code snippet are revoked.")
+}
@@ -4,18 +4,19 @@ import (
 	"codesfer/internal/client"
 	"fmt"
 	"log"
+	"strings"
 )
 
-// List displays all code snippets for the logged-in user.
-func List() {
+// List displays all code snippets for the logged-in user, or of the organization org if set.
+func List(org string) {
 	sessionID := client.ReadSessionID()
 	if sessionID == "" {
 		log.Fatal("You are not logged in. Login first to list codes.")
 	}
 
-	objs, err := client.List(sessionID)
+	objs, err := client.List(sessionID, org)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	for _, obj := range objs {
@@ -25,6 +26,10 @@ func List() {
 		} else {
 			pass = obj.Password
 		}
-		fmt.Printf("[%s] %s (pass: %s; created at: %s)\n", obj.Key, obj.Path, pass, obj.CreatedAt)
+		if len(obj.To) > 0 {
+			fmt.Printf("[%s] %s (%s; pass: %s; shared with: %s; created at: %s)\n", obj.Key, obj.Path, obj.Visibility, pass, strings.Join(obj.To, ","), obj.CreatedAt)
+			continue
+		}
+		fmt.Printf("[%s] %s (%s; pass: %s; created at: %s)\n", obj.Key, obj.Path, obj.Visibility, pass, obj.CreatedAt)
 	}
 }
@@ -0,0 +1,28 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"fmt"
+	"log"
+)
+
+// Move renames a code snippet's path without re-uploading it.
+func Move(code, newPath string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	p := sanitizePath(newPath)
+	if p == "" {
+		log.Fatal("Invalid path: only A-Z, a-z, 0-9, _, - and / are allowed.")
+	}
+
+	resp, err := client.Move(sessionID, code, p)
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Printf("ID: %s\n", resp.Uid)
+	fmt.Printf("Path: %s\n", resp.Path)
+}
@@ -0,0 +1,148 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"fmt"
+	"log"
+)
+
+// OrgCreate creates an organization owned by the logged-in user.
+func OrgCreate(name string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	org, err := client.CreateOrg(sessionID, name)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("Organization %s created, push to it with 'codesfer push --org %s'.\n", org.Name, org.Name)
+}
+
+// OrgList shows the organizations of the logged-in user.
+func OrgList() {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	orgs, err := client.ListOrgs(sessionID)
+	if err != nil {
+		fatal(err)
+	}
+	for _, org := range orgs {
+		fmt.Printf("%s (role: %s; created at: %s)\n", org.Name, org.Role, org.CreatedAt[:10])
+	}
+}
+
+// OrgMembers shows the members of an organization.
+func OrgMembers(org string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	members, err := client.OrgMembers(sessionID, org)
+	if err != nil {
+		fatal(err)
+	}
+	for _, m := range members {
+		if m.Pending {
+			fmt.Printf("%s (role: %s; invited by: %s; invited at: %s; not accepted yet)\n", m.Username, m.Role, m.AddedBy, m.CreatedAt[:10])
+			continue
+		}
+		fmt.Printf("%s (role: %s; added by: %s; added at: %s)\n", m.Username, m.Role, m.AddedBy, m.CreatedAt[:10])
+	}
+}
+
+// OrgInvite invites users to an organization with role, or changes the role of members.
+func OrgInvite(org, role string, usernames []string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	for _, username := range usernames {
+		member, err := client.SetOrgMember(sessionID, org, username, role)
+		if err != nil {
+			fatal(err)
+		}
+		if member.Pending {
+			fmt.Printf("%s is invited as %s of %s, they join once they run 'codesfer org accept %s'.\n", username, role, org, org)
+			continue
+		}
+		fmt.Printf("%s is now %s of %s.\n", username, role, org)
+	}
+}
+
+// OrgInvites shows the invitations of the logged-in user.
+func OrgInvites() {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	invites, err := client.OrgInvites(sessionID)
+	if err != nil {
+		fatal(err)
+	}
+	if len(invites) == 0 {
+		fmt.Println("No pending invitations.")
+		return
+	}
+	for _, invite := range invites {
+		fmt.Printf("%s (role: %s; invited by: %s; invited at: %s)\n", invite.Org, invite.Role, invite.InvitedBy, invite.CreatedAt[:10])
+	}
+}
+
+// OrgAnswer accepts or declines the invitation to an organization.
+func OrgAnswer(org string, decline bool) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	if err := client.AnswerOrgInvite(sessionID, org, decline); err != nil {
+		fatal(err)
+	}
+	if decline {
+		fmt.Printf("Invitation to %s declined.\n", org)
+		return
+	}
+	fmt.Printf("You joined %s.\n", org)
+}
+
+// OrgRemove removes users from an organization.
+func OrgRemove(org string, usernames []string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	for _, username := range usernames {
+		if err := client.RemoveOrgMember(sessionID, org, username); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("%s removed from %s.\n", username, org)
+	}
+}
+
+// OrgDelete deletes an organization and all of its code snippets.
+func OrgDelete(org string, yes bool) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	if !yes {
+		fmt.Printf("This deletes %s and all of its code snippets. It cannot be undone.\n", org)
+		if prompt("Type the organization name to confirm: ") != org {
+			log.Fatal("Name does not match, organization not deleted.")
+		}
+	}
+	if err := client.DeleteOrg(sessionID, org); err != nil {
+		fatal(err)
+	}
+	fmt.Println("Organization deleted.")
+}
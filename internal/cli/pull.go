@@ -2,6 +2,7 @@ package cli
 
 import (
 	"codesfer/internal/client"
+	"fmt"
 	"log"
 )
 
@@ -19,7 +20,7 @@ func Pull(flags PullFlags, code string) {
 	log.Print("Pulling...")
 	zip, err := client.Pull(sessionID, code, flags.Pass)
 	if err != nil {
-		log.Fatalf("Pull failed: %v", err)
+		fatal(fmt.Errorf("Pull failed: %w", err))
 	}
 
 	log.Printf("File downloaded: %s", zip)
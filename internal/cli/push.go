@@ -14,6 +14,10 @@ type PushFlags struct {
 	Pass string
 	Key  string
 	Desc string
+	Org  string
+	To   []string
+	// private, unlisted or public, empty leaves it to the server
+	Visibility string
 }
 
 // sanitizePath ensures the path contains only allowed characters i.e. A~Z, a~z, 0~9, _, - and /
@@ -64,9 +68,9 @@ func Push(flags PushFlags, args []string) {
 
 	customPath := getPath(flags, args)
 
-	sessionID := client.ReadSessionID()
-	if sessionID == "" {
-		log.Fatal("You are not logged in. Login first push.")
+	// Servers that allow it take anonymous pushes, which expire after a while
+	if client.ReadSessionID() == "" {
+		log.Printf("Not logged in, pushing anonymously")
 	}
 	log.Printf("Pushing code with name: %s%s%s", colorYellow, customPath, colorReset)
 
@@ -84,15 +88,25 @@ func Push(flags PushFlags, args []string) {
 
 	log.Printf("Uploading ...")
 	form := client.PushForm{
-		Key:      flags.Key,
-		Path:     customPath,
-		Password: flags.Pass,
+		Key:        flags.Key,
+		Path:       customPath,
+		Password:   flags.Pass,
+		Org:        flags.Org,
+		To:         flags.To,
+		Visibility: flags.Visibility,
 	}
 	resp, err := client.Push(form, f.Name())
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	fmt.Printf("ID: %s\n", resp.Uid)
 	fmt.Printf("Path: %s\n", resp.Path)
+	fmt.Printf("Visibility: %s\n", resp.Visibility)
+	if resp.ExpiresAt != "" {
+		fmt.Printf("Expires: %s\n", resp.ExpiresAt)
+	}
+	if len(flags.To) > 0 {
+		fmt.Printf("Shared with: %s\n", strings.Join(flags.To, ", "))
+	}
 }
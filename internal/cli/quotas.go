@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"fmt"
+	"log"
+)
+
+// AccountUsage prints the storage used by the user, or by the organization org, against its quota.
+func AccountUsage(org string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	usage, err := client.Usage(sessionID, org)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("Storage used by %s:\n", usage.Namespace)
+	if usage.MaxBytes > 0 {
+		fmt.Printf("  Size:     %s of %s (%.0f%%)\n", formatSize(usage.Bytes), formatSize(usage.MaxBytes), 100*float64(usage.Bytes)/float64(usage.MaxBytes))
+	} else {
+		fmt.Printf("  Size:     %s (no limit)\n", formatSize(usage.Bytes))
+	}
+	if usage.MaxObjects > 0 {
+		fmt.Printf("  Snippets: %d of %d\n", usage.Objects, usage.MaxObjects)
+	} else {
+		fmt.Printf("  Snippets: %d (no limit)\n", usage.Objects)
+	}
+}
+
+// formatSize prints n bytes in the largest unit it reaches
+func formatSize(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGT"[exp])
+}
@@ -20,7 +20,7 @@ func Remove(codes []string) {
 
 	resp, err := client.Remove(sessionID, codes)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	for code, status := range resp.Results {
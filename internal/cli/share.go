@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Share grants users access to a code snippet and drops it into their inbox.
+func Share(key string, to []string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	result, err := client.Share(sessionID, key, to)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("%s is shared with: %s\n", result.Uid, strings.Join(result.To, ", "))
+}
+
+// Inbox lists the code snippets shared with the logged-in user, unread ones marked with *.
+func Inbox() {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	items, err := client.Inbox(sessionID)
+	if err != nil {
+		fatal(err)
+	}
+	if len(items) == 0 {
+		fmt.Println("Your inbox is empty.")
+		return
+	}
+	for _, item := range items {
+		mark := " "
+		if item.ReadAt == "" {
+			mark = "*"
+		}
+		fmt.Printf("%s [%s] %s (from: %s; shared at: %s)\n", mark, item.Key, item.Path, item.From, item.SharedAt)
+	}
+}
+
+// InboxRead marks code snippets in the inbox as read, all of them if keys is empty.
+func InboxRead(keys []string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	if err := client.MarkRead(sessionID, keys); err != nil {
+		fatal(err)
+	}
+	fmt.Println("Marked read.")
+}
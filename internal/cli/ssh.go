@@ -0,0 +1,162 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// defaultSSHKeys are tried in order, like ssh does
+var defaultSSHKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sshSigners returns the keys to log in with: the identity file if given, otherwise
+// the keys in ssh-agent and the default key files. Passphrase protected default
+// keys are only unlocked when nothing else is available.
+func sshSigners(identity string) []ssh.Signer {
+	if identity != "" {
+		signer, err := loadSSHKey(identity, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return []ssh.Signer{signer}
+	}
+
+	var signers []ssh.Signer
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+	home, _ := os.UserHomeDir()
+	var encrypted []string
+	for _, name := range defaultSSHKeys {
+		path := filepath.Join(home, ".ssh", name)
+		signer, err := loadSSHKey(path, false)
+		var missing *ssh.PassphraseMissingError
+		switch {
+		case errors.As(err, &missing):
+			encrypted = append(encrypted, path)
+		case err == nil:
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) == 0 {
+		for _, path := range encrypted {
+			if signer, err := loadSSHKey(path, true); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+	return signers
+}
+
+// loadSSHKey reads a private key file, asking for its passphrase if allowed
+func loadSSHKey(path string, askPassphrase bool) (ssh.Signer, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) && askPassphrase {
+		passphrase := readPassword(fmt.Sprintf("Passphrase for %s: ", path), false)
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// readPublicKey returns the authorized_keys line in path ("-" for stdin), or of
+// the first default key when path is empty. A private key path is mapped to its .pub file.
+func readPublicKey(path string) (string, error) {
+	if path == "-" {
+		b, err := io.ReadAll(os.Stdin)
+		return string(b), err
+	}
+	if path == "" {
+		home, _ := os.UserHomeDir()
+		for _, name := range defaultSSHKeys {
+			candidate := filepath.Join(home, ".ssh", name+".pub")
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+		if path == "" {
+			return "", errors.New("no public key found in ~/.ssh, pass the .pub file to add")
+		}
+	}
+	if !strings.HasSuffix(path, ".pub") {
+		if _, err := os.Stat(path + ".pub"); err == nil {
+			path += ".pub"
+		}
+	}
+	b, err := os.ReadFile(path)
+	return string(b), err
+}
+
+// AccountSSHKeyAdd registers a public key so `codesfer login --ssh` can use it.
+func AccountSSHKeyAdd(path, name string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+	publicKey, err := readPublicKey(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	key, err := client.AddSSHKey(sessionID, publicKey, name)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("Added %s key %s (%s), ID: %s\n", key.Type, key.Fingerprint, key.Name, key.ID)
+}
+
+// AccountSSHKeyList shows the ssh keys registered on the account.
+func AccountSSHKeyList() {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+	keys, err := client.ListSSHKeys(sessionID)
+	if err != nil {
+		fatal(err)
+	}
+	if len(keys) == 0 {
+		fmt.Println("No ssh keys, add one with `codesfer account ssh-key add`.")
+		return
+	}
+	for _, k := range keys {
+		lastUsed := "never"
+		if k.LastUsed != "" {
+			lastUsed = formatLastSeen(k.LastUsed)
+		}
+		fmt.Printf("[%s] %s %s, Type: %s, Created: %s, Last used: %s\n",
+			k.ID, k.Name, k.Fingerprint, k.Type, k.CreatedAt[:10], lastUsed)
+	}
+}
+
+// AccountSSHKeyRemove removes an ssh key by the id shown in `codesfer account ssh-key list`.
+func AccountSSHKeyRemove(id string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+	if err := client.RemoveSSHKey(sessionID, id); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("SSH key %s removed.\n", id)
+}
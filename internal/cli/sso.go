@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// loginSSO logs in through the server's identity provider. The login URL is
+// opened in a browser when possible and can be opened on any other device too.
+func loginSSO(noBrowser bool) string {
+	start, err := client.StartSSO()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("To log in, open this URL in a browser on any device:")
+	fmt.Printf("\n  %s\n\n", start.URL)
+	if !noBrowser {
+		if err := openBrowser(start.URL); err == nil {
+			fmt.Println("A browser window was opened for you.")
+		}
+	}
+	fmt.Printf("Confirm in the browser that it shows the code %s.\n", start.UserCode)
+	fmt.Println("Waiting for the login to complete...")
+
+	interval := time.Duration(start.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(start.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		sessionID, err := client.PollSSO(start.PollToken)
+		if errors.Is(err, client.ErrAuthorizationPending) {
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return sessionID
+	}
+	log.Fatal("Login request expired, please try again.")
+	return ""
+}
+
+// openBrowser opens url with the desktop's default handler
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		// Over SSH or in a container there is nothing to open a browser on
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return errors.New("no display")
+		}
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"codesfer/pkg/api"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TokenFlags struct {
+	Name    string
+	Scopes  []string
+	Expires string
+}
+
+// TokenCreate issues a personal access token and prints it once.
+func TokenCreate(flags TokenFlags) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	expires, err := parseDuration(flags.Expires)
+	if err != nil {
+		log.Fatalf("Invalid expiry %q: %v", flags.Expires, err)
+	}
+
+	token, err := client.CreateToken(sessionID, api.TokenCreateRequest{
+		Name:      flags.Name,
+		Scopes:    flags.Scopes,
+		ExpiresIn: int64(expires / time.Second),
+	})
+	if err != nil {
+		fatal(err)
+	}
+
+	fmt.Printf("Token: %s\n", token.Token)
+	fmt.Printf("ID: %s, Scopes: %s, Expires: %s\n", token.ID, strings.Join(token.Scopes, ","), orNever(token.ExpiresAt))
+	fmt.Println("Store it now, it will not be shown again.")
+}
+
+// TokenList shows the personal access tokens of the logged-in user.
+func TokenList() {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	tokens, err := client.ListTokens(sessionID)
+	if err != nil {
+		fatal(err)
+	}
+	for _, t := range tokens {
+		lastUsed := "never"
+		if t.LastUsed != "" {
+			lastUsed = formatLastSeen(t.LastUsed)
+		}
+		fmt.Printf(
+			"[%s] %s (scopes: %s; expires: %s; last used: %s; created at: %s)\n",
+			t.ID, t.Name, strings.Join(t.Scopes, ","), orNever(t.ExpiresAt), lastUsed, t.CreatedAt[:10],
+		)
+	}
+}
+
+// TokenRevoke deletes personal access tokens by id.
+func TokenRevoke(ids []string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	for _, id := range ids {
+		if err := client.RevokeToken(sessionID, id); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("Token %s revoked.\n", id)
+	}
+}
+
+// parseDuration accepts time.ParseDuration values plus whole days, e.g. "30d".
+// An empty string means no expiry.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("expected a number of days")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func orNever(expiresAt string) string {
+	if expiresAt == "" {
+		return "never"
+	}
+	return expiresAt
+}
@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"fmt"
+	"log"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// AccountTwoFactorEnable enrolls an authenticator app and turns on two-factor
+// authentication once it produced a valid code.
+func AccountTwoFactorEnable() {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	enrollment, err := client.EnrollTwoFactor(sessionID)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Println("Scan the QR code with your authenticator app, or open this URI:")
+	fmt.Println(enrollment.URI)
+	if code, err := qr.Encode(enrollment.URI, qr.M); err == nil {
+		printQR(code)
+	}
+	fmt.Printf("Secret for manual entry: %s\n\n", enrollment.Secret)
+
+	recoveryCodes, err := client.EnableTwoFactor(sessionID, prompt("Code from the app: "))
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Println("Two-factor authentication enabled.")
+	fmt.Println("Store these recovery codes somewhere safe, each one can replace a code from the app once:")
+	for _, code := range recoveryCodes {
+		fmt.Printf("  %s\n", code)
+	}
+}
+
+// AccountTwoFactorDisable turns two-factor authentication off.
+func AccountTwoFactorDisable() {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	password := readPassword("Password: ", false)
+	code := prompt("Code from the app or a recovery code: ")
+	if err := client.DisableTwoFactor(sessionID, password, code); err != nil {
+		fatal(err)
+	}
+	fmt.Println("Two-factor authentication disabled.")
+}
+
+// printQR draws code on the terminal, two modules per character using half blocks
+func printQR(code *qr.Code) {
+	const quiet = 2
+	black := func(x, y int) bool {
+		return x >= 0 && y >= 0 && x < code.Size && y < code.Size && code.Black(x, y)
+	}
+	var b strings.Builder
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		for x := -quiet; x < code.Size+quiet; x++ {
+			// Dark modules are drawn in the background colour, so it also reads on dark terminals
+			top, bottom := !black(x, y), !black(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	fmt.Print(b.String())
+}
@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"codesfer/internal/client"
+	"fmt"
+	"log"
+)
+
+// Chmod changes who can pull a code snippet: private, unlisted or public.
+func Chmod(key, visibility string) {
+	sessionID := client.ReadSessionID()
+	if sessionID == "" {
+		log.Fatal("You are not logged in. Login first.")
+	}
+
+	result, err := client.Chmod(sessionID, key, visibility)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("%s is now %s\n", result.Uid, result.Visibility)
+}
+
+// Profile lists the public code snippets of a user or organization. It works without logging in.
+func Profile(username string) {
+	objs, err := client.Profile(client.ReadSessionID(), username)
+	if err != nil {
+		fatal(err)
+	}
+	if len(objs) == 0 {
+		fmt.Printf("%s has no public code snippets.\n", username)
+		return
+	}
+	for _, obj := range objs {
+		if obj.Protected {
+			fmt.Printf("[%s] %s (password protected; created at: %s)\n", obj.Key, obj.Path, obj.CreatedAt)
+			continue
+		}
+		fmt.Printf("[%s] %s (created at: %s)\n", obj.Key, obj.Path, obj.CreatedAt)
+	}
+}
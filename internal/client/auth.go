@@ -1,13 +1,14 @@
 package client
 
 import (
+	"bytes"
 	"codesfer/pkg/api"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,6 +19,16 @@ const (
 	sessionFile = "session"   // This should be in the config directory
 )
 
+// ErrSessionExpired is returned when the server rejects the stored session,
+// because it expired or was revoked.
+var ErrSessionExpired = errors.New("session expired, please log in again")
+
+// sessionRejected reports whether the server turned the request down because of its session token
+func sessionRejected(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized &&
+		strings.Contains(resp.Header.Get("WWW-Authenticate"), "invalid_token")
+}
+
 // makePaths will make sure the given directory exists, if not, it will be created
 func makePaths(path string) error {
 	err := os.MkdirAll(path, 0755)
@@ -27,9 +38,22 @@ func makePaths(path string) error {
 	return nil
 }
 
-// ReadSessionID returns the SessionID if the user is logged in,
-// or an empty string if not.
+// TokenEnv names the environment variable holding a session or access token.
+// When set it takes precedence over the session stored by `codesfer login`.
+const TokenEnv = "CODESFER_TOKEN"
+
+// UsingEnvToken reports whether credentials come from TokenEnv
+func UsingEnvToken() bool {
+	return strings.TrimSpace(os.Getenv(TokenEnv)) != ""
+}
+
+// ReadSessionID returns the token from TokenEnv if set, otherwise the SessionID
+// if the user is logged in, or an empty string if not.
 func ReadSessionID() string {
+	if token := strings.TrimSpace(os.Getenv(TokenEnv)); token != "" {
+		return token
+	}
+
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return ""
@@ -69,8 +93,11 @@ func RemoveSessionID() error {
 
 func Login(email, password string) (string, error) {
 	url := BaseURL + "/auth/login"
-	body := `{"email": "` + email + `", "password": "` + password + `"}`
-	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	body, err := json.Marshal(map[string]string{"email": email, "password": password})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
 	if err != nil {
 		return "", err
 	}
@@ -82,6 +109,13 @@ func Login(email, password string) (string, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusAccepted {
+		var challenge api.LoginChallenge
+		if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+			return "", err
+		}
+		return "", &TwoFactorRequired{Challenge: challenge.Challenge}
+	}
 	if resp.StatusCode != http.StatusOK {
 		// Read plain text from response body
 		errmsg, err := io.ReadAll(resp.Body)
@@ -95,6 +129,64 @@ func Login(email, password string) (string, error) {
 	return sessionID, nil
 }
 
+// TwoFactorRequired is returned by Login when the password was right but the
+// account needs a second factor, pass the challenge on to LoginTwoFactor
+type TwoFactorRequired struct {
+	Challenge string
+}
+
+func (e *TwoFactorRequired) Error() string {
+	return "two-factor authentication code required"
+}
+
+// LoginTwoFactor completes a login with a TOTP or recovery code and returns the session ID
+func LoginTwoFactor(challenge, code string) (string, error) {
+	return postForSession(BaseURL+"/auth/login/2fa", api.TwoFactorLoginRequest{Challenge: challenge, Code: code})
+}
+
+// postForSession posts payload to a login endpoint and returns the session ID it issues
+func postForSession(url string, payload any) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	resp, err := GetHTTPClient().Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errmsg, _ := io.ReadAll(resp.Body)
+		return "", errors.New(strings.TrimSpace(string(errmsg)))
+	}
+	return strings.TrimSpace(resp.Header.Get("X-Session-ID")), nil
+}
+
+// EnrollTwoFactor creates a TOTP secret to be added to an authenticator app
+func EnrollTwoFactor(sessionID string) (*api.TwoFactorEnrollResponse, error) {
+	var enrollment api.TwoFactorEnrollResponse
+	if err := doJSONInto("POST", BaseURL+"/auth/2fa/enroll", sessionID, struct{}{}, http.StatusOK, &enrollment); err != nil {
+		return nil, err
+	}
+	return &enrollment, nil
+}
+
+// EnableTwoFactor confirms the enrollment with a first code and returns the recovery codes
+func EnableTwoFactor(sessionID, code string) ([]string, error) {
+	var enabled api.TwoFactorEnableResponse
+	if err := doJSONInto("POST", BaseURL+"/auth/2fa/enable", sessionID, api.TwoFactorRequest{Code: code}, http.StatusOK, &enabled); err != nil {
+		return nil, err
+	}
+	return enabled.RecoveryCodes, nil
+}
+
+// DisableTwoFactor turns two-factor authentication off, code may be a TOTP or recovery code
+func DisableTwoFactor(sessionID, password, code string) error {
+	return doJSON("POST", BaseURL+"/auth/2fa/disable", sessionID,
+		api.TwoFactorRequest{Code: code, Password: password}, http.StatusOK)
+}
+
 func Logout(sessionID string) error {
 	url := BaseURL + "/auth/logout"
 	req, err := http.NewRequest("POST", url, nil)
@@ -124,8 +216,11 @@ func Logout(sessionID string) error {
 
 func Register(email, password, username string) error {
 	url := BaseURL + "/auth/register"
-	body := fmt.Sprintf(`{"email": "%s", "password": "%s", "username": "%s"}`, email, password, username)
-	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	body, err := json.Marshal(api.RegisterRequest{Email: email, Password: password, Username: username})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -174,11 +269,11 @@ func UsernameAvailable(username string) (bool, error) {
 }
 
 func AccountInfo(sessionID string) (*api.AccountResponse, error) {
-	url := BaseURL + "/auth/me?session_id=" + sessionID
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequest("GET", BaseURL+"/auth/me", nil)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Authorization", "Bearer "+sessionID)
 
 	resp, err := GetHTTPClient().Do(req)
 	if err != nil {
@@ -186,6 +281,9 @@ func AccountInfo(sessionID string) (*api.AccountResponse, error) {
 	}
 	defer resp.Body.Close()
 
+	if sessionRejected(resp) {
+		return nil, ErrSessionExpired
+	}
 	if resp.StatusCode != http.StatusOK {
 		// Read plain text from response body
 		errmsg, err := io.ReadAll(resp.Body)
@@ -203,3 +301,112 @@ func AccountInfo(sessionID string) (*api.AccountResponse, error) {
 
 	return &account, nil
 }
+
+// RevokeSession deletes one of the user's sessions by its public id
+func RevokeSession(sessionID, id string) error {
+	return revokeSessions(sessionID, BaseURL+"/auth/sessions/"+url.PathEscape(id))
+}
+
+// RevokeOtherSessions deletes every session of the user except sessionID
+func RevokeOtherSessions(sessionID string) error {
+	return revokeSessions(sessionID, BaseURL+"/auth/sessions")
+}
+
+func revokeSessions(sessionID, url string) error {
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+sessionID)
+
+	resp, err := GetHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if sessionRejected(resp) {
+		return ErrSessionExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		errmsg, _ := io.ReadAll(resp.Body)
+		return errors.New(string(errmsg))
+	}
+	return nil
+}
+
+// ChangePassword sets a new password for the logged in user, other sessions are signed out
+func ChangePassword(sessionID, oldPassword, newPassword string) error {
+	return doJSON("POST", BaseURL+"/auth/passwd", sessionID,
+		api.PasswordChangeRequest{OldPassword: oldPassword, NewPassword: newPassword}, http.StatusOK)
+}
+
+// RequestPasswordReset asks the server to mail a reset code to email
+func RequestPasswordReset(email string) error {
+	return doJSON("POST", BaseURL+"/auth/reset/request", "", api.ResetRequest{Email: email}, http.StatusAccepted)
+}
+
+// ResetPassword sets a new password with a code from RequestPasswordReset
+func ResetPassword(code, newPassword string) error {
+	return doJSON("POST", BaseURL+"/auth/reset/confirm", "",
+		api.ResetConfirmRequest{Code: code, NewPassword: newPassword}, http.StatusOK)
+}
+
+// DeleteAccount deletes the logged in user along with all of their snippets
+func DeleteAccount(sessionID, password string) error {
+	return doJSON("DELETE", BaseURL+"/auth/account", sessionID, api.AccountDeleteRequest{Password: password}, http.StatusOK)
+}
+
+// doJSON sends payload as JSON and expects the status want, the response body is used as error message otherwise
+func doJSON(method, url, sessionID string, payload any, want int) error {
+	return doJSONInto(method, url, sessionID, payload, want, nil)
+}
+
+// doJSONInto is doJSON that also decodes the JSON response into out, unless out is nil.
+// A nil payload sends no body.
+func doJSONInto(method, url, sessionID string, payload any, want int, out any) error {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sessionID != "" {
+		req.Header.Set("Authorization", "Bearer "+sessionID)
+	}
+
+	resp, err := GetHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if sessionID != "" && sessionRejected(resp) {
+		return ErrSessionExpired
+	}
+	if resp.StatusCode != want {
+		errmsg, _ := io.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(errmsg)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// VerifyEmail confirms the email address of an account with a code from the verification email
+func VerifyEmail(code string) error {
+	return doJSON("POST", BaseURL+"/auth/verify", "", api.VerifyRequest{Code: code}, http.StatusOK)
+}
+
+// ResendVerification asks the server to mail a new verification code to email
+func ResendVerification(email string) error {
+	return doJSON("POST", BaseURL+"/auth/verify/resend", "", api.ResetRequest{Email: email}, http.StatusAccepted)
+}
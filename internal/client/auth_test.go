@@ -0,0 +1,29 @@
+package client
+
+import "testing"
+
+func TestEnvTokenTakesPrecedence(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(TokenEnv, "")
+
+	if got := ReadSessionID(); got != "" {
+		t.Fatalf("no session: got %q", got)
+	}
+	if err := WriteSessionID("saved"); err != nil {
+		t.Fatalf("write session: %v", err)
+	}
+	if got := ReadSessionID(); got != "saved" || UsingEnvToken() {
+		t.Fatalf("saved session: got %q, env token %v", got, UsingEnvToken())
+	}
+
+	t.Setenv(TokenEnv, " from-env\n")
+	if got := ReadSessionID(); got != "from-env" || !UsingEnvToken() {
+		t.Fatalf("env token: got %q, env token %v", got, UsingEnvToken())
+	}
+
+	// A blank variable does not hide the saved session
+	t.Setenv(TokenEnv, "  ")
+	if got := ReadSessionID(); got != "saved" || UsingEnvToken() {
+		t.Fatalf("blank env token: got %q, env token %v", got, UsingEnvToken())
+	}
+}
@@ -57,3 +57,16 @@ func GetHTTPClient() *http.Client {
 		},
 	}
 }
+
+// resolveURL resolves a possibly relative URL returned by the server against BaseURL
+func resolveURL(ref string) (string, error) {
+	base, err := url.Parse(BaseURL)
+	if err != nil {
+		return "", err
+	}
+	u, err := base.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"bytes"
+	"codesfer/pkg/api"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrSlowDown is returned by PollDeviceToken when the device polls faster than the server allows.
+var ErrSlowDown = errors.New("polling too fast")
+
+// RequestDeviceCode starts a device login, the user code is then approved from another machine
+func RequestDeviceCode() (*api.DeviceCodeResponse, error) {
+	var code api.DeviceCodeResponse
+	if err := doJSONInto("POST", BaseURL+"/auth/device/code", "", struct{}{}, http.StatusOK, &code); err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+// PollDeviceToken returns the session ID once the device login was approved.
+// Until then it returns ErrAuthorizationPending or ErrSlowDown.
+func PollDeviceToken(deviceCode string) (string, error) {
+	body, err := json.Marshal(api.DeviceTokenRequest{DeviceCode: deviceCode})
+	if err != nil {
+		return "", err
+	}
+	resp, err := GetHTTPClient().Post(BaseURL+"/auth/device/token", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return strings.TrimSpace(resp.Header.Get("X-Session-ID")), nil
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	var deviceErr api.DeviceTokenError
+	if json.Unmarshal(raw, &deviceErr) != nil || deviceErr.Error == "" {
+		return "", errors.New(strings.TrimSpace(string(raw)))
+	}
+	switch deviceErr.Error {
+	case "authorization_pending":
+		return "", ErrAuthorizationPending
+	case "slow_down":
+		return "", ErrSlowDown
+	default:
+		return "", errors.New(deviceErr.ErrorDescription)
+	}
+}
+
+// DeviceRequest describes the pending device login with userCode, to be checked before approving it
+func DeviceRequest(sessionID, userCode string) (*api.DeviceRequestInfo, error) {
+	req, err := http.NewRequest("GET", BaseURL+"/auth/device/requests/"+url.PathEscape(userCode), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+sessionID)
+
+	resp, err := GetHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if sessionRejected(resp) {
+		return nil, ErrSessionExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		errmsg, _ := io.ReadAll(resp.Body)
+		return nil, errors.New(strings.TrimSpace(string(errmsg)))
+	}
+	var info api.DeviceRequestInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ApproveDevice logs the device with userCode in as the current user, or denies it
+func ApproveDevice(sessionID, userCode string, deny bool) error {
+	return doJSON("POST", BaseURL+"/auth/device/approve", sessionID,
+		api.DeviceApproveRequest{UserCode: userCode, Deny: deny}, http.StatusOK)
+}
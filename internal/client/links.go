@@ -0,0 +1,23 @@
+package client
+
+import (
+	"codesfer/pkg/api"
+	"time"
+)
+
+// Link signs a share link to the snippet identified by key, valid for ttl and
+// at most maxDownloads downloads if positive. The URL is resolved against BaseURL.
+func Link(sessionID, key string, ttl time.Duration, maxDownloads int) (*api.LinkResponse, error) {
+	var result api.LinkResponse
+	payload := api.LinkRequest{Key: key, ExpiresIn: int64(ttl / time.Second), MaxDownloads: maxDownloads}
+	if err := storageJSON(sessionID, "POST", "/link", payload, &result); err != nil {
+		return nil, err
+	}
+	result.URL = BaseURL + result.URL
+	return &result, nil
+}
+
+// RevokeLinks invalidates every share link to the snippet identified by key
+func RevokeLinks(sessionID, key string) error {
+	return storageJSON(sessionID, "POST", "/link/revoke", api.LinkRevokeRequest{Key: key}, nil)
+}
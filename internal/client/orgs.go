@@ -0,0 +1,112 @@
+package client
+
+import (
+	"bytes"
+	"codesfer/pkg/api"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// orgRequest sends a request to the /auth/orgs routes and decodes a JSON answer into out, if not nil
+func orgRequest(sessionID, method, route string, payload any, want int, out any) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, BaseURL+"/auth/orgs"+route, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+sessionID)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := GetHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if sessionRejected(resp) {
+		return ErrSessionExpired
+	}
+	if resp.StatusCode != want {
+		errmsg, _ := io.ReadAll(resp.Body)
+		return errors.New(string(errmsg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// CreateOrg creates an organization owned by the logged in user
+func CreateOrg(sessionID, name string) (*api.Org, error) {
+	var org api.Org
+	if err := orgRequest(sessionID, "POST", "", api.OrgCreateRequest{Name: name}, http.StatusCreated, &org); err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// ListOrgs returns the organizations of the logged in user
+func ListOrgs(sessionID string) (api.OrgListResponse, error) {
+	var orgs api.OrgListResponse
+	if err := orgRequest(sessionID, "GET", "", nil, http.StatusOK, &orgs); err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+// DeleteOrg deletes an organization with all of its snippets
+func DeleteOrg(sessionID, org string) error {
+	return orgRequest(sessionID, "DELETE", "/"+url.PathEscape(org), nil, http.StatusOK, nil)
+}
+
+// OrgMembers returns the members of an organization
+func OrgMembers(sessionID, org string) (api.OrgMembersResponse, error) {
+	var members api.OrgMembersResponse
+	if err := orgRequest(sessionID, "GET", "/"+url.PathEscape(org)+"/members", nil, http.StatusOK, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// SetOrgMember invites username to an organization with role, or changes the
+// role of a member. The result is pending until an invitee accepts.
+func SetOrgMember(sessionID, org, username, role string) (*api.OrgMember, error) {
+	route := "/" + url.PathEscape(org) + "/members/" + url.PathEscape(username)
+	var member api.OrgMember
+	if err := orgRequest(sessionID, "PUT", route, api.OrgMemberRequest{Role: role}, http.StatusOK, &member); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// RemoveOrgMember removes username from an organization, or withdraws their invitation
+func RemoveOrgMember(sessionID, org, username string) error {
+	route := "/" + url.PathEscape(org) + "/members/" + url.PathEscape(username)
+	return orgRequest(sessionID, "DELETE", route, nil, http.StatusOK, nil)
+}
+
+// OrgInvites returns the pending invitations of the logged in user
+func OrgInvites(sessionID string) (api.OrgInvitesResponse, error) {
+	var invites api.OrgInvitesResponse
+	if err := orgRequest(sessionID, "GET", "/invites", nil, http.StatusOK, &invites); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// AnswerOrgInvite joins an organization the logged in user was invited to, or declines the invitation
+func AnswerOrgInvite(sessionID, org string, decline bool) error {
+	return orgRequest(sessionID, "POST", "/invites/"+url.PathEscape(org), api.OrgInviteAnswer{Decline: decline}, http.StatusOK, nil)
+}
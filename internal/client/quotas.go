@@ -0,0 +1,19 @@
+package client
+
+import (
+	"codesfer/pkg/api"
+	neturl "net/url"
+)
+
+// Usage returns the storage used by the logged in user, or by the organization org if it is set
+func Usage(sessionID, org string) (*api.UsageResponse, error) {
+	route := "/usage"
+	if org != "" {
+		route += "?org=" + neturl.QueryEscape(org)
+	}
+	var result api.UsageResponse
+	if err := storageJSON(sessionID, "GET", route, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"codesfer/pkg/api"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// storageJSON sends payload as JSON to a /storage route and decodes the answer into out, if not nil
+func storageJSON(sessionID, method, route string, payload, out any) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, BaseURL+"/storage"+route, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+sessionID)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := GetHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if sessionRejected(resp) {
+		return ErrSessionExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		errmsg, _ := io.ReadAll(resp.Body)
+		return errors.New(string(errmsg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Share grants the users in to access to the snippet identified by key
+func Share(sessionID, key string, to []string) (*api.ShareResponse, error) {
+	var result api.ShareResponse
+	if err := storageJSON(sessionID, "POST", "/share", api.ShareRequest{Key: key, To: to}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Inbox returns the snippets shared with the logged in user, newest first
+func Inbox(sessionID string) (api.InboxResponse, error) {
+	var items api.InboxResponse
+	if err := storageJSON(sessionID, "GET", "/inbox", nil, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// MarkRead marks snippets in the inbox as read, all of them if keys is empty
+func MarkRead(sessionID string, keys []string) error {
+	return storageJSON(sessionID, "POST", "/inbox/read", api.InboxReadRequest{Keys: keys}, nil)
+}
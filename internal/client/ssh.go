@@ -0,0 +1,94 @@
+package client
+
+import (
+	"codesfer/pkg/api"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AddSSHKey registers a public key in authorized_keys format on the account
+func AddSSHKey(sessionID, publicKey, name string) (*api.SSHKey, error) {
+	var key api.SSHKey
+	err := doJSONInto("POST", BaseURL+"/auth/ssh-keys", sessionID,
+		api.SSHKeyAddRequest{PublicKey: publicKey, Name: name}, http.StatusCreated, &key)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// ListSSHKeys returns the ssh keys registered on the account
+func ListSSHKeys(sessionID string) (api.SSHKeyListResponse, error) {
+	var keys api.SSHKeyListResponse
+	if err := doJSONInto("GET", BaseURL+"/auth/ssh-keys", sessionID, nil, http.StatusOK, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RemoveSSHKey deletes a registered ssh key by id
+func RemoveSSHKey(sessionID, id string) error {
+	return doJSON("DELETE", BaseURL+"/auth/ssh-keys/"+url.PathEscape(id), sessionID, nil, http.StatusOK)
+}
+
+// LoginSSH logs in with the first of signers whose key is registered on an account
+// and returns the session ID
+func LoginSSH(signers []ssh.Signer) (string, error) {
+	if len(signers) == 0 {
+		return "", errors.New("no ssh keys found, start ssh-agent or pass a key file")
+	}
+	publicKeys := make([]string, len(signers))
+	for i, signer := range signers {
+		publicKeys[i] = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	}
+	var challenge api.SSHChallengeResponse
+	err := doJSONInto("POST", BaseURL+"/auth/login/ssh/challenge", "",
+		api.SSHChallengeRequest{PublicKeys: publicKeys}, http.StatusOK, &challenge)
+	if err != nil {
+		return "", err
+	}
+
+	var signer ssh.Signer
+	var publicKey string
+	for i, candidate := range signers {
+		if ssh.FingerprintSHA256(candidate.PublicKey()) == challenge.Fingerprint {
+			signer, publicKey = candidate, publicKeys[i]
+			break
+		}
+	}
+	if signer == nil {
+		return "", errors.New("server asked for a key that was not offered")
+	}
+
+	server, err := url.Parse(BaseURL)
+	if err != nil {
+		return "", err
+	}
+	signature, err := signSSH(signer, api.SSHLoginMessage(server.Host, challenge.Challenge))
+	if err != nil {
+		return "", err
+	}
+
+	return postForSession(BaseURL+"/auth/login/ssh", api.SSHLoginRequest{
+		Challenge: challenge.Challenge,
+		PublicKey: publicKey,
+		Signature: base64.StdEncoding.EncodeToString(ssh.Marshal(signature)),
+	})
+}
+
+// signSSH signs data, using SHA-2 for RSA keys since the server refuses SHA-1 signatures
+func signSSH(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok {
+			return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA256)
+		}
+		return nil, errors.New("this rsa key can only make SHA-1 signatures, use an ed25519 key")
+	}
+	return signer.Sign(rand.Reader, data)
+}
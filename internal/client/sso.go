@@ -0,0 +1,46 @@
+package client
+
+import (
+	"bytes"
+	"codesfer/pkg/api"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrAuthorizationPending is returned by PollSSO and PollDeviceToken until the login was completed elsewhere.
+var ErrAuthorizationPending = errors.New("authorization pending")
+
+// StartSSO creates a single sign-on login request, its URL is opened in a browser
+func StartSSO() (*api.SSOStartResponse, error) {
+	var start api.SSOStartResponse
+	if err := doJSONInto("POST", BaseURL+"/auth/sso/start", "", struct{}{}, http.StatusOK, &start); err != nil {
+		return nil, err
+	}
+	return &start, nil
+}
+
+// PollSSO returns the session ID once the login request of pollToken was completed
+func PollSSO(pollToken string) (string, error) {
+	body, err := json.Marshal(api.SSOPollRequest{PollToken: pollToken})
+	if err != nil {
+		return "", err
+	}
+	resp, err := GetHTTPClient().Post(BaseURL+"/auth/sso/poll", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return strings.TrimSpace(resp.Header.Get("X-Session-ID")), nil
+	case http.StatusAccepted:
+		return "", ErrAuthorizationPending
+	default:
+		errmsg, _ := io.ReadAll(resp.Body)
+		return "", errors.New(strings.TrimSpace(string(errmsg)))
+	}
+}
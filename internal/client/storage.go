@@ -10,60 +10,182 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 type PushForm struct {
-	Key      string
-	Path     string
-	Password string
+	Key        string
+	Path       string
+	Password   string
+	Org        string   // Push into the namespace of this organization instead of the user's
+	To         []string // Share with these users
+	Visibility string   // private, unlisted or public, the server defaults to private
 }
 
+// errDirectUnsupported is returned when the server does not offer direct transfers
+var errDirectUnsupported = errors.New("direct transfer unsupported")
+
+// Push uploads the archive, sending the bytes straight to object storage when the
+// server hands out a presigned URL and falling back to a regular upload otherwise.
+// Anonymous pushes are never direct, and each request counts against their rate
+// limit, so they skip asking.
 func Push(form PushForm, zipFile string) (*api.UploadResponse, error) {
-	// Open the file
+	if ReadSessionID() == "" {
+		return pushProxied(form, zipFile)
+	}
+	result, err := pushDirect(form, zipFile)
+	if errors.Is(err, errDirectUnsupported) {
+		return pushProxied(form, zipFile)
+	}
+	return result, err
+}
+
+// pushDirect asks the server for a presigned URL and PUTs the archive to it
+func pushDirect(form PushForm, zipFile string) (*api.UploadResponse, error) {
 	file, err := os.Open(zipFile)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	// Prepare multipart writer
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
 
-	// Add the file field
-	part, err := writer.CreateFormFile("file", filepath.Base(zipFile))
+	result, err := postUpload(form, nil, map[string]string{
+		"direct": "true",
+		"size":   strconv.FormatInt(info.Size(), 10),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.UploadURL == "" {
+		return nil, errors.New("server did not return an upload url")
+	}
+
+	uploadURL, err := resolveURL(result.UploadURL)
 	if err != nil {
 		return nil, err
 	}
-	if _, err = io.Copy(part, file); err != nil {
+	req, err := http.NewRequest("PUT", uploadURL, file)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = info.Size()
+
+	resp, err := GetHTTPClient().Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			errmsg, _ := io.ReadAll(resp.Body)
+			err = fmt.Errorf("storage returned status: %s; error: %s", resp.Status, errmsg)
+		}
+	}
+	var completed *api.UploadResponse
+	if err == nil {
+		// The snippet can be pulled and reaches its recipients once the server saw the archive
+		completed, err = completeUpload(result.Uid)
+	}
+	if err != nil {
+		// Release the reserved key so the snippet does not point at nothing
+		if _, rerr := Remove(ReadSessionID(), []string{result.Uid}); rerr != nil {
+			log.Printf("Failed to release key %s: %v", result.Uid, rerr)
+		}
 		return nil, err
 	}
 
+	return completed, nil
+}
+
+// completeUpload tells the server the archive of the direct upload with key was PUT
+func completeUpload(key string) (*api.UploadResponse, error) {
+	var result api.UploadResponse
+	if err := storageJSON(ReadSessionID(), "POST", "/upload/complete", api.UploadCompleteRequest{Key: key}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// pushProxied sends the archive to the server in a multipart form
+func pushProxied(form PushForm, zipFile string) (*api.UploadResponse, error) {
+	file, err := os.Open(zipFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return postUpload(form, file, nil)
+}
+
+// postUpload sends the push form to /storage/upload, including file when it is not nil
+func postUpload(form PushForm, file *os.File, extra map[string]string) (*api.UploadResponse, error) {
+	// Prepare multipart writer
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	// Add the file field
+	if file != nil {
+		part, err := writer.CreateFormFile("file", filepath.Base(file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.Copy(part, file); err != nil {
+			return nil, err
+		}
+	}
+
 	// Add the customName field (key)
 	if form.Key != "" {
-		if err = writer.WriteField("key", form.Key); err != nil {
+		if err := writer.WriteField("key", form.Key); err != nil {
 			return nil, err
 		}
 	}
 
 	// Add the customName field (path)
 	if form.Path != "" {
-		if err = writer.WriteField("path", form.Path); err != nil {
+		if err := writer.WriteField("path", form.Path); err != nil {
 			return nil, err
 		}
 	}
 
 	// Add the customName field (password)
 	if form.Password != "" {
-		if err = writer.WriteField("password", form.Password); err != nil {
+		if err := writer.WriteField("password", form.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	if form.Org != "" {
+		if err := writer.WriteField("org", form.Org); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(form.To) > 0 {
+		if err := writer.WriteField("to", strings.Join(form.To, ",")); err != nil {
+			return nil, err
+		}
+	}
+
+	if form.Visibility != "" {
+		if err := writer.WriteField("visibility", form.Visibility); err != nil {
+			return nil, err
+		}
+	}
+
+	for k, v := range extra {
+		if err := writer.WriteField(k, v); err != nil {
 			return nil, err
 		}
 	}
 
 	// Close writer to finalize the body
-	if err = writer.Close(); err != nil {
+	if err := writer.Close(); err != nil {
 		return nil, err
 	}
 
@@ -83,6 +205,12 @@ func Push(form PushForm, zipFile string) (*api.UploadResponse, error) {
 	}
 	defer resp.Body.Close()
 
+	if sessionRejected(resp) {
+		return nil, ErrSessionExpired
+	}
+	if resp.StatusCode == http.StatusNotImplemented && extra["direct"] == "true" {
+		return nil, errDirectUnsupported
+	}
 	if resp.StatusCode != http.StatusOK {
 		// Read plain text from response body
 		errmsg, err := io.ReadAll(resp.Body)
@@ -100,8 +228,12 @@ func Push(form PushForm, zipFile string) (*api.UploadResponse, error) {
 	return &result, nil
 }
 
-func List(sessionID string) (api.ListResponse, error) {
+// List returns the snippets of the logged in user, or of the organization org if it is set
+func List(sessionID, org string) (api.ListResponse, error) {
 	url := BaseURL + "/storage/list"
+	if org != "" {
+		url += "?org=" + neturl.QueryEscape(org)
+	}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -114,6 +246,9 @@ func List(sessionID string) (api.ListResponse, error) {
 	}
 	defer resp.Body.Close()
 
+	if sessionRejected(resp) {
+		return nil, ErrSessionExpired
+	}
 	if resp.StatusCode != http.StatusOK {
 		errmsg, err := io.ReadAll(resp.Body)
 		if err != nil {
@@ -131,10 +266,14 @@ func List(sessionID string) (api.ListResponse, error) {
 }
 
 // Pull a file and automatically extract
-// key: <uid> || <username>/<uid> || <username>/<path>
+// key: <uid> || <username>/<uid> || <username>/<path> || a share link
+// The server may redirect to a presigned URL, which the HTTP client follows.
 func Pull(sessionID, key, password string) (string, error) {
 	prefix := "/storage/download"
-	url := BaseURL + prefix + "?key=" + key + "&password=" + password
+	url := BaseURL + prefix + "?key=" + key + "&password=" + password + "&direct=true"
+	if strings.HasPrefix(key, "http://") || strings.HasPrefix(key, "https://") {
+		url = key + "&password=" + neturl.QueryEscape(password) + "&direct=true"
+	}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return "", err
@@ -147,6 +286,9 @@ func Pull(sessionID, key, password string) (string, error) {
 	}
 	defer resp.Body.Close()
 
+	if sessionRejected(resp) {
+		return "", ErrSessionExpired
+	}
 	if resp.StatusCode != http.StatusOK {
 		errmsg, err := io.ReadAll(resp.Body)
 		if err != nil {
@@ -190,6 +332,9 @@ func Remove(sessionID string, keys []string) (*api.RemoveResponse, error) {
 	}
 	defer resp.Body.Close()
 
+	if sessionRejected(resp) {
+		return nil, ErrSessionExpired
+	}
 	if resp.StatusCode != http.StatusOK {
 		// Read plain text from response body
 		errmsg, err := io.ReadAll(resp.Body)
@@ -205,3 +350,43 @@ func Remove(sessionID string, keys []string) (*api.RemoveResponse, error) {
 	}
 	return &result, nil
 }
+
+// Move renames the snippet identified by key to a new path
+func Move(sessionID, key, path string) (*api.MoveResponse, error) {
+	body, err := json.Marshal(api.MoveRequest{Key: key, Path: path})
+	if err != nil {
+		return nil, err
+	}
+
+	url := BaseURL + "/storage/move"
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+sessionID)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := GetHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if sessionRejected(resp) {
+		return nil, ErrSessionExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Read plain text from response body
+		errmsg, err := io.ReadAll(resp.Body)
+		if err != nil {
+			panic(err)
+		}
+		return nil, errors.New(string(errmsg))
+	}
+
+	var result api.MoveResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
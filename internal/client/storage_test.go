@@ -0,0 +1,116 @@
+package client
+
+import (
+	"codesfer/pkg/api"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeStorage serves the /storage upload routes, offering direct uploads if direct is set
+type fakeStorage struct {
+	direct   bool
+	uploads  []string // "direct" or "proxied", one per upload request
+	put      []byte
+	complete []string
+}
+
+func (f *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method + " " + r.URL.Path {
+	case "POST /storage/upload":
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("direct") == "true" {
+			f.uploads = append(f.uploads, "direct")
+			if !f.direct {
+				http.Error(w, "direct transfer disabled", http.StatusNotImplemented)
+				return
+			}
+			json.NewEncoder(w).Encode(api.UploadResponse{Uid: "d1", Path: "notes", UploadURL: "/put?key=d1"})
+			return
+		}
+		f.uploads = append(f.uploads, "proxied")
+		if _, _, err := r.FormFile("file"); err != nil {
+			http.Error(w, "missing file", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(api.UploadResponse{Uid: "p1", Path: "notes"})
+	case "PUT /put":
+		f.put, _ = io.ReadAll(r.Body)
+	case "POST /storage/upload/complete":
+		var data api.UploadCompleteRequest
+		json.NewDecoder(r.Body).Decode(&data)
+		f.complete = append(f.complete, data.Key)
+		json.NewEncoder(w).Encode(api.UploadResponse{Uid: data.Key, Path: "notes"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// withFakeStorage points BaseURL at f and returns an archive to push
+func withFakeStorage(t *testing.T, f *fakeStorage) string {
+	t.Helper()
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	old := BaseURL
+	BaseURL = ts.URL
+	t.Cleanup(func() { BaseURL = old })
+
+	archive := filepath.Join(t.TempDir(), "notes.zip")
+	if err := os.WriteFile(archive, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestPushFallsBackToProxied(t *testing.T) {
+	f := &fakeStorage{}
+	archive := withFakeStorage(t, f)
+	t.Setenv(TokenEnv, "token")
+
+	result, err := Push(PushForm{Path: "notes"}, archive)
+	if err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if result.Uid != "p1" || len(f.uploads) != 2 || f.uploads[0] != "direct" || f.uploads[1] != "proxied" {
+		t.Fatalf("want a direct attempt then a proxied upload, got %v, uid %s", f.uploads, result.Uid)
+	}
+}
+
+func TestPushDirect(t *testing.T) {
+	f := &fakeStorage{direct: true}
+	archive := withFakeStorage(t, f)
+	t.Setenv(TokenEnv, "token")
+
+	result, err := Push(PushForm{Path: "notes"}, archive)
+	if err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if string(f.put) != "archive" {
+		t.Fatalf("archive PUT to the upload url: %q", f.put)
+	}
+	if len(f.complete) != 1 || f.complete[0] != "d1" || result.Uid != "d1" || result.UploadURL != "" {
+		t.Fatalf("direct upload not completed: %v, %+v", f.complete, result)
+	}
+}
+
+func TestAnonymousPushSkipsDirect(t *testing.T) {
+	f := &fakeStorage{direct: true}
+	archive := withFakeStorage(t, f)
+	t.Setenv(TokenEnv, "")
+	t.Setenv("HOME", t.TempDir())
+
+	result, err := Push(PushForm{Path: "notes"}, archive)
+	if err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if result.Uid != "p1" || len(f.uploads) != 1 || f.uploads[0] != "proxied" {
+		t.Fatalf("want a single proxied upload, got %v, uid %s", f.uploads, result.Uid)
+	}
+}
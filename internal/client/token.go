@@ -0,0 +1,99 @@
+package client
+
+import (
+	"bytes"
+	"codesfer/pkg/api"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// CreateToken issues a personal access token; the secret is only returned here
+func CreateToken(sessionID string, request api.TokenCreateRequest) (*api.AccessToken, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", BaseURL+"/auth/tokens", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+sessionID)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := GetHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if sessionRejected(resp) {
+		return nil, ErrSessionExpired
+	}
+	if resp.StatusCode != http.StatusCreated {
+		errmsg, _ := io.ReadAll(resp.Body)
+		return nil, errors.New(string(errmsg))
+	}
+
+	var token api.AccessToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ListTokens returns the personal access tokens of the logged in user
+func ListTokens(sessionID string) (api.TokenListResponse, error) {
+	req, err := http.NewRequest("GET", BaseURL+"/auth/tokens", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+sessionID)
+
+	resp, err := GetHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if sessionRejected(resp) {
+		return nil, ErrSessionExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		errmsg, _ := io.ReadAll(resp.Body)
+		return nil, errors.New(string(errmsg))
+	}
+
+	var tokens api.TokenListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RevokeToken deletes a personal access token by id
+func RevokeToken(sessionID, id string) error {
+	req, err := http.NewRequest("DELETE", BaseURL+"/auth/tokens/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+sessionID)
+
+	resp, err := GetHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if sessionRejected(resp) {
+		return ErrSessionExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		errmsg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned status: %s; error: %s", resp.Status, errmsg)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package client
+
+import (
+	"codesfer/pkg/api"
+	neturl "net/url"
+)
+
+// Chmod changes the visibility of the snippet identified by key
+func Chmod(sessionID, key, visibility string) (*api.ChmodResponse, error) {
+	var result api.ChmodResponse
+	if err := storageJSON(sessionID, "POST", "/chmod", api.ChmodRequest{Key: key, Visibility: visibility}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Profile lists the public snippets of a user or organization. sessionID may be empty.
+func Profile(sessionID, username string) (api.ListResponse, error) {
+	var objs api.ListResponse
+	if err := storageJSON(sessionID, "GET", "/profile/"+neturl.PathEscape(username), nil, &objs); err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"codesfer/internal/server/identity"
+	"codesfer/pkg/api"
+	"codesfer/pkg/mailer"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// One-time token purposes
+const (
+	purposeReset  = "reset"
+	purposeVerify = "verify"
+)
+
+const (
+	resetTTL  = time.Hour
+	verifyTTL = 24 * time.Hour
+)
+
+// createOneTimeToken stores a single-use code for email and returns it; only its hash is kept
+func (s *Service) createOneTimeToken(email, purpose string, ttl time.Duration) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+	now := time.Now()
+	_, err := s.db.Exec(
+		"INSERT INTO one_time_tokens (hash, email, purpose, expires_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		hashToken(code), email, purpose, now.Add(ttl).Format(time.RFC3339), now.Format(time.RFC3339),
+	)
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// consumeOneTimeToken deletes the code and returns the email it was issued for,
+// if it exists, matches purpose and has not expired
+func (s *Service) consumeOneTimeToken(code, purpose string) (string, error) {
+	var email, expiresAt string
+	err := s.db.QueryRow(
+		"DELETE FROM one_time_tokens WHERE hash = ? AND purpose = ? RETURNING email, expires_at",
+		hashToken(code), purpose,
+	).Scan(&email, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrInvalidCode
+		}
+		return "", err
+	}
+	t, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil || time.Now().After(t) {
+		return "", ErrInvalidCode
+	}
+	return email, nil
+}
+
+func (s *Service) updatePassword(email, password string) error {
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("UPDATE users SET password = ? WHERE email = ?", hashed, email)
+	return err
+}
+
+// deleteUser removes the user with everything that references it. SQLite does not
+// enforce the ON DELETE CASCADE clauses unless asked to, so rows are deleted explicitly.
+func (s *Service) deleteUser(email string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM org_members WHERE username = (SELECT username FROM users WHERE email = ?)", email); err != nil {
+		return fmt.Errorf("delete from org_members: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM org_invites WHERE username = (SELECT username FROM users WHERE email = ?)", email); err != nil {
+		return fmt.Errorf("delete from org_invites: %w", err)
+	}
+	for _, table := range []string{"device_requests", "sso_requests", "one_time_tokens", "recovery_codes", "sso_identities", "ssh_keys", "access_tokens", "sessions", "users"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE email = ?", email); err != nil {
+			return fmt.Errorf("delete from %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// passwd changes the logged in user's password and signs out their other sessions
+func (s *Service) passwd(w http.ResponseWriter, r *http.Request) {
+	sessionID := identity.SessionID(r)
+	user, err := s.getUserFromSessionID(sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var data api.PasswordChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.NewPassword == "" {
+		http.Error(w, "new password is required", http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/auth/passwd] user %s is changing password", user.Username)
+	if !checkPassword(data.OldPassword, user.Password) {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.updatePassword(user.Email, data.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.deleteOtherSessions(user.Email, sessionID); err != nil {
+		log.Printf("  failed to revoke other sessions: %v", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("password changed"))
+}
+
+// resetRequest mails a reset code. It answers the same whether or not the
+// email is registered, and at once: the code is created and mailed in the
+// background, so neither the answer nor its timing reveals accounts.
+func (s *Service) resetRequest(w http.ResponseWriter, r *http.Request) {
+	var data api.ResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.Email == "" {
+		http.Error(w, "email is required", http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/auth/reset/request] password reset requested for %s", data.Email)
+
+	go s.sendReset(data.Email)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("if the account exists, a reset code was sent to its email"))
+}
+
+// sendReset mails a reset code to email if it belongs to an account
+func (s *Service) sendReset(email string) {
+	user, err := s.getUser(email)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			log.Printf("[/auth/reset/request] failed to look up user: %v", err)
+		}
+		return
+	}
+	code, err := s.createOneTimeToken(user.Email, purposeReset, resetTTL)
+	if err != nil {
+		log.Printf("[/auth/reset/request] failed to create reset code: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+	err = s.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your codesfer password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nRun the following command to choose a new password:\n\n    codesfer account reset --code %s\n\nThe code expires in %s. If you did not ask for a reset, ignore this email.\n",
+			user.Username, code, resetTTL,
+		),
+	})
+	if err != nil {
+		log.Printf("[/auth/reset/request] failed to send reset email to %s: %v", user.Email, err)
+	}
+}
+
+// resetConfirm sets a new password with a code from resetRequest and signs out every session
+func (s *Service) resetConfirm(w http.ResponseWriter, r *http.Request) {
+	var data api.ResetConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.Code == "" || data.NewPassword == "" {
+		http.Error(w, "code and new password are required", http.StatusBadRequest)
+		return
+	}
+
+	email, err := s.consumeOneTimeToken(data.Code, purposeReset)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[/auth/reset/confirm] user %s is resetting password", email)
+
+	if err := s.updatePassword(email, data.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE email = ?", email); err != nil {
+		log.Printf("  failed to revoke sessions: %v", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("password reset, please log in"))
+}
+
+// deleteAccount removes the logged in user after confirming the password,
+// including their files through onDeleteUser
+func (s *Service) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var data api.AccountDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/auth/account] user %s is deleting their account", user.Username)
+	// Accounts created through single sign-on have no password to confirm with
+	if user.Password != "" && !checkPassword(data.Password, user.Password) {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	// An organization without owners could never be managed again
+	sole, err := s.soleOwnerOf(user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(sole) > 0 {
+		http.Error(w, "you are the only owner of "+strings.Join(sole, ", ")+", add another owner or delete it first", http.StatusConflict)
+		return
+	}
+
+	if s.onDeleteUser != nil {
+		if err := s.onDeleteUser(r.Context(), user.Username); err != nil {
+			log.Printf("  failed to delete user data: %v", err)
+			http.Error(w, "failed to delete account data: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := s.deleteUser(user.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("account deleted"))
+}
+
+// sendVerification mails a code that confirms the user owns their email address
+func (s *Service) sendVerification(ctx context.Context, user *User) error {
+	code, err := s.createOneTimeToken(user.Email, purposeVerify, verifyTTL)
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your codesfer email",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nRun the following command to verify your email address:\n\n    codesfer account verify %s\n\nThe code expires in %s.\n",
+			user.Username, code, verifyTTL,
+		),
+	})
+}
+
+// verifyEmail marks the account of a verification code as verified
+func (s *Service) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data api.VerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email, err := s.consumeOneTimeToken(data.Code, purposeVerify)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[/auth/verify] user %s verified their email", email)
+	if err := s.setVerified(email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("email verified"))
+}
+
+// verifyResend mails a new verification code to an unverified account. Like
+// resetRequest, the answer does not reveal whether the account exists.
+func (s *Service) verifyResend(w http.ResponseWriter, r *http.Request) {
+	var data api.ResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.Email == "" {
+		http.Error(w, "email is required", http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/auth/verify/resend] verification email requested for %s", data.Email)
+
+	go s.resendVerification(data.Email)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("if the account exists and is not verified, a verification code was sent to its email"))
+}
+
+// resendVerification mails a new verification code to email if it belongs to an unverified account
+func (s *Service) resendVerification(email string) {
+	user, err := s.getUser(email)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			log.Printf("[/auth/verify/resend] failed to look up user: %v", err)
+		}
+		return
+	}
+	if user.Verified {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+	if err := s.sendVerification(ctx, user); err != nil {
+		log.Printf("[/auth/verify/resend] failed to send verification email to %s: %v", user.Email, err)
+	}
+}
@@ -2,35 +2,156 @@
 package auth
 
 import (
+	"codesfer/internal/server/identity"
 	"codesfer/pkg/api"
+	"codesfer/pkg/geo"
+	"codesfer/pkg/mailer"
+	"codesfer/pkg/ratelimit"
+	"codesfer/pkg/realip"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"net"
 	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
 )
 
 var reservedUsername = [3]string{"anon", "admin", "root"}
 
-func AuthHandler(driver, source string) http.Handler {
-	// Setup user database
-	err := connect(driver, source)
-	if err != nil {
-		panic(err)
+// Default session lifetimes, used when SessionConfig leaves them unset.
+const (
+	DefaultAbsoluteTTL = 30 * 24 * time.Hour
+	DefaultIdleTTL     = 7 * 24 * time.Hour
+)
+
+// SessionConfig bounds how long a session token stays valid.
+type SessionConfig struct {
+	// AbsoluteTTL is the maximum age of a session, regardless of activity.
+	AbsoluteTTL time.Duration
+	// IdleTTL expires a session that has not been used for this long. Every
+	// authenticated request slides the window forward.
+	IdleTTL time.Duration
+}
+
+// Config holds the settings and collaborators of the auth service.
+type Config struct {
+	Sessions SessionConfig
+	// Mailer delivers password reset codes, defaults to logging them.
+	Mailer mailer.Mailer
+	// OnDeleteUser runs before an account or an organization is deleted, with its
+	// username or organization name, e.g. to remove its files. The account is kept
+	// if it returns an error.
+	OnDeleteUser func(ctx context.Context, username string) error
+	// SSO enables login through an OpenID Connect provider.
+	SSO SSOConfig
+	// Limiter throttles logins and locks accounts out after failed ones, nil disables it.
+	Limiter *ratelimit.Limiter
+	// Geolocator finds where sessions are created from, defaults to geo.Disabled.
+	Geolocator geo.Geolocator
+}
+
+// Service owns the user database and serves the /auth routes.
+type Service struct {
+	db           *sql.DB
+	sessions     SessionConfig
+	mailer       mailer.Mailer
+	onDeleteUser func(ctx context.Context, username string) error
+	sso          SSOConfig
+	limiter      *ratelimit.Limiter
+	geo          geo.Geolocator
+	handler      http.Handler
+}
+
+// New prepares the auth tables in db and builds the routes.
+func New(db *sql.DB, cfg Config) (*Service, error) {
+	if cfg.Sessions.AbsoluteTTL <= 0 {
+		cfg.Sessions.AbsoluteTTL = DefaultAbsoluteTTL
+	}
+	if cfg.Sessions.IdleTTL <= 0 {
+		cfg.Sessions.IdleTTL = DefaultIdleTTL
+	}
+	if cfg.Mailer == nil {
+		cfg.Mailer = &mailer.Log{}
+	}
+	if cfg.Geolocator == nil {
+		cfg.Geolocator = geo.Disabled{}
+	}
+	s := &Service{
+		db:           db,
+		sessions:     cfg.Sessions,
+		mailer:       cfg.Mailer,
+		onDeleteUser: cfg.OnDeleteUser,
+		sso:          cfg.SSO,
+		limiter:      cfg.Limiter,
+		geo:          cfg.Geolocator,
+	}
+	if err := s.createTable(); err != nil {
+		return nil, err
 	}
 
 	authhandler := http.NewServeMux()
-	authhandler.HandleFunc("GET /username", username)
-	authhandler.HandleFunc("POST /register", register)
-	authhandler.HandleFunc("POST /login", login)
-	authhandler.HandleFunc("POST /logout", logout)
+	handle(authhandler, "GET /username", http.HandlerFunc(s.username), s.limitIP("username", usernameRate))
+	handle(authhandler, "POST /register", http.HandlerFunc(s.register), s.passwordsEnabled, s.limitIP("register", ipRate))
+	handle(authhandler, "POST /login", http.HandlerFunc(s.login), s.passwordsEnabled, s.limitIP("login", ipRate))
+	handle(authhandler, "POST /login/2fa", http.HandlerFunc(s.loginTwoFactor), s.passwordsEnabled, s.limitIP("login", ipRate))
+	handle(authhandler, "POST /login/ssh/challenge", http.HandlerFunc(s.sshChallenge), s.limitIP("login", ipRate))
+	handle(authhandler, "POST /login/ssh", http.HandlerFunc(s.loginSSH), s.limitIP("login", ipRate))
+	handle(authhandler, "POST /sso/start", http.HandlerFunc(s.ssoStart), s.ssoEnabled, s.limitIP("sso", ipRate))
+	handle(authhandler, "GET /sso/go/{code}", http.HandlerFunc(s.ssoConfirm), s.ssoEnabled)
+	handle(authhandler, "POST /sso/go/{code}", http.HandlerFunc(s.ssoRedirect), s.ssoEnabled)
+	handle(authhandler, "GET /sso/callback", http.HandlerFunc(s.ssoCallback), s.ssoEnabled)
+	handle(authhandler, "POST /sso/poll", http.HandlerFunc(s.ssoPoll), s.ssoEnabled)
+	handle(authhandler, "POST /device/code", http.HandlerFunc(s.deviceCode), s.limitIP("device", ipRate))
+	authhandler.HandleFunc("POST /device/token", s.deviceToken)
+	authhandler.HandleFunc("GET /device", s.devicePage)
+	handle(authhandler, "GET /device/sso", http.HandlerFunc(s.deviceSSO), s.ssoEnabled)
+	handle(authhandler, "GET /device/requests/{code}", http.HandlerFunc(s.deviceInfo), s.refreshTime)
+	handle(authhandler, "POST /device/approve", http.HandlerFunc(s.deviceApprove), s.refreshTime)
+	authhandler.HandleFunc("POST /logout", s.logout)
 	// authhandler.HandleFunc("GET /me", me)
-	handle(authhandler, "/me", http.HandlerFunc(me), refreshTime)
+	handle(authhandler, "/me", http.HandlerFunc(s.me), s.refreshTime)
+	handle(authhandler, "DELETE /sessions/{id}", http.HandlerFunc(s.revokeSession), s.refreshTime)
+	handle(authhandler, "DELETE /sessions", http.HandlerFunc(s.revokeOtherSessions), s.refreshTime)
+	handle(authhandler, "POST /passwd", http.HandlerFunc(s.passwd), s.passwordsEnabled, s.refreshTime)
+	handle(authhandler, "DELETE /account", http.HandlerFunc(s.deleteAccount), s.refreshTime)
+	handle(authhandler, "POST /verify", http.HandlerFunc(s.verifyEmail), s.limitIP("verify", ipRate))
+	handle(authhandler, "POST /verify/resend", http.HandlerFunc(s.verifyResend), s.limitIP("verify", ipRate))
+	handle(authhandler, "POST /reset/request", http.HandlerFunc(s.resetRequest), s.passwordsEnabled, s.limitIP("reset", ipRate))
+	handle(authhandler, "POST /reset/confirm", http.HandlerFunc(s.resetConfirm), s.passwordsEnabled, s.limitIP("reset", ipRate))
+	handle(authhandler, "POST /2fa/enroll", http.HandlerFunc(s.enrollTwoFactor), s.refreshTime)
+	handle(authhandler, "POST /2fa/enable", http.HandlerFunc(s.enableTwoFactor), s.refreshTime)
+	handle(authhandler, "POST /2fa/disable", http.HandlerFunc(s.disableTwoFactor), s.refreshTime)
+	handle(authhandler, "POST /ssh-keys", http.HandlerFunc(s.addSSHKey), s.refreshTime)
+	handle(authhandler, "GET /ssh-keys", http.HandlerFunc(s.listSSHKeys), s.refreshTime)
+	handle(authhandler, "DELETE /ssh-keys/{id}", http.HandlerFunc(s.removeSSHKey), s.refreshTime)
+	handle(authhandler, "POST /tokens", http.HandlerFunc(s.createToken), s.refreshTime)
+	handle(authhandler, "GET /tokens", http.HandlerFunc(s.listTokens), s.refreshTime)
+	handle(authhandler, "DELETE /tokens/{id}", http.HandlerFunc(s.revokeToken), s.refreshTime)
+	handle(authhandler, "POST /orgs", http.HandlerFunc(s.createOrgRoute), s.refreshTime)
+	handle(authhandler, "GET /orgs", http.HandlerFunc(s.listOrgs), s.refreshTime)
+	handle(authhandler, "GET /orgs/invites", http.HandlerFunc(s.listInvites), s.refreshTime)
+	handle(authhandler, "POST /orgs/invites/{org}", http.HandlerFunc(s.answerInviteRoute), s.refreshTime)
+	handle(authhandler, "DELETE /orgs/{org}", http.HandlerFunc(s.deleteOrgRoute), s.refreshTime)
+	handle(authhandler, "GET /orgs/{org}/members", http.HandlerFunc(s.listOrgMembers), s.refreshTime)
+	handle(authhandler, "PUT /orgs/{org}/members/{username}", http.HandlerFunc(s.setOrgMemberRoute), s.refreshTime)
+	handle(authhandler, "DELETE /orgs/{org}/members/{username}", http.HandlerFunc(s.removeOrgMemberRoute), s.refreshTime)
+
+	s.handler = authhandler
+	return s, nil
+}
 
-	return authhandler
+// ServeHTTP serves the /auth routes, with the /auth prefix already stripped.
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
 }
 
 // username route will check if a username is taken
-func username(w http.ResponseWriter, r *http.Request) {
+func (s *Service) username(w http.ResponseWriter, r *http.Request) {
 	username := r.URL.Query().Get("username")
 	for _, reserved := range reservedUsername {
 		if username == reserved {
@@ -39,7 +160,7 @@ func username(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	exists := usernameExists(username)
+	exists := s.usernameExists(username)
 	if exists {
 		w.WriteHeader(http.StatusConflict)
 		w.Write([]byte("username taken"))
@@ -49,7 +170,7 @@ func username(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("username available"))
 }
 
-func register(w http.ResponseWriter, r *http.Request) {
+func (s *Service) register(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -64,18 +185,35 @@ func register(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "email, password and username are required", http.StatusBadRequest)
 		return
 	}
+	if addr, err := mail.ParseAddress(data.Email); err != nil || addr.Address != data.Email {
+		http.Error(w, "invalid email address", http.StatusBadRequest)
+		return
+	}
 	log.Printf("[/auth/register] user %s is trying to register", data.Email)
-	err = createUser(data.Email, data.Password, data.Username)
+	if slices.Contains(reservedUsername[:], data.Username) || s.usernameExists(data.Username) {
+		http.Error(w, "username taken", http.StatusConflict)
+		return
+	}
+	err = s.createUser(data.Email, data.Password, data.Username)
 	if err != nil {
+		if errors.Is(err, ErrUserAlreadyExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	log.Printf("[/auth/register] user created: %s", data.Email)
+
+	user := &User{Email: data.Email, Username: data.Username}
+	if err := s.sendVerification(r.Context(), user); err != nil {
+		log.Printf("  failed to send verification email: %v", err)
+	}
 	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte("user created"))
+	w.Write([]byte("user created, check your email to verify it"))
 }
 
-func login(w http.ResponseWriter, r *http.Request) {
+func (s *Service) login(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -90,8 +228,12 @@ func login(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	log.Printf("[/auth/login] user %s is trying to login", data.Email)
-	verified, err := verify(data.Email, data.Password)
+	ip, _ := ClientIP(r)
+	log.Printf("[/auth/login] user %s is trying to login from %s", data.Email, ip)
+	if s.throttleAccount(w, r, data.Email) {
+		return
+	}
+	verified, err := s.verify(data.Email, data.Password)
 	if err != nil {
 		if err.Error() == "user not found" {
 			http.Error(w, err.Error(), http.StatusNotFound)
@@ -103,29 +245,47 @@ func login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if !verified {
+		s.loginFailed(r, data.Email)
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		log.Printf("  [invalid credentials] user %s failed to login", data.Email)
 		return
 	}
-	agent := r.Header.Get("User-Agent")
 
-	// Get real IP from headers if behind proxy
-	ip := r.Header.Get("CF-Connecting-IP") // Cloudflare
-	if ip == "" {
-		ip = r.Header.Get("X-Forwarded-For") // Standard header
+	// With two-factor authentication the password only earns a challenge for /login/2fa
+	user, err := s.getUser(data.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	if ip == "" {
-		// Fallback to RemoteAddr
-		var err error
-		ip, _, err = net.SplitHostPort(r.RemoteAddr)
+	if user.TwoFactor {
+		challenge, err := s.createOneTimeToken(user.Email, purposeTwoFactor, twoFactorTTL)
 		if err != nil {
-			log.Printf("  failed to split remote addr: %v", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		log.Printf("  user %s passed the password step, awaiting second factor", data.Email)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(api.LoginChallenge{Challenge: challenge})
+		return
 	}
 
-	sessionID, err := createSession(data.Email, agent, ip)
+	s.loginSucceeded(r, data.Email)
+	s.issueSession(w, r, data.Email)
+}
+
+// issueSession creates a session for email and writes its token to the response
+func (s *Service) issueSession(w http.ResponseWriter, r *http.Request, email string) {
+	agent := r.Header.Get("User-Agent")
+	ip, err := ClientIP(r)
+	if err != nil {
+		log.Printf("  failed to determine the client address: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("  issuing a session for %s to %s", email, ip)
+
+	sessionID, err := s.createSession(email, agent, ip)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -135,15 +295,24 @@ func login(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(sessionID))
 }
 
-func logout(w http.ResponseWriter, r *http.Request) {
-	sessionID := r.Header.Get("Authorization")
-	if sessionID == "" {
+// ClientIP returns the address of the client, as computed by the realip
+// middleware in front of the service
+func ClientIP(r *http.Request) (string, error) {
+	ip, err := realip.FromRequest(r)
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+func (s *Service) logout(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || sessionID == "" {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
-	sessionID = sessionID[7:] // Remove "Bearer "
 
-	err := deleteSession(sessionID)
+	err := s.deleteSession(sessionID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -152,20 +321,21 @@ func logout(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("logout success"))
 }
 
-func me(w http.ResponseWriter, r *http.Request) {
-	sessionID := r.URL.Query().Get("session_id")
+// me describes the account and the sessions of the logged in user
+func (s *Service) me(w http.ResponseWriter, r *http.Request) {
+	sessionID := identity.SessionID(r)
 	if sessionID == "" {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	user, err := getUserFromSessionID(sessionID)
+	user, err := s.getUserFromSessionID(sessionID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	sessions, err := getSessions(user.Email)
+	sessions, err := s.getSessions(user.Email)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -175,18 +345,60 @@ func me(w http.ResponseWriter, r *http.Request) {
 
 	for _, session := range sessions {
 		respSessions = append(respSessions, api.AccountSession{
+			ID:        session.PublicID,
 			Location:  session.Location,
 			Agent:     session.Agent,
 			LastSeen:  session.LastSeen,
 			CreatedAt: session.CreatedAt,
-			Current:   session.ID == sessionID,
+			Current:   session.ID == hashToken(sessionID),
 		})
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(api.AccountResponse{
-		Email:    user.Email,
-		Username: user.Username,
-		Sessions: respSessions,
+		Email:     user.Email,
+		Username:  user.Username,
+		Verified:  user.Verified,
+		TwoFactor: user.TwoFactor,
+		Sessions:  respSessions,
 	})
 }
+
+// revokeSession deletes one of the logged in user's sessions by its public id
+func (s *Service) revokeSession(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := r.PathValue("id")
+	log.Printf("[/auth/sessions] user %s is revoking session %s", user.Username, id)
+	if err := s.deleteSessionByPublicID(user.Email, id); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("session revoked"))
+}
+
+// revokeOtherSessions deletes every session of the logged in user except the current one
+func (s *Service) revokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	sessionID := identity.SessionID(r)
+	user, err := s.getUserFromSessionID(sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[/auth/sessions] user %s is revoking all other sessions", user.Username)
+	n, err := s.deleteOtherSessions(user.Email, sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%d session(s) revoked", n)
+}
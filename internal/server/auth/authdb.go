@@ -1,27 +1,26 @@
 package auth
 
 import (
-	"database/sql"
 	"errors"
 	"log"
+	"strings"
 	"time"
 
-	_ "github.com/tursodatabase/libsql-client-go/libsql"
 	"golang.org/x/crypto/bcrypt"
-	_ "modernc.org/sqlite"
 )
 
-var db *sql.DB
-
 type User struct {
 	Email     string
 	Password  string
 	Username  string
 	CreatedAt string
+	Verified  bool
+	TwoFactor bool // TOTP is enabled, login needs a second step
 }
 
 type Session struct {
 	ID        string `json:"-"`
+	PublicID  string `json:"id"` // Safe to show, identifies the session without granting access
 	Email     string `json:"-"`
 	Location  string `json:"location"`
 	Agent     string `json:"agent"`
@@ -40,19 +39,14 @@ func (e AuthError) Error() string {
 const (
 	ErrUserAlreadyExists AuthError = "user already exists"
 	ErrUserNotFound      AuthError = "user not found"
+	ErrSessionNotFound   AuthError = "session not found"
+	ErrSessionExpired    AuthError = "session expired"
+	ErrTokenNotFound     AuthError = "access token not found"
+	ErrTokenExpired      AuthError = "access token expired"
+	ErrInvalidCode       AuthError = "invalid or expired code"
 )
 
-func connect(driver, source string) error {
-	_db, err := sql.Open(driver, source)
-	if err != nil {
-		panic(err)
-	}
-
-	db = _db
-	return createTable()
-}
-
-func createTable() error {
+func (s *Service) createTable() error {
 	query := `
         CREATE TABLE IF NOT EXISTS users (
             email VARCHAR(255) PRIMARY KEY,
@@ -69,9 +63,145 @@ func createTable() error {
             created_at VARCHAR(255),
 
 			FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS one_time_tokens (
+			hash VARCHAR(255) PRIMARY KEY,
+			email VARCHAR(255),
+			purpose VARCHAR(255),
+			expires_at VARCHAR(255),
+			created_at VARCHAR(255),
+
+			FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			hash VARCHAR(255) PRIMARY KEY,
+			email VARCHAR(255),
+
+			FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS sso_identities (
+			issuer VARCHAR(255),
+			subject VARCHAR(255),
+			email VARCHAR(255),
+			created_at VARCHAR(255),
+
+			PRIMARY KEY (issuer, subject),
+			FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS sso_requests (
+			code VARCHAR(255) PRIMARY KEY,
+			poll_hash VARCHAR(255) UNIQUE,
+			state VARCHAR(255) UNIQUE,
+			nonce VARCHAR(255),
+			verifier VARCHAR(255),
+			redirect_url VARCHAR(255),
+			email VARCHAR(255),
+			error VARCHAR(255),
+			device VARCHAR(255) NOT NULL DEFAULT '',
+			agent VARCHAR(255) NOT NULL DEFAULT '',
+			location VARCHAR(255) NOT NULL DEFAULT '',
+			expires_at VARCHAR(255),
+			created_at VARCHAR(255)
+		);
+		CREATE TABLE IF NOT EXISTS device_requests (
+			user_code VARCHAR(255) PRIMARY KEY,
+			device_hash VARCHAR(255) UNIQUE,
+			email VARCHAR(255) NOT NULL DEFAULT '',
+			status VARCHAR(255),
+			agent VARCHAR(255),
+			location VARCHAR(255),
+			last_poll VARCHAR(255) NOT NULL DEFAULT '',
+			expires_at VARCHAR(255),
+			created_at VARCHAR(255)
+		);
+		CREATE TABLE IF NOT EXISTS ssh_keys (
+			id VARCHAR(255) PRIMARY KEY,
+			email VARCHAR(255),
+			name VARCHAR(255),
+			fingerprint VARCHAR(255) UNIQUE,
+			key_type VARCHAR(255),
+			public_key TEXT,
+			created_at VARCHAR(255),
+			last_used VARCHAR(255),
+
+			FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS access_tokens (
+			id VARCHAR(255) PRIMARY KEY,
+			hash VARCHAR(255) UNIQUE,
+			email VARCHAR(255),
+			name VARCHAR(255),
+			scopes VARCHAR(255),
+			created_at VARCHAR(255),
+			expires_at VARCHAR(255),
+			last_used VARCHAR(255),
+
+			FOREIGN KEY (email) REFERENCES users(email) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS orgs (
+			name VARCHAR(255) PRIMARY KEY,  -- Shares the namespace of usernames
+			created_by VARCHAR(255),
+			created_at VARCHAR(255)
+		);
+		CREATE TABLE IF NOT EXISTS org_members (
+			org VARCHAR(255),
+			username VARCHAR(255),
+			role VARCHAR(255),
+			added_by VARCHAR(255),
+			created_at VARCHAR(255),
+
+			PRIMARY KEY (org, username),
+			FOREIGN KEY (org) REFERENCES orgs(name) ON DELETE CASCADE
+		);
+		-- Invitations become org_members rows once the invitee accepts
+		CREATE TABLE IF NOT EXISTS org_invites (
+			org VARCHAR(255),
+			username VARCHAR(255),
+			role VARCHAR(255),
+			invited_by VARCHAR(255),
+			created_at VARCHAR(255),
+
+			PRIMARY KEY (org, username),
+			FOREIGN KEY (org) REFERENCES orgs(name) ON DELETE CASCADE
 	)`
 
-	_, err := db.Exec(query)
+	if _, err := s.db.Exec(query); err != nil {
+		return err
+	}
+
+	// Migrations for tables created by older versions
+	if err := s.addColumn("sessions", "public_id", "VARCHAR(255)"); err != nil {
+		return err
+	}
+	// Users from before email verification keep working, new ones start unverified
+	if err := s.addColumn("users", "verified", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	// totp_secret is set on enrollment, totp_enabled once a first code confirmed it
+	for column, definition := range map[string]string{
+		"totp_secret":    "VARCHAR(255) NOT NULL DEFAULT ''",
+		"totp_enabled":   "INTEGER NOT NULL DEFAULT 0",
+		"totp_last_step": "INTEGER NOT NULL DEFAULT 0",
+	} {
+		if err := s.addColumn("users", column, definition); err != nil {
+			return err
+		}
+	}
+	for _, column := range []string{"device", "agent", "location"} {
+		if err := s.addColumn("sso_requests", column, "VARCHAR(255) NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	_, err := s.db.Exec("UPDATE sessions SET public_id = lower(hex(randomblob(8))) WHERE public_id IS NULL OR public_id = ''")
+	return err
+}
+
+// addColumn adds a column to an existing table, doing nothing if it is already there
+func (s *Service) addColumn(table, column, definition string) error {
+	_, err := s.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	if err != nil && strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+		return nil
+	}
 	return err
 }
 
@@ -94,8 +224,8 @@ func checkPassword(password, hash string) bool {
 	return err == nil
 }
 
-func createUser(email, password, username string) error {
-	user, err := getUser(email)
+func (s *Service) createUser(email, password, username string) error {
+	user, err := s.getUser(email)
 	if err != nil && err != ErrUserNotFound {
 		return err
 	}
@@ -106,17 +236,17 @@ func createUser(email, password, username string) error {
 	if err != nil {
 		return err
 	}
-	db.Exec(
-		"INSERT INTO users (email, password, username, created_at) VALUES (?, ?, ?, ?)",
+	_, err = s.db.Exec(
+		"INSERT INTO users (email, password, username, created_at, verified) VALUES (?, ?, ?, ?, 0)",
 		email, hashed, username, time.Now().Format(time.RFC3339),
 	)
-	return nil
+	return err
 }
 
-func getUser(email string) (*User, error) {
-	row := db.QueryRow("SELECT email, password, username FROM users WHERE email = ?", email)
+func (s *Service) getUser(email string) (*User, error) {
+	row := s.db.QueryRow("SELECT email, password, username, verified, totp_enabled FROM users WHERE email = ?", email)
 	user := &User{}
-	err := row.Scan(&user.Email, &user.Password, &user.Username)
+	err := row.Scan(&user.Email, &user.Password, &user.Username, &user.Verified, &user.TwoFactor)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			return nil, ErrUserNotFound
@@ -126,83 +256,158 @@ func getUser(email string) (*User, error) {
 	return user, nil
 }
 
-func getUserFromSessionID(sessionID string) (*User, error) {
-	session, err := getSession(sessionID)
+func (s *Service) getUserFromSessionID(sessionID string) (*User, error) {
+	session, err := s.getSession(sessionID)
 	if err != nil {
 		return nil, err
 	}
 	if session == nil {
 		return nil, errors.New("session not found")
 	}
-	return getUser(session.Email)
+	return s.getUser(session.Email)
 }
 
-func createSession(email, agent, ip string) (string, error) {
-	uniqueID := generateUniqueID()
-	location, err := ip2Location(ip)
+// createSession stores a new session and returns the token the client authenticates with
+func (s *Service) createSession(email, agent, ip string) (string, error) {
+	token, id, err := newSessionToken()
 	if err != nil {
-		location = "unknown"
+		return "", err
+	}
+	publicID, err := newPublicID()
+	if err != nil {
+		return "", err
 	}
+	location, lookup := s.location(ip, func(location string) error {
+		_, err := s.db.Exec("UPDATE sessions SET location = ? WHERE id = ?", location, id)
+		return err
+	})
 
-	query := "INSERT INTO sessions (id, email, location, agent, last_seen, created_at) VALUES (?, ?, ?, ?, ?, ?)"
-	_, err = db.Exec(query, uniqueID, email, location, agent, time.Now().Format(time.RFC3339), time.Now().Format(time.RFC3339))
+	query := "INSERT INTO sessions (id, public_id, email, location, agent, last_seen, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err = s.db.Exec(query, id, publicID, email, location, agent, time.Now().Format(time.RFC3339), time.Now().Format(time.RFC3339))
 	if err != nil {
 		return "", err
 	}
-	return uniqueID, nil
+	lookup()
+	return token, nil
 }
 
-func getSession(sessionID string) (*Session, error) {
-	row := db.QueryRow("SELECT id, email, location, agent, last_seen, created_at FROM sessions WHERE id = ?", sessionID)
+// getSession looks up the session of a client token, expired sessions are deleted
+func (s *Service) getSession(token string) (*Session, error) {
+	row := s.db.QueryRow("SELECT id, email, location, agent, last_seen, created_at FROM sessions WHERE id = ?", hashToken(token))
 	session := &Session{}
 	err := row.Scan(&session.ID, &session.Email, &session.Location, &session.Agent, &session.LastSeen, &session.CreatedAt)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
-			return nil, ErrUserNotFound
+			return nil, ErrSessionNotFound
 		}
 		return nil, err
 	}
+	if s.expired(session, time.Now()) {
+		if _, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", session.ID); err != nil {
+			log.Printf("[getSession] failed to delete expired session: %v", err)
+		}
+		return nil, ErrSessionExpired
+	}
 	return session, nil
 }
 
-func getSessions(email string) ([]Session, error) {
-	rows, err := db.Query("SELECT id, location, agent, last_seen, created_at FROM sessions WHERE email = ?", email)
+// getSessions returns the live sessions of a user and deletes the expired ones
+func (s *Service) getSessions(email string) ([]Session, error) {
+	rows, err := s.db.Query("SELECT id, public_id, location, agent, last_seen, created_at FROM sessions WHERE email = ? ORDER BY created_at", email)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	now := time.Now()
 	sessions := []Session{}
+	expired := []string{}
 	for rows.Next() {
 		session := Session{}
-		err := rows.Scan(&session.ID, &session.Location, &session.Agent, &session.LastSeen, &session.CreatedAt)
+		err := rows.Scan(&session.ID, &session.PublicID, &session.Location, &session.Agent, &session.LastSeen, &session.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
+		if s.expired(&session, now) {
+			expired = append(expired, session.ID)
+			continue
+		}
 		sessions = append(sessions, session)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, id := range expired {
+		if _, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", id); err != nil {
+			log.Printf("[getSessions] failed to delete expired session: %v", err)
+		}
+	}
 	return sessions, nil
 }
 
-func deleteSession(sessionID string) error {
+// expired reports whether the session outlived its absolute lifetime or sat idle too long
+func (s *Service) expired(session *Session, now time.Time) bool {
+	createdAt, err := time.Parse(time.RFC3339, session.CreatedAt)
+	if err != nil {
+		return true
+	}
+	lastSeen, err := time.Parse(time.RFC3339, session.LastSeen)
+	if err != nil {
+		return true
+	}
+	return now.After(createdAt.Add(s.sessions.AbsoluteTTL)) || now.After(lastSeen.Add(s.sessions.IdleTTL))
+}
+
+func (s *Service) deleteSession(token string) error {
 	query := "DELETE FROM sessions WHERE id = ?"
-	_, err := db.Exec(query, sessionID)
+	_, err := s.db.Exec(query, hashToken(token))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func updateSessionLastSeen(sessionID string) error {
+// deleteSessionByPublicID revokes one session of a user
+func (s *Service) deleteSessionByPublicID(email, publicID string) error {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE public_id = ? AND email = ?", publicID, email)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// deleteOtherSessions revokes every session of a user except the one of token
+func (s *Service) deleteOtherSessions(email, token string) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE email = ? AND id != ?", email, hashToken(token))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// updateSessionLastSeen slides the idle window of the session forward
+func (s *Service) updateSessionLastSeen(token string) error {
 	query := "UPDATE sessions SET last_seen = ? WHERE id = ?"
-	_, err := db.Exec(query, time.Now().Format(time.RFC3339), sessionID)
+	_, err := s.db.Exec(query, time.Now().Format(time.RFC3339), hashToken(token))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func usernameExists(username string) bool {
-	row := db.QueryRow("SELECT username FROM users WHERE username = ?", username)
+func (s *Service) setVerified(email string) error {
+	_, err := s.db.Exec("UPDATE users SET verified = 1 WHERE email = ?", email)
+	return err
+}
+
+// usernameExists reports whether username is taken by a user or an organization,
+// which share a namespace
+func (s *Service) usernameExists(username string) bool {
+	row := s.db.QueryRow("SELECT username FROM users WHERE username = ? UNION SELECT name FROM orgs WHERE name = ?", username, username)
 	user := &User{}
 	err := row.Scan(&user.Username)
 	if err != nil {
@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"codesfer/internal/server/identity"
+	"codesfer/pkg/api"
+	"codesfer/pkg/oidc"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Device authorization (RFC 8628): a machine without a browser or a trusted
+// terminal asks for a user code, and a logged in user approves it elsewhere.
+const (
+	deviceTTL = 10 * time.Minute
+	// devicePollInterval is the minimum number of seconds between polls
+	devicePollInterval = 5
+
+	devicePending  = "pending"
+	deviceApproved = "approved"
+	deviceDenied   = "denied"
+)
+
+// Token endpoint error codes, RFC 8628 section 3.5
+const (
+	deviceAuthorizationPending = "authorization_pending"
+	deviceSlowDown             = "slow_down"
+	deviceAccessDenied         = "access_denied"
+	deviceExpiredToken         = "expired_token"
+)
+
+type deviceRequest struct {
+	UserCode  string
+	Email     string
+	Status    string
+	Agent     string
+	Location  string
+	LastPoll  time.Time
+	CreatedAt string
+}
+
+// getDeviceRequest looks a device request up by column, expired requests are deleted
+func (s *Service) getDeviceRequest(column, value string) (*deviceRequest, error) {
+	req := &deviceRequest{}
+	var lastPoll, expiresAt string
+	err := s.db.QueryRow(
+		"SELECT user_code, email, status, agent, location, last_poll, expires_at, created_at FROM device_requests WHERE "+column+" = ?", value,
+	).Scan(&req.UserCode, &req.Email, &req.Status, &req.Agent, &req.Location, &lastPoll, &expiresAt, &req.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidCode
+		}
+		return nil, err
+	}
+	req.LastPoll, _ = time.Parse(time.RFC3339Nano, lastPoll)
+	if t, err := time.Parse(time.RFC3339, expiresAt); err != nil || time.Now().After(t) {
+		s.db.Exec("DELETE FROM device_requests WHERE user_code = ?", req.UserCode)
+		return nil, ErrInvalidCode
+	}
+	return req, nil
+}
+
+// decideDevice approves or denies a pending device request on behalf of email
+func (s *Service) decideDevice(userCode, email string, approve bool) error {
+	req, err := s.getDeviceRequest("user_code", normalizeUserCode(userCode))
+	if err != nil {
+		return err
+	}
+	status := deviceDenied
+	if approve {
+		status = deviceApproved
+	}
+	result, err := s.db.Exec(
+		"UPDATE device_requests SET status = ?, email = ? WHERE user_code = ? AND status = ?",
+		status, email, req.UserCode, devicePending,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// deviceCode starts a device login and returns the codes for the device and the user
+func (s *Service) deviceCode(w http.ResponseWriter, r *http.Request) {
+	userCode, err := newUserCode()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deviceCode, err := oidc.RandomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	location, lookup := "unknown", func() {}
+	if ip, err := ClientIP(r); err == nil {
+		location, lookup = s.location(ip, func(location string) error {
+			_, err := s.db.Exec("UPDATE device_requests SET location = ? WHERE user_code = ?", location, userCode)
+			return err
+		})
+	}
+	now := time.Now()
+	_, err = s.db.Exec(
+		"INSERT INTO device_requests (user_code, device_hash, status, agent, location, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userCode, hashToken(deviceCode), devicePending, r.Header.Get("User-Agent"), location,
+		now.Add(deviceTTL).Format(time.RFC3339), now.Format(time.RFC3339),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	lookup()
+	log.Printf("[/auth/device/code] device request %s created from %s", userCode, location)
+
+	verificationURI := baseURL(r) + "/auth/device"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.DeviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?code=" + url.QueryEscape(userCode),
+		ExpiresIn:               int(deviceTTL.Seconds()),
+		Interval:                devicePollInterval,
+	})
+}
+
+func deviceError(w http.ResponseWriter, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(api.DeviceTokenError{Error: code, ErrorDescription: description})
+}
+
+// deviceToken is polled by the device. It issues a session once the request was
+// approved and answers with RFC 8628 error codes until then.
+func (s *Service) deviceToken(w http.ResponseWriter, r *http.Request) {
+	var data api.DeviceTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := s.getDeviceRequest("device_hash", hashToken(data.DeviceCode))
+	if err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			deviceError(w, deviceExpiredToken, "the device code is invalid or expired, please log in again")
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Status {
+	case devicePending:
+		now := time.Now()
+		// A second of leeway for network jitter between polls
+		tooFast := now.Sub(req.LastPoll) < (devicePollInterval-1)*time.Second
+		s.db.Exec("UPDATE device_requests SET last_poll = ? WHERE user_code = ?", now.Format(time.RFC3339Nano), req.UserCode)
+		if tooFast {
+			deviceError(w, deviceSlowDown, "polling too fast")
+			return
+		}
+		deviceError(w, deviceAuthorizationPending, "waiting for approval")
+		return
+	case deviceDenied:
+		s.db.Exec("DELETE FROM device_requests WHERE user_code = ?", req.UserCode)
+		deviceError(w, deviceAccessDenied, "the login was denied")
+		return
+	}
+
+	// Only one poll may collect the session
+	result, err := s.db.Exec("DELETE FROM device_requests WHERE user_code = ? AND status = ?", req.UserCode, deviceApproved)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		deviceError(w, deviceExpiredToken, "the device code was already used")
+		return
+	}
+	log.Printf("[/auth/device/token] device %s logged in as %s", req.UserCode, req.Email)
+	s.issueSession(w, r, req.Email)
+}
+
+// deviceInfo shows a logged in user what they are about to approve
+func (s *Service) deviceInfo(w http.ResponseWriter, r *http.Request) {
+	req, err := s.getDeviceRequest("user_code", normalizeUserCode(r.PathValue("code")))
+	if err == nil && req.Status != devicePending {
+		err = ErrInvalidCode
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			http.Error(w, "no pending device login with this code", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.DeviceRequestInfo{
+		UserCode:  req.UserCode,
+		Agent:     req.Agent,
+		Location:  req.Location,
+		CreatedAt: req.CreatedAt,
+	})
+}
+
+// deviceApprove approves or denies a device login as the logged in user
+func (s *Service) deviceApprove(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var data api.DeviceApproveRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.decideDevice(data.UserCode, user.Email, !data.Deny); err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			http.Error(w, "no pending device login with this code", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data.Deny {
+		log.Printf("[/auth/device/approve] user %s denied device %s", user.Username, data.UserCode)
+		w.Write([]byte("device login denied"))
+		return
+	}
+	log.Printf("[/auth/device/approve] user %s approved device %s", user.Username, data.UserCode)
+	w.Write([]byte("device login approved"))
+}
+
+// devicePage is the verification URI. It explains how to approve a code and,
+// with single sign-on, lets the user approve it from the browser.
+func (s *Service) devicePage(w http.ResponseWriter, r *http.Request) {
+	code := normalizeUserCode(r.URL.Query().Get("code"))
+	if code == "" {
+		code = "<code>"
+	}
+	approve := ""
+	if s.sso.Provider != nil && code != "<code>" {
+		approve = fmt.Sprintf(`<p><a href="/auth/device/sso?code=%s">Sign in with single sign-on to approve it</a></p>`, url.QueryEscape(code))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>Codesfer device login</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto;">
+<p>To log a device in, run this on a machine where you are already logged in:</p>
+<pre>codesfer approve %s</pre>
+%s</body></html>
+`, html.EscapeString(code), approve)
+}
+
+// deviceSSO approves a device request by logging in through the identity provider
+func (s *Service) deviceSSO(w http.ResponseWriter, r *http.Request) {
+	req, err := s.getDeviceRequest("user_code", normalizeUserCode(r.URL.Query().Get("code")))
+	if err != nil || req.Status != devicePending {
+		ssoPage(w, http.StatusNotFound, "There is no pending device login with this code.")
+		return
+	}
+	code, _, err := s.createSSORequest(req.UserCode, req.Agent, req.Location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/auth/sso/go/"+code, http.StatusFound)
+}
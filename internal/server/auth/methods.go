@@ -1,17 +1,42 @@
 package auth
 
-func UsernameFromSessionID(sessionID string) (string, error) {
-	session, err := getSession(sessionID)
+import (
+	"database/sql"
+	"errors"
+)
+
+func (s *Service) UsernameFromSessionID(sessionID string) (string, error) {
+	session, err := s.getSession(sessionID)
 	if err != nil {
 		return "", err
 	}
-	user, err := getUser(session.Email)
+	user, err := s.getUser(session.Email)
 	if err != nil {
 		return "", err
 	}
 	return user.Username, nil
 }
 
-func UpdateSessionLastSeen(sessionID string) error {
-	return updateSessionLastSeen(sessionID)
+func (s *Service) UpdateSessionLastSeen(sessionID string) error {
+	return s.updateSessionLastSeen(sessionID)
+}
+
+// Verified reports whether the user with username confirmed their email address.
+func (s *Service) Verified(username string) (bool, error) {
+	var verified bool
+	err := s.db.QueryRow("SELECT verified FROM users WHERE username = ?", username).Scan(&verified)
+	if err != nil {
+		return false, err
+	}
+	return verified, nil
+}
+
+// UserExists reports whether username belongs to a user, not an organization.
+func (s *Service) UserExists(username string) (bool, error) {
+	var found string
+	err := s.db.QueryRow("SELECT username FROM users WHERE username = ?", username).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
 }
@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"codesfer/internal/server/identity"
+	"errors"
 	"log"
 	"net/http"
 )
@@ -14,14 +16,25 @@ func handle(mux *http.ServeMux, pattern string, handler http.Handler, middleware
 	mux.Handle(pattern, handler)
 }
 
+// InvalidSession rejects a request carrying an unknown or expired session token.
+// The WWW-Authenticate header lets clients tell this apart from other 401s and ask for a new login.
+func InvalidSession(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	switch {
+	case errors.Is(err, ErrSessionExpired):
+		http.Error(w, "unauthorized, session expired, please log in again", http.StatusUnauthorized)
+	case errors.Is(err, ErrTokenExpired), errors.Is(err, ErrTokenNotFound):
+		http.Error(w, "unauthorized, "+err.Error(), http.StatusUnauthorized)
+	default:
+		http.Error(w, "unauthorized, session not found, please log in", http.StatusUnauthorized)
+	}
+}
+
 // refreshTime will check if user is logged in and also refresh last active timestamp
-func refreshTime(next http.Handler) http.Handler {
+func (s *Service) refreshTime(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Get sessionID
 		sessionID := r.Header.Get("Authorization")
-		if sessionID == "" {
-			sessionID = r.URL.Query().Get("session_id")
-		}
 		if sessionID == "" {
 			http.Error(w, "unauthorized, session not provided, please log in", http.StatusUnauthorized)
 			return
@@ -31,26 +44,25 @@ func refreshTime(next http.Handler) http.Handler {
 		if len(sessionID) > 7 && sessionID[:7] == "Bearer " {
 			sessionID = sessionID[7:]
 		}
+		if IsAccessToken(sessionID) {
+			http.Error(w, "forbidden, access tokens cannot be used here, please log in", http.StatusForbidden)
+			return
+		}
 
 		// Get username
-		username, err := UsernameFromSessionID(sessionID)
+		username, err := s.UsernameFromSessionID(sessionID)
 		if err != nil {
-			http.Error(w, "unauthorized, session not found, please log in", http.StatusUnauthorized)
+			InvalidSession(w, err)
 			return
 		}
-		// Set custom header
-		r.Header.Set("X-Authorized", "true")
-		r.Header.Set("X-Session-ID", sessionID)
-		r.Header.Set("X-Username", username)
-
 		// Refresh last active timestamp
-		err = updateSessionLastSeen(sessionID)
+		err = s.updateSessionLastSeen(sessionID)
 		if err != nil {
 			log.Println("[/auth/me] Failed to update session:", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, identity.WithPrincipal(r, &identity.Principal{Username: username, SessionID: sessionID}))
 	})
 }
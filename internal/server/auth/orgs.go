@@ -0,0 +1,456 @@
+package auth
+
+import (
+	"codesfer/internal/server/identity"
+	"codesfer/pkg/api"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// define organization errors
+const (
+	ErrOrgNotFound    AuthError = "organization not found"
+	ErrNotMember      AuthError = "not a member of the organization"
+	ErrLastOwner      AuthError = "an organization needs at least one owner"
+	ErrInvalidOrgName AuthError = "organization names are 1 to 39 letters, digits, '-' or '_'"
+	ErrNoInvite       AuthError = "no pending invitation to this organization"
+)
+
+// orgName matches the names an organization can take. Snippets of the
+// organization live under <name>/, so it is kept to characters that are safe in paths.
+var orgName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,39}$`)
+
+// OrgRole returns the role of username in the organization org, "" if they are
+// not a member or have not accepted their invitation yet. isOrg is false if org is not an organization, e.g. a username.
+func (s *Service) OrgRole(org, username string) (role string, isOrg bool, err error) {
+	if !s.orgExists(org) {
+		return "", false, nil
+	}
+	err = s.db.QueryRow("SELECT role FROM org_members WHERE org = ? AND username = ?", org, username).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", true, nil
+	}
+	if err != nil {
+		return "", true, err
+	}
+	return role, true, nil
+}
+
+func (s *Service) orgExists(name string) bool {
+	var found string
+	err := s.db.QueryRow("SELECT name FROM orgs WHERE name = ?", name).Scan(&found)
+	return err == nil
+}
+
+func (s *Service) getOrgs(username string) ([]api.Org, error) {
+	rows, err := s.db.Query(
+		"SELECT orgs.name, org_members.role, orgs.created_at FROM orgs JOIN org_members ON org_members.org = orgs.name WHERE org_members.username = ? ORDER BY orgs.name",
+		username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orgs := []api.Org{}
+	for rows.Next() {
+		var o api.Org
+		if err := rows.Scan(&o.Name, &o.Role, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+// getOrgMembers returns the members of org followed by the users invited to it
+func (s *Service) getOrgMembers(org string) ([]api.OrgMember, error) {
+	rows, err := s.db.Query(
+		`SELECT username, role, added_by, created_at, 0 FROM org_members WHERE org = ?
+		UNION ALL SELECT username, role, invited_by, created_at, 1 FROM org_invites WHERE org = ?
+		ORDER BY 5, 4`,
+		org, org,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := []api.OrgMember{}
+	for rows.Next() {
+		var m api.OrgMember
+		if err := rows.Scan(&m.Username, &m.Role, &m.AddedBy, &m.CreatedAt, &m.Pending); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// getInvites returns the pending invitations of username
+func (s *Service) getInvites(username string) ([]api.OrgInvite, error) {
+	rows, err := s.db.Query("SELECT org, role, invited_by, created_at FROM org_invites WHERE username = ? ORDER BY created_at", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invites := []api.OrgInvite{}
+	for rows.Next() {
+		var i api.OrgInvite
+		if err := rows.Scan(&i.Org, &i.Role, &i.InvitedBy, &i.CreatedAt); err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+// createOrg stores a new organization with username as its first owner
+func (s *Service) createOrg(name, username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().Format(time.RFC3339)
+	if _, err := tx.Exec("INSERT INTO orgs (name, created_by, created_at) VALUES (?, ?, ?)", name, username, now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO org_members (org, username, role, added_by, created_at) VALUES (?, ?, ?, ?, ?)",
+		name, username, api.RoleOwner, username, now,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteOrg removes the organization, its memberships and invitations
+func (s *Service) deleteOrg(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"org_members", "org_invites"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE org = ?", name); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM orgs WHERE name = ?", name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// otherOwners counts the owners of org besides username
+func (s *Service) otherOwners(org, username string) (int, error) {
+	var n int
+	err := s.db.QueryRow(
+		"SELECT COUNT(*) FROM org_members WHERE org = ? AND role = ? AND username != ?", org, api.RoleOwner, username,
+	).Scan(&n)
+	return n, err
+}
+
+// setOrgMember changes the role of an existing member of org, or invites
+// username with role. invited reports whether they still have to accept.
+func (s *Service) setOrgMember(org, username, role, addedBy string) (invited bool, err error) {
+	current, _, err := s.OrgRole(org, username)
+	if err != nil {
+		return false, err
+	}
+	if current == api.RoleOwner && role != api.RoleOwner {
+		owners, err := s.otherOwners(org, username)
+		if err != nil {
+			return false, err
+		}
+		if owners == 0 {
+			return false, ErrLastOwner
+		}
+	}
+	if current != "" {
+		_, err = s.db.Exec("UPDATE org_members SET role = ? WHERE org = ? AND username = ?", role, org, username)
+		return false, err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO org_invites (org, username, role, invited_by, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (org, username) DO UPDATE SET role = excluded.role, invited_by = excluded.invited_by`,
+		org, username, role, addedBy, time.Now().Format(time.RFC3339),
+	)
+	return true, err
+}
+
+// answerInvite makes username a member of org with the role they were invited
+// with, or drops the invitation if they decline
+func (s *Service) answerInvite(org, username string, accept bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var role, invitedBy string
+	err = tx.QueryRow("SELECT role, invited_by FROM org_invites WHERE org = ? AND username = ?", org, username).Scan(&role, &invitedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNoInvite
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM org_invites WHERE org = ? AND username = ?", org, username); err != nil {
+		return err
+	}
+	if accept {
+		if _, err := tx.Exec(
+			"INSERT INTO org_members (org, username, role, added_by, created_at) VALUES (?, ?, ?, ?, ?)",
+			org, username, role, invitedBy, time.Now().Format(time.RFC3339),
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// removeOrgMember removes username from org, unless they are its last owner,
+// or withdraws their invitation
+func (s *Service) removeOrgMember(org, username string) error {
+	role, _, err := s.OrgRole(org, username)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		result, err := s.db.Exec("DELETE FROM org_invites WHERE org = ? AND username = ?", org, username)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n != 1 {
+			return ErrNotMember
+		}
+		return nil
+	}
+	if role == api.RoleOwner {
+		owners, err := s.otherOwners(org, username)
+		if err != nil {
+			return err
+		}
+		if owners == 0 {
+			return ErrLastOwner
+		}
+	}
+	_, err = s.db.Exec("DELETE FROM org_members WHERE org = ? AND username = ?", org, username)
+	return err
+}
+
+// soleOwnerOf returns the organizations username is the only owner of
+func (s *Service) soleOwnerOf(username string) ([]string, error) {
+	orgs, err := s.getOrgs(username)
+	if err != nil {
+		return nil, err
+	}
+	var sole []string
+	for _, org := range orgs {
+		if org.Role != api.RoleOwner {
+			continue
+		}
+		owners, err := s.otherOwners(org.Name, username)
+		if err != nil {
+			return nil, err
+		}
+		if owners == 0 {
+			sole = append(sole, org.Name)
+		}
+	}
+	return sole, nil
+}
+
+// requireOrgRole writes an error and returns false unless the logged in user
+// has one of roles in the organization of the request path. Non-members are
+// told the organization does not exist.
+func (s *Service) requireOrgRole(w http.ResponseWriter, r *http.Request, roles ...string) bool {
+	role, _, err := s.OrgRole(r.PathValue("org"), identity.Username(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if role == "" {
+		http.Error(w, ErrOrgNotFound.Error(), http.StatusNotFound)
+		return false
+	}
+	if !slices.Contains(roles, role) {
+		http.Error(w, "forbidden, this needs the "+roles[0]+" role in "+r.PathValue("org"), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// createOrgRoute creates an organization owned by the logged in user
+func (s *Service) createOrgRoute(w http.ResponseWriter, r *http.Request) {
+	username := identity.Username(r)
+	var data api.OrgCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/auth/orgs] user %s is creating organization %s", username, data.Name)
+	if !orgName.MatchString(data.Name) {
+		http.Error(w, ErrInvalidOrgName.Error(), http.StatusBadRequest)
+		return
+	}
+	if slices.Contains(reservedUsername[:], data.Name) || s.usernameExists(data.Name) {
+		http.Error(w, "name taken", http.StatusConflict)
+		return
+	}
+	if err := s.createOrg(data.Name, username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(api.Org{Name: data.Name, Role: api.RoleOwner, CreatedAt: time.Now().Format(time.RFC3339)})
+}
+
+// listOrgs returns the organizations of the logged in user with their role
+func (s *Service) listOrgs(w http.ResponseWriter, r *http.Request) {
+	orgs, err := s.getOrgs(identity.Username(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.OrgListResponse(orgs))
+}
+
+// deleteOrgRoute deletes an organization and, through onDeleteUser, its snippets. Owners only.
+func (s *Service) deleteOrgRoute(w http.ResponseWriter, r *http.Request) {
+	org := r.PathValue("org")
+	if !s.requireOrgRole(w, r, api.RoleOwner) {
+		return
+	}
+	log.Printf("[/auth/orgs] user %s is deleting organization %s", identity.Username(r), org)
+	if s.onDeleteUser != nil {
+		if err := s.onDeleteUser(r.Context(), org); err != nil {
+			log.Printf("  failed to delete organization data: %v", err)
+			http.Error(w, "failed to delete organization data: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := s.deleteOrg(org); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("organization deleted"))
+}
+
+// listOrgMembers returns the members of an organization to any of its members
+func (s *Service) listOrgMembers(w http.ResponseWriter, r *http.Request) {
+	if !s.requireOrgRole(w, r, api.Roles...) {
+		return
+	}
+	members, err := s.getOrgMembers(r.PathValue("org"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.OrgMembersResponse(members))
+}
+
+// setOrgMemberRoute invites a user to an organization or changes the role of a member. Owners only.
+func (s *Service) setOrgMemberRoute(w http.ResponseWriter, r *http.Request) {
+	org, member := r.PathValue("org"), r.PathValue("username")
+	if !s.requireOrgRole(w, r, api.RoleOwner) {
+		return
+	}
+	var data api.OrgMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(api.Roles, data.Role) {
+		http.Error(w, "unknown role: "+data.Role, http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/auth/orgs] user %s is setting %s as %s of %s", identity.Username(r), member, data.Role, org)
+	if s.orgExists(member) || !s.usernameExists(member) {
+		http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	invited, err := s.setOrgMember(org, member, data.Role, identity.Username(r))
+	if err != nil {
+		if errors.Is(err, ErrLastOwner) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.OrgMember{Username: member, Role: data.Role, AddedBy: identity.Username(r), Pending: invited})
+}
+
+// removeOrgMemberRoute removes a member from an organization or withdraws an
+// invitation. Owners remove anyone, other members can only leave.
+func (s *Service) removeOrgMemberRoute(w http.ResponseWriter, r *http.Request) {
+	org, member := r.PathValue("org"), r.PathValue("username")
+	roles := []string{api.RoleOwner}
+	if member == identity.Username(r) {
+		roles = api.Roles
+	}
+	if !s.requireOrgRole(w, r, roles...) {
+		return
+	}
+	log.Printf("[/auth/orgs] user %s is removing %s from %s", identity.Username(r), member, org)
+	if err := s.removeOrgMember(org, member); err != nil {
+		switch {
+		case errors.Is(err, ErrNotMember):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrLastOwner):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(member + " removed from " + org))
+}
+
+// listInvites returns the pending invitations of the logged in user
+func (s *Service) listInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := s.getInvites(identity.Username(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.OrgInvitesResponse(invites))
+}
+
+// answerInviteRoute accepts or declines an invitation of the logged in user
+func (s *Service) answerInviteRoute(w http.ResponseWriter, r *http.Request) {
+	org, username := r.PathValue("org"), identity.Username(r)
+	var data api.OrgInviteAnswer
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.answerInvite(org, username, !data.Decline); err != nil {
+		if errors.Is(err, ErrNoInvite) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data.Decline {
+		log.Printf("[/auth/orgs/invites] user %s declined the invitation to %s", username, org)
+		w.Write([]byte("invitation to " + org + " declined"))
+		return
+	}
+	log.Printf("[/auth/orgs/invites] user %s joined %s", username, org)
+	w.Write([]byte("joined " + org))
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"codesfer/pkg/ratelimit"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Rate limits of the /auth routes. Endpoints are limited per client IP by
+// middleware, logins also per account, and failed logins lock the account out.
+var (
+	ipRate       = ratelimit.Rate{Limit: 20, Window: time.Minute}
+	usernameRate = ratelimit.Rate{Limit: 30, Window: time.Minute}
+	accountRate  = ratelimit.Rate{Limit: 10, Window: time.Minute}
+	loginLockout = ratelimit.Lockout{Threshold: 5, Base: 30 * time.Second, Max: 15 * time.Minute}
+)
+
+// limitIP limits the requests of each client IP, routes sharing a name share the bucket
+func (s *Service) limitIP(name string, rate ratelimit.Rate) middleware {
+	return s.limiter.Limit(rate, func(r *http.Request) string {
+		ip, err := ClientIP(r)
+		if err != nil {
+			return ""
+		}
+		return name + ":" + ip
+	})
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+// throttleAccount rejects a login for email with 429 if the account is locked out
+// or tried too often, and reports whether it did
+func (s *Service) throttleAccount(w http.ResponseWriter, r *http.Request, email string) bool {
+	wait, err := s.limiter.Locked(r.Context(), accountKey(email))
+	if err == nil && wait == 0 {
+		wait, err = s.limiter.Allow(r.Context(), accountKey(email), accountRate)
+	}
+	if err != nil {
+		log.Printf("  failed to check the rate limit of %s: %v", email, err)
+		return false
+	}
+	if wait > 0 {
+		log.Printf("  [rate limited] user %s is throttled for %s", email, wait)
+		ratelimit.TooManyRequests(w, wait)
+		return true
+	}
+	return false
+}
+
+// loginFailed counts a failed login for email towards its lockout
+func (s *Service) loginFailed(r *http.Request, email string) {
+	wait, err := s.limiter.Fail(r.Context(), accountKey(email), loginLockout)
+	if err != nil {
+		log.Printf("  failed to record the failed login of %s: %v", email, err)
+		return
+	}
+	if wait > 0 {
+		ip, _ := ClientIP(r)
+		log.Printf("  [locked out] user %s is locked out for %s after a failed login from %s", email, wait, ip)
+	}
+}
+
+// loginSucceeded forgets the failed logins of email
+func (s *Service) loginSucceeded(r *http.Request, email string) {
+	if err := s.limiter.Reset(r.Context(), accountKey(email)); err != nil {
+		log.Printf("  failed to reset the failed logins of %s: %v", email, err)
+	}
+}
@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"codesfer/internal/server/identity"
+	"codesfer/pkg/api"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	purposeSSH = "ssh"
+	// sshChallengeTTL is how long the client has to sign a login challenge
+	sshChallengeTTL = time.Minute
+)
+
+// ErrSSHKeyNotFound is returned for keys that are not registered to the user
+const ErrSSHKeyNotFound AuthError = "ssh key not found"
+
+// sshSignatureFormats are the accepted signature algorithms. Plain ssh-rsa
+// signatures use SHA-1 and are refused, RSA keys sign with rsa-sha2-* instead.
+var sshSignatureFormats = []string{
+	ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512,
+}
+
+func (s *Service) getSSHKeys(email string) ([]api.SSHKey, error) {
+	rows, err := s.db.Query("SELECT id, name, fingerprint, key_type, created_at, last_used FROM ssh_keys WHERE email = ? ORDER BY created_at", email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []api.SSHKey{}
+	for rows.Next() {
+		var k api.SSHKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.Fingerprint, &k.Type, &k.CreatedAt, &k.LastUsed); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// sshKeyOwner returns the email the key with fingerprint is registered to
+func (s *Service) sshKeyOwner(fingerprint string) (id, email string, err error) {
+	err = s.db.QueryRow("SELECT id, email FROM ssh_keys WHERE fingerprint = ?", fingerprint).Scan(&id, &email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrSSHKeyNotFound
+	}
+	return id, email, err
+}
+
+// addSSHKey registers a public key, in authorized_keys format, for the logged in user
+func (s *Service) addSSHKey(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var data api.SSHKeyAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	publicKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(data.PublicKey))
+	if err != nil {
+		http.Error(w, "invalid public key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := data.Name
+	if name == "" {
+		name = comment
+	}
+
+	id, err := newPublicID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key := api.SSHKey{
+		ID:          id,
+		Name:        name,
+		Fingerprint: ssh.FingerprintSHA256(publicKey),
+		Type:        publicKey.Type(),
+		CreatedAt:   time.Now().Format(time.RFC3339),
+	}
+	// A key identifies its account at login, so it can only be registered once
+	if _, _, err := s.sshKeyOwner(key.Fingerprint); !errors.Is(err, ErrSSHKeyNotFound) {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "this key is already registered", http.StatusConflict)
+		return
+	}
+	_, err = s.db.Exec(
+		"INSERT INTO ssh_keys (id, email, name, fingerprint, key_type, public_key, created_at, last_used) VALUES (?, ?, ?, ?, ?, ?, ?, '')",
+		key.ID, user.Email, key.Name, key.Fingerprint, key.Type, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), key.CreatedAt,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[/auth/ssh-keys] user %s added ssh key %s", user.Username, key.Fingerprint)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+// listSSHKeys returns the logged in user's ssh keys
+func (s *Service) listSSHKeys(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	keys, err := s.getSSHKeys(user.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.SSHKeyListResponse(keys))
+}
+
+// removeSSHKey deletes one of the logged in user's ssh keys by id
+func (s *Service) removeSSHKey(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := r.PathValue("id")
+	result, err := s.db.Exec("DELETE FROM ssh_keys WHERE id = ? AND email = ?", id, user.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, string(ErrSSHKeyNotFound), http.StatusNotFound)
+		return
+	}
+	log.Printf("[/auth/ssh-keys] user %s removed ssh key %s", user.Username, id)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ssh key removed"))
+}
+
+// sshChallenge picks the first registered key among those the client offers and
+// returns a challenge for it to sign
+func (s *Service) sshChallenge(w http.ResponseWriter, r *http.Request) {
+	var data api.SSHChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, line := range data.PublicKeys {
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			continue
+		}
+		fingerprint := ssh.FingerprintSHA256(publicKey)
+		_, email, err := s.sshKeyOwner(fingerprint)
+		if errors.Is(err, ErrSSHKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		challenge, err := s.createOneTimeToken(email, purposeSSH, sshChallengeTTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.SSHChallengeResponse{Challenge: challenge, Fingerprint: fingerprint})
+		return
+	}
+	http.Error(w, "none of these ssh keys is registered, add one with `codesfer account ssh-key add`", http.StatusNotFound)
+}
+
+// loginSSH issues a session for a challenge signed with one of the account's keys.
+// The signed message includes the host the client talks to, so a challenge
+// relayed through another server does not produce a valid signature here.
+func (s *Service) loginSSH(w http.ResponseWriter, r *http.Request) {
+	var data api.SSHLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email, err := s.consumeOneTimeToken(data.Challenge, purposeSSH)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			http.Error(w, "login challenge invalid or expired, please try again", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(data.PublicKey))
+	if err != nil {
+		http.Error(w, "invalid public key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, owner, err := s.sshKeyOwner(ssh.FingerprintSHA256(publicKey))
+	if err != nil || owner != email {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(data.Signature)
+	signature := new(ssh.Signature)
+	if err == nil {
+		err = ssh.Unmarshal(blob, signature)
+	}
+	if err != nil {
+		http.Error(w, "malformed signature", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(sshSignatureFormats, signature.Format) {
+		http.Error(w, "unsupported signature algorithm "+signature.Format+", use an ed25519, ecdsa or rsa-sha2 signature", http.StatusBadRequest)
+		return
+	}
+	if err := publicKey.Verify(api.SSHLoginMessage(r.Host, data.Challenge), signature); err != nil {
+		log.Printf("[/auth/login/ssh] invalid signature for user %s: %v", email, err)
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	log.Printf("[/auth/login/ssh] user %s logged in with ssh key %s", email, id)
+	if _, err := s.db.Exec("UPDATE ssh_keys SET last_used = ? WHERE id = ?", time.Now().Format(time.RFC3339), id); err != nil {
+		log.Printf("  failed to update last used: %v", err)
+	}
+	s.issueSession(w, r, email)
+}
@@ -0,0 +1,485 @@
+package auth
+
+import (
+	"codesfer/pkg/api"
+	"codesfer/pkg/oidc"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// ssoTTL is how long a login request waits for the browser to complete
+	ssoTTL = 10 * time.Minute
+	// ssoPollInterval is how often clients should poll for the result, in seconds
+	ssoPollInterval = 2
+
+	defaultUsernameClaim = "preferred_username"
+)
+
+// ErrAuthorizationPending is returned while a login request waits for the browser.
+const ErrAuthorizationPending AuthError = "authorization pending"
+
+// SSOConfig enables login through an OpenID Connect provider.
+type SSOConfig struct {
+	// Provider is the identity provider, nil disables single sign-on.
+	Provider *oidc.Client
+	// RedirectURL is the callback registered with the provider, i.e.
+	// https://codesfer.example.com/auth/sso/callback. When empty it is derived
+	// from the URL the browser used to reach the server.
+	RedirectURL string
+	// UsernameClaim names the ID token claim usernames are taken from,
+	// defaults to preferred_username. The local part of the email is the fallback.
+	UsernameClaim string
+	// DisablePasswords turns off registration and password login, every user
+	// then signs in through the provider.
+	DisablePasswords bool
+	// TrustUnverifiedEmail trusts emails of ID tokens without an email_verified
+	// claim, for providers that only hand out addresses they own. An explicit
+	// email_verified=false is never trusted.
+	TrustUnverifiedEmail bool
+}
+
+// ssoRequest is a pending login, created by the CLI and completed in a browser
+type ssoRequest struct {
+	Code        string
+	State       string
+	Nonce       string
+	Verifier    string
+	RedirectURL string
+	Email       string
+	Error       string
+	Device      string // User code of the device request this login approves
+	Agent       string
+	Location    string
+	CreatedAt   string
+	ExpiresAt   time.Time
+}
+
+// newUserCode returns a short code a user can type, like BCDF-GHJK. The alphabet
+// has no vowels and no look-alike characters (RFC 8628 section 6.1).
+func newUserCode() (string, error) {
+	const alphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := make([]byte, 0, 9)
+	for i, c := range b {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		code = append(code, alphabet[int(c)%len(alphabet)])
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode accepts codes typed in lowercase or without the dash
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// baseURL is the scheme and host the client reached us at, honouring X-Forwarded-Proto from proxies
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// ssoEnabled rejects single sign-on routes when no provider is configured
+func (s *Service) ssoEnabled(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.sso.Provider == nil {
+			http.Error(w, "single sign-on is not configured on this server", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// passwordsEnabled rejects password based routes when the server only allows single sign-on
+func (s *Service) passwordsEnabled(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.sso.DisablePasswords {
+			http.Error(w, "password login is disabled on this server, use `codesfer login --sso`", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ssoStart creates a login request. The client shows its URL to the user and
+// polls /sso/poll with the poll token until the browser completed the login.
+func (s *Service) ssoStart(w http.ResponseWriter, r *http.Request) {
+	var code string
+	location, lookup := "unknown", func() {}
+	if ip, err := ClientIP(r); err == nil {
+		location, lookup = s.location(ip, func(location string) error {
+			_, err := s.db.Exec("UPDATE sso_requests SET location = ? WHERE code = ?", location, code)
+			return err
+		})
+	}
+	code, pollToken, err := s.createSSORequest("", r.Header.Get("User-Agent"), location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	lookup()
+	log.Printf("[/auth/sso/start] login request %s created", code)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.SSOStartResponse{
+		URL:       baseURL(r) + "/auth/sso/go/" + code,
+		UserCode:  code,
+		PollToken: pollToken,
+		Interval:  ssoPollInterval,
+		ExpiresIn: int(ssoTTL.Seconds()),
+	})
+}
+
+// createSSORequest stores a login request and returns its code and poll token. When
+// device is set, the login approves that device request instead of being polled for.
+// agent and location describe the requesting machine on the confirmation page.
+func (s *Service) createSSORequest(device, agent, location string) (string, string, error) {
+	code, err := newUserCode()
+	if err != nil {
+		return "", "", err
+	}
+	var secrets [4]string // poll token, state, nonce, PKCE verifier
+	for i := range secrets {
+		if secrets[i], err = oidc.RandomString(); err != nil {
+			return "", "", err
+		}
+	}
+	now := time.Now()
+	_, err = s.db.Exec(
+		"INSERT INTO sso_requests (code, poll_hash, state, nonce, verifier, redirect_url, email, error, device, agent, location, expires_at, created_at) VALUES (?, ?, ?, ?, ?, '', '', '', ?, ?, ?, ?, ?)",
+		code, hashToken(secrets[0]), secrets[1], secrets[2], secrets[3], device, agent, location,
+		now.Add(ssoTTL).Format(time.RFC3339), now.Format(time.RFC3339),
+	)
+	if err != nil {
+		return "", "", err
+	}
+	return code, secrets[0], nil
+}
+
+func (s *Service) getSSORequest(column, value string) (*ssoRequest, error) {
+	req := &ssoRequest{}
+	var expiresAt string
+	err := s.db.QueryRow(
+		"SELECT code, state, nonce, verifier, redirect_url, email, error, device, agent, location, expires_at, created_at FROM sso_requests WHERE "+column+" = ?", value,
+	).Scan(&req.Code, &req.State, &req.Nonce, &req.Verifier, &req.RedirectURL, &req.Email, &req.Error, &req.Device, &req.Agent, &req.Location, &expiresAt, &req.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidCode
+		}
+		return nil, err
+	}
+	req.ExpiresAt, _ = time.Parse(time.RFC3339, expiresAt)
+	if time.Now().After(req.ExpiresAt) {
+		s.db.Exec("DELETE FROM sso_requests WHERE code = ?", req.Code)
+		return nil, ErrInvalidCode
+	}
+	return req, nil
+}
+
+// openSSORequest returns the unused login request whose link the browser opened,
+// or renders why there is none
+func (s *Service) openSSORequest(w http.ResponseWriter, r *http.Request) (*ssoRequest, bool) {
+	req, err := s.getSSORequest("code", normalizeUserCode(r.PathValue("code")))
+	if err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			ssoPage(w, http.StatusNotFound, "This login link is invalid or expired, run `codesfer login --sso` again.")
+			return nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if req.Email != "" || req.Error != "" {
+		ssoPage(w, http.StatusConflict, "This login link was already used, run `codesfer login --sso` again.")
+		return nil, false
+	}
+	return req, true
+}
+
+// ssoConfirm shows the browser that opened a login request's URL what it is
+// about to log in, so a link sent by someone else is not followed blindly
+func (s *Service) ssoConfirm(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.openSSORequest(w, r)
+	if !ok {
+		return
+	}
+	what := fmt.Sprintf("Log in the codesfer CLI that shows the code <b>%s</b>", html.EscapeString(req.Code))
+	if req.Device != "" {
+		what = fmt.Sprintf("Approve the device login <b>%s</b>", html.EscapeString(req.Device))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>Codesfer login</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto;">
+<p>%s?</p>
+<p>Requested %s from %s by %s.</p>
+<p>Only continue if you started this login yourself and the code matches the one on your screen.</p>
+<form method="post"><button type="submit">Continue to sign in</button> <button type="submit" name="deny" value="1">Deny</button></form>
+</body></html>
+`, what, html.EscapeString(req.CreatedAt), html.EscapeString(req.Location), html.EscapeString(req.Agent))
+}
+
+// ssoRedirect sends the browser that confirmed a login request to the provider,
+// or fails the request if the user denied it
+func (s *Service) ssoRedirect(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != baseURL(r) {
+		ssoPage(w, http.StatusForbidden, "Confirm the login on the codesfer page, not from another site.")
+		return
+	}
+	req, ok := s.openSSORequest(w, r)
+	if !ok {
+		return
+	}
+	if r.FormValue("deny") != "" {
+		log.Printf("[/auth/sso/go] login request %s denied in the browser", req.Code)
+		s.db.Exec("UPDATE sso_requests SET error = ? WHERE code = ?", "the login was denied in the browser", req.Code)
+		ssoPage(w, http.StatusOK, "The login was denied. You can close this window.")
+		return
+	}
+
+	redirectURL := s.sso.RedirectURL
+	if redirectURL == "" {
+		redirectURL = baseURL(r) + "/auth/sso/callback"
+	}
+	if _, err := s.db.Exec("UPDATE sso_requests SET redirect_url = ? WHERE code = ?", redirectURL, req.Code); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	authURL, err := s.sso.Provider.AuthCodeURL(r.Context(), redirectURL, req.State, req.Nonce, req.Verifier)
+	if err != nil {
+		log.Printf("[/auth/sso/go] %v", err)
+		ssoPage(w, http.StatusBadGateway, "The identity provider is unavailable, please try again later.")
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusSeeOther)
+}
+
+// ssoCallback receives the browser back from the provider, validates the ID
+// token and records who logged in for the polling client
+func (s *Service) ssoCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req, err := s.getSSORequest("state", query.Get("state"))
+	if err != nil || req.Email != "" || req.Error != "" {
+		ssoPage(w, http.StatusBadRequest, "This login request is invalid or expired, run `codesfer login --sso` again.")
+		return
+	}
+
+	fail := func(status int, message string) {
+		log.Printf("[/auth/sso/callback] login request %s failed: %s", req.Code, message)
+		s.db.Exec("UPDATE sso_requests SET error = ? WHERE code = ?", message, req.Code)
+		ssoPage(w, status, "Login failed: "+message)
+	}
+	if errorCode := query.Get("error"); errorCode != "" {
+		fail(http.StatusUnauthorized, strings.TrimSpace(errorCode+" "+query.Get("error_description")))
+		return
+	}
+
+	claims, err := s.sso.Provider.Exchange(r.Context(), req.RedirectURL, query.Get("code"), req.Verifier, req.Nonce)
+	if err != nil {
+		fail(http.StatusUnauthorized, err.Error())
+		return
+	}
+	email, err := s.ssoUser(r.Context(), claims)
+	if err != nil {
+		fail(http.StatusForbidden, err.Error())
+		return
+	}
+	if req.Device != "" {
+		s.db.Exec("DELETE FROM sso_requests WHERE code = ?", req.Code)
+		if err := s.decideDevice(req.Device, email, true); err != nil {
+			ssoPage(w, http.StatusBadRequest, "Could not approve the device: "+err.Error())
+			return
+		}
+		log.Printf("[/auth/sso/callback] user %s approved device %s", email, req.Device)
+		ssoPage(w, http.StatusOK, fmt.Sprintf("Device %s is now logged in as %s. You can close this window.", req.Device, email))
+		return
+	}
+	if _, err := s.db.Exec("UPDATE sso_requests SET email = ? WHERE code = ?", email, req.Code); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[/auth/sso/callback] user %s logged in through single sign-on", email)
+	ssoPage(w, http.StatusOK, fmt.Sprintf("Logged in as %s (request %s). You can close this window and return to your terminal.", email, req.Code))
+}
+
+// ssoPoll answers 202 while the login is pending and issues a session once the
+// browser completed it. Either way a finished request is removed.
+func (s *Service) ssoPoll(w http.ResponseWriter, r *http.Request) {
+	var data api.SSOPollRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := s.getSSORequest("poll_hash", hashToken(data.PollToken))
+	if err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			http.Error(w, "login request invalid or expired, please try again", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.Email == "" && req.Error == "" {
+		http.Error(w, string(ErrAuthorizationPending), http.StatusAccepted)
+		return
+	}
+
+	// Only one poll may collect the result
+	result, err := s.db.Exec("DELETE FROM sso_requests WHERE code = ?", req.Code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		http.Error(w, "login request invalid or expired, please try again", http.StatusUnauthorized)
+		return
+	}
+	if req.Error != "" {
+		http.Error(w, "single sign-on failed: "+req.Error, http.StatusUnauthorized)
+		return
+	}
+	s.issueSession(w, r, req.Email)
+}
+
+// ssoUser returns the account of the provider identity in claims. The identity
+// is linked to the account with the same email on first login, or a new account
+// is created for it.
+func (s *Service) ssoUser(ctx context.Context, claims *oidc.Claims) (string, error) {
+	var email string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT email FROM sso_identities WHERE issuer = ? AND subject = ?", claims.Issuer, claims.Subject,
+	).Scan(&email)
+	if err == nil {
+		return email, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	if claims.Email == "" {
+		return "", errors.New("the identity provider did not share an email address, request the email scope")
+	}
+	user, err := s.getUser(claims.Email)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return "", err
+	}
+	now := time.Now().Format(time.RFC3339)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	switch {
+	case user != nil && !s.emailTrusted(claims):
+		// Linking on an address the provider did not verify would hand over the account
+		return "", fmt.Errorf("an account for %s exists, but the identity provider has not verified that address", claims.Email)
+	case user != nil:
+		log.Printf("  linking %s to existing user %s", claims.Subject, user.Username)
+		if _, err := tx.Exec("UPDATE users SET verified = 1 WHERE email = ?", user.Email); err != nil {
+			return "", err
+		}
+	default:
+		username := s.uniqueUsername(ssoUsername(claims, s.sso.UsernameClaim))
+		verified := 0
+		if s.emailTrusted(claims) {
+			verified = 1
+		}
+		log.Printf("  creating user %s for %s", username, claims.Email)
+		// No password: the account can only log in through the provider until one is set by reset
+		if _, err := tx.Exec(
+			"INSERT INTO users (email, password, username, created_at, verified) VALUES (?, '', ?, ?, ?)",
+			claims.Email, username, now, verified,
+		); err != nil {
+			return "", err
+		}
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO sso_identities (issuer, subject, email, created_at) VALUES (?, ?, ?, ?)",
+		claims.Issuer, claims.Subject, claims.Email, now,
+	); err != nil {
+		return "", err
+	}
+	return claims.Email, tx.Commit()
+}
+
+// emailTrusted reports whether the email of claims may link and verify an account
+func (s *Service) emailTrusted(claims *oidc.Claims) bool {
+	return claims.EmailTrusted() || (s.sso.TrustUnverifiedEmail && !claims.EmailUnverified())
+}
+
+// ssoUsername derives a username from the configured claim, falling back to
+// the local part of the email, keeping only characters that are safe in paths
+func ssoUsername(claims *oidc.Claims, claim string) string {
+	if claim == "" {
+		claim = defaultUsernameClaim
+	}
+	name := claims.String(claim)
+	if name == "" {
+		name = claims.Email
+	}
+	// Some providers put an email in preferred_username
+	name, _, _ = strings.Cut(name, "@")
+
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)), r == '-', r == '_':
+			b.WriteRune(r)
+		case r == '.' || r == ' ':
+			b.WriteRune('-')
+		}
+	}
+	if b.Len() == 0 {
+		return "user"
+	}
+	return b.String()
+}
+
+// uniqueUsername appends a number to base until it is neither taken nor reserved
+func (s *Service) uniqueUsername(base string) string {
+	taken := func(name string) bool {
+		for _, reserved := range reservedUsername {
+			if name == reserved {
+				return true
+			}
+		}
+		return s.usernameExists(name)
+	}
+	name := base
+	for i := 2; taken(name); i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	return name
+}
+
+// ssoPage renders the minimal page the browser lands on during single sign-on
+func ssoPage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>Codesfer login</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto;"><p>%s</p></body></html>
+`, html.EscapeString(message))
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"codesfer/internal/server/identity"
+	"codesfer/pkg/api"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// accessTokenPrefix marks personal access tokens, so they are told apart from session tokens
+const accessTokenPrefix = "cft_"
+
+// IsAccessToken reports whether a bearer token is a personal access token
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, accessTokenPrefix)
+}
+
+// newAccessToken returns a public id, the secret token and the hash it is stored under
+func newAccessToken() (id, token, hash string, err error) {
+	id, err = newPublicID()
+	if err != nil {
+		return "", "", "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	token = accessTokenPrefix + hex.EncodeToString(b)
+	return id, token, hashToken(token), nil
+}
+
+func (s *Service) createAccessToken(email, name string, scopes []string, expiresAt time.Time) (*api.AccessToken, error) {
+	id, token, hash, err := newAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	t := &api.AccessToken{
+		ID:        id,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now().Format(time.RFC3339),
+		Token:     token,
+	}
+	if !expiresAt.IsZero() {
+		t.ExpiresAt = expiresAt.Format(time.RFC3339)
+	}
+	_, err = s.db.Exec(
+		"INSERT INTO access_tokens (id, hash, email, name, scopes, created_at, expires_at, last_used) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		t.ID, hash, email, t.Name, strings.Join(scopes, ","), t.CreatedAt, t.ExpiresAt, "",
+	)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *Service) getAccessTokens(email string) ([]api.AccessToken, error) {
+	rows, err := s.db.Query("SELECT id, name, scopes, created_at, expires_at, last_used FROM access_tokens WHERE email = ? ORDER BY created_at", email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []api.AccessToken{}
+	for rows.Next() {
+		var t api.AccessToken
+		var scopes string
+		if err := rows.Scan(&t.ID, &t.Name, &scopes, &t.CreatedAt, &t.ExpiresAt, &t.LastUsed); err != nil {
+			return nil, err
+		}
+		t.Scopes = strings.Split(scopes, ",")
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *Service) deleteAccessToken(email, id string) error {
+	result, err := s.db.Exec("DELETE FROM access_tokens WHERE id = ? AND email = ?", id, email)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// UsernameFromAccessToken resolves a personal access token to its owner and scopes.
+// Expired tokens are deleted.
+func (s *Service) UsernameFromAccessToken(token string) (string, []string, error) {
+	var id, email, scopes, expiresAt string
+	err := s.db.QueryRow(
+		"SELECT id, email, scopes, expires_at FROM access_tokens WHERE hash = ?", hashToken(token),
+	).Scan(&id, &email, &scopes, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil, ErrTokenNotFound
+		}
+		return "", nil, err
+	}
+
+	now := time.Now()
+	if expiresAt != "" {
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil || now.After(t) {
+			if _, err := s.db.Exec("DELETE FROM access_tokens WHERE id = ?", id); err != nil {
+				log.Printf("[UsernameFromAccessToken] failed to delete expired token: %v", err)
+			}
+			return "", nil, ErrTokenExpired
+		}
+	}
+
+	user, err := s.getUser(email)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := s.db.Exec("UPDATE access_tokens SET last_used = ? WHERE id = ?", now.Format(time.RFC3339), id); err != nil {
+		log.Printf("[UsernameFromAccessToken] failed to update last used: %v", err)
+	}
+	return user.Username, strings.Split(scopes, ","), nil
+}
+
+// createToken issues a personal access token for the logged in user
+func (s *Service) createToken(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var data api.TokenCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if len(data.Scopes) == 0 {
+		http.Error(w, "at least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range data.Scopes {
+		if !slices.Contains(api.Scopes, scope) {
+			http.Error(w, "unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	if data.ExpiresIn < 0 {
+		http.Error(w, "expires_in must not be negative", http.StatusBadRequest)
+		return
+	}
+	var expiresAt time.Time
+	if data.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(data.ExpiresIn) * time.Second)
+	}
+
+	log.Printf("[/auth/tokens] user %s is creating token %s with scopes %v", user.Username, data.Name, data.Scopes)
+	token, err := s.createAccessToken(user.Email, data.Name, slices.Compact(slices.Sorted(slices.Values(data.Scopes))), expiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+// listTokens returns the logged in user's access tokens, without their secrets
+func (s *Service) listTokens(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tokens, err := s.getAccessTokens(user.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.TokenListResponse(tokens))
+}
+
+// revokeToken deletes one of the logged in user's access tokens by id
+func (s *Service) revokeToken(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := r.PathValue("id")
+	log.Printf("[/auth/tokens] user %s is revoking token %s", user.Username, id)
+	if err := s.deleteAccessToken(user.Email, id); err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("token revoked"))
+}
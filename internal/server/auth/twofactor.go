@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"codesfer/internal/server/identity"
+	"codesfer/pkg/api"
+	"codesfer/pkg/totp"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	purposeTwoFactor = "2fa"
+	// twoFactorTTL is how long a login challenge waits for its second factor
+	twoFactorTTL = 5 * time.Minute
+
+	totpIssuer        = "codesfer"
+	recoveryCodeCount = 10
+)
+
+// newRecoveryCodes returns single-use codes formatted as xxxxx-xxxxx
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode lets users type recovery codes without the dash or in uppercase
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func (s *Service) getTOTPSecret(email string) (string, error) {
+	var secret string
+	err := s.db.QueryRow("SELECT totp_secret FROM users WHERE email = ?", email).Scan(&secret)
+	return secret, err
+}
+
+// replaceRecoveryCodes drops the user's recovery codes and stores the new ones hashed
+func (s *Service) replaceRecoveryCodes(email string, codes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE email = ?", email); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (hash, email) VALUES (?, ?)", hashToken(normalizeRecoveryCode(code)), email); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// checkSecondFactor accepts a current TOTP code that was not used before, or an
+// unused recovery code, which is then spent
+func (s *Service) checkSecondFactor(email, code string) (bool, error) {
+	secret, err := s.getTOTPSecret(email)
+	if err != nil {
+		return false, err
+	}
+	if step, ok := totp.Validate(secret, strings.TrimSpace(code), time.Now()); ok {
+		// Only one login per code, moving last_step forward fails on replay
+		result, err := s.db.Exec("UPDATE users SET totp_last_step = ? WHERE email = ? AND totp_last_step < ?", step, email, step)
+		if err != nil {
+			return false, err
+		}
+		n, err := result.RowsAffected()
+		return n == 1, err
+	}
+
+	result, err := s.db.Exec("DELETE FROM recovery_codes WHERE hash = ? AND email = ?", hashToken(normalizeRecoveryCode(code)), email)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if n == 1 {
+		log.Printf("[checkSecondFactor] user %s used a recovery code", email)
+	}
+	return n == 1, err
+}
+
+// loginTwoFactor exchanges a login challenge and a second factor for a session.
+// The challenge is spent on the first attempt, a wrong code means starting over with the password.
+func (s *Service) loginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var data api.TwoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email, err := s.consumeOneTimeToken(data.Challenge, purposeTwoFactor)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			http.Error(w, "login challenge invalid or expired, please log in again", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[/auth/login/2fa] user %s is completing login", email)
+	if s.throttleAccount(w, r, email) {
+		return
+	}
+
+	ok, err := s.checkSecondFactor(email, data.Code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		log.Printf("  [invalid code] user %s failed the second factor", email)
+		s.loginFailed(r, email)
+		http.Error(w, "invalid authentication code", http.StatusUnauthorized)
+		return
+	}
+	s.loginSucceeded(r, email)
+	s.issueSession(w, r, email)
+}
+
+// enrollTwoFactor creates a TOTP secret for the logged in user. It is not enforced
+// until enableTwoFactor confirms that the authenticator produces valid codes.
+func (s *Service) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if user.TwoFactor {
+		http.Error(w, "two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.db.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE email = ?", secret, user.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[/auth/2fa/enroll] user %s started two-factor enrollment", user.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.TwoFactorEnrollResponse{
+		Secret: secret,
+		URI:    totp.URI(totpIssuer, user.Email, secret),
+	})
+}
+
+// enableTwoFactor turns on the enrolled secret after checking a code and returns fresh recovery codes
+func (s *Service) enableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var data api.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if user.TwoFactor {
+		http.Error(w, "two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := s.getTOTPSecret(user.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if secret == "" {
+		http.Error(w, "no pending enrollment, enroll first", http.StatusBadRequest)
+		return
+	}
+	step, ok := totp.Validate(secret, strings.TrimSpace(data.Code), time.Now())
+	if !ok {
+		http.Error(w, "invalid authentication code", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.replaceRecoveryCodes(user.Email, codes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.db.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE email = ?", step, user.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[/auth/2fa/enable] user %s enabled two-factor authentication", user.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.TwoFactorEnableResponse{RecoveryCodes: codes})
+}
+
+// disableTwoFactor turns two-factor authentication off, given the password and a second factor
+func (s *Service) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserFromSessionID(identity.SessionID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var data api.TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !user.TwoFactor {
+		http.Error(w, "two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if !checkPassword(data.Password, user.Password) {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	ok, err := s.checkSecondFactor(user.Email, data.Code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid authentication code", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := s.db.Exec("UPDATE users SET totp_enabled = 0, totp_secret = '', totp_last_step = 0 WHERE email = ?", user.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.replaceRecoveryCodes(user.Email, nil); err != nil {
+		log.Printf("  failed to delete recovery codes: %v", err)
+	}
+	log.Printf("[/auth/2fa/disable] user %s disabled two-factor authentication", user.Username)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("two-factor authentication disabled"))
+}
@@ -1,74 +1,84 @@
 package auth
 
 import (
+	"codesfer/pkg/geo"
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
-	"net/http"
+	"net/netip"
 	"time"
 )
 
-func generateUniqueID() string {
-	// Get the current time in nanoseconds
-	currentTime := time.Now().UnixNano()
+// locateTimeout bounds a background location lookup
+const locateTimeout = 10 * time.Second
 
-	// Convert the current time to a byte array
-	timeBytes := fmt.Appendf(nil, "%d", currentTime)
+// mailTimeout bounds an email sent after the request that caused it was answered
+const mailTimeout = time.Minute
 
-	// Create a new SHA256 hash
-	hash := sha256.New()
-	hash.Write(timeBytes)
-
-	// Get the hashed bytes and convert to a hex string
-	hashedID := hash.Sum(nil)
-	return hex.EncodeToString(hashedID)
+// newSessionToken returns a random token for the client and the hash it is stored under
+func newSessionToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, hashToken(token), nil
 }
 
-type LocationResponse struct {
-	City    string `json:"city"`
-	Region  string `json:"region"`
-	Country string `json:"country"`
-	Bogon   bool   `json:"bogon"`
+// newPublicID returns a random identifier that can be shown to users
+func newPublicID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
-// getLocation returns the location as a string based on the IP address
-func ip2Location(ip string) (string, error) {
-	// Example API endpoint (you can use any geolocation API)
-	apiURL := fmt.Sprintf("https://ipinfo.io/%s/json", ip)
+// hashToken maps a client token to its sessions.id, so a leaked database does not leak sessions
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-	resp, err := http.Get(apiURL)
+// location returns where ip is, as far as it is known right away, and a lookup
+// that runs in the background and hands its result to update, so it never holds
+// up a login. Start the lookup once the row update writes to exists.
+func (s *Service) location(ip string, update func(location string) error) (string, func()) {
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
-		return "", err
+		return "unknown", func() {}
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to get location: status code %d", resp.StatusCode)
+	if geo.Local(addr) {
+		return "Localhost", func() {}
 	}
-
-	var locResp LocationResponse
-	if err := json.NewDecoder(resp.Body).Decode(&locResp); err != nil {
-		return "", err
+	if _, disabled := s.geo.(geo.Disabled); disabled {
+		return "unknown", func() {}
 	}
+	return "unknown", func() { go s.locate(addr, update) }
+}
 
-	if locResp.Bogon {
-		return "Localhost", nil
+// locate looks addr up and stores the result with update
+func (s *Service) locate(addr netip.Addr, update func(location string) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), locateTimeout)
+	defer cancel()
+	location, err := s.geo.Locate(ctx, addr)
+	if err != nil {
+		if !errors.Is(err, geo.ErrUnknown) {
+			log.Printf("[geo] failed to locate %s: %v", addr, err)
+		}
+		return
 	}
-
-	if locResp.City == "" && locResp.Region == "" && locResp.Country == "" {
-		return "Unknown", nil
+	if err := update(location); err != nil {
+		log.Printf("[geo] failed to store the location of %s: %v", addr, err)
 	}
-
-	location := fmt.Sprintf("%s, %s, %s", locResp.City, locResp.Region, locResp.Country)
-	return location, nil
 }
 
 // verify will verify the user with it's email and password
-func verify(email, password string) (bool, error) {
-	user, err := getUser(email)
+func (s *Service) verify(email, password string) (bool, error) {
+	user, err := s.getUser(email)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"codesfer/pkg/cache"
+	"codesfer/pkg/mirror"
+	"codesfer/pkg/object"
+	"codesfer/pkg/r2"
+	"codesfer/pkg/sqlite"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gnitoahc/go-dotenv"
+)
+
+// objectBackend builds the object storage from the environment:
+// the OBJECT_BACKEND_DRIVER backend, optionally mirrored, optionally cached.
+func objectBackend() (object.ObjectStorage, error) {
+	backend, location, err := newBackend(
+		dotenv.Get("OBJECT_BACKEND_DRIVER", "sqlite"),
+		"",
+		dotenv.Get("OBJECT_STORAGE_SOURCE", "file:object_storage.db?cache=shared"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if drivers := dotenv.Get("OBJECT_MIRROR_DRIVERS", ""); drivers != "" {
+		m, err := mirrored(backend, location, strings.Split(drivers, ","))
+		if err != nil {
+			backend.Close(context.Background())
+			return nil, err
+		}
+		backend = m
+	}
+
+	if cacheDir := dotenv.Get("OBJECT_CACHE_DIR", ""); cacheDir != "" {
+		maxMB, err := strconv.ParseInt(dotenv.Get("OBJECT_CACHE_MAX_MB", "1024"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OBJECT_CACHE_MAX_MB: %w", err)
+		}
+		log.Printf("Caching objects in %s (max %d MB)", cacheDir, maxMB)
+		cached := &cache.Storage{}
+		if err := cached.Init(context.Background(), cache.Config{
+			Backend:  backend,
+			Dir:      cacheDir,
+			MaxBytes: maxMB << 20,
+		}); err != nil {
+			return nil, err
+		}
+		backend = cached
+	}
+
+	return backend, nil
+}
+
+// newBackend initializes a single backend and returns where it keeps its objects,
+// the bucket or database. The R2 driver reads the CF_* variables behind envPrefix,
+// sqliteSource is only used by the sqlite driver.
+func newBackend(driver, envPrefix, sqliteSource string) (object.ObjectStorage, string, error) {
+	var backend object.ObjectStorage
+	var param any
+	var location string
+	switch driver {
+	case "r2":
+		log.Println("Using R2 as object storage backend")
+		cfg := r2.Config{}
+		for key, dst := range map[string]*string{
+			"CF_ACCOUNT_ID":        &cfg.AccountID,
+			"CF_ACCESS_KEY":        &cfg.AccessKey,
+			"CF_SECRET_ACCESS_KEY": &cfg.SecretAccessKey,
+			"CF_BUCKET":            &cfg.Bucket,
+		} {
+			value, err := requireEnv(envPrefix + key)
+			if err != nil {
+				return nil, "", err
+			}
+			*dst = value
+		}
+		backend = &r2.Storage{}
+		param = cfg
+		location = "r2:" + cfg.AccountID + "/" + cfg.Bucket
+	case "sqlite":
+		log.Println("Using SQLite as object storage backend")
+		backend = &sqlite.Storage{}
+		param = sqlite.Config{Source: sqliteSource}
+		location = "sqlite:" + sqliteSource
+	default:
+		return nil, "", fmt.Errorf("unknown backend driver: %s", driver)
+	}
+
+	if err := backend.Init(context.Background(), param); err != nil {
+		return nil, "", err
+	}
+	return backend, location, nil
+}
+
+// mirrored replicates primary, stored at location, to the given secondary drivers.
+// Secondary n reads its settings from OBJECT_MIRROR_<n>_CF_* and
+// OBJECT_MIRROR_<n>_STORAGE_SOURCE, the first one falls back to
+// OBJECT_MIRROR_STORAGE_SOURCE. The mirror is configured by OBJECT_MIRROR_MODE
+// and OBJECT_MIRROR_CHECK_INTERVAL.
+func mirrored(primary object.ObjectStorage, location string, drivers []string) (object.ObjectStorage, error) {
+	locations := map[string]bool{location: true}
+	var secondaries []object.ObjectStorage
+	fail := func(err error) (object.ObjectStorage, error) {
+		for _, sec := range secondaries {
+			sec.Close(context.Background())
+		}
+		return nil, err
+	}
+	for i, driver := range drivers {
+		prefix := fmt.Sprintf("OBJECT_MIRROR_%d_", i+1)
+		source := fmt.Sprintf("file:object_storage_mirror_%d.db?cache=shared", i+1)
+		if i == 0 {
+			source = dotenv.Get("OBJECT_MIRROR_STORAGE_SOURCE", "file:object_storage_mirror.db?cache=shared")
+		}
+		sec, location, err := newBackend(strings.TrimSpace(driver), prefix, dotenv.Get(prefix+"STORAGE_SOURCE", source))
+		if err != nil {
+			return fail(fmt.Errorf("mirror %d: %w", i+1, err))
+		}
+		// A mirror sharing the storage of the primary or another mirror copies objects onto themselves
+		if locations[location] {
+			sec.Close(context.Background())
+			return fail(fmt.Errorf("mirror %d: %s is already used by the primary or another mirror", i+1, location))
+		}
+		locations[location] = true
+		secondaries = append(secondaries, sec)
+	}
+
+	mode := dotenv.Get("OBJECT_MIRROR_MODE", "async")
+	if mode != "sync" && mode != "async" {
+		return fail(fmt.Errorf("invalid OBJECT_MIRROR_MODE: %s", mode))
+	}
+	log.Printf("Mirroring objects to %s (%s)", strings.Join(drivers, ", "), mode)
+
+	m := &mirror.Storage{}
+	if err := m.Init(context.Background(), mirror.Config{
+		Primary:     primary,
+		Secondaries: secondaries,
+		Async:       mode == "async",
+	}); err != nil {
+		return fail(err)
+	}
+
+	if interval := dotenv.Get("OBJECT_MIRROR_CHECK_INTERVAL", ""); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OBJECT_MIRROR_CHECK_INTERVAL: %w", err)
+		}
+		go checkMirror(m, d)
+	}
+
+	return m, nil
+}
+
+// checkMirror periodically compares the replicas with the primary and repairs drift
+func checkMirror(m *mirror.Storage, interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx := context.Background()
+		ds, err := m.Check(ctx, "")
+		if err != nil {
+			log.Printf("[mirror check] failed: %v", err)
+			continue
+		}
+		if len(ds) == 0 {
+			continue
+		}
+		log.Printf("[mirror check] %d discrepancies found, repairing", len(ds))
+		if err := m.Repair(ctx, ds); err != nil {
+			log.Printf("[mirror check] repair failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Package identity carries the authenticated principal of a request from the
+// auth middleware to the handlers, in the request context. Identity never
+// travels in request headers, which a client could set itself.
+package identity
+
+import (
+	"context"
+	"net/http"
+	"slices"
+)
+
+// Principal is who a request is authenticated as.
+type Principal struct {
+	Username string
+	// SessionID is the session token, empty for personal access tokens.
+	SessionID string
+	// Scopes are granted to a personal access token. Sessions may do anything.
+	Scopes []string
+}
+
+// HasScope reports whether the principal may act within scope.
+func (p *Principal) HasScope(scope string) bool {
+	return p.SessionID != "" || slices.Contains(p.Scopes, scope)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying p.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// WithPrincipal returns a shallow copy of r authenticated as p.
+func WithPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(NewContext(r.Context(), p))
+}
+
+// FromRequest returns the principal of an authenticated request, nil for an anonymous one.
+func FromRequest(r *http.Request) *Principal {
+	p, _ := r.Context().Value(contextKey{}).(*Principal)
+	return p
+}
+
+// Username returns the username of an authenticated request, "" for an anonymous one.
+func Username(r *http.Request) string {
+	if p := FromRequest(r); p != nil {
+		return p.Username
+	}
+	return ""
+}
+
+// SessionID returns the session token of a request authenticated with a session, "" otherwise.
+func SessionID(r *http.Request) string {
+	if p := FromRequest(r); p != nil {
+		return p.SessionID
+	}
+	return ""
+}
+
+// forgeable are the headers identity used to be passed in. Nothing reads them
+// anymore, they are removed so no handler or proxy behind us mistakes one for ours.
+var forgeable = []string{"X-Authorized", "X-Session-ID", "X-Username", "X-Scopes"}
+
+// StripHeaders removes identity headers sent by the client.
+func StripHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range forgeable {
+			r.Header.Del(header)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -2,9 +2,15 @@ package server
 
 import (
 	"codesfer/internal/server/auth"
+	"codesfer/internal/server/identity"
+	"codesfer/pkg/ratelimit"
 	"net/http"
+	"time"
 )
 
+// downloadRate is the number of downloads allowed per client IP
+var downloadRate = ratelimit.Rate{Limit: 60, Window: time.Minute}
+
 type middleware func(next http.Handler) http.Handler
 
 func handle(mux *http.ServeMux, pattern string, handler http.Handler, middlewares ...middleware) {
@@ -14,43 +20,72 @@ func handle(mux *http.ServeMux, pattern string, handler http.Handler, middleware
 	mux.Handle(pattern, handler)
 }
 
-// authMiddleware will check if user is logged in and assign custom headers to the request
-func authMiddleware(next http.Handler) http.Handler {
+// authMiddleware authenticates requests carrying a session or personal access
+// token and puts the principal into the request context. Requests without a
+// bearer token pass on anonymously.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get sessionID
+		// Remove "Bearer " (only if present, detect to prevent out-of-bounds)
 		sessionID := r.Header.Get("Authorization")
-		if sessionID == "" {
-			r.Header.Set("X-Authorized", "false")
-			r.Header.Set("X-Session-ID", "")
-			r.Header.Set("X-Username", "")
+		if len(sessionID) <= 7 || sessionID[:7] != "Bearer " {
 			next.ServeHTTP(w, r)
 			return
 		}
+		sessionID = sessionID[7:]
 
-		// Remove "Bearer " (only if present, detect to prevent out-of-bounds)
-		if len(sessionID) > 7 && sessionID[:7] == "Bearer " {
-			sessionID = sessionID[7:]
-		} else {
-			r.Header.Set("X-Authorized", "false")
-			r.Header.Set("X-Session-ID", "")
-			r.Header.Set("X-Username", "")
-			next.ServeHTTP(w, r)
+		// Personal access tokens carry their own scopes, sessions may do anything
+		if auth.IsAccessToken(sessionID) {
+			username, scopes, err := s.auth.UsernameFromAccessToken(sessionID)
+			if err != nil {
+				auth.InvalidSession(w, err)
+				return
+			}
+			next.ServeHTTP(w, identity.WithPrincipal(r, &identity.Principal{Username: username, Scopes: scopes}))
 			return
 		}
 
 		// Get username
-		username, err := auth.UsernameFromSessionID(sessionID)
+		username, err := s.auth.UsernameFromSessionID(sessionID)
 		if err != nil {
-			http.Error(w, "unauthorized, session not found, please log in", http.StatusUnauthorized)
+			auth.InvalidSession(w, err)
 			return
 		}
-		// Set custom header
-		r.Header.Set("X-Authorized", "true")
-		r.Header.Set("X-Session-ID", sessionID)
-		r.Header.Set("X-Username", username)
+		s.auth.UpdateSessionLastSeen(sessionID)
+
+		next.ServeHTTP(w, identity.WithPrincipal(r, &identity.Principal{Username: username, SessionID: sessionID}))
+	})
+}
 
-		auth.UpdateSessionLastSeen(sessionID)
+// verifiedMiddleware rejects requests from users who did not verify their email,
+// when the server requires it. It runs after authMiddleware.
+func (s *Server) verifiedMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := identity.Username(r)
+		if !s.requireVerification || username == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
 
+		verified, err := s.auth.Verified(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !verified {
+			http.Error(w, "forbidden, verify your email before uploading (codesfer account verify)", http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// limitDownloads limits the downloads of each client IP
+func (s *Server) limitDownloads(next http.Handler) http.Handler {
+	return s.limiter.Limit(downloadRate, func(r *http.Request) string {
+		ip, err := auth.ClientIP(r)
+		if err != nil {
+			return ""
+		}
+		return "download:" + ip
+	})(next)
+}
@@ -3,86 +3,462 @@ package server
 
 import (
 	"codesfer/internal/server/auth"
+	"codesfer/internal/server/identity"
 	"codesfer/internal/server/storage"
+	"codesfer/pkg/geo"
+	"codesfer/pkg/mailer"
 	"codesfer/pkg/object"
-	"codesfer/pkg/r2"
-	"codesfer/pkg/sqlite"
+	"codesfer/pkg/oidc"
+	"codesfer/pkg/ratelimit"
+	"codesfer/pkg/realip"
 	"context"
-	"flag"
+	"crypto/rand"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gnitoahc/go-dotenv"
+	_ "github.com/tursodatabase/libsql-client-go/libsql"
+	_ "modernc.org/sqlite"
 )
 
-var (
-	port = flag.Int("port", 3000, "The server port")
-)
+// Config holds the explicit dependencies of a Server. The caller owns them and
+// closes them after the server is no longer used.
+type Config struct {
+	// AuthDB stores users and sessions.
+	AuthDB *sql.DB
+	// IndexDB maps snippet ids and paths to objects.
+	IndexDB *sql.DB
+	// Objects stores the uploaded archives.
+	Objects object.ObjectStorage
+	// Direct enables presigned direct-to-storage transfers.
+	Direct storage.DirectConfig
+	// Sessions bounds session lifetimes, zero values use the auth defaults.
+	Sessions auth.SessionConfig
+	// Mailer delivers account emails, password reset codes are logged if nil.
+	Mailer mailer.Mailer
+	// RequireVerification rejects uploads from users who did not verify their email.
+	RequireVerification bool
+	// SSO enables login through an OpenID Connect provider.
+	SSO auth.SSOConfig
+	// Limiter throttles logins and downloads and locks out password guessing, nil disables it.
+	Limiter *ratelimit.Limiter
+	// Geolocator finds where sessions are created from, nil disables it.
+	Geolocator geo.Geolocator
+	// Proxies decides which forwarding headers reveal the client address. The
+	// zero value believes none and uses the address of the connection.
+	Proxies realip.Resolver
+	// LinkSecret signs share links. If empty a random one is used and links
+	// stop working when the server restarts.
+	LinkSecret []byte
+	// Anonymous allows uploads without an account, run Janitor to delete them once
+	// expired, and direct uploads that are never completed.
+	Anonymous storage.AnonConfig
+	// Quotas bounds the bytes and snippets each user and organization stores.
+	Quotas storage.QuotaConfig
+}
+
+// Server is the codesfer HTTP API. It holds no global state, so several
+// servers can run in the same process.
+type Server struct {
+	auth    *auth.Service
+	storage *storage.Service
+	limiter *ratelimit.Limiter
+	mux     *http.ServeMux
+	handler http.Handler
 
-func init() {
-	dotenv.Load(".env")
+	requireVerification bool
 }
 
-func getOrPanic(key string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		panic(fmt.Sprintf("environment variable %s not set", key))
-	}
-	return value
-}
-
-func Serve() {
-	flag.Parse()
-
-	driver := dotenv.Get("DB_DRIVER", "sqlite")
-	source := dotenv.Get("DB_SOURCE", "file:auth.db?cache=shared")
-	indexDriver := dotenv.Get("INDEX_DB_DRIVER", "sqlite")
-	indexSource := dotenv.Get("INDEX_DB_SOURCE", "file:index.db?cache=shared")
-	backendDriver := dotenv.Get("OBJECT_BACKEND_DRIVER", "sqlite")
-
-	var backend object.ObjectStorage
-	switch backendDriver {
-	case "r2":
-		log.Println("Using R2 as object storage backend")
-		backend = &r2.Storage{}
-		if err := backend.Init(context.Background(), r2.Config{
-			AccountID:       getOrPanic("CF_ACCOUNT_ID"),
-			AccessKey:       getOrPanic("CF_ACCESS_KEY"),
-			SecretAccessKey: getOrPanic("CF_SECRET_ACCESS_KEY"),
-			Bucket:          getOrPanic("CF_BUCKET"),
-		}); err != nil {
-			panic(err)
-		}
-	case "sqlite":
-		log.Println("Using SQLite as object storage backend")
-		backend = &sqlite.Storage{}
-		if err := backend.Init(context.Background(), sqlite.Config{
-			Source: dotenv.Get("OBJECT_STORAGE_SOURCE", "file:object_storage.db?cache=shared"),
-		}); err != nil {
-			panic(err)
-		}
-	default:
-		panic(fmt.Sprintf("unknown backend driver: %s", backendDriver))
+// New builds a Server on top of the stores in cfg, creating missing tables.
+func New(cfg Config) (*Server, error) {
+	if cfg.AuthDB == nil || cfg.IndexDB == nil || cfg.Objects == nil {
+		return nil, errors.New("server: AuthDB, IndexDB and Objects are required")
+	}
+
+	// Auth deletes the files of accounts through storage, storage asks auth
+	// about organizations, so storage is only assigned once auth exists
+	var storageService *storage.Service
+	authService, err := auth.New(cfg.AuthDB, auth.Config{
+		Sessions: cfg.Sessions,
+		Mailer:   cfg.Mailer,
+		OnDeleteUser: func(ctx context.Context, username string) error {
+			return storageService.DeleteUser(ctx, username)
+		},
+		SSO:        cfg.SSO,
+		Limiter:    cfg.Limiter,
+		Geolocator: cfg.Geolocator,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("server: setup auth: %w", err)
+	}
+	storageService, err = storage.New(cfg.IndexDB, cfg.Objects, storage.Config{
+		Direct:     cfg.Direct,
+		Limiter:    cfg.Limiter,
+		Accounts:   authService,
+		LinkSecret: cfg.LinkSecret,
+		Anonymous:  cfg.Anonymous,
+		Quotas:     cfg.Quotas,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("server: setup storage: %w", err)
+	}
+
+	s := &Server{
+		auth:    authService,
+		storage: storageService,
+		limiter: cfg.Limiter,
+		mux:     http.NewServeMux(),
+
+		requireVerification: cfg.RequireVerification,
 	}
 
 	// Mux definition start
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /ping", func(w http.ResponseWriter, r *http.Request) {
+	s.mux.HandleFunc("GET /ping", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("pong"))
 	})
-	handle(mux, "/auth/", http.StripPrefix("/auth", auth.AuthHandler(driver, source)))
-	handle(mux, "/storage/", http.StripPrefix("/storage", storage.StorageHandler(indexDriver, indexSource, backend)), authMiddleware)
+	handle(s.mux, "/auth/", http.StripPrefix("/auth", s.auth))
+	handle(s.mux, "/storage/", http.StripPrefix("/storage", s.storage), s.authMiddleware)
+	handle(s.mux, "POST /storage/upload", http.StripPrefix("/storage", s.storage), s.authMiddleware, s.verifiedMiddleware)
+	handle(s.mux, "GET /storage/download", http.StripPrefix("/storage", s.storage), s.authMiddleware, s.limitDownloads)
 	// Mux definition end
 
-	log.Printf("Starting server on port %d", *port)
+	// The client address is computed once, sessions, rate limits and logs use it
+	s.handler = cfg.Proxies.Middleware(identity.StripHeaders(s.mux))
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Janitor deletes expired snippets and abandoned direct uploads every interval until ctx is done.
+func (s *Server) Janitor(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.storage.Sweep(ctx)
+			if err != nil {
+				log.Printf("[janitor] failed to delete expired snippets: %v", err)
+			}
+			if n > 0 {
+				log.Printf("[janitor] deleted %d expired snippet(s)", n)
+			}
+		}
+	}
+}
+
+// ConfigFromEnv builds a Config from environment variables, opening the databases
+// and object storage they describe. See the README for the list of variables.
+func ConfigFromEnv() (Config, error) {
+	authDB, err := sql.Open(
+		dotenv.Get("DB_DRIVER", "sqlite"),
+		dotenv.Get("DB_SOURCE", "file:auth.db?cache=shared"),
+	)
+	if err != nil {
+		return Config{}, fmt.Errorf("open auth db: %w", err)
+	}
+	indexDB, err := sql.Open(
+		dotenv.Get("INDEX_DB_DRIVER", "sqlite"),
+		dotenv.Get("INDEX_DB_SOURCE", "file:index.db?cache=shared"),
+	)
+	if err != nil {
+		return Config{}, fmt.Errorf("open index db: %w", err)
+	}
+
+	backend, err := objectBackend()
+	if err != nil {
+		return Config{}, err
+	}
+
+	direct, err := directConfig()
+	if err != nil {
+		return Config{}, err
+	}
 
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	sessions, err := sessionConfig()
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		return Config{}, err
+	}
+
+	sso, err := ssoConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	limiter, err := limiterFromEnv(authDB)
+	if err != nil {
+		return Config{}, err
+	}
+
+	geolocator, err := geolocatorFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	proxies, err := proxiesFromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	anonymous, err := anonConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	quotas, err := quotaConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	linkSecret := []byte(os.Getenv("SIGNING_SECRET"))
+	if len(linkSecret) == 0 {
+		log.Println("SIGNING_SECRET not set, share links will not survive a restart")
+	}
+
+	return Config{
+		AuthDB:     authDB,
+		IndexDB:    indexDB,
+		Objects:    backend,
+		Direct:     direct,
+		Sessions:   sessions,
+		Mailer:     mailerFromEnv(),
+		SSO:        sso,
+		Limiter:    limiter,
+		Geolocator: geolocator,
+		Proxies:    proxies,
+		LinkSecret: linkSecret,
+		Anonymous:  anonymous,
+		Quotas:     quotas,
+
+		RequireVerification: dotenv.Get("REQUIRE_EMAIL_VERIFICATION", "false") == "true",
+	}, nil
+}
+
+func requireEnv(key string) (string, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s not set", key)
+	}
+	return value, nil
+}
+
+// directConfig reads DIRECT_TRANSFER, DIRECT_TRANSFER_TTL and SIGNING_SECRET
+func directConfig() (storage.DirectConfig, error) {
+	cfg := storage.DirectConfig{Enabled: dotenv.Get("DIRECT_TRANSFER", "false") == "true"}
+	if !cfg.Enabled {
+		return cfg, nil
+	}
+
+	ttl, err := time.ParseDuration(dotenv.Get("DIRECT_TRANSFER_TTL", "15m"))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid DIRECT_TRANSFER_TTL: %w", err)
+	}
+	cfg.TTL = ttl
+
+	if secret := os.Getenv("SIGNING_SECRET"); secret != "" {
+		cfg.Secret = []byte(secret)
+	} else {
+		log.Println("SIGNING_SECRET not set, signed URLs will not survive a restart")
+		cfg.Secret = make([]byte, 32)
+		if _, err := rand.Read(cfg.Secret); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// anonConfig reads ANON_UPLOADS, ANON_UPLOAD_TTL and ANON_MAX_UPLOAD_SIZE
+func anonConfig() (storage.AnonConfig, error) {
+	cfg := storage.AnonConfig{Enabled: dotenv.Get("ANON_UPLOADS", "false") == "true"}
+	if !cfg.Enabled {
+		return cfg, nil
+	}
+
+	ttl, err := time.ParseDuration(dotenv.Get("ANON_UPLOAD_TTL", storage.DefaultAnonTTL.String()))
+	if err != nil || ttl <= 0 {
+		return cfg, fmt.Errorf("invalid ANON_UPLOAD_TTL: %q", os.Getenv("ANON_UPLOAD_TTL"))
+	}
+	cfg.TTL = ttl
+
+	size, err := strconv.ParseInt(dotenv.Get("ANON_MAX_UPLOAD_SIZE", strconv.Itoa(storage.DefaultAnonMaxSize)), 10, 64)
+	if err != nil || size <= 0 {
+		return cfg, fmt.Errorf("invalid ANON_MAX_UPLOAD_SIZE: %q", os.Getenv("ANON_MAX_UPLOAD_SIZE"))
+	}
+	cfg.MaxSize = size
+	return cfg, nil
+}
+
+// quotaConfig reads QUOTA_MB, QUOTA_OBJECTS, ORG_QUOTA_MB, ORG_QUOTA_OBJECTS and
+// QUOTA_OVERRIDES, a comma separated list of <namespace>=<MB>:<objects>
+func quotaConfig() (storage.QuotaConfig, error) {
+	var cfg storage.QuotaConfig
+	var err error
+	if cfg.User, err = quotaFromEnv("QUOTA_MB", "QUOTA_OBJECTS"); err != nil {
+		return cfg, err
+	}
+	if cfg.Org, err = quotaFromEnv("ORG_QUOTA_MB", "ORG_QUOTA_OBJECTS"); err != nil {
+		return cfg, err
+	}
+
+	overrides := dotenv.Get("QUOTA_OVERRIDES", "")
+	if overrides == "" {
+		return cfg, nil
+	}
+	cfg.Overrides = make(map[string]storage.Quota)
+	for _, override := range strings.Split(overrides, ",") {
+		namespace, limits, ok := strings.Cut(strings.TrimSpace(override), "=")
+		mb, objects, ok2 := strings.Cut(limits, ":")
+		if !ok || !ok2 || namespace == "" {
+			return cfg, fmt.Errorf("invalid QUOTA_OVERRIDES entry %q, want <namespace>=<MB>:<objects>", override)
+		}
+		q, err := parseQuota(mb, objects)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid QUOTA_OVERRIDES entry %q: %w", override, err)
+		}
+		cfg.Overrides[namespace] = q
+	}
+	return cfg, nil
+}
+
+// quotaFromEnv reads a quota in megabytes and objects, 0 for no limit
+func quotaFromEnv(mbKey, objectsKey string) (storage.Quota, error) {
+	q, err := parseQuota(dotenv.Get(mbKey, "0"), dotenv.Get(objectsKey, "0"))
+	if err != nil {
+		return q, fmt.Errorf("invalid %s or %s: %w", mbKey, objectsKey, err)
+	}
+	return q, nil
+}
+
+func parseQuota(mb, objects string) (storage.Quota, error) {
+	var q storage.Quota
+	m, err := strconv.ParseInt(strings.TrimSpace(mb), 10, 64)
+	if err != nil || m < 0 {
+		return q, fmt.Errorf("megabytes must be a non-negative integer, got %q", mb)
+	}
+	o, err := strconv.ParseInt(strings.TrimSpace(objects), 10, 64)
+	if err != nil || o < 0 {
+		return q, fmt.Errorf("objects must be a non-negative integer, got %q", objects)
+	}
+	return storage.Quota{Bytes: m << 20, Objects: o}, nil
+}
+
+// sessionConfig reads SESSION_ABSOLUTE_TTL and SESSION_IDLE_TTL
+func sessionConfig() (auth.SessionConfig, error) {
+	cfg := auth.SessionConfig{}
+	absolute, err := time.ParseDuration(dotenv.Get("SESSION_ABSOLUTE_TTL", auth.DefaultAbsoluteTTL.String()))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid SESSION_ABSOLUTE_TTL: %w", err)
+	}
+	idle, err := time.ParseDuration(dotenv.Get("SESSION_IDLE_TTL", auth.DefaultIdleTTL.String()))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid SESSION_IDLE_TTL: %w", err)
+	}
+	cfg.AbsoluteTTL, cfg.IdleTTL = absolute, idle
+	return cfg, nil
+}
+
+// ssoConfig reads the OIDC_* variables, single sign-on stays off without OIDC_ISSUER
+func ssoConfig() (auth.SSOConfig, error) {
+	cfg := auth.SSOConfig{}
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return cfg, nil
+	}
+	clientID, err := requireEnv("OIDC_CLIENT_ID")
+	if err != nil {
+		return cfg, err
+	}
+	provider, err := oidc.New(oidc.Config{
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		Scopes:       strings.Fields(dotenv.Get("OIDC_SCOPES", "email profile")),
+	})
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Provider = provider
+	cfg.RedirectURL = os.Getenv("OIDC_REDIRECT_URL")
+	cfg.UsernameClaim = os.Getenv("OIDC_USERNAME_CLAIM")
+	cfg.DisablePasswords = dotenv.Get("OIDC_DISABLE_PASSWORDS", "false") == "true"
+	cfg.TrustUnverifiedEmail = dotenv.Get("OIDC_TRUST_UNVERIFIED_EMAIL", "false") == "true"
+	return cfg, nil
+}
+
+// limiterFromEnv reads RATE_LIMIT_STORE: "memory" (the default) for a single
+// process, "sqlite" to share limits through the auth database, or "off"
+func limiterFromEnv(authDB *sql.DB) (*ratelimit.Limiter, error) {
+	switch store := dotenv.Get("RATE_LIMIT_STORE", "memory"); store {
+	case "memory":
+		return ratelimit.New(ratelimit.NewMemory()), nil
+	case "sqlite":
+		sqlStore, err := ratelimit.NewSQL(authDB)
+		if err != nil {
+			return nil, err
+		}
+		return ratelimit.New(sqlStore), nil
+	case "off":
+		log.Println("RATE_LIMIT_STORE is off, logins and downloads are not rate limited")
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid RATE_LIMIT_STORE %q, use memory, sqlite or off", store)
+	}
+}
+
+// proxiesFromEnv reads TRUSTED_PROXIES, loopback and private networks by
+// default, and CLIENT_IP_HEADERS, X-Forwarded-For by default
+func proxiesFromEnv() (realip.Resolver, error) {
+	trusted, err := realip.ParseTrusted(dotenv.Get("TRUSTED_PROXIES", "private"))
+	if err != nil {
+		return realip.Resolver{}, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	var headers []string
+	for _, header := range strings.Split(dotenv.Get("CLIENT_IP_HEADERS", "X-Forwarded-For"), ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+	return realip.Resolver{Trusted: trusted, Headers: headers}, nil
+}
+
+// geolocatorFromEnv reads GEOLOCATION: "off" (the default), "ipinfo" to ask
+// ipinfo.io, or the path of a MaxMind-format database file
+func geolocatorFromEnv() (geo.Geolocator, error) {
+	switch source := dotenv.Get("GEOLOCATION", "off"); source {
+	case "off":
+		return geo.Disabled{}, nil
+	case "ipinfo":
+		log.Println("GEOLOCATION is ipinfo, client addresses are sent to ipinfo.io")
+		return &geo.IPInfo{}, nil
+	default:
+		return geo.OpenMMDB(source)
+	}
+}
+
+// mailerFromEnv sends mail through SMTP_ADDR when set and logs it otherwise
+func mailerFromEnv() mailer.Mailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		log.Println("SMTP_ADDR not set, account emails are written to the log")
+		return &mailer.Log{}
+	}
+	return &mailer.SMTP{
+		Addr:     addr,
+		From:     dotenv.Get("SMTP_FROM", "noreply@codesfer.io"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
 	}
-	log.Fatal(http.Serve(lis, mux))
 }
@@ -0,0 +1,2047 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"codesfer/internal/server/auth"
+	"codesfer/internal/server/storage"
+	"codesfer/pkg/api"
+	"codesfer/pkg/geo"
+	"codesfer/pkg/mailer"
+	"codesfer/pkg/object"
+	"codesfer/pkg/oidc"
+	"codesfer/pkg/oidc/oidctest"
+	"codesfer/pkg/ratelimit"
+	"codesfer/pkg/realip"
+	"codesfer/pkg/sqlite"
+	"codesfer/pkg/totp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestServer starts a server backed by its own temporary SQLite databases.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts, _ := startTestServer(t, nil)
+	return ts
+}
+
+// startTestServer is newTestServer with a hook to adjust the config; it also returns the config.
+func startTestServer(t *testing.T, configure func(*Config)) (*httptest.Server, Config) {
+	t.Helper()
+	dir := t.TempDir()
+
+	open := func(name string) *sql.DB {
+		db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=rwc", filepath.Join(dir, name)))
+		if err != nil {
+			t.Fatalf("open %s: %v", name, err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+
+	objects := &sqlite.Storage{}
+	if err := objects.Init(context.Background(), sqlite.Config{DB: open("objects.db"), AllowOverwrite: true}); err != nil {
+		t.Fatalf("init objects: %v", err)
+	}
+
+	cfg := Config{
+		AuthDB:  open("auth.db"),
+		IndexDB: open("index.db"),
+		Objects: objects,
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return ts, cfg
+}
+
+// login registers a user and returns a fresh session id.
+func login(t *testing.T, ts *httptest.Server, email, username string) string {
+	t.Helper()
+	body, _ := json.Marshal(api.RegisterRequest{Email: email, Password: "secret", Username: username})
+	resp, err := http.Post(ts.URL+"/auth/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: status %d", resp.StatusCode)
+	}
+	return newSession(t, ts, email)
+}
+
+// newSession logs an existing user in again and returns the new session id.
+func newSession(t *testing.T, ts *httptest.Server, email string) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"email": email, "password": "secret"})
+	resp, err := http.Post(ts.URL+"/auth/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: status %d", resp.StatusCode)
+	}
+	sessionID, _ := io.ReadAll(resp.Body)
+	return string(sessionID)
+}
+
+func do(t *testing.T, req *http.Request, sessionID string) *http.Response {
+	t.Helper()
+	req.Header.Set("Authorization", "Bearer "+sessionID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+	}
+	return resp
+}
+
+func upload(t *testing.T, ts *httptest.Server, sessionID, path string, content []byte) api.UploadResponse {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", "archive.zip")
+	fw.Write(content)
+	mw.WriteField("path", path)
+	mw.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/storage/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp := do(t, req, sessionID)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		t.Fatalf("upload: status %d: %s", resp.StatusCode, msg)
+	}
+	var out api.UploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decode upload: %v", err)
+	}
+	return out
+}
+
+func list(t *testing.T, ts *httptest.Server, sessionID string) api.ListResponse {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/storage/list", nil)
+	resp := do(t, req, sessionID)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("list: status %d", resp.StatusCode)
+	}
+	var out api.ListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	return out
+}
+
+func download(t *testing.T, ts *httptest.Server, key string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Get(ts.URL + "/storage/download?key=" + key)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+func TestServerRoundTrip(t *testing.T) {
+	ts := newTestServer(t)
+	sessionID := login(t, ts, "alice@example.com", "alice")
+
+	content := []byte("zip archive bytes")
+	up := upload(t, ts, sessionID, "notes", content)
+	if up.Uid == "" || up.Path != "notes" {
+		t.Fatalf("unexpected upload response: %+v", up)
+	}
+
+	objs := list(t, ts, sessionID)
+	if len(objs) != 1 || objs[0].Key != up.Uid {
+		t.Fatalf("unexpected list: %+v", objs)
+	}
+
+	// Snippets are private until made pullable by anyone with the code
+	if status := postJSON(t, ts, http.MethodPost, "/storage/chmod", sessionID, api.ChmodRequest{Key: up.Uid, Visibility: api.VisibilityUnlisted}); status != http.StatusOK {
+		t.Fatalf("chmod: status %d", status)
+	}
+	for _, key := range []string{up.Uid, "alice/notes"} {
+		status, body := download(t, ts, key)
+		if status != http.StatusOK || !bytes.Equal(body, content) {
+			t.Fatalf("download %s: status %d body %q", key, status, body)
+		}
+	}
+}
+
+func TestServersAreIsolated(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+
+	// The same account can exist on both servers without clashing
+	sessionA := login(t, a, "bob@example.com", "bob")
+	sessionB := login(t, b, "bob@example.com", "bob")
+
+	up := upload(t, a, sessionA, "only-on-a", []byte("a"))
+
+	if objs := list(t, b, sessionB); len(objs) != 0 {
+		t.Fatalf("server b sees objects of server a: %+v", objs)
+	}
+	if status, _ := download(t, b, up.Uid); status != http.StatusNotFound {
+		t.Fatalf("download from b: want 404, got %d", status)
+	}
+
+	// A session from one server is unknown to the other
+	req, _ := http.NewRequest(http.MethodGet, b.URL+"/storage/list", nil)
+	resp := do(t, req, sessionA)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("list on b with a's session: want 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestSessionTokensAreHashed(t *testing.T) {
+	ts, cfg := startTestServer(t, nil)
+	sessionID := login(t, ts, "carol@example.com", "carol")
+	if len(sessionID) != 64 {
+		t.Fatalf("unexpected token length %d", len(sessionID))
+	}
+
+	var n int
+	if err := cfg.AuthDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE id = ?", sessionID).Scan(&n); err != nil {
+		t.Fatalf("query sessions: %v", err)
+	}
+	if n != 0 {
+		t.Fatal("session token stored in plain text")
+	}
+	list(t, ts, sessionID)
+}
+
+func TestExpiredSessionIsRejected(t *testing.T) {
+	ts, cfg := startTestServer(t, func(cfg *Config) {
+		cfg.Sessions = auth.SessionConfig{AbsoluteTTL: time.Nanosecond}
+	})
+	sessionID := login(t, ts, "dave@example.com", "dave")
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/storage/list", nil)
+	resp := do(t, req, sessionID)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("want 401, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("WWW-Authenticate"); !strings.Contains(got, "invalid_token") {
+		t.Fatalf("unexpected WWW-Authenticate %q", got)
+	}
+
+	var n int
+	if err := cfg.AuthDB.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&n); err != nil {
+		t.Fatalf("query sessions: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("expired session not deleted, %d left", n)
+	}
+}
+
+func TestAccessTokenScopes(t *testing.T) {
+	ts := newTestServer(t)
+	sessionID := login(t, ts, "erin@example.com", "erin")
+
+	body, _ := json.Marshal(api.TokenCreateRequest{Name: "ci", Scopes: []string{api.ScopePush}, ExpiresIn: 3600})
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/auth/tokens", bytes.NewReader(body))
+	resp := do(t, req, sessionID)
+	var token api.AccessToken
+	json.NewDecoder(resp.Body).Decode(&token)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(token.Token, "cft_") {
+		t.Fatalf("create token: status %d, token %+v", resp.StatusCode, token)
+	}
+
+	// A push-only token can upload but not list
+	upload(t, ts, token.Token, "artifact", []byte("build"))
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/storage/list", nil)
+	resp = do(t, req, token.Token)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("list with push-only token: want 403, got %d", resp.StatusCode)
+	}
+
+	// Tokens cannot mint tokens
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/auth/tokens", bytes.NewReader(body))
+	resp = do(t, req, token.Token)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("create token with a token: want 403, got %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, ts.URL+"/auth/tokens/"+token.ID, nil)
+	resp = do(t, req, sessionID)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoke: status %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/storage/list", nil)
+	resp = do(t, req, token.Token)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked token: want 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	ts := newTestServer(t)
+	laptop := login(t, ts, "frank@example.com", "frank")
+	phone := newSession(t, ts, "frank@example.com")
+	desktop := newSession(t, ts, "frank@example.com")
+
+	account := func(sessionID string) api.AccountResponse {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/auth/me", nil)
+		resp := do(t, req, sessionID)
+		defer resp.Body.Close()
+		var out api.AccountResponse
+		json.NewDecoder(resp.Body).Decode(&out)
+		return out
+	}
+	status := func(method, path, sessionID string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		resp := do(t, req, sessionID)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	var laptopID string
+	for _, s := range account(laptop).Sessions {
+		if s.ID == "" || s.ID == laptop {
+			t.Fatalf("session id missing or leaking the token: %+v", s)
+		}
+		if s.Current {
+			laptopID = s.ID
+		}
+	}
+
+	// Revoke the lost laptop from the phone
+	if code := status(http.MethodDelete, "/auth/sessions/"+laptopID, phone); code != http.StatusOK {
+		t.Fatalf("revoke: status %d", code)
+	}
+	if code := status(http.MethodGet, "/storage/list", laptop); code != http.StatusUnauthorized {
+		t.Fatalf("revoked session: want 401, got %d", code)
+	}
+
+	if code := status(http.MethodDelete, "/auth/sessions", phone); code != http.StatusOK {
+		t.Fatalf("revoke others: status %d", code)
+	}
+	if code := status(http.MethodGet, "/storage/list", desktop); code != http.StatusUnauthorized {
+		t.Fatalf("other session: want 401, got %d", code)
+	}
+	if sessions := account(phone).Sessions; len(sessions) != 1 || !sessions[0].Current {
+		t.Fatalf("unexpected sessions left: %+v", sessions)
+	}
+
+	// Logout ends the session and turns away malformed headers instead of panicking
+	for _, header := range []string{"x", "Bearer", "Bearer ", "Token " + phone} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/auth/logout", nil)
+		req.Header.Set("Authorization", header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("logout with %q: %v", header, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("logout with %q: want 401, got %d", header, resp.StatusCode)
+		}
+	}
+	if code := status(http.MethodPost, "/auth/logout", phone); code != http.StatusOK {
+		t.Fatalf("logout: status %d", code)
+	}
+	if code := status(http.MethodGet, "/storage/list", phone); code != http.StatusUnauthorized {
+		t.Fatalf("logged out session: want 401, got %d", code)
+	}
+}
+
+// outbox is a mailer.Mailer that keeps messages in memory.
+type outbox struct {
+	mu       sync.Mutex
+	messages []mailer.Message
+	held     chan struct{} // Send blocks until it is closed, when set
+}
+
+func (o *outbox) Send(_ context.Context, msg mailer.Message) error {
+	o.mu.Lock()
+	held := o.held
+	o.mu.Unlock()
+	if held != nil {
+		<-held
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+// hold makes Send block like a slow mail server until release is called
+func (o *outbox) hold() (release func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	held := make(chan struct{})
+	o.held = held
+	return func() {
+		o.mu.Lock()
+		o.held = nil
+		o.mu.Unlock()
+		close(held)
+	}
+}
+
+// wait blocks until n messages were sent, for mail sent in the background
+func (o *outbox) wait(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		o.mu.Lock()
+		sent := len(o.messages)
+		o.mu.Unlock()
+		if sent >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d mails, %d sent", n, sent)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (o *outbox) last(t *testing.T) mailer.Message {
+	t.Helper()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.messages) == 0 {
+		t.Fatal("no mail sent")
+	}
+	return o.messages[len(o.messages)-1]
+}
+
+func postJSON(t *testing.T, ts *httptest.Server, method, path, sessionID string, payload any) int {
+	t.Helper()
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+	resp := do(t, req, sessionID)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func loginStatus(t *testing.T, ts *httptest.Server, email, password string) int {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	resp, err := http.Post(ts.URL+"/auth/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPasswordChangeAndReset(t *testing.T) {
+	mail := &outbox{}
+	ts, _ := startTestServer(t, func(cfg *Config) { cfg.Mailer = mail })
+	sessionID := login(t, ts, "grace@example.com", "grace")
+	other := newSession(t, ts, "grace@example.com")
+
+	if code := postJSON(t, ts, http.MethodPost, "/auth/passwd", sessionID, api.PasswordChangeRequest{OldPassword: "wrong", NewPassword: "x"}); code != http.StatusUnauthorized {
+		t.Fatalf("passwd with wrong password: want 401, got %d", code)
+	}
+	if code := postJSON(t, ts, http.MethodPost, "/auth/passwd", sessionID, api.PasswordChangeRequest{OldPassword: "secret", NewPassword: "changed"}); code != http.StatusOK {
+		t.Fatalf("passwd: status %d", code)
+	}
+	if loginStatus(t, ts, "grace@example.com", "changed") != http.StatusOK {
+		t.Fatal("login with the new password failed")
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/storage/list", nil)
+	resp := do(t, req, other)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("other session after passwd: want 401, got %d", resp.StatusCode)
+	}
+
+	// Unknown emails get the same answer and no mail, and the answer does not wait for the mail
+	release := mail.hold()
+	if code := postJSON(t, ts, http.MethodPost, "/auth/reset/request", "", api.ResetRequest{Email: "nobody@example.com"}); code != http.StatusAccepted {
+		t.Fatalf("reset request for unknown email: status %d", code)
+	}
+	if code := postJSON(t, ts, http.MethodPost, "/auth/reset/request", "", api.ResetRequest{Email: "grace@example.com"}); code != http.StatusAccepted {
+		t.Fatalf("reset request: status %d", code)
+	}
+	release()
+	// The verification mail from registering plus the reset mail
+	mail.wait(t, 2)
+	msg := mail.last(t)
+	if msg.To != "grace@example.com" || len(mail.messages) != 2 {
+		t.Fatalf("unexpected mail: %+v", mail.messages)
+	}
+	_, rest, _ := strings.Cut(msg.Body, "--code ")
+	code, _, _ := strings.Cut(rest, "\n")
+
+	if status := postJSON(t, ts, http.MethodPost, "/auth/reset/confirm", "", api.ResetConfirmRequest{Code: code, NewPassword: "reset"}); status != http.StatusOK {
+		t.Fatalf("reset confirm: status %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/reset/confirm", "", api.ResetConfirmRequest{Code: code, NewPassword: "again"}); status != http.StatusBadRequest {
+		t.Fatalf("reusing the reset code: want 400, got %d", status)
+	}
+	if loginStatus(t, ts, "grace@example.com", "reset") != http.StatusOK {
+		t.Fatal("login with the reset password failed")
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	ts, cfg := startTestServer(t, nil)
+	sessionID := login(t, ts, "heidi@example.com", "heidi")
+	up := upload(t, ts, sessionID, "doomed", []byte("bye"))
+	var device api.DeviceCodeResponse
+	postJSONFor(t, ts, "/auth/device/code", "", struct{}{}, &device)
+	if status := postJSON(t, ts, http.MethodPost, "/auth/device/approve", sessionID, api.DeviceApproveRequest{UserCode: device.UserCode}); status != http.StatusOK {
+		t.Fatalf("approve: status %d", status)
+	}
+
+	if code := postJSON(t, ts, http.MethodDelete, "/auth/account", sessionID, api.AccountDeleteRequest{Password: "wrong"}); code != http.StatusUnauthorized {
+		t.Fatalf("delete with wrong password: want 401, got %d", code)
+	}
+	if code := postJSON(t, ts, http.MethodDelete, "/auth/account", sessionID, api.AccountDeleteRequest{Password: "secret"}); code != http.StatusOK {
+		t.Fatalf("delete: status %d", code)
+	}
+
+	if status, _ := download(t, ts, up.Uid); status != http.StatusNotFound {
+		t.Fatalf("download after delete: want 404, got %d", status)
+	}
+	if objs, err := cfg.Objects.List(context.Background(), ""); err != nil || len(objs) != 0 {
+		t.Fatalf("objects left after delete: %v %+v", err, objs)
+	}
+	for _, table := range []string{"users", "sessions", "device_requests"} {
+		var n int
+		cfg.AuthDB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n)
+		if n != 0 {
+			t.Fatalf("%d row(s) left in %s", n, table)
+		}
+	}
+	if loginStatus(t, ts, "heidi@example.com", "secret") == http.StatusOK {
+		t.Fatal("deleted user can still log in")
+	}
+	if status, _, deviceSession := pollDevice(t, ts, device.DeviceCode); status == http.StatusOK || deviceSession != "" {
+		t.Fatalf("device approved before the delete still logs in: status %d", status)
+	}
+}
+
+func TestDeleteAccountPendingUpload(t *testing.T) {
+	ts, cfg := startTestServer(t, func(cfg *Config) {
+		cfg.Direct = storage.DirectConfig{Enabled: true, TTL: time.Minute, Secret: []byte("blob secret")}
+	})
+	sessionID := login(t, ts, "heidi@example.com", "heidi")
+	content := []byte("never completed")
+	status, up := pushForm(t, ts, sessionID, map[string]string{"path": "pending", "direct": "true", "size": fmt.Sprint(len(content))})
+	if status != http.StatusOK {
+		t.Fatalf("direct upload: status %d", status)
+	}
+	if status, _, _ := transfer(t, http.MethodPut, ts.URL+up.UploadURL, "", content); status != http.StatusOK {
+		t.Fatalf("PUT: status %d", status)
+	}
+
+	if code := postJSON(t, ts, http.MethodDelete, "/auth/account", sessionID, api.AccountDeleteRequest{Password: "secret"}); code != http.StatusOK {
+		t.Fatalf("delete: status %d", code)
+	}
+	var n int
+	cfg.IndexDB.QueryRow("SELECT COUNT(*) FROM objects").Scan(&n)
+	if n != 0 {
+		t.Fatalf("%d pending row(s) left after delete", n)
+	}
+	if objs, err := cfg.Objects.List(context.Background(), ""); err != nil || len(objs) != 0 {
+		t.Fatalf("objects left after delete: %v %+v", err, objs)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	mail := &outbox{}
+	ts, _ := startTestServer(t, func(cfg *Config) {
+		cfg.Mailer = mail
+		cfg.RequireVerification = true
+	})
+
+	body, _ := json.Marshal(api.RegisterRequest{Email: "not an email", Password: "secret", Username: "ivan"})
+	resp, err := http.Post(ts.URL+"/auth/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("register with invalid email: want 400, got %d", resp.StatusCode)
+	}
+
+	sessionID := login(t, ts, "ivan@example.com", "ivan")
+	msg := mail.last(t)
+	_, rest, _ := strings.Cut(msg.Body, "account verify ")
+	code, _, _ := strings.Cut(rest, "\n")
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", "archive.zip")
+	fw.Write([]byte("x"))
+	mw.Close()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/storage/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp = do(t, req, sessionID)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("upload before verification: want 403, got %d", resp.StatusCode)
+	}
+
+	// Resending answers before looking the account up or mailing, unknown emails get no mail
+	release := mail.hold()
+	for _, email := range []string{"nobody@example.com", "ivan@example.com"} {
+		if status := postJSON(t, ts, http.MethodPost, "/auth/verify/resend", "", api.ResetRequest{Email: email}); status != http.StatusAccepted {
+			t.Fatalf("resend to %s: status %d", email, status)
+		}
+	}
+	release()
+	mail.wait(t, 2)
+	if msg := mail.last(t); msg.To != "ivan@example.com" || len(mail.messages) != 2 {
+		t.Fatalf("unexpected mail: %+v", mail.messages)
+	}
+
+	if status := postJSON(t, ts, http.MethodPost, "/auth/verify", "", api.VerifyRequest{Code: code}); status != http.StatusOK {
+		t.Fatalf("verify: status %d", status)
+	}
+	upload(t, ts, sessionID, "verified", []byte("x"))
+}
+
+func TestExistingUsersAreVerified(t *testing.T) {
+	ts, _ := startTestServer(t, func(cfg *Config) {
+		cfg.RequireVerification = true
+		// Schema and user from before email verification existed
+		hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+		_, err := cfg.AuthDB.Exec("CREATE TABLE users (email VARCHAR(255) PRIMARY KEY, password VARCHAR(255), username VARCHAR(255) UNIQUE, created_at VARCHAR(255))")
+		if err == nil {
+			_, err = cfg.AuthDB.Exec("INSERT INTO users VALUES (?, ?, ?, ?)", "judy@example.com", string(hash), "judy", "2024-01-01T00:00:00Z")
+		}
+		if err != nil {
+			t.Fatalf("seed legacy user: %v", err)
+		}
+	})
+	sessionID := newSession(t, ts, "judy@example.com")
+	upload(t, ts, sessionID, "legacy", []byte("x"))
+}
+
+// postJSONFor is postJSON that decodes the JSON response into out on success
+func postJSONFor(t *testing.T, ts *httptest.Server, path, sessionID string, payload, out any) int {
+	t.Helper()
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(body))
+	resp := do(t, req, sessionID)
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 && out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s: decode: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	ts := newTestServer(t)
+	sessionID := login(t, ts, "kim@example.com", "kim")
+
+	var enrollment api.TwoFactorEnrollResponse
+	if status := postJSONFor(t, ts, "/auth/2fa/enroll", sessionID, struct{}{}, &enrollment); status != http.StatusOK {
+		t.Fatalf("enroll: status %d", status)
+	}
+	if loginStatus(t, ts, "kim@example.com", "secret") != http.StatusOK {
+		t.Fatal("enrollment alone must not require a second factor")
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/2fa/enable", sessionID, api.TwoFactorRequest{Code: "000000"}); status != http.StatusBadRequest {
+		t.Fatalf("enable with wrong code: want 400, got %d", status)
+	}
+	now := time.Now()
+	code, _ := totp.Code(enrollment.Secret, now)
+	var enabled api.TwoFactorEnableResponse
+	if status := postJSONFor(t, ts, "/auth/2fa/enable", sessionID, api.TwoFactorRequest{Code: code}, &enabled); status != http.StatusOK {
+		t.Fatalf("enable: status %d", status)
+	}
+	if len(enabled.RecoveryCodes) != 10 {
+		t.Fatalf("want 10 recovery codes, got %d", len(enabled.RecoveryCodes))
+	}
+
+	secondStep := func(code string) int {
+		var challenge api.LoginChallenge
+		body := map[string]string{"email": "kim@example.com", "password": "secret"}
+		if status := postJSONFor(t, ts, "/auth/login", "", body, &challenge); status != http.StatusAccepted {
+			t.Fatalf("login: want 202, got %d", status)
+		}
+		return postJSON(t, ts, http.MethodPost, "/auth/login/2fa", "", api.TwoFactorLoginRequest{Challenge: challenge.Challenge, Code: code})
+	}
+	if status := secondStep(code); status != http.StatusUnauthorized {
+		t.Fatalf("replayed code: want 401, got %d", status)
+	}
+	next, _ := totp.Code(enrollment.Secret, now.Add(totp.Period))
+	if status := secondStep(next); status != http.StatusOK {
+		t.Fatalf("login with code: status %d", status)
+	}
+	if status := secondStep(strings.ToUpper(enabled.RecoveryCodes[0])); status != http.StatusOK {
+		t.Fatalf("login with recovery code: status %d", status)
+	}
+	if status := secondStep(enabled.RecoveryCodes[0]); status != http.StatusUnauthorized {
+		t.Fatalf("reused recovery code: want 401, got %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/login/2fa", "", api.TwoFactorLoginRequest{Challenge: "bogus", Code: next}); status != http.StatusUnauthorized {
+		t.Fatalf("bogus challenge: want 401, got %d", status)
+	}
+
+	disable := api.TwoFactorRequest{Code: enabled.RecoveryCodes[1], Password: "wrong"}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/2fa/disable", sessionID, disable); status != http.StatusUnauthorized {
+		t.Fatalf("disable with wrong password: want 401, got %d", status)
+	}
+	disable.Password = "secret"
+	if status := postJSON(t, ts, http.MethodPost, "/auth/2fa/disable", sessionID, disable); status != http.StatusOK {
+		t.Fatalf("disable: status %d", status)
+	}
+	if status := loginStatus(t, ts, "kim@example.com", "secret"); status != http.StatusOK {
+		t.Fatalf("login after disable: want 200, got %d", status)
+	}
+}
+
+// confirmSSO opens a login link, checks that the confirmation page shows code and
+// submits it, denying the login if deny is set
+func confirmSSO(t *testing.T, link, code, deny string) *http.Response {
+	t.Helper()
+	page, err := http.Get(link)
+	if err != nil {
+		t.Fatalf("browser: %v", err)
+	}
+	body, _ := io.ReadAll(page.Body)
+	page.Body.Close()
+	if page.StatusCode != http.StatusOK || !strings.Contains(string(body), code) || !strings.Contains(string(body), `method="post"`) {
+		t.Fatalf("confirmation page: status %d, %s", page.StatusCode, body)
+	}
+	form := url.Values{}
+	if deny != "" {
+		form.Set("deny", deny)
+	}
+	resp, err := http.PostForm(page.Request.URL.String(), form)
+	if err != nil {
+		t.Fatalf("browser: %v", err)
+	}
+	return resp
+}
+
+// ssoLogin runs a single sign-on login like the CLI and a browser would and returns the poll status and session
+func ssoLogin(t *testing.T, ts *httptest.Server) (int, string) {
+	t.Helper()
+	var start api.SSOStartResponse
+	if status := postJSONFor(t, ts, "/auth/sso/start", "", struct{}{}, &start); status != http.StatusOK {
+		t.Fatalf("sso start: status %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/sso/poll", "", api.SSOPollRequest{PollToken: start.PollToken}); status != http.StatusAccepted {
+		t.Fatalf("poll before login: want 202, got %d", status)
+	}
+
+	// The browser confirms the code, then follows the redirects to the provider and back to the callback
+	confirmSSO(t, strings.ToLower(start.URL), start.UserCode, "").Body.Close()
+
+	body, _ := json.Marshal(api.SSOPollRequest{PollToken: start.PollToken})
+	resp, err := http.Post(ts.URL+"/auth/sso/poll", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, resp.Header.Get("X-Session-ID")
+}
+
+func TestSSOLogin(t *testing.T) {
+	provider := oidctest.NewProvider("codesfer", "s3cret")
+	defer provider.Close()
+	client, err := oidc.New(oidc.Config{Issuer: provider.Issuer(), ClientID: "codesfer", ClientSecret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, _ := startTestServer(t, func(cfg *Config) {
+		cfg.SSO = auth.SSOConfig{Provider: client}
+	})
+	me := func(sessionID string) api.AccountResponse {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/auth/me", nil)
+		resp := do(t, req, sessionID)
+		defer resp.Body.Close()
+		var account api.AccountResponse
+		json.NewDecoder(resp.Body).Decode(&account)
+		return account
+	}
+
+	// A new identity gets an account, the username taken from preferred_username
+	login(t, ts, "other@example.com", "lee")
+	verified, unverified := true, false
+	provider.SetUser(oidctest.User{Subject: "1", Email: "lee@corp.example.com", EmailVerified: &verified, PreferredUsername: "Lee"})
+	status, sessionID := ssoLogin(t, ts)
+	if status != http.StatusOK {
+		t.Fatalf("sso login: status %d", status)
+	}
+	if account := me(sessionID); account.Username != "lee-2" || account.Email != "lee@corp.example.com" || !account.Verified {
+		t.Fatalf("provisioned account: %+v", account)
+	}
+	if loginStatus(t, ts, "lee@corp.example.com", "") == http.StatusOK {
+		t.Fatal("SSO account must not log in with an empty password")
+	}
+
+	// The same identity logs into the same account, even if its email changed
+	provider.SetUser(oidctest.User{Subject: "1", Email: "lee.new@corp.example.com", EmailVerified: &verified, PreferredUsername: "lee"})
+	if _, sessionID := ssoLogin(t, ts); me(sessionID).Username != "lee-2" {
+		t.Fatal("second login created another account")
+	}
+
+	// An existing password account is linked only if the provider vouches for the email
+	login(t, ts, "mo@example.com", "mo")
+	provider.SetUser(oidctest.User{Subject: "2", Email: "mo@example.com", EmailVerified: &unverified})
+	if status, _ := ssoLogin(t, ts); status != http.StatusUnauthorized {
+		t.Fatalf("linking unverified email: want 401, got %d", status)
+	}
+	provider.SetUser(oidctest.User{Subject: "2", Email: "mo@example.com"})
+	if status, _ := ssoLogin(t, ts); status != http.StatusUnauthorized {
+		t.Fatalf("linking email without email_verified: want 401, got %d", status)
+	}
+	provider.SetUser(oidctest.User{Subject: "2", Email: "mo@example.com", EmailVerified: &verified})
+	if _, sessionID := ssoLogin(t, ts); me(sessionID).Username != "mo" {
+		t.Fatal("existing account was not linked")
+	}
+
+	// Opening a login link does nothing until the user confirms it, and they may deny it
+	var start api.SSOStartResponse
+	postJSONFor(t, ts, "/auth/sso/start", "", struct{}{}, &start)
+	page, err := http.Get(start.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Body.Close()
+	if status := postJSON(t, ts, http.MethodPost, "/auth/sso/poll", "", api.SSOPollRequest{PollToken: start.PollToken}); status != http.StatusAccepted {
+		t.Fatalf("poll after opening the link: want 202, got %d", status)
+	}
+	req, _ := http.NewRequest(http.MethodPost, start.URL, nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	if resp := do(t, req, ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-site confirmation: want 403, got %d", resp.StatusCode)
+	}
+	confirmSSO(t, start.URL, start.UserCode, "1").Body.Close()
+	if status := postJSON(t, ts, http.MethodPost, "/auth/sso/poll", "", api.SSOPollRequest{PollToken: start.PollToken}); status != http.StatusUnauthorized {
+		t.Fatalf("poll after deny: want 401, got %d", status)
+	}
+}
+
+func TestSSOTrustUnverifiedEmail(t *testing.T) {
+	provider := oidctest.NewProvider("codesfer", "s3cret")
+	defer provider.Close()
+	client, _ := oidc.New(oidc.Config{Issuer: provider.Issuer(), ClientID: "codesfer", ClientSecret: "s3cret"})
+	ts, _ := startTestServer(t, func(cfg *Config) {
+		cfg.SSO = auth.SSOConfig{Provider: client, TrustUnverifiedEmail: true}
+	})
+
+	login(t, ts, "mo@example.com", "mo")
+	unverified := false
+	provider.SetUser(oidctest.User{Subject: "2", Email: "mo@example.com", EmailVerified: &unverified})
+	if status, _ := ssoLogin(t, ts); status != http.StatusUnauthorized {
+		t.Fatalf("linking unverified email: want 401, got %d", status)
+	}
+	provider.SetUser(oidctest.User{Subject: "2", Email: "mo@example.com"})
+	if status, _ := ssoLogin(t, ts); status != http.StatusOK {
+		t.Fatalf("linking email without email_verified when trusted: status %d", status)
+	}
+}
+
+func TestSSODisablesPasswords(t *testing.T) {
+	provider := oidctest.NewProvider("codesfer", "s3cret")
+	defer provider.Close()
+	client, _ := oidc.New(oidc.Config{Issuer: provider.Issuer(), ClientID: "codesfer", ClientSecret: "s3cret"})
+	ts, _ := startTestServer(t, func(cfg *Config) {
+		cfg.SSO = auth.SSOConfig{Provider: client, DisablePasswords: true}
+	})
+
+	register := api.RegisterRequest{Email: "nat@example.com", Password: "secret", Username: "nat"}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/register", "", register); status != http.StatusForbidden {
+		t.Fatalf("register: want 403, got %d", status)
+	}
+	if status := loginStatus(t, ts, "nat@example.com", "secret"); status != http.StatusForbidden {
+		t.Fatalf("password login: want 403, got %d", status)
+	}
+	if status, _ := ssoLogin(t, ts); status != http.StatusOK {
+		t.Fatalf("sso login: status %d", status)
+	}
+
+	plain := newTestServer(t)
+	if status := postJSON(t, plain, http.MethodPost, "/auth/sso/start", "", struct{}{}); status != http.StatusNotFound {
+		t.Fatalf("sso without provider: want 404, got %d", status)
+	}
+}
+
+// pollDevice polls the device token endpoint and returns the status, the RFC 8628 error code and the session
+func pollDevice(t *testing.T, ts *httptest.Server, deviceCode string) (int, string, string) {
+	t.Helper()
+	body, _ := json.Marshal(api.DeviceTokenRequest{DeviceCode: deviceCode})
+	resp, err := http.Post(ts.URL+"/auth/device/token", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("device token: %v", err)
+	}
+	defer resp.Body.Close()
+	var deviceErr api.DeviceTokenError
+	if resp.StatusCode != http.StatusOK {
+		json.NewDecoder(resp.Body).Decode(&deviceErr)
+	}
+	return resp.StatusCode, deviceErr.Error, resp.Header.Get("X-Session-ID")
+}
+
+func TestDeviceLogin(t *testing.T) {
+	ts := newTestServer(t)
+	sessionID := login(t, ts, "olga@example.com", "olga")
+
+	var code api.DeviceCodeResponse
+	if status := postJSONFor(t, ts, "/auth/device/code", "", struct{}{}, &code); status != http.StatusOK {
+		t.Fatalf("device code: status %d", status)
+	}
+	if _, errorCode, _ := pollDevice(t, ts, code.DeviceCode); errorCode != "authorization_pending" {
+		t.Fatalf("first poll: want authorization_pending, got %q", errorCode)
+	}
+	if _, errorCode, _ := pollDevice(t, ts, code.DeviceCode); errorCode != "slow_down" {
+		t.Fatalf("immediate second poll: want slow_down, got %q", errorCode)
+	}
+
+	// Approving needs a session and accepts the code in any case, with or without the dash
+	userCode := strings.ToLower(strings.ReplaceAll(code.UserCode, "-", ""))
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/auth/device/requests/"+userCode, nil)
+	resp := do(t, req, sessionID)
+	var info api.DeviceRequestInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || info.UserCode != code.UserCode || info.Agent != "Go-http-client/1.1" {
+		t.Fatalf("device info: status %d, %+v", resp.StatusCode, info)
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/device/approve", "", api.DeviceApproveRequest{UserCode: userCode}); status != http.StatusUnauthorized {
+		t.Fatalf("approve without session: want 401, got %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/device/approve", sessionID, api.DeviceApproveRequest{UserCode: userCode}); status != http.StatusOK {
+		t.Fatalf("approve: status %d", status)
+	}
+
+	status, _, deviceSession := pollDevice(t, ts, code.DeviceCode)
+	if status != http.StatusOK || deviceSession == "" {
+		t.Fatalf("poll after approval: status %d", status)
+	}
+	upload(t, ts, deviceSession, "from-device", []byte("x"))
+	if _, errorCode, _ := pollDevice(t, ts, code.DeviceCode); errorCode != "expired_token" {
+		t.Fatalf("poll after login: want expired_token, got %q", errorCode)
+	}
+
+	// A denied code never logs in
+	postJSONFor(t, ts, "/auth/device/code", "", struct{}{}, &code)
+	if status := postJSON(t, ts, http.MethodPost, "/auth/device/approve", sessionID, api.DeviceApproveRequest{UserCode: code.UserCode, Deny: true}); status != http.StatusOK {
+		t.Fatalf("deny: status %d", status)
+	}
+	if _, errorCode, _ := pollDevice(t, ts, code.DeviceCode); errorCode != "access_denied" {
+		t.Fatalf("poll after deny: want access_denied, got %q", errorCode)
+	}
+}
+
+func TestDeviceApprovalWithSSO(t *testing.T) {
+	provider := oidctest.NewProvider("codesfer", "s3cret")
+	defer provider.Close()
+	client, _ := oidc.New(oidc.Config{Issuer: provider.Issuer(), ClientID: "codesfer", ClientSecret: "s3cret"})
+	ts, _ := startTestServer(t, func(cfg *Config) {
+		cfg.SSO = auth.SSOConfig{Provider: client}
+	})
+
+	var code api.DeviceCodeResponse
+	postJSONFor(t, ts, "/auth/device/code", "", struct{}{}, &code)
+	page, err := http.Get(code.VerificationURIComplete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(page.Body)
+	page.Body.Close()
+	if !strings.Contains(string(body), "codesfer approve "+code.UserCode) || !strings.Contains(string(body), "/auth/device/sso?code=") {
+		t.Fatalf("verification page: %s", body)
+	}
+
+	// The browser confirms the device and signs in with the provider, which approves it
+	resp := confirmSSO(t, ts.URL+"/auth/device/sso?code="+code.UserCode, code.UserCode, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("sso approval: status %d", resp.StatusCode)
+	}
+	if status, _, sessionID := pollDevice(t, ts, code.DeviceCode); status != http.StatusOK || sessionID == "" {
+		t.Fatalf("poll after sso approval: status %d", status)
+	}
+}
+
+func TestSSHKeyLogin(t *testing.T) {
+	ts := newTestServer(t)
+	sessionID := login(t, ts, "pia@example.com", "pia")
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(private)
+	publicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	var key api.SSHKey
+	if status := postJSONFor(t, ts, "/auth/ssh-keys", sessionID, api.SSHKeyAddRequest{PublicKey: publicKey + " pia@laptop"}, &key); status != http.StatusCreated {
+		t.Fatalf("add key: status %d", status)
+	}
+	if key.Name != "pia@laptop" || key.Fingerprint != ssh.FingerprintSHA256(signer.PublicKey()) {
+		t.Fatalf("added key: %+v", key)
+	}
+	other := login(t, ts, "quinn@example.com", "quinn")
+	if status := postJSON(t, ts, http.MethodPost, "/auth/ssh-keys", other, api.SSHKeyAddRequest{PublicKey: publicKey}); status != http.StatusConflict {
+		t.Fatalf("adding a key twice: want 409, got %d", status)
+	}
+
+	host := strings.TrimPrefix(ts.URL, "http://")
+	sshLogin := func(host string) (int, string) {
+		var challenge api.SSHChallengeResponse
+		if status := postJSONFor(t, ts, "/auth/login/ssh/challenge", "", api.SSHChallengeRequest{PublicKeys: []string{publicKey}}, &challenge); status != http.StatusOK {
+			return status, ""
+		}
+		signature, err := signer.Sign(rand.Reader, api.SSHLoginMessage(host, challenge.Challenge))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(api.SSHLoginRequest{
+			Challenge: challenge.Challenge,
+			PublicKey: publicKey,
+			Signature: base64.StdEncoding.EncodeToString(ssh.Marshal(signature)),
+		})
+		resp, err := http.Post(ts.URL+"/auth/login/ssh", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("X-Session-ID")
+	}
+
+	status, keySession := sshLogin(host)
+	if status != http.StatusOK {
+		t.Fatalf("ssh login: status %d", status)
+	}
+	upload(t, ts, keySession, "from-ssh", []byte("x"))
+	// A signature made for another server must not log in here
+	if status, _ := sshLogin("evil.example.com"); status != http.StatusUnauthorized {
+		t.Fatalf("signature for another host: want 401, got %d", status)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/auth/ssh-keys/"+key.ID, nil)
+	resp := do(t, req, sessionID)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("remove key: status %d", resp.StatusCode)
+	}
+	if status, _ := sshLogin(host); status != http.StatusNotFound {
+		t.Fatalf("removed key: want 404, got %d", status)
+	}
+}
+
+func TestBruteForceProtection(t *testing.T) {
+	ts, _ := startTestServer(t, func(cfg *Config) { cfg.Limiter = ratelimit.New(ratelimit.NewMemory()) })
+	sessionID := login(t, ts, "rita@example.com", "rita")
+
+	// Five wrong passwords lock the account, even for the right one
+	for i := range 5 {
+		if status := loginStatus(t, ts, "rita@example.com", "wrong"); status != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: want 401, got %d", i, status)
+		}
+	}
+	body, _ := json.Marshal(map[string]string{"email": "rita@example.com", "password": "secret"})
+	resp, err := http.Post(ts.URL+"/auth/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "30" {
+		t.Fatalf("locked login: want 429 with Retry-After 30, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// Wrong download passwords lock the snippet
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", "archive.zip")
+	fw.Write([]byte("guarded"))
+	mw.WriteField("path", "guarded")
+	mw.WriteField("password", "hunter2")
+	mw.WriteField("visibility", api.VisibilityUnlisted)
+	mw.Close()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/storage/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp = do(t, req, sessionID)
+	var uploaded api.UploadResponse
+	json.NewDecoder(resp.Body).Decode(&uploaded)
+	resp.Body.Close()
+
+	if status, _ := download(t, ts, uploaded.Uid+"&password=hunter2"); status != http.StatusOK {
+		t.Fatalf("download with password: status %d", status)
+	}
+	for i := range 5 {
+		if status, _ := download(t, ts, uploaded.Uid+"&password=guess"); status != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: want 401, got %d", i, status)
+		}
+	}
+	if status, _ := download(t, ts, uploaded.Uid+"&password=hunter2"); status != http.StatusTooManyRequests {
+		t.Fatalf("locked snippet: want 429, got %d", status)
+	}
+
+	// Username lookups are limited per client IP
+	status := 0
+	for range 31 {
+		resp, err := http.Get(ts.URL + "/auth/username?username=someone")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		status = resp.StatusCode
+	}
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("username enumeration: want 429, got %d", status)
+	}
+}
+
+// fakeGeolocator places every address in Testville and remembers what it was asked
+type fakeGeolocator struct {
+	mu     sync.Mutex
+	lookup []netip.Addr
+}
+
+var _ geo.Geolocator = (*fakeGeolocator)(nil)
+
+func (g *fakeGeolocator) Locate(_ context.Context, ip netip.Addr) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lookup = append(g.lookup, ip)
+	return "Testville, TV", nil
+}
+
+func TestSessionLocation(t *testing.T) {
+	locator := &fakeGeolocator{}
+	ts, _ := startTestServer(t, func(cfg *Config) {
+		cfg.Geolocator = locator
+		cfg.Proxies = realip.Resolver{Trusted: realip.DefaultTrusted}
+	})
+	login(t, ts, "sam@example.com", "sam")
+
+	// The test client is a trusted proxy on loopback, only the hop it appended counts
+	body, _ := json.Marshal(map[string]string{"email": "sam@example.com", "password": "secret"})
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/auth/login", bytes.NewReader(body))
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	locations := map[string]bool{}
+	for range 50 {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/auth/me", nil)
+		resp := do(t, req, string(sessionID))
+		var account api.AccountResponse
+		json.NewDecoder(resp.Body).Decode(&account)
+		resp.Body.Close()
+		clear(locations)
+		for _, s := range account.Sessions {
+			locations[s.Location] = true
+		}
+		if locations["Testville, TV"] {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !locations["Testville, TV"] || !locations["Localhost"] {
+		t.Fatalf("want a located session and a local one, got %v", locations)
+	}
+	locator.mu.Lock()
+	defer locator.mu.Unlock()
+	if len(locator.lookup) != 1 || locator.lookup[0] != netip.MustParseAddr("203.0.113.7") {
+		t.Fatalf("looked up %v, want only 203.0.113.7", locator.lookup)
+	}
+}
+
+func TestForwardedForNeedsTrustedProxy(t *testing.T) {
+	locator := &fakeGeolocator{}
+	ts, _ := startTestServer(t, func(cfg *Config) { cfg.Geolocator = locator })
+	login(t, ts, "tom@example.com", "tom")
+
+	body, _ := json.Marshal(map[string]string{"email": "tom@example.com", "password": "secret"})
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/auth/login", bytes.NewReader(body))
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("CF-Connecting-IP", "203.0.113.8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: status %d", resp.StatusCode)
+	}
+	// Spoofed headers are ignored, so the session is local and nothing is looked up
+	time.Sleep(50 * time.Millisecond)
+	locator.mu.Lock()
+	defer locator.mu.Unlock()
+	if len(locator.lookup) != 0 {
+		t.Fatalf("looked up spoofed addresses %v", locator.lookup)
+	}
+}
+
+func TestForgedIdentityHeaders(t *testing.T) {
+	ts := newTestServer(t)
+	sessionID := login(t, ts, "uma@example.com", "uma")
+	upload(t, ts, sessionID, "private", []byte("data"))
+
+	forged := func(method, path, token string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.Header.Set("X-Authorized", "true")
+		req.Header.Set("X-Username", "uma")
+		req.Header.Set("X-Session-ID", sessionID)
+		req.Header.Set("X-Scopes", "*")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := forged(http.MethodGet, "/storage/list", ""); status != http.StatusUnauthorized {
+		t.Fatalf("anonymous list as uma: want 401, got %d", status)
+	}
+	if status := forged(http.MethodDelete, "/storage/remove?key=private", ""); status != http.StatusUnauthorized {
+		t.Fatalf("anonymous remove as uma: want 401, got %d", status)
+	}
+	if status := forged(http.MethodGet, "/auth/me?session_id="+sessionID, ""); status != http.StatusUnauthorized {
+		t.Fatalf("me with the session in the query: want 401, got %d", status)
+	}
+
+	// A token cannot widen its scopes with a header
+	var token api.AccessToken
+	if status := postJSONFor(t, ts, "/auth/tokens", sessionID, api.TokenCreateRequest{Name: "ci", Scopes: []string{api.ScopePull}, ExpiresIn: 3600}, &token); status != http.StatusCreated {
+		t.Fatalf("create token: status %d", status)
+	}
+	if status := forged(http.MethodGet, "/storage/list", token.Token); status != http.StatusForbidden {
+		t.Fatalf("list with a pull-only token: want 403, got %d", status)
+	}
+}
+
+func getJSON(t *testing.T, ts *httptest.Server, path, sessionID string, out any) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	resp := do(t, req, sessionID)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s: decode: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// pushForm uploads a small archive with the given form fields and returns the status and response
+func pushForm(t *testing.T, ts *httptest.Server, sessionID string, fields map[string]string) (int, api.UploadResponse) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", "archive.zip")
+	fw.Write([]byte("content of " + fields["path"]))
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/storage/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp := do(t, req, sessionID)
+	defer resp.Body.Close()
+	var out api.UploadResponse
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+func TestOrganizations(t *testing.T) {
+	ts := newTestServer(t)
+	owner := login(t, ts, "vera@example.com", "vera")
+	writer := login(t, ts, "walt@example.com", "walt")
+	reader := login(t, ts, "xena@example.com", "xena")
+	outsider := login(t, ts, "yuri@example.com", "yuri")
+
+	if status := postJSON(t, ts, http.MethodPost, "/auth/orgs", owner, api.OrgCreateRequest{Name: "walt"}); status != http.StatusConflict {
+		t.Fatalf("org named like a user: want 409, got %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/orgs", owner, api.OrgCreateRequest{Name: "in/fra"}); status != http.StatusBadRequest {
+		t.Fatalf("org name with a slash: want 400, got %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/orgs", owner, api.OrgCreateRequest{Name: "infra"}); status != http.StatusCreated {
+		t.Fatalf("create org: status %d", status)
+	}
+	body, _ := json.Marshal(api.RegisterRequest{Email: "infra@example.com", Password: "secret", Username: "infra"})
+	if resp, err := http.Post(ts.URL+"/auth/register", "application/json", bytes.NewReader(body)); err != nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("register with an org name: want 409, got %v %v", resp.StatusCode, err)
+	}
+
+	for member, role := range map[string]string{"walt": api.RoleWriter, "xena": api.RoleReader} {
+		if status := postJSON(t, ts, http.MethodPut, "/auth/orgs/infra/members/"+member, owner, api.OrgMemberRequest{Role: role}); status != http.StatusOK {
+			t.Fatalf("invite %s: status %d", member, status)
+		}
+	}
+
+	// Invitees have no access until they accept
+	if status, _ := pushForm(t, ts, writer, map[string]string{"path": "early", "org": "infra"}); status != http.StatusNotFound {
+		t.Fatalf("push before accepting: want 404, got %d", status)
+	}
+	var invites api.OrgInvitesResponse
+	if status := getJSON(t, ts, "/auth/orgs/invites", writer, &invites); status != http.StatusOK || len(invites) != 1 ||
+		invites[0].Org != "infra" || invites[0].Role != api.RoleWriter || invites[0].InvitedBy != "vera" {
+		t.Fatalf("invites: status %d, %+v", status, invites)
+	}
+	for _, invitee := range []string{writer, reader} {
+		if status := postJSON(t, ts, http.MethodPost, "/auth/orgs/invites/infra", invitee, api.OrgInviteAnswer{}); status != http.StatusOK {
+			t.Fatalf("accept: status %d", status)
+		}
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/orgs/invites/infra", writer, api.OrgInviteAnswer{}); status != http.StatusNotFound {
+		t.Fatalf("accept twice: want 404, got %d", status)
+	}
+
+	// Declined and withdrawn invitations grant nothing
+	invite := func() {
+		t.Helper()
+		if status := postJSON(t, ts, http.MethodPut, "/auth/orgs/infra/members/yuri", owner, api.OrgMemberRequest{Role: api.RoleReader}); status != http.StatusOK {
+			t.Fatalf("invite yuri: status %d", status)
+		}
+	}
+	invite()
+	if status := postJSON(t, ts, http.MethodPost, "/auth/orgs/invites/infra", outsider, api.OrgInviteAnswer{Decline: true}); status != http.StatusOK {
+		t.Fatalf("decline: status %d", status)
+	}
+	invite()
+	var pending api.OrgMembersResponse
+	if status := getJSON(t, ts, "/auth/orgs/infra/members", owner, &pending); status != http.StatusOK || len(pending) != 4 || !pending[3].Pending || pending[3].Username != "yuri" {
+		t.Fatalf("members with an invitation: status %d, %+v", status, pending)
+	}
+	if status := postJSON(t, ts, http.MethodDelete, "/auth/orgs/infra/members/yuri", owner, nil); status != http.StatusOK {
+		t.Fatalf("withdraw invitation: status %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/orgs/invites/infra", outsider, api.OrgInviteAnswer{}); status != http.StatusNotFound {
+		t.Fatalf("accept a withdrawn invitation: want 404, got %d", status)
+	}
+
+	if status := postJSON(t, ts, http.MethodPut, "/auth/orgs/infra/members/yuri", writer, api.OrgMemberRequest{Role: api.RoleOwner}); status != http.StatusForbidden {
+		t.Fatalf("invite by a writer: want 403, got %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodPut, "/auth/orgs/infra/members/vera", owner, api.OrgMemberRequest{Role: api.RoleReader}); status != http.StatusConflict {
+		t.Fatalf("demote the last owner: want 409, got %d", status)
+	}
+	var members api.OrgMembersResponse
+	if status := getJSON(t, ts, "/auth/orgs/infra/members", reader, &members); status != http.StatusOK || len(members) != 3 {
+		t.Fatalf("members: status %d, %+v", status, members)
+	}
+
+	push := func(sessionID, path string) (int, api.UploadResponse) {
+		return pushForm(t, ts, sessionID, map[string]string{"path": path, "org": "infra"})
+	}
+	status, up := push(writer, "deploy")
+	if status != http.StatusOK {
+		t.Fatalf("push by a writer: status %d", status)
+	}
+	if status, _ := push(reader, "nope"); status != http.StatusForbidden {
+		t.Fatalf("push by a reader: want 403, got %d", status)
+	}
+	if status, _ := push(outsider, "nope"); status != http.StatusNotFound {
+		t.Fatalf("push by an outsider: want 404, got %d", status)
+	}
+
+	pull := func(sessionID, key string) int {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/storage/download?key="+key, nil)
+		resp := do(t, req, sessionID)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, key := range []string{"infra/deploy", up.Uid} {
+		if status := pull(reader, key); status != http.StatusOK {
+			t.Fatalf("pull %s by a reader: status %d", key, status)
+		}
+		if status := pull(outsider, key); status != http.StatusNotFound {
+			t.Fatalf("pull %s by an outsider: want 404, got %d", key, status)
+		}
+	}
+	if status, _ := download(t, ts, "infra/deploy"); status != http.StatusNotFound {
+		t.Fatalf("anonymous pull: want 404, got %d", status)
+	}
+
+	orgList := func(sessionID string) (int, api.ListResponse) {
+		var objs api.ListResponse
+		status := getJSON(t, ts, "/storage/list?org=infra", sessionID, &objs)
+		return status, objs
+	}
+	if status, objs := orgList(reader); status != http.StatusOK || len(objs) != 1 || objs[0].Path != "infra/deploy" {
+		t.Fatalf("list by a reader: status %d, %+v", status, objs)
+	}
+	if status, _ := orgList(outsider); status != http.StatusNotFound {
+		t.Fatalf("list by an outsider: want 404, got %d", status)
+	}
+	if objs := list(t, ts, writer); len(objs) != 0 {
+		t.Fatalf("org snippet listed as the writer's own: %+v", objs)
+	}
+
+	remove := func(sessionID string) string {
+		var out api.RemoveResponse
+		req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/storage/remove?key="+up.Uid, nil)
+		resp := do(t, req, sessionID)
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&out)
+		return out.Results[up.Uid]
+	}
+	if result := remove(reader); result == "removed" {
+		t.Fatal("a reader removed an org snippet")
+	}
+	if result := remove(writer); result != "removed" {
+		t.Fatalf("remove by a writer: %s", result)
+	}
+
+	// Leaving is allowed, removing others is for owners
+	if status := postJSON(t, ts, http.MethodDelete, "/auth/orgs/infra/members/walt", reader, nil); status != http.StatusForbidden {
+		t.Fatalf("reader removes a writer: want 403, got %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodDelete, "/auth/orgs/infra/members/xena", reader, nil); status != http.StatusOK {
+		t.Fatalf("reader leaves: status %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodDelete, "/auth/account", owner, api.AccountDeleteRequest{Password: "secret"}); status != http.StatusConflict {
+		t.Fatalf("delete the account of the last owner: want 409, got %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodDelete, "/auth/orgs/infra", owner, nil); status != http.StatusOK {
+		t.Fatalf("delete org: status %d", status)
+	}
+	var orgs api.OrgListResponse
+	if status := getJSON(t, ts, "/auth/orgs", writer, &orgs); status != http.StatusOK || len(orgs) != 0 {
+		t.Fatalf("orgs after delete: status %d, %+v", status, orgs)
+	}
+}
+
+func TestDirectSharing(t *testing.T) {
+	ts := newTestServer(t)
+	sender := login(t, ts, "zack@example.com", "zack")
+	alice := login(t, ts, "alice@example.com", "alice")
+	bob := login(t, ts, "bob@example.com", "bob")
+	carol := login(t, ts, "carol@example.com", "carol")
+
+	if status, _ := pushForm(t, ts, sender, map[string]string{"path": "typo", "to": "alice,nobody"}); status != http.StatusNotFound {
+		t.Fatalf("share with an unknown user: want 404, got %d", status)
+	}
+	status, up := pushForm(t, ts, sender, map[string]string{"path": "fix", "to": "alice, bob"})
+	if status != http.StatusOK {
+		t.Fatalf("push --to: status %d", status)
+	}
+
+	pull := func(sessionID string) int {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/storage/download?key="+up.Uid, nil)
+		resp := do(t, req, sessionID)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status, _ := download(t, ts, up.Uid); status != http.StatusNotFound {
+		t.Fatalf("anonymous pull of a shared snippet: want 404, got %d", status)
+	}
+	if status := pull(carol); status != http.StatusNotFound {
+		t.Fatalf("pull by a non-recipient: want 404, got %d", status)
+	}
+	if status := pull(sender); status != http.StatusOK {
+		t.Fatalf("pull by the owner: status %d", status)
+	}
+
+	var inbox api.InboxResponse
+	if status := getJSON(t, ts, "/storage/inbox", alice, &inbox); status != http.StatusOK || len(inbox) != 1 {
+		t.Fatalf("inbox: status %d, %+v", status, inbox)
+	}
+	if item := inbox[0]; item.Key != up.Uid || item.From != "zack" || item.ReadAt != "" {
+		t.Fatalf("inbox item: %+v", item)
+	}
+	if status := pull(alice); status != http.StatusOK {
+		t.Fatalf("pull by a recipient: status %d", status)
+	}
+	getJSON(t, ts, "/storage/inbox", alice, &inbox)
+	if inbox[0].ReadAt == "" {
+		t.Fatal("pulling did not mark the snippet read")
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/storage/inbox/read", bob, api.InboxReadRequest{}); status != http.StatusOK {
+		t.Fatalf("mark all read: status %d", status)
+	}
+	getJSON(t, ts, "/storage/inbox", bob, &inbox)
+	if len(inbox) != 1 || inbox[0].ReadAt == "" {
+		t.Fatalf("bob's inbox after marking read: %+v", inbox)
+	}
+
+	// Only someone who can write to the snippet shares it further
+	if status := postJSON(t, ts, http.MethodPost, "/storage/share", alice, api.ShareRequest{Key: up.Uid, To: []string{"carol"}}); status != http.StatusNotFound {
+		t.Fatalf("share by a recipient: want 404, got %d", status)
+	}
+	var shared api.ShareResponse
+	if status := postJSONFor(t, ts, "/storage/share", sender, api.ShareRequest{Key: up.Uid, To: []string{"carol"}}, &shared); status != http.StatusOK || len(shared.To) != 3 {
+		t.Fatalf("share: status %d, %+v", status, shared)
+	}
+	if status := pull(carol); status != http.StatusOK {
+		t.Fatalf("pull after share: status %d", status)
+	}
+	if objs := list(t, ts, sender); len(objs) != 1 || len(objs[0].To) != 3 {
+		t.Fatalf("list shows recipients: %+v", objs)
+	}
+
+	// Removing the snippet empties the inboxes
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/storage/remove?key="+up.Uid, nil)
+	do(t, req, sender).Body.Close()
+	getJSON(t, ts, "/storage/inbox", carol, &inbox)
+	if len(inbox) != 0 {
+		t.Fatalf("inbox after remove: %+v", inbox)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	ts := newTestServer(t)
+	owner := login(t, ts, "una@example.com", "una")
+	other := login(t, ts, "otto@example.com", "otto")
+
+	pull := func(sessionID, key string) int {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/storage/download?key="+key, nil)
+		resp := do(t, req, sessionID)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status, _ := pushForm(t, ts, owner, map[string]string{"path": "bad", "visibility": "secret"}); status != http.StatusBadRequest {
+		t.Fatalf("unknown visibility: want 400, got %d", status)
+	}
+	status, private := pushForm(t, ts, owner, map[string]string{"path": "internal"})
+	if status != http.StatusOK || private.Visibility != api.VisibilityPrivate {
+		t.Fatalf("default push: status %d, %+v", status, private)
+	}
+	_, unlisted := pushForm(t, ts, owner, map[string]string{"path": "link", "visibility": api.VisibilityUnlisted})
+	_, public := pushForm(t, ts, owner, map[string]string{"path": "demo", "visibility": api.VisibilityPublic})
+
+	for _, key := range []string{private.Uid, "una/internal"} {
+		if status := pull("", key); status != http.StatusNotFound {
+			t.Fatalf("anonymous pull of private %s: want 404, got %d", key, status)
+		}
+		if status := pull(other, key); status != http.StatusNotFound {
+			t.Fatalf("pull of private %s by another user: want 404, got %d", key, status)
+		}
+	}
+	if status := pull(owner, private.Uid); status != http.StatusOK {
+		t.Fatalf("pull of private by the owner: status %d", status)
+	}
+	for _, key := range []string{unlisted.Uid, public.Uid} {
+		if status := pull("", key); status != http.StatusOK {
+			t.Fatalf("anonymous pull of %s: status %d", key, status)
+		}
+	}
+
+	// Only public snippets show up on the profile, to anyone
+	var profile api.ListResponse
+	if status := getJSON(t, ts, "/storage/profile/una", "", &profile); status != http.StatusOK || len(profile) != 1 || profile[0].Key != public.Uid {
+		t.Fatalf("profile: status %d, %+v", status, profile)
+	}
+
+	if status := postJSON(t, ts, http.MethodPost, "/storage/chmod", other, api.ChmodRequest{Key: private.Uid, Visibility: api.VisibilityPublic}); status != http.StatusNotFound {
+		t.Fatalf("chmod by another user: want 404, got %d", status)
+	}
+	var changed api.ChmodResponse
+	if status := postJSONFor(t, ts, "/storage/chmod", owner, api.ChmodRequest{Key: private.Uid, Visibility: api.VisibilityPublic}, &changed); status != http.StatusOK || changed.Visibility != api.VisibilityPublic {
+		t.Fatalf("chmod: status %d, %+v", status, changed)
+	}
+	if status := pull("", private.Uid); status != http.StatusOK {
+		t.Fatalf("anonymous pull after chmod public: status %d", status)
+	}
+	getJSON(t, ts, "/storage/profile/una", "", &profile)
+	if len(profile) != 2 {
+		t.Fatalf("profile after chmod: %+v", profile)
+	}
+	postJSON(t, ts, http.MethodPost, "/storage/chmod", owner, api.ChmodRequest{Key: public.Uid, Visibility: api.VisibilityPrivate})
+	if status := pull("", public.Uid); status != http.StatusNotFound {
+		t.Fatalf("anonymous pull after chmod private: want 404, got %d", status)
+	}
+}
+
+func TestVisibilityMigration(t *testing.T) {
+	ts, _ := startTestServer(t, func(cfg *Config) {
+		// Index from before visibility existed, one snippet was shared
+		_, err := cfg.IndexDB.Exec(`CREATE TABLE objects (id VARCHAR(255) NOT NULL PRIMARY KEY, username VARCHAR(255) NOT NULL,
+			filename VARCHAR(255), password VARCHAR(255), path VARCHAR(255) UNIQUE, created_at VARCHAR(255), metadata TEXT, UNIQUE (username, filename));
+			CREATE TABLE shares (object_id VARCHAR(255) NOT NULL, username VARCHAR(255) NOT NULL, shared_by VARCHAR(255),
+			read_at VARCHAR(255) NOT NULL DEFAULT '', created_at VARCHAR(255), PRIMARY KEY (object_id, username));
+			INSERT INTO objects (id, username, filename, password, path, created_at) VALUES
+				('old1', 'kim', 'open', '', 'kim/open', '2024-01-01T00:00:00Z'),
+				('old2', 'kim', 'shared', '', 'kim/shared', '2024-01-01T00:00:00Z');
+			INSERT INTO shares (object_id, username, shared_by, created_at) VALUES ('old2', 'lee', 'kim', '2024-01-01T00:00:00Z')`)
+		if err != nil {
+			t.Fatalf("seed legacy index: %v", err)
+		}
+	})
+	sessionID := login(t, ts, "kim@example.com", "kim")
+	objs := list(t, ts, sessionID)
+	visibility := map[string]string{}
+	for _, obj := range objs {
+		visibility[obj.Key] = obj.Visibility
+	}
+	if visibility["old1"] != api.VisibilityUnlisted || visibility["old2"] != api.VisibilityPrivate {
+		t.Fatalf("migrated visibility: %v", visibility)
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	ts := newTestServer(t)
+	owner := login(t, ts, "sam@example.com", "sam")
+	other := login(t, ts, "tia@example.com", "tia")
+	_, up := pushForm(t, ts, owner, map[string]string{"path": "contract"})
+
+	get := func(url string) int {
+		resp, err := http.Get(ts.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := postJSON(t, ts, http.MethodPost, "/storage/link", owner, api.LinkRequest{Key: up.Uid}); status != http.StatusBadRequest {
+		t.Fatalf("link without expiry: want 400, got %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/storage/link", other, api.LinkRequest{Key: up.Uid, ExpiresIn: 3600}); status != http.StatusNotFound {
+		t.Fatalf("link by another user: want 404, got %d", status)
+	}
+	var limited, unlimited api.LinkResponse
+	if status := postJSONFor(t, ts, "/storage/link", owner, api.LinkRequest{Key: up.Uid, ExpiresIn: 3600, MaxDownloads: 2}, &limited); status != http.StatusOK {
+		t.Fatalf("link: status %d", status)
+	}
+	postJSONFor(t, ts, "/storage/link", owner, api.LinkRequest{Key: up.Uid, ExpiresIn: 3600}, &unlimited)
+
+	// Anyone with the link downloads the private snippet, until it is used up
+	for i := range 2 {
+		if status := get(limited.URL); status != http.StatusOK {
+			t.Fatalf("download %d through link: status %d", i, status)
+		}
+	}
+	if status := get(limited.URL); status != http.StatusGone {
+		t.Fatalf("used up link: want 410, got %d", status)
+	}
+	for range 3 {
+		if status := get(unlimited.URL); status != http.StatusOK {
+			t.Fatalf("unlimited link: status %d", status)
+		}
+	}
+	if status := get(strings.Replace(limited.URL, "max=2", "max=20", 1)); status != http.StatusForbidden {
+		t.Fatalf("tampered link: want 403, got %d", status)
+	}
+
+	// Revoking invalidates every link issued before, new ones work
+	if status := postJSON(t, ts, http.MethodPost, "/storage/link/revoke", owner, api.LinkRevokeRequest{Key: up.Uid}); status != http.StatusOK {
+		t.Fatalf("revoke: status %d", status)
+	}
+	if status := get(unlimited.URL); status != http.StatusForbidden {
+		t.Fatalf("revoked link: want 403, got %d", status)
+	}
+	postJSONFor(t, ts, "/storage/link", owner, api.LinkRequest{Key: up.Uid, ExpiresIn: 60}, &unlimited)
+	if status := get(unlimited.URL); status != http.StatusOK {
+		t.Fatalf("link after revoke: status %d", status)
+	}
+}
+
+func TestAnonymousUploads(t *testing.T) {
+	if status, _ := pushForm(t, newTestServer(t), "", map[string]string{"path": "trace"}); status != http.StatusUnauthorized {
+		t.Fatalf("anonymous upload when disabled: want 401, got %d", status)
+	}
+
+	ts, cfg := startTestServer(t, func(cfg *Config) {
+		cfg.Anonymous = storage.AnonConfig{Enabled: true, TTL: time.Hour, MaxSize: 64}
+		cfg.Limiter = ratelimit.New(ratelimit.NewMemory())
+	})
+	status, up := pushForm(t, ts, "", map[string]string{"path": "crash.log"})
+	if status != http.StatusOK || up.Visibility != api.VisibilityUnlisted || up.ExpiresAt == "" {
+		t.Fatalf("anonymous upload: status %d, %+v", status, up)
+	}
+	for _, key := range []string{up.Uid, "anon/crash.log"} {
+		if status, _ := download(t, ts, key); status != http.StatusOK {
+			t.Fatalf("download %s: status %d", key, status)
+		}
+	}
+
+	// Nobody can register the namespace anonymous snippets live in
+	register := api.RegisterRequest{Email: "anon@example.com", Password: "secret", Username: "anon"}
+	if status := postJSON(t, ts, http.MethodPost, "/auth/register", "", register); status != http.StatusConflict {
+		t.Fatalf("register anon: want 409, got %d", status)
+	}
+
+	for _, fields := range []map[string]string{
+		{"path": "alias", "key": "incident"},
+		{"path": "org", "org": "infra"},
+		{"path": "hidden", "visibility": api.VisibilityPrivate},
+	} {
+		if status, _ := pushForm(t, ts, "", fields); status != http.StatusBadRequest {
+			t.Fatalf("anonymous upload with %v: want 400, got %d", fields, status)
+		}
+	}
+	if status, _ := pushForm(t, ts, "", map[string]string{"path": "huge", "filler": strings.Repeat("x", 100)}); status != http.StatusOK {
+		t.Fatalf("form fields do not count towards the size: status %d", status)
+	}
+	if status, _ := pushForm(t, ts, "", map[string]string{"path": strings.Repeat("x", 80)}); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("anonymous upload over the size limit: want 413, got %d", status)
+	}
+
+	// Expired snippets are gone at once and swept from the stores by the janitor
+	if _, err := cfg.IndexDB.Exec("UPDATE objects SET expires_at = 1 WHERE id = ?", up.Uid); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := download(t, ts, up.Uid); status != http.StatusNotFound {
+		t.Fatalf("expired snippet: want 404, got %d", status)
+	}
+	waitSwept(t, cfg, up.Uid)
+	if _, err := cfg.Objects.Stat(context.Background(), "anon/crash.log"); err == nil {
+		t.Fatal("the janitor left the archive in object storage")
+	}
+
+	// Anonymous uploads are limited per client IP
+	for i := 0; ; i++ {
+		status, _ := pushForm(t, ts, "", map[string]string{"path": "flood"})
+		if status == http.StatusTooManyRequests {
+			break
+		}
+		if i == 10 {
+			t.Fatal("anonymous uploads are not rate limited")
+		}
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	ts, _ := startTestServer(t, func(cfg *Config) {
+		cfg.Quotas = storage.QuotaConfig{
+			User:      storage.Quota{Objects: 2},
+			Org:       storage.Quota{Bytes: 40},
+			Overrides: map[string]storage.Quota{"ben": {}},
+		}
+		// Index from before sizes were recorded, object storage has the archive
+		_, err := cfg.IndexDB.Exec(`CREATE TABLE objects (id VARCHAR(255) NOT NULL PRIMARY KEY, username VARCHAR(255) NOT NULL,
+			filename VARCHAR(255), password VARCHAR(255), path VARCHAR(255) UNIQUE, created_at VARCHAR(255), metadata TEXT, UNIQUE (username, filename));
+			INSERT INTO objects (id, username, filename, password, path, created_at) VALUES ('old1', 'cid', 'old', '', 'cid/old', '2024-01-01T00:00:00Z')`)
+		if err != nil {
+			t.Fatalf("seed legacy index: %v", err)
+		}
+		if _, err := cfg.Objects.Put(context.Background(), "cid/old", strings.NewReader("0123456789"), 10, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	ann := login(t, ts, "ann@example.com", "ann")
+	ben := login(t, ts, "ben@example.com", "ben")
+	cid := login(t, ts, "cid@example.com", "cid")
+
+	// Users are limited to two snippets, removing one frees its slot
+	var first api.UploadResponse
+	for i, path := range []string{"one", "two"} {
+		status, up := pushForm(t, ts, ann, map[string]string{"path": path})
+		if status != http.StatusOK {
+			t.Fatalf("push %s: status %d", path, status)
+		}
+		if i == 0 {
+			first = up
+		}
+	}
+	if status, _ := pushForm(t, ts, ann, map[string]string{"path": "three"}); status != http.StatusInsufficientStorage {
+		t.Fatalf("push over the object quota: want 507, got %d", status)
+	}
+	var usage api.UsageResponse
+	if status := getJSON(t, ts, "/storage/usage", ann, &usage); status != http.StatusOK || usage.Objects != 2 || usage.MaxObjects != 2 || usage.Bytes != int64(len("content of one")+len("content of two")) {
+		t.Fatalf("usage: status %d, %+v", status, usage)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/storage/remove?key="+first.Uid, nil)
+	do(t, req, ann).Body.Close()
+	if status, _ := pushForm(t, ts, ann, map[string]string{"path": "three"}); status != http.StatusOK {
+		t.Fatalf("push after removing a snippet: status %d", status)
+	}
+
+	// Overrides lift the quota of a namespace
+	for _, path := range []string{"one", "two", "three"} {
+		if status, _ := pushForm(t, ts, ben, map[string]string{"path": path}); status != http.StatusOK {
+			t.Fatalf("push %s with an override: status %d", path, status)
+		}
+	}
+
+	// Organizations are limited to 40 bytes
+	if status := postJSON(t, ts, http.MethodPost, "/auth/orgs", ann, api.OrgCreateRequest{Name: "ops"}); status != http.StatusCreated {
+		t.Fatalf("create org: status %d", status)
+	}
+	for _, path := range []string{"a", "b", "c"} {
+		if status, _ := pushForm(t, ts, ann, map[string]string{"path": path, "org": "ops"}); status != http.StatusOK {
+			t.Fatalf("push %s to ops: status %d", path, status)
+		}
+	}
+	if status, _ := pushForm(t, ts, ann, map[string]string{"path": "d", "org": "ops"}); status != http.StatusInsufficientStorage {
+		t.Fatalf("push over the byte quota: want 507, got %d", status)
+	}
+	if status := getJSON(t, ts, "/storage/usage?org=ops", ann, &usage); status != http.StatusOK || usage.Namespace != "ops" || usage.Bytes != 36 || usage.MaxBytes != 40 {
+		t.Fatalf("org usage: status %d, %+v", status, usage)
+	}
+	if status := getJSON(t, ts, "/storage/usage?org=ops", ben, &usage); status != http.StatusNotFound {
+		t.Fatalf("usage of another org: want 404, got %d", status)
+	}
+
+	// Sizes of existing snippets are read from object storage
+	if status := getJSON(t, ts, "/storage/usage", cid, &usage); status != http.StatusOK || usage.Bytes != 10 || usage.Objects != 1 {
+		t.Fatalf("backfilled usage: status %d, %+v", status, usage)
+	}
+}
+
+// transfer sends body to url with method, without following redirects, and returns the response
+func transfer(t *testing.T, method, url, sessionID string, body []byte) (int, string, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	if sessionID != "" {
+		req.Header.Set("Authorization", "Bearer "+sessionID)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("Location"), data
+}
+
+// waitSwept runs a janitor on a second server over cfg until the object with id is gone
+func waitSwept(t *testing.T, cfg Config, id string) {
+	t.Helper()
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Janitor(ctx, 10*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for n := 1; n > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the janitor did not delete %s", id)
+		}
+		time.Sleep(20 * time.Millisecond)
+		cfg.IndexDB.QueryRow("SELECT COUNT(*) FROM objects WHERE id = ?", id).Scan(&n)
+	}
+}
+
+func TestDirectTransfer(t *testing.T) {
+	ts, cfg := startTestServer(t, func(cfg *Config) {
+		cfg.Direct = storage.DirectConfig{Enabled: true, TTL: time.Minute, Secret: []byte("blob secret")}
+	})
+	bob := login(t, ts, "bob@example.com", "bob")
+	ann := login(t, ts, "ann@example.com", "ann")
+	content := []byte("direct archive")
+
+	status, up := pushForm(t, ts, bob, map[string]string{"path": "notes", "direct": "true", "size": fmt.Sprint(len(content)), "to": "ann"})
+	if status != http.StatusOK || !strings.HasPrefix(up.UploadURL, "/storage/blob?") {
+		t.Fatalf("direct upload: status %d, %+v", status, up)
+	}
+	complete := func() int {
+		return postJSON(t, ts, http.MethodPost, "/storage/upload/complete", bob, api.UploadCompleteRequest{Key: up.Uid})
+	}
+
+	// Until the archive arrives the snippet cannot be completed, pulled, listed or found in an inbox
+	if status := complete(); status != http.StatusConflict {
+		t.Fatalf("complete before the PUT: want 409, got %d", status)
+	}
+	if status, _, _ := transfer(t, http.MethodGet, ts.URL+"/storage/download?key="+up.Uid, bob, nil); status != http.StatusNotFound {
+		t.Fatalf("download of a pending upload: want 404, got %d", status)
+	}
+	if objs := list(t, ts, bob); len(objs) != 0 {
+		t.Fatalf("pending upload listed: %+v", objs)
+	}
+	var inbox api.InboxResponse
+	if getJSON(t, ts, "/storage/inbox", ann, &inbox); len(inbox) != 0 {
+		t.Fatalf("pending upload shared: %+v", inbox)
+	}
+
+	uploadURL := ts.URL + up.UploadURL
+	if status, _, _ := transfer(t, http.MethodPut, uploadURL+"0", "", content); status != http.StatusForbidden {
+		t.Fatalf("PUT with a forged signature: want 403, got %d", status)
+	}
+	if status, _, _ := transfer(t, http.MethodPut, uploadURL, "", append(content, '!')); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("PUT larger than declared: want 413, got %d", status)
+	}
+	if status, _, body := transfer(t, http.MethodPut, uploadURL, "", content); status != http.StatusOK {
+		t.Fatalf("PUT: status %d, %s", status, body)
+	}
+	if status := complete(); status != http.StatusOK {
+		t.Fatalf("complete: status %d", status)
+	}
+	if status, _, _ := transfer(t, http.MethodPut, uploadURL, "", []byte("overwrite")); status != http.StatusNotFound {
+		t.Fatalf("PUT to a completed upload: want 404, got %d", status)
+	}
+	if getJSON(t, ts, "/storage/inbox", ann, &inbox); len(inbox) != 1 || inbox[0].Key != up.Uid {
+		t.Fatalf("completed upload not shared: %+v", inbox)
+	}
+
+	// Proxied and direct downloads return the archive
+	if status, _, body := transfer(t, http.MethodGet, ts.URL+"/storage/download?key="+up.Uid, bob, nil); status != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("download: status %d, %q", status, body)
+	}
+	status, location, _ := transfer(t, http.MethodGet, ts.URL+"/storage/download?direct=true&key="+up.Uid, bob, nil)
+	if status != http.StatusTemporaryRedirect || !strings.HasPrefix(location, "/storage/blob?") {
+		t.Fatalf("direct download: status %d, location %q", status, location)
+	}
+	if status, _, body := transfer(t, http.MethodGet, ts.URL+location, "", nil); status != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("blob download: status %d, %q", status, body)
+	}
+	if status, _, _ := transfer(t, http.MethodGet, ts.URL+location+"0", "", nil); status != http.StatusForbidden {
+		t.Fatalf("blob download with a forged signature: want 403, got %d", status)
+	}
+
+	// Uploads that are never completed are swept
+	status, abandoned := pushForm(t, ts, bob, map[string]string{"path": "abandoned", "direct": "true", "size": "5"})
+	if status != http.StatusOK {
+		t.Fatalf("direct upload: status %d", status)
+	}
+	if _, err := cfg.IndexDB.Exec("UPDATE objects SET pending_until = 1 WHERE id = ?", abandoned.Uid); err != nil {
+		t.Fatal(err)
+	}
+	waitSwept(t, cfg, abandoned.Uid)
+}
+
+// presigningObjects hands out URLs to a fake bucket that stores into the wrapped backend.
+// Like a bucket without signed content lengths, it accepts a body of any size.
+type presigningObjects struct {
+	object.ObjectStorage
+	bucket string
+	sizes  sync.Map // key to the size its PUT URL was presigned for
+}
+
+func (p *presigningObjects) PresignGet(_ context.Context, key string, _ time.Duration) (string, error) {
+	return p.bucket + "/" + key, nil
+}
+
+func (p *presigningObjects) PresignPut(_ context.Context, key string, size int64, _ time.Duration) (string, error) {
+	p.sizes.Store(key, size)
+	return p.bucket + "/" + key, nil
+}
+
+func (p *presigningObjects) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodPut:
+		if _, err := p.Put(r.Context(), key, r.Body, r.ContentLength, "", nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case http.MethodGet:
+		_, body, err := p.Get(r.Context(), key, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer body.Close()
+		io.Copy(w, body)
+	}
+}
+
+func TestDirectTransferPresigned(t *testing.T) {
+	objects := &presigningObjects{}
+	bucket := httptest.NewServer(objects)
+	t.Cleanup(bucket.Close)
+	ts, _ := startTestServer(t, func(cfg *Config) {
+		objects.ObjectStorage, objects.bucket = cfg.Objects, bucket.URL
+		cfg.Objects = objects
+		cfg.Direct = storage.DirectConfig{Enabled: true, TTL: time.Minute}
+	})
+	bob := login(t, ts, "bob@example.com", "bob")
+	content := []byte("presigned archive")
+
+	status, up := pushForm(t, ts, bob, map[string]string{"path": "notes", "direct": "true", "size": fmt.Sprint(len(content))})
+	if status != http.StatusOK || up.UploadURL != bucket.URL+"/bob/notes" {
+		t.Fatalf("direct upload: status %d, %+v", status, up)
+	}
+	if size, _ := objects.sizes.Load("bob/notes"); size != int64(len(content)) {
+		t.Fatalf("upload URL presigned for %v bytes, want %d", size, len(content))
+	}
+	if status, _, _ := transfer(t, http.MethodPut, up.UploadURL, "", content); status != http.StatusOK {
+		t.Fatalf("PUT to the bucket: status %d", status)
+	}
+	if status := postJSON(t, ts, http.MethodPost, "/storage/upload/complete", bob, api.UploadCompleteRequest{Key: up.Uid}); status != http.StatusOK {
+		t.Fatalf("complete: status %d", status)
+	}
+	status, location, _ := transfer(t, http.MethodGet, ts.URL+"/storage/download?direct=true&key="+up.Uid, bob, nil)
+	if status != http.StatusTemporaryRedirect || location != bucket.URL+"/bob/notes" {
+		t.Fatalf("direct download: status %d, location %q", status, location)
+	}
+	if status, _, body := transfer(t, http.MethodGet, location, "", nil); status != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("bucket download: status %d, %q", status, body)
+	}
+
+	// The bucket took more than was declared, completing drops the upload
+	status, big := pushForm(t, ts, bob, map[string]string{"path": "big", "direct": "true", "size": "4"})
+	if status != http.StatusOK {
+		t.Fatalf("direct upload: status %d", status)
+	}
+	transfer(t, http.MethodPut, big.UploadURL, "", content)
+	if status := postJSON(t, ts, http.MethodPost, "/storage/upload/complete", bob, api.UploadCompleteRequest{Key: big.Uid}); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("complete oversize upload: want 413, got %d", status)
+	}
+	if status, _ := download(t, ts, big.Uid); status != http.StatusNotFound {
+		t.Fatalf("oversize upload kept: status %d", status)
+	}
+
+	// A smaller archive is recorded with its actual size
+	status, small := pushForm(t, ts, bob, map[string]string{"path": "small", "direct": "true", "size": "1000"})
+	if status != http.StatusOK {
+		t.Fatalf("direct upload: status %d", status)
+	}
+	transfer(t, http.MethodPut, small.UploadURL, "", content)
+	if status := postJSON(t, ts, http.MethodPost, "/storage/upload/complete", bob, api.UploadCompleteRequest{Key: small.Uid}); status != http.StatusOK {
+		t.Fatalf("complete: status %d", status)
+	}
+	var usage api.UsageResponse
+	if status := getJSON(t, ts, "/storage/usage", bob, &usage); status != http.StatusOK || usage.Bytes != int64(2*len(content)) || usage.Objects != 2 {
+		t.Fatalf("usage: status %d, %+v", status, usage)
+	}
+}
+
+func TestMirrorsNeedTheirOwnStorage(t *testing.T) {
+	dir := t.TempDir()
+	primary := "file:" + filepath.Join(dir, "primary.db")
+	t.Setenv("OBJECT_BACKEND_DRIVER", "sqlite")
+	t.Setenv("OBJECT_STORAGE_SOURCE", primary)
+	t.Setenv("OBJECT_MIRROR_DRIVERS", "sqlite,sqlite")
+	t.Setenv("OBJECT_MIRROR_MODE", "sync")
+	t.Setenv("OBJECT_MIRROR_1_STORAGE_SOURCE", "file:"+filepath.Join(dir, "mirror.db"))
+	t.Setenv("OBJECT_MIRROR_2_STORAGE_SOURCE", primary)
+	if _, err := objectBackend(); err == nil {
+		t.Fatal("mirror sharing the primary's database accepted")
+	}
+
+	t.Setenv("OBJECT_MIRROR_2_STORAGE_SOURCE", "file:"+filepath.Join(dir, "mirror.db"))
+	if _, err := objectBackend(); err == nil {
+		t.Fatal("two mirrors sharing a database accepted")
+	}
+
+	t.Setenv("OBJECT_MIRROR_2_STORAGE_SOURCE", "file:"+filepath.Join(dir, "mirror2.db"))
+	backend, err := objectBackend()
+	if err != nil {
+		t.Fatalf("mirrors with their own databases: %v", err)
+	}
+	backend.Close(context.Background())
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"codesfer/pkg/object"
+	"codesfer/pkg/ratelimit"
+	"codesfer/pkg/realip"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Defaults of AnonConfig
+const (
+	DefaultAnonTTL     = 24 * time.Hour
+	DefaultAnonMaxSize = 10 << 20 // 10 MB
+)
+
+// anonNamespace holds the snippets pushed without an account, no user can take the name
+const anonNamespace = "anon"
+
+// anonUploadRate is the number of anonymous uploads allowed per client IP
+var anonUploadRate = ratelimit.Rate{Limit: 10, Window: time.Hour}
+
+// AnonConfig controls uploads without an account. They are stored under anon/,
+// pulled by their code only and deleted once they expire.
+type AnonConfig struct {
+	Enabled bool
+	// TTL is how long an anonymous snippet lives, DefaultAnonTTL if zero.
+	TTL time.Duration
+	// MaxSize bounds an anonymous upload in bytes, DefaultAnonMaxSize if zero.
+	MaxSize int64
+}
+
+// admitAnonymous rate limits an anonymous upload by client IP and caps its body.
+// It writes an error and returns false if the upload is refused.
+func (s *Service) admitAnonymous(w http.ResponseWriter, r *http.Request) bool {
+	if !s.anon.Enabled {
+		http.Error(w, "unauthorized, only authorized users can upload", http.StatusUnauthorized)
+		return false
+	}
+	ip, err := realip.FromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	wait, err := s.limiter.Allow(r.Context(), "anon-upload:"+ip.String(), anonUploadRate)
+	if err != nil {
+		log.Printf("  failed to rate limit anonymous upload from %s: %v", ip, err)
+	}
+	if wait > 0 {
+		log.Printf("[/storage/upload] anonymous uploads from %s throttled for %s", ip, wait)
+		ratelimit.TooManyRequests(w, wait)
+		return false
+	}
+	if r.ContentLength > s.anon.MaxSize+formSlack {
+		http.Error(w, fmt.Sprintf("file too large, anonymous uploads are limited to %d bytes", s.anon.MaxSize), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.anon.MaxSize+formSlack)
+	return true
+}
+
+// expired reports whether obj has an expiry and it passed
+func (obj *Object) expired(now time.Time) bool {
+	return obj.ExpiresAt > 0 && now.Unix() >= obj.ExpiresAt
+}
+
+// Sweep deletes the expired snippets and the direct uploads that were not
+// completed in time from object storage and the index and returns how many it deleted.
+func (s *Service) Sweep(ctx context.Context) (int, error) {
+	now := time.Now().Unix()
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, username, path FROM objects WHERE (expires_at > 0 AND expires_at <= ?) OR (pending_until > 0 AND pending_until <= ?)",
+		now, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var objs []Object
+	for rows.Next() {
+		var obj Object
+		if err := rows.Scan(&obj.ID, &obj.Username, &obj.Path); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		objs = append(objs, obj)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, obj := range objs {
+		if err := s.objects.Delete(ctx, obj.Path); err != nil && !errors.Is(err, object.ErrNotFound) {
+			return i, fmt.Errorf("delete %s: %w", obj.Path, err)
+		}
+		if _, err := s.removeByID(obj.Username, obj.ID); err != nil {
+			return i, fmt.Errorf("remove %s from index: %w", obj.ID, err)
+		}
+	}
+	return len(objs), nil
+}
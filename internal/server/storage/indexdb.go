@@ -1,35 +1,34 @@
 package storage
 
 import (
+	"codesfer/pkg/api"
 	"database/sql"
+	"errors"
+	"strings"
 	"time"
-
-	_ "github.com/tursodatabase/libsql-client-go/libsql"
-	_ "modernc.org/sqlite"
 )
 
-var db *sql.DB
-
 type Object struct {
-	ID        string `json:"id"`
-	Username  string `json:"username"`
-	Filename  string `json:"filename"`
-	Password  string `json:"password"`
-	Path      string `json:"path"`
-	CreatedAt string `json:"created_at"`
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	Filename   string `json:"filename"`
+	Password   string `json:"password"`
+	Path       string `json:"path"`
+	CreatedAt  string `json:"created_at"`
+	Visibility string `json:"visibility"`
+	// LinkVersion is signed into share links, bumping it revokes them all
+	LinkVersion int `json:"link_version"`
+	// ExpiresAt is the unix time the object is deleted at, 0 if never
+	ExpiresAt int64 `json:"expires_at"`
+	// Size of the archive in bytes, counted against the quota of the namespace
+	Size int64 `json:"size"`
+	// PendingUntil is the unix time a direct upload must be completed by, 0 once it is
+	PendingUntil int64 `json:"pending_until"`
+	// PendingTo lists the users a pending upload is shared with once it is completed
+	PendingTo []string `json:"pending_to"`
 }
 
-func connect(driver, source string) error {
-	_db, err := sql.Open(driver, source)
-	if err != nil {
-		panic(err)
-	}
-
-	db = _db
-	return createTable()
-}
-
-func createTable() error {
+func (s *Service) createTable() error {
 	query := `
         CREATE TABLE IF NOT EXISTS objects (
             id VARCHAR(255) NOT NULL PRIMARY KEY,
@@ -39,16 +38,121 @@ func createTable() error {
             path VARCHAR(255) UNIQUE,        -- Path in object storage
             created_at VARCHAR(255),
 			metadata TEXT,                   -- JSON string for additional metadata (TODO)
+			visibility VARCHAR(255) NOT NULL DEFAULT 'private',
+			link_version INTEGER NOT NULL DEFAULT 0,
+			expires_at INTEGER NOT NULL DEFAULT 0, -- Unix time, 0 for objects that do not expire
+			size INTEGER NOT NULL DEFAULT 0,       -- Bytes, counted against quotas
+			pending_until INTEGER NOT NULL DEFAULT 0, -- Unix time a direct upload must be completed by, 0 once it is
+			pending_to TEXT NOT NULL DEFAULT '',      -- Comma separated recipients of a pending upload
             UNIQUE (username, filename)
+		);
+		CREATE TABLE IF NOT EXISTS shares (
+			object_id VARCHAR(255) NOT NULL,
+			username VARCHAR(255) NOT NULL,  -- Recipient
+			shared_by VARCHAR(255),
+			read_at VARCHAR(255) NOT NULL DEFAULT '',
+			created_at VARCHAR(255),
+			PRIMARY KEY (object_id, username)
+		);
+		CREATE TABLE IF NOT EXISTS link_downloads (
+			sig VARCHAR(255) NOT NULL PRIMARY KEY, -- Signature of a share link with a download limit
+			object_id VARCHAR(255) NOT NULL,
+			count INTEGER NOT NULL DEFAULT 0,
+			expires_at INTEGER NOT NULL      -- Unix time the link expires, its count is useless after
 	)`
 
-	_, err := db.Exec(query)
-	return err
+	if _, err := s.db.Exec(query); err != nil {
+		return err
+	}
+	for _, column := range []string{"link_version", "expires_at", "pending_until"} {
+		if _, err := s.addColumn("objects", column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	if _, err := s.addColumn("objects", "pending_to", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Sizes were not recorded before quotas, object storage knows them
+	if added, err := s.addColumn("objects", "size", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	} else if added {
+		s.backfillSizes()
+	}
+	// Snippets from before visibility could be pulled by anyone with the code
+	added, err := s.addColumn("objects", "visibility", "VARCHAR(255) NOT NULL DEFAULT '"+api.VisibilityUnlisted+"'")
+	if err != nil || !added {
+		return err
+	}
+	return s.privatizeRestricted()
+}
+
+// addColumn adds a column to an existing table and reports whether it was missing
+func (s *Service) addColumn(table, column, definition string) (bool, error) {
+	_, err := s.db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	if err != nil && strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// privatizeRestricted makes the snippets that were already restricted before
+// visibility existed private: shared ones and those of organizations.
+func (s *Service) privatizeRestricted() error {
+	_, err := s.db.Exec("UPDATE objects SET visibility = ? WHERE id IN (SELECT object_id FROM shares)", api.VisibilityPrivate)
+	if err != nil || s.accounts == nil {
+		return err
+	}
+	rows, err := s.db.Query("SELECT DISTINCT username FROM objects")
+	if err != nil {
+		return err
+	}
+	var namespaces []string
+	for rows.Next() {
+		var namespace string
+		if err := rows.Scan(&namespace); err != nil {
+			rows.Close()
+			return err
+		}
+		namespaces = append(namespaces, namespace)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, namespace := range namespaces {
+		_, isOrg, err := s.accounts.OrgRole(namespace, "")
+		if err != nil {
+			return err
+		}
+		if !isOrg {
+			continue
+		}
+		if _, err := s.db.Exec("UPDATE objects SET visibility = ? WHERE username = ?", api.VisibilityPrivate, namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) show(username string) ([]Object, error) {
+	query := "SELECT id, username, filename, password, path, created_at, visibility, expires_at, size FROM objects WHERE username = ? AND pending_until = 0"
+	return s.queryObjects(query, username)
+}
+
+// namespace returns every object of username, pending direct uploads included
+func (s *Service) namespace(username string) ([]Object, error) {
+	query := "SELECT id, username, filename, password, path, created_at, visibility, expires_at, size FROM objects WHERE username = ?"
+	return s.queryObjects(query, username)
+}
+
+// showPublic returns the public objects of username, newest first
+func (s *Service) showPublic(username string) ([]Object, error) {
+	query := "SELECT id, username, filename, password, path, created_at, visibility, expires_at, size FROM objects WHERE username = ? AND visibility = ? AND pending_until = 0 ORDER BY created_at DESC"
+	return s.queryObjects(query, username, api.VisibilityPublic)
 }
 
-func show(username string) ([]Object, error) {
-	query := "SELECT id, username, filename, password, path, created_at FROM objects WHERE username = ?"
-	rows, err := db.Query(query, username)
+func (s *Service) queryObjects(query string, args ...any) ([]Object, error) {
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -56,7 +160,7 @@ func show(username string) ([]Object, error) {
 	var objs []Object
 	for rows.Next() {
 		obj := Object{}
-		err := rows.Scan(&obj.ID, &obj.Username, &obj.Filename, &obj.Password, &obj.Path, &obj.CreatedAt)
+		err := rows.Scan(&obj.ID, &obj.Username, &obj.Filename, &obj.Password, &obj.Path, &obj.CreatedAt, &obj.Visibility, &obj.ExpiresAt, &obj.Size)
 		if err != nil {
 			return nil, err
 		}
@@ -65,15 +169,31 @@ func show(username string) ([]Object, error) {
 	return objs, nil
 }
 
-func insert(id, user, filename, password, path string) error {
-	query := "INSERT INTO objects (id, username, filename, password, path, created_at) VALUES (?, ?, ?, ?, ?, ?)"
-	_, err := db.Exec(query, id, user, filename, password, path, time.Now().Format(time.RFC3339))
-	return err
+// insert stores obj unless that takes its namespace over quota, which fails
+// with errQuotaExceeded. The check and insert are one statement, so concurrent
+// uploads cannot overshoot the quota together.
+func (s *Service) insert(obj *Object, quota Quota) error {
+	query := `INSERT INTO objects (id, username, filename, password, path, created_at, visibility, expires_at, size, pending_until, pending_to)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE (? = 0 OR (SELECT COALESCE(SUM(size), 0) FROM objects WHERE username = ?) + ? <= ?)
+		AND (? = 0 OR (SELECT COUNT(*) FROM objects WHERE username = ?) < ?)`
+	res, err := s.db.Exec(query,
+		obj.ID, obj.Username, obj.Filename, obj.Password, obj.Path, time.Now().Format(time.RFC3339), obj.Visibility, obj.ExpiresAt, obj.Size, obj.PendingUntil, strings.Join(obj.PendingTo, ","),
+		quota.Bytes, obj.Username, obj.Size, quota.Bytes,
+		quota.Objects, obj.Username, quota.Objects,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errQuotaExceeded
+	}
+	return nil
 }
 
-func getFiles(username string) ([]Object, error) {
+func (s *Service) getFiles(username string) ([]Object, error) {
 	query := "SELECT filename FROM objects WHERE username = ?"
-	rows, err := db.Query(query, username)
+	rows, err := s.db.Query(query, username)
 	if err != nil {
 		return nil, err
 	}
@@ -89,9 +209,9 @@ func getFiles(username string) ([]Object, error) {
 	return objs, nil
 }
 
-func haveFile(username, filename string) (bool, error) {
+func (s *Service) haveFile(username, filename string) (bool, error) {
 	query := "SELECT id FROM objects WHERE username = ? AND filename = ?"
-	row := db.QueryRow(query, username, filename)
+	row := s.db.QueryRow(query, username, filename)
 	var id string
 	if err := row.Scan(&id); err != nil {
 		if err.Error() == "sql: no rows in result set" {
@@ -102,43 +222,86 @@ func haveFile(username, filename string) (bool, error) {
 	return true, nil
 }
 
-func get(id string) (*Object, error) {
-	query := "SELECT id, username, filename, password, path FROM objects WHERE id = ?"
-	row := db.QueryRow(query, id)
+func (s *Service) get(id string) (*Object, error) {
+	query := "SELECT id, username, filename, password, path, visibility, link_version, expires_at, size, pending_until, pending_to FROM objects WHERE id = ?"
+	row := s.db.QueryRow(query, id)
+	return scanObject(row)
+}
+
+// scanObject reads an object selected by get or getByUsernamePath, nil if there is none
+func scanObject(row *sql.Row) (*Object, error) {
 	obj := &Object{}
-	err := row.Scan(&obj.ID, &obj.Username, &obj.Filename, &obj.Password, &obj.Path)
+	var pendingTo string
+	err := row.Scan(&obj.ID, &obj.Username, &obj.Filename, &obj.Password, &obj.Path, &obj.Visibility, &obj.LinkVersion, &obj.ExpiresAt, &obj.Size, &obj.PendingUntil, &pendingTo)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			return nil, nil
 		}
 		return nil, err
 	}
+	if pendingTo != "" {
+		obj.PendingTo = strings.Split(pendingTo, ",")
+	}
 	return obj, nil
 }
 
-// removeByID removes the object with given id and returns the path in object storage
+// complete marks the pending upload with given id as completed, recording the size
+// it was stored with, and reports whether it was still pending
+func (s *Service) complete(id string, size int64) (bool, error) {
+	res, err := s.db.Exec("UPDATE objects SET pending_until = 0, pending_to = '', size = ? WHERE id = ? AND pending_until > 0", size, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// removeByID removes the object with given id, its shares and link counters and returns the path in object storage
 // username should be provided to prevent unauthorized removal
-func removeByID(username, id string) (string, error) {
+func (s *Service) removeByID(username, id string) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
 	query := "DELETE FROM objects WHERE username = ? AND id = ? returning path"
 	var path string
-	if err := db.QueryRow(query, username, id).Scan(&path); err != nil {
+	if err := tx.QueryRow(query, username, id).Scan(&path); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM shares WHERE object_id = ?", id); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM link_downloads WHERE object_id = ?", id); err != nil {
 		return "", err
 	}
-	return path, nil
+	return path, tx.Commit()
 }
 
 // getByUsernamePath returns the object with given username and path.
 // The path here refers to the `filename` field that is stored in the db
-func getByUsernamePath(username, path string) (*Object, error) {
-	query := "SELECT id, username, filename, password, path FROM objects WHERE username = ? AND filename = ?"
-	row := db.QueryRow(query, username, path)
-	obj := &Object{}
-	err := row.Scan(&obj.ID, &obj.Username, &obj.Filename, &obj.Password, &obj.Path)
+func (s *Service) getByUsernamePath(username, path string) (*Object, error) {
+	query := "SELECT id, username, filename, password, path, visibility, link_version, expires_at, size, pending_until, pending_to FROM objects WHERE username = ? AND filename = ?"
+	row := s.db.QueryRow(query, username, path)
+	return scanObject(row)
+}
+
+// rename points the object with given id at a new filename and object storage path.
+// username should be provided to prevent unauthorized renames
+func (s *Service) rename(username, id, filename, path string) error {
+	query := "UPDATE objects SET filename = ?, path = ? WHERE username = ? AND id = ?"
+	res, err := s.db.Exec(query, filename, path, username, id)
 	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
-			return nil, nil
-		}
-		return nil, err
+		return err
 	}
-	return obj, nil
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return errors.New("object not found")
+	}
+	return nil
+}
+
+// setVisibility changes the visibility of the object with given id
+func (s *Service) setVisibility(id, visibility string) error {
+	_, err := s.db.Exec("UPDATE objects SET visibility = ? WHERE id = ?", visibility, id)
+	return err
 }
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"codesfer/pkg/api"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// maxLinkTTL bounds how long a share link stays valid
+const maxLinkTTL = 30 * 24 * time.Hour
+
+// Share links carry everything needed to check them: the object, when they
+// expire, the link version of the object and the download limit, signed with
+// HMAC-SHA256. Only the download count of limited links is kept in the index.
+//
+//	/storage/download?key=<uid>&exp=<unix>&v=<link version>&max=<downloads>&sig=<hex>
+
+// signLink returns a relative download URL for obj valid until expiresAt, for at
+// most maxDownloads downloads if positive
+func (s *Service) signLink(obj *Object, expiresAt time.Time, maxDownloads int) string {
+	exp := strconv.FormatInt(expiresAt.Unix(), 10)
+	v := strconv.Itoa(obj.LinkVersion)
+	max := strconv.Itoa(maxDownloads)
+	q := url.Values{}
+	q.Set("key", obj.ID)
+	q.Set("exp", exp)
+	q.Set("v", v)
+	if maxDownloads > 0 {
+		q.Set("max", max)
+	}
+	q.Set("sig", s.linkMAC(obj.ID, exp, v, max))
+	return "/storage/download?" + q.Encode()
+}
+
+// link is a verified share link
+type link struct {
+	sig          string
+	expiresAt    int64 // Unix time
+	maxDownloads int   // 0 for no limit
+}
+
+// verifyLink checks the share link for obj in the query q
+func (s *Service) verifyLink(obj *Object, q url.Values) (*link, error) {
+	exp, v, sig := q.Get("exp"), q.Get("v"), q.Get("sig")
+	max := q.Get("max")
+	if max == "" {
+		max = "0"
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.linkMAC(obj.ID, exp, v, max))) {
+		return nil, errors.New("invalid link")
+	}
+	l := &link{sig: sig}
+	var err error
+	if l.expiresAt, err = strconv.ParseInt(exp, 10, 64); err != nil {
+		return nil, errors.New("invalid link expiry")
+	}
+	if l.maxDownloads, err = strconv.Atoi(max); err != nil {
+		return nil, errors.New("invalid link download limit")
+	}
+	if time.Now().Unix() > l.expiresAt {
+		return nil, errors.New("link expired")
+	}
+	if v != strconv.Itoa(obj.LinkVersion) {
+		return nil, errors.New("link revoked")
+	}
+	return l, nil
+}
+
+func (s *Service) linkMAC(id, exp, v, max string) string {
+	h := hmac.New(sha256.New, s.linkSecret)
+	h.Write([]byte("link\n" + id + "\n" + exp + "\n" + v + "\n" + max))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// useLink counts a download of the object with id through l and reports
+// whether it was within the limit of the link
+func (s *Service) useLink(id string, l *link) (bool, error) {
+	if l.maxDownloads == 0 {
+		return true, nil
+	}
+	var count int
+	err := s.db.QueryRow(
+		`INSERT INTO link_downloads (sig, object_id, count, expires_at) VALUES (?, ?, 1, ?)
+		ON CONFLICT (sig) DO UPDATE SET count = count + 1 WHERE count < ? RETURNING count`,
+		l.sig, id, l.expiresAt, l.maxDownloads,
+	).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// revokeLinks invalidates every share link of the object with id
+func (s *Service) revokeLinks(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE objects SET link_version = link_version + 1 WHERE id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM link_downloads WHERE object_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// linkRoute signs a share link that lets anyone download a snippet until it expires
+// body: api.LinkRequest, key must be the uid of an object the user can write to
+func (s *Service) linkRoute(w http.ResponseWriter, r *http.Request, username string) {
+	var data api.LinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := time.Duration(data.ExpiresIn) * time.Second
+	if ttl <= 0 || ttl > maxLinkTTL {
+		http.Error(w, "expires_in must be between 1s and "+maxLinkTTL.String(), http.StatusBadRequest)
+		return
+	}
+	if data.MaxDownloads < 0 {
+		http.Error(w, "max_downloads must not be negative", http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/storage/link] user %s is creating a link to object %s for %s, max downloads: %d", username, data.Key, ttl, data.MaxDownloads)
+
+	obj, ok := s.writableObject(w, data.Key, username)
+	if !ok {
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	if _, err := s.db.Exec("DELETE FROM link_downloads WHERE expires_at < ?", time.Now().Unix()); err != nil {
+		log.Printf("  failed to clean up expired link counters: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.LinkResponse{
+		URL:          s.signLink(obj, expiresAt, data.MaxDownloads),
+		ExpiresAt:    expiresAt.Format(time.RFC3339),
+		MaxDownloads: data.MaxDownloads,
+		Protected:    obj.Password != "",
+	})
+}
+
+// revokeLinksRoute invalidates every share link of a snippet
+// body: api.LinkRevokeRequest, key must be the uid of an object the user can write to
+func (s *Service) revokeLinksRoute(w http.ResponseWriter, r *http.Request, username string) {
+	var data api.LinkRevokeRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/storage/link/revoke] user %s is revoking the links to object %s", username, data.Key)
+
+	obj, ok := s.writableObject(w, data.Key, username)
+	if !ok {
+		return
+	}
+	if err := s.revokeLinks(obj.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("links revoked"))
+}
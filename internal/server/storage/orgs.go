@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"codesfer/pkg/api"
+	"net/http"
+	"slices"
+)
+
+// access returns the role of username in the namespace owner: the owner of their
+// own namespace, their member role in an organization and "" otherwise. isOrg
+// tells whether owner is an organization.
+func (s *Service) access(owner, username string) (role string, isOrg bool, err error) {
+	if username != "" && owner == username {
+		return api.RoleOwner, false, nil
+	}
+	if s.accounts == nil {
+		return "", false, nil
+	}
+	return s.accounts.OrgRole(owner, username)
+}
+
+// canWrite reports whether username may move or remove obj
+func (s *Service) canWrite(obj *Object, username string) (bool, error) {
+	role, _, err := s.access(obj.Username, username)
+	if err != nil {
+		return false, err
+	}
+	return role == api.RoleOwner || role == api.RoleWriter, nil
+}
+
+// writableObject looks up the object with key and writes an error unless username may write to it
+func (s *Service) writableObject(w http.ResponseWriter, key, username string) (*Object, bool) {
+	obj, err := s.get(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if obj == nil || obj.PendingUntil > 0 {
+		http.Error(w, "object not found", http.StatusNotFound)
+		return nil, false
+	}
+	if ok, err := s.canWrite(obj, username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	} else if !ok {
+		http.Error(w, "object not found", http.StatusNotFound)
+		return nil, false
+	}
+	return obj, true
+}
+
+// writableOwner returns the namespace of the object with key if username may
+// remove it, and username otherwise, so the removal finds nothing
+func (s *Service) writableOwner(key, username string) (string, error) {
+	obj, err := s.get(key)
+	if err != nil || obj == nil {
+		return username, err
+	}
+	ok, err := s.canWrite(obj, username)
+	if err != nil || !ok {
+		return username, err
+	}
+	return obj.Username, nil
+}
+
+// requireRole writes an error and returns false unless username has one of
+// roles in the organization org. Non-members are told it does not exist.
+func (s *Service) requireRole(w http.ResponseWriter, org, username string, roles ...string) bool {
+	role, isOrg, err := s.access(org, username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !isOrg || role == "" {
+		http.Error(w, "organization not found: "+org, http.StatusNotFound)
+		return false
+	}
+	if !slices.Contains(roles, role) {
+		http.Error(w, "forbidden, you are a "+role+" of "+org, http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"codesfer/pkg/api"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// errQuotaExceeded is returned by insert when an object does not fit in the quota of its namespace
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Quota bounds what a namespace stores, a zero field is unlimited
+type Quota struct {
+	Bytes   int64
+	Objects int64
+}
+
+// QuotaConfig sets the quotas of namespaces. The zero value is unlimited.
+type QuotaConfig struct {
+	// User applies to every user namespace, and to anon/.
+	User Quota
+	// Org applies to every organization namespace.
+	Org Quota
+	// Overrides replaces the quota of the namespaces it names.
+	Overrides map[string]Quota
+}
+
+// quota returns the quota of namespace
+func (s *Service) quota(namespace string) (Quota, error) {
+	if q, ok := s.quotas.Overrides[namespace]; ok {
+		return q, nil
+	}
+	_, isOrg, err := s.access(namespace, "")
+	if err != nil {
+		return Quota{}, err
+	}
+	if isOrg {
+		return s.quotas.Org, nil
+	}
+	return s.quotas.User, nil
+}
+
+// usage returns how many bytes and objects namespace stores
+func (s *Service) usage(namespace string) (bytes, objects int64, err error) {
+	err = s.db.QueryRow("SELECT COALESCE(SUM(size), 0), COUNT(*) FROM objects WHERE username = ?", namespace).Scan(&bytes, &objects)
+	return bytes, objects, err
+}
+
+// quotaError explains to the uploader why a size byte object did not fit in namespace
+func (s *Service) quotaError(w http.ResponseWriter, namespace string, size int64) {
+	quota, err := s.quota(namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	bytes, objects, err := s.usage(namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("  %s is over quota: %d bytes in %d objects, uploading %d bytes", namespace, bytes, objects, size)
+	msg := fmt.Sprintf("quota exceeded for %s: %s in %d snippets", namespace, formatSize(bytes), objects)
+	if quota.Bytes > 0 {
+		msg += fmt.Sprintf(", %s allowed, this upload is %s", formatSize(quota.Bytes), formatSize(size))
+	}
+	if quota.Objects > 0 {
+		msg += fmt.Sprintf(", %d snippets allowed", quota.Objects)
+	}
+	http.Error(w, msg, http.StatusInsufficientStorage)
+}
+
+// formatSize prints n bytes in the largest unit it reaches
+func formatSize(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// usageRoute reports the storage used by the user, or by an organization they are a member of
+// org: optional
+func (s *Service) usageRoute(w http.ResponseWriter, r *http.Request, username string) {
+	namespace := username
+	if org := r.URL.Query().Get("org"); org != "" {
+		if !s.requireRole(w, org, username, api.Roles...) {
+			return
+		}
+		namespace = org
+	}
+	log.Printf("[/storage/usage] user %s is checking the usage of %s", username, namespace)
+
+	quota, err := s.quota(namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	bytes, objects, err := s.usage(namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.UsageResponse{
+		Namespace:  namespace,
+		Bytes:      bytes,
+		Objects:    objects,
+		MaxBytes:   quota.Bytes,
+		MaxObjects: quota.Objects,
+	})
+}
+
+// sizeOf returns the size declared for the pending upload at path in object storage
+func (s *Service) sizeOf(path string) (int64, error) {
+	var size int64
+	err := s.db.QueryRow("SELECT size FROM objects WHERE path = ? AND pending_until > 0", path).Scan(&size)
+	return size, err
+}
+
+// backfillSizes records the size of objects stored before sizes were tracked.
+// Objects missing from storage keep a size of 0.
+func (s *Service) backfillSizes() {
+	rows, err := s.db.Query("SELECT id, path FROM objects")
+	if err != nil {
+		log.Printf("failed to backfill object sizes: %v", err)
+		return
+	}
+	var objs []Object
+	for rows.Next() {
+		var obj Object
+		if err := rows.Scan(&obj.ID, &obj.Path); err != nil {
+			log.Printf("failed to backfill object sizes: %v", err)
+			rows.Close()
+			return
+		}
+		objs = append(objs, obj)
+	}
+	rows.Close()
+
+	for _, obj := range objs {
+		meta, err := s.objects.Stat(context.Background(), obj.Path)
+		if err != nil {
+			log.Printf("  failed to stat %s for its size: %v", obj.Path, err)
+			continue
+		}
+		if _, err := s.db.Exec("UPDATE objects SET size = ? WHERE id = ?", meta.Size, obj.ID); err != nil {
+			log.Printf("  failed to record the size of %s: %v", obj.ID, err)
+		}
+	}
+	log.Printf("recorded the sizes of %d existing objects", len(objs))
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"codesfer/pkg/api"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// recipients returns the users the object with id is shared with
+func (s *Service) recipients(id string) ([]string, error) {
+	rows, err := s.db.Query("SELECT username FROM shares WHERE object_id = ? ORDER BY created_at, username", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// share grants the users in to access to the object with id, users who already have it are skipped
+func (s *Service) share(id, sharedBy string, to []string) error {
+	now := time.Now().Format(time.RFC3339)
+	for _, username := range to {
+		_, err := s.db.Exec(
+			"INSERT INTO shares (object_id, username, shared_by, created_at) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING",
+			id, username, sharedBy, now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inbox returns the objects shared with username, newest first
+func (s *Service) inbox(username string) ([]api.InboxItem, error) {
+	query := `SELECT objects.id, objects.path, shares.shared_by, shares.created_at, shares.read_at
+		FROM shares JOIN objects ON objects.id = shares.object_id
+		WHERE shares.username = ? ORDER BY shares.created_at DESC`
+	rows, err := s.db.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []api.InboxItem{}
+	for rows.Next() {
+		var item api.InboxItem
+		if err := rows.Scan(&item.Key, &item.Path, &item.From, &item.SharedAt, &item.ReadAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// markRead marks the objects with ids in the inbox of username as read, every unread one if ids is empty
+func (s *Service) markRead(username string, ids []string) (int64, error) {
+	now := time.Now().Format(time.RFC3339)
+	if len(ids) == 0 {
+		res, err := s.db.Exec("UPDATE shares SET read_at = ? WHERE username = ? AND read_at = ''", now, username)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+	var n int64
+	for _, id := range ids {
+		res, err := s.db.Exec("UPDATE shares SET read_at = ? WHERE username = ? AND object_id = ? AND read_at = ''", now, username, id)
+		if err != nil {
+			return n, err
+		}
+		affected, _ := res.RowsAffected()
+		n += affected
+	}
+	return n, nil
+}
+
+// parseRecipients cleans up a list of usernames to share with and checks they
+// exist. It writes an error and returns false if one does not.
+func (s *Service) parseRecipients(w http.ResponseWriter, username string, to []string) ([]string, bool) {
+	var recipients []string
+	for _, name := range to {
+		for name := range strings.SplitSeq(name, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && name != username && !slices.Contains(recipients, name) {
+				recipients = append(recipients, name)
+			}
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, true
+	}
+	if s.accounts == nil {
+		http.Error(w, "sharing is disabled", http.StatusNotImplemented)
+		return nil, false
+	}
+	for _, name := range recipients {
+		exists, err := s.accounts.UserExists(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		if !exists {
+			http.Error(w, "user not found: "+name, http.StatusNotFound)
+			return nil, false
+		}
+	}
+	return recipients, true
+}
+
+// shareUploaded shares a just reserved or uploaded object with to. If that fails
+// the object is removed again, rather than left without the recipients it was meant for.
+func (s *Service) shareUploaded(r *http.Request, owner, sharedBy, id string, to []string) error {
+	if len(to) == 0 {
+		return nil
+	}
+	err := s.share(id, sharedBy, to)
+	if err == nil {
+		log.Printf("  key: %s; shared with %v", id, to)
+		return nil
+	}
+	path, rerr := s.removeByID(owner, id)
+	if rerr == nil {
+		rerr = s.objects.Delete(r.Context(), path)
+	}
+	if rerr != nil {
+		log.Printf("  failed to remove %s after it could not be shared: %v", id, rerr)
+	}
+	return err
+}
+
+// shareRoute shares an existing snippet with more users
+// body: api.ShareRequest, key must be the uid of an object the user can write to
+func (s *Service) shareRoute(w http.ResponseWriter, r *http.Request, username string) {
+	var data api.ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/storage/share] user %s is trying to share object %s with %v", username, data.Key, data.To)
+
+	obj, ok := s.writableObject(w, data.Key, username)
+	if !ok {
+		return
+	}
+
+	to, ok := s.parseRecipients(w, username, data.To)
+	if !ok {
+		return
+	}
+	if len(to) == 0 {
+		http.Error(w, "at least one other user is required", http.StatusBadRequest)
+		return
+	}
+	if err := s.share(obj.ID, username, to); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	all, err := s.recipients(obj.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.ShareResponse{Uid: obj.ID, To: all})
+}
+
+// inboxRoute lists the snippets shared with the user
+func (s *Service) inboxRoute(w http.ResponseWriter, r *http.Request, username string) {
+	log.Printf("[/storage/inbox] user %s is reading their inbox", username)
+	items, err := s.inbox(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.InboxResponse(items))
+}
+
+// inboxReadRoute marks snippets in the user's inbox as read
+// body: api.InboxReadRequest
+func (s *Service) inboxReadRoute(w http.ResponseWriter, r *http.Request, username string) {
+	var data api.InboxReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := s.markRead(username, data.Keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%d snippet(s) marked read", n)
+}
@@ -2,76 +2,303 @@
 package storage
 
 import (
+	"codesfer/internal/server/identity"
 	"codesfer/pkg/api"
 	"codesfer/pkg/object"
+	"codesfer/pkg/ratelimit"
+	"codesfer/pkg/realip"
+	"context"
+	"crypto/rand"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
-var objectStorage object.ObjectStorage
+// Accounts answers questions about users and organizations, the auth service implements it.
+type Accounts interface {
+	// OrgRole returns the role of username in the organization org, "" if they
+	// are not a member. isOrg is false if org is not an organization.
+	OrgRole(org, username string) (role string, isOrg bool, err error)
+	// UserExists reports whether username belongs to a user, not an organization.
+	UserExists(username string) (bool, error)
+}
 
-func StorageHandler(driver, source string, objStorage object.ObjectStorage) http.Handler {
-	// Setup indexdb
-	err := connect(driver, source)
-	if err != nil {
-		panic(err)
-	}
+// Config holds the settings and collaborators of the storage service.
+type Config struct {
+	// Direct enables presigned direct-to-storage transfers.
+	Direct DirectConfig
+	// Limiter locks password protected snippets after wrong passwords, nil disables it.
+	Limiter *ratelimit.Limiter
+	// Accounts lets members push to and pull from organization namespaces and
+	// snippets be shared with users, nil disables both.
+	Accounts Accounts
+	// LinkSecret signs share links, a random one is used if empty.
+	LinkSecret []byte
+	// Anonymous allows uploads without an account.
+	Anonymous AnonConfig
+	// Quotas bounds the storage of each namespace.
+	Quotas QuotaConfig
+}
+
+// Service owns the index database and object storage and serves the /storage routes.
+type Service struct {
+	db         *sql.DB
+	objects    object.ObjectStorage
+	presigner  object.Presigner // nil when direct transfers are disabled
+	blobSigner *signer          // non-nil when /storage/blob emulates presigned URLs
+	directTTL  time.Duration
+	limiter    *ratelimit.Limiter
+	accounts   Accounts
+	linkSecret []byte
+	anon       AnonConfig
+	quotas     QuotaConfig
+	handler    http.Handler
+}
+
+const maxUploadSize = 500 << 20 // 500 MB
+
+// completeGrace is how long after its upload URL expires a direct upload may still
+// be completed, a PUT started just in time can take a while to finish
+const completeGrace = time.Hour
+
+// formSlack leaves room for the other fields of an upload form
+const formSlack = 64 << 10
 
-	// Setup object storage
-	objectStorage = objStorage
+// passwordLockout locks a snippet out of downloads after repeated wrong passwords
+var passwordLockout = ratelimit.Lockout{Threshold: 5, Base: 30 * time.Second, Max: 15 * time.Minute}
+
+// New prepares the index table in db and builds the routes on top of objects.
+func New(db *sql.DB, objects object.ObjectStorage, cfg Config) (*Service, error) {
+	s := &Service{db: db, objects: objects, limiter: cfg.Limiter, accounts: cfg.Accounts, linkSecret: cfg.LinkSecret, anon: cfg.Anonymous, quotas: cfg.Quotas}
+	direct := cfg.Direct
+	if s.anon.TTL <= 0 {
+		s.anon.TTL = DefaultAnonTTL
+	}
+	if s.anon.MaxSize <= 0 {
+		s.anon.MaxSize = DefaultAnonMaxSize
+	}
+	if len(s.linkSecret) == 0 {
+		s.linkSecret = make([]byte, 32)
+		if _, err := rand.Read(s.linkSecret); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.createTable(); err != nil {
+		return nil, err
+	}
 
 	storageHandler := http.NewServeMux()
+
+	// Setup direct transfers, prefer the backend's own presigned URLs, also behind a cache or mirror
+	if direct.Enabled {
+		s.directTTL = direct.TTL
+		if p, ok := object.AsPresigner(objects); ok {
+			s.presigner = p
+		} else {
+			s.blobSigner = &signer{secret: direct.Secret}
+			s.presigner = s.blobSigner
+			storageHandler.HandleFunc("GET /blob", s.blobGet)
+			storageHandler.HandleFunc("PUT /blob", s.blobPut)
+		}
+	}
+
 	storageHandler.HandleFunc("POST /upload", func(w http.ResponseWriter, r *http.Request) {
-		if username := r.Header.Get("X-Username"); username != "" {
-			upload(w, r, username)
+		if !hasScope(w, r, api.ScopePush) {
 			return
 		}
-		http.Error(w, "unauthorized, only authorized users can upload", http.StatusUnauthorized)
+		if username := identity.Username(r); username != "" {
+			s.upload(w, r, username)
+			return
+		}
+		if s.admitAnonymous(w, r) {
+			s.upload(w, r, "")
+		}
+	})
+	storageHandler.HandleFunc("POST /upload/complete", func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(w, r, api.ScopePush) {
+			return
+		}
+		if username := identity.Username(r); username != "" {
+			s.completeUpload(w, r, username)
+			return
+		}
+		http.Error(w, "unauthorized, only authorized users can upload directly", http.StatusUnauthorized)
+	})
+	storageHandler.HandleFunc("GET /download", func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(w, r, api.ScopePull) {
+			return
+		}
+		s.download(w, r)
 	})
-	storageHandler.HandleFunc("GET /download", download)
 	storageHandler.HandleFunc("GET /list", func(w http.ResponseWriter, r *http.Request) {
-		if username := r.Header.Get("X-Username"); username != "" {
-			list(w, r)
+		if !hasScope(w, r, api.ScopeList) {
+			return
+		}
+		if username := identity.Username(r); username != "" {
+			s.list(w, r)
 			return
 		}
 		http.Error(w, "unauthorized, only authorized users can list", http.StatusUnauthorized)
 	})
 	storageHandler.HandleFunc("DELETE /remove", func(w http.ResponseWriter, r *http.Request) {
-		if username := r.Header.Get("X-Username"); username != "" {
+		if !hasScope(w, r, api.ScopeRemove) {
+			return
+		}
+		if username := identity.Username(r); username != "" {
 			log.Printf("[/storage/remove] user %s is trying to remove objects, including key %s", username, r.URL.Query()["key"])
-			remove(w, r, username, r.URL.Query()["key"])
+			s.remove(w, r, username, r.URL.Query()["key"])
 			return
 		}
 		http.Error(w, "unauthorized, only authorized users can remove", http.StatusUnauthorized)
 	})
-	return storageHandler
+	storageHandler.HandleFunc("POST /move", func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(w, r, api.ScopeMove) {
+			return
+		}
+		if username := identity.Username(r); username != "" {
+			s.move(w, r, username)
+			return
+		}
+		http.Error(w, "unauthorized, only authorized users can move", http.StatusUnauthorized)
+	})
+	storageHandler.HandleFunc("POST /share", func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(w, r, api.ScopePush) {
+			return
+		}
+		if username := identity.Username(r); username != "" {
+			s.shareRoute(w, r, username)
+			return
+		}
+		http.Error(w, "unauthorized, only authorized users can share", http.StatusUnauthorized)
+	})
+	storageHandler.HandleFunc("POST /chmod", func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(w, r, api.ScopePush) {
+			return
+		}
+		if username := identity.Username(r); username != "" {
+			s.chmod(w, r, username)
+			return
+		}
+		http.Error(w, "unauthorized, only authorized users can change visibility", http.StatusUnauthorized)
+	})
+	storageHandler.HandleFunc("POST /link", func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(w, r, api.ScopePush) {
+			return
+		}
+		if username := identity.Username(r); username != "" {
+			s.linkRoute(w, r, username)
+			return
+		}
+		http.Error(w, "unauthorized, only authorized users can create links", http.StatusUnauthorized)
+	})
+	storageHandler.HandleFunc("POST /link/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(w, r, api.ScopePush) {
+			return
+		}
+		if username := identity.Username(r); username != "" {
+			s.revokeLinksRoute(w, r, username)
+			return
+		}
+		http.Error(w, "unauthorized, only authorized users can revoke links", http.StatusUnauthorized)
+	})
+	storageHandler.HandleFunc("GET /profile/{username}", func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(w, r, api.ScopeList) {
+			return
+		}
+		s.profile(w, r)
+	})
+	storageHandler.HandleFunc("GET /usage", func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(w, r, api.ScopeList) {
+			return
+		}
+		if username := identity.Username(r); username != "" {
+			s.usageRoute(w, r, username)
+			return
+		}
+		http.Error(w, "unauthorized, only authorized users have a quota", http.StatusUnauthorized)
+	})
+	storageHandler.HandleFunc("GET /inbox", func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(w, r, api.ScopeList) {
+			return
+		}
+		if username := identity.Username(r); username != "" {
+			s.inboxRoute(w, r, username)
+			return
+		}
+		http.Error(w, "unauthorized, only authorized users have an inbox", http.StatusUnauthorized)
+	})
+	storageHandler.HandleFunc("POST /inbox/read", func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(w, r, api.ScopeList) {
+			return
+		}
+		if username := identity.Username(r); username != "" {
+			s.inboxReadRoute(w, r, username)
+			return
+		}
+		http.Error(w, "unauthorized, only authorized users have an inbox", http.StatusUnauthorized)
+	})
+	s.handler = storageHandler
+	return s, nil
+}
+
+// ServeHTTP serves the /storage routes, with the /storage prefix already stripped.
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
 }
 
-func list(w http.ResponseWriter, r *http.Request) {
-	username := r.Header.Get("X-Username")
+// hasScope rejects the request with 403 if its credential was not granted scope.
+// Anonymous requests pass.
+func hasScope(w http.ResponseWriter, r *http.Request, scope string) bool {
+	if p := identity.FromRequest(r); p == nil || p.HasScope(scope) {
+		return true
+	}
+	http.Error(w, "forbidden, token lacks the "+scope+" scope", http.StatusForbidden)
+	return false
+}
+
+func (s *Service) list(w http.ResponseWriter, r *http.Request) {
+	username := identity.Username(r)
 	if username == "" {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
-	log.Printf("[/storage/list] user %s is trying to list objects", username)
-	objs, err := show(username)
+	namespace := username
+	if org := r.URL.Query().Get("org"); org != "" {
+		if !s.requireRole(w, org, username, api.Roles...) {
+			return
+		}
+		namespace = org
+	}
+	log.Printf("[/storage/list] user %s is trying to list objects of %s", username, namespace)
+	objs, err := s.show(namespace)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	response := api.ListResponse{}
 	for _, obj := range objs {
+		to, err := s.recipients(obj.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		response = append(response, api.SingleObject{
-			Key:       obj.ID,
-			Password:  obj.Password,
-			Path:      obj.Path,
-			CreatedAt: obj.CreatedAt,
+			Key:        obj.ID,
+			Password:   obj.Password,
+			Path:       obj.Path,
+			CreatedAt:  obj.CreatedAt,
+			To:         to,
+			Visibility: obj.Visibility,
+			Size:       obj.Size,
 		})
 	}
 	w.WriteHeader(http.StatusOK)
@@ -79,34 +306,120 @@ func list(w http.ResponseWriter, r *http.Request) {
 }
 
 // upload compressed file to R2 and return uid; path: username/<dir>/filename
+// An empty username uploads anonymously to anon/<dir>/filename, unlisted and expiring, without key, org, to or direct
 // file: multipart/form-data
 // key: optional
 // path: optional
 // password: optional
-func upload(w http.ResponseWriter, r *http.Request, username string) {
-	// Max upload size: 500 MB
-	if err := r.ParseMultipartForm(500 << 20); err != nil {
-		http.Error(w, "failed to parse form: "+err.Error(), http.StatusBadRequest)
+// org: optional, push to org/<dir>/filename, needs the writer or owner role
+// to: optional, comma separated usernames to share the snippet with
+// visibility: optional, private (default), unlisted or public
+// direct: optional, "true" to receive a presigned upload_url instead of sending file
+// size: required with direct
+func (s *Service) upload(w http.ResponseWriter, r *http.Request, username string) {
+	if r.ContentLength > maxUploadSize+formSlack {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
 		return
 	}
-
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "missing file: "+err.Error(), http.StatusBadRequest)
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+formSlack)
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "failed to parse form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
 	key := r.FormValue("key")
 	path := r.FormValue("path")
 	password := r.FormValue("password")
-	if path == "" || path == "." || path == "/" { // path gaurd
-		path = header.Filename
+	direct := r.FormValue("direct") == "true"
+	visibility := r.FormValue("visibility")
+
+	// Anonymous snippets live in the anon namespace for a short while and are
+	// only found by their code. Snippets of an organization live in its namespace.
+	owner := username
+	var expiresAt int64
+	if username == "" {
+		if key != "" || r.FormValue("org") != "" || len(r.Form["to"]) > 0 || (visibility != "" && visibility != api.VisibilityUnlisted) {
+			http.Error(w, "anonymous uploads cannot set a key, org, recipients or visibility", http.StatusBadRequest)
+			return
+		}
+		if direct {
+			http.Error(w, "direct transfer disabled for anonymous uploads", http.StatusNotImplemented)
+			return
+		}
+		owner = anonNamespace
+		visibility = api.VisibilityUnlisted
+		expiresAt = time.Now().Add(s.anon.TTL).Unix()
+	} else if org := r.FormValue("org"); org != "" {
+		if !s.requireRole(w, org, username, api.RoleOwner, api.RoleWriter) {
+			return
+		}
+		owner = org
+	}
+	if visibility == "" {
+		visibility = api.VisibilityPrivate
+	}
+	if !slices.Contains(api.Visibilities, visibility) {
+		http.Error(w, "unknown visibility: "+visibility, http.StatusBadRequest)
+		return
+	}
+	to, ok := s.parseRecipients(w, username, r.Form["to"])
+	if !ok {
+		return
 	}
-	log.Printf("[/storage/upload] user %s is trying to upload file with key: %s; path: %s; password: %s", username, key, path, password)
+
+	var (
+		file   multipart.File
+		header *multipart.FileHeader
+		size   int64
+		err    error
+	)
+	if direct {
+		if s.presigner == nil {
+			http.Error(w, "direct transfer disabled", http.StatusNotImplemented)
+			return
+		}
+		size, err = strconv.ParseInt(r.FormValue("size"), 10, 64)
+		if err != nil || size < 0 {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+		if size > maxUploadSize {
+			http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if path == "" || path == "." || path == "/" { // path gaurd
+			http.Error(w, "path is required for direct uploads", http.StatusBadRequest)
+			return
+		}
+	} else {
+		file, header, err = r.FormFile("file")
+		if err != nil {
+			http.Error(w, "missing file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		size = header.Size
+		if size > maxUploadSize {
+			http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if username == "" && header.Size > s.anon.MaxSize {
+			http.Error(w, fmt.Sprintf("file too large, anonymous uploads are limited to %d bytes", s.anon.MaxSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if path == "" || path == "." || path == "/" { // path gaurd
+			path = header.Filename
+		}
+	}
+	log.Printf("[/storage/upload] user %s is trying to upload file to %s with key: %s; path: %s; password: %s; visibility: %s; direct: %t", username, owner, key, path, password, visibility, direct)
 
 	// Make sure unique filename per user
-	files, err := getFiles(username)
+	files, err := s.getFiles(owner)
 	if err != nil {
 		http.Error(w, "failed to get existing files: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -114,7 +427,7 @@ func upload(w http.ResponseWriter, r *http.Request, username string) {
 
 	// Auto rename file if conflict by adding _1, _2, ...
 	idx := 1
-	haveFile, err := haveFile(username, path)
+	haveFile, err := s.haveFile(owner, path)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -138,22 +451,161 @@ func upload(w http.ResponseWriter, r *http.Request, username string) {
 	}
 	// Rename complete
 
-	uid, err := opupload(r.Context(), file, header.Size, key, username, password, path)
+	obj := &Object{
+		ID:         key,
+		Username:   owner,
+		Filename:   path,
+		Password:   password,
+		Visibility: visibility,
+		ExpiresAt:  expiresAt,
+		Size:       size,
+	}
+	if direct {
+		s.uploadDirect(w, r, obj, to)
+		return
+	}
+
+	if err := s.opupload(r.Context(), file, obj); err != nil {
+		if errors.Is(err, errQuotaExceeded) {
+			s.quotaError(w, owner, obj.Size)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	uid := obj.ID
+	if err := s.shareUploaded(r, owner, username, uid, to); err != nil {
+		http.Error(w, "failed to share: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := api.UploadResponse{
+		Uid:        uid,
+		Path:       path,
+		Visibility: visibility,
+	}
+	if expiresAt > 0 {
+		response.ExpiresAt = time.Unix(expiresAt, 0).Format(time.RFC3339)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// uploadDirect reserves the index record and hands out a presigned URL the client PUTs
+// the archive to. The record stays pending, hidden and unshared, until the client
+// completes the upload; Sweep drops reservations that are never completed.
+func (s *Service) uploadDirect(w http.ResponseWriter, r *http.Request, obj *Object, to []string) {
+	obj.PendingUntil = time.Now().Add(s.directTTL + completeGrace).Unix()
+	obj.PendingTo = to
+	if err := s.opreserve(obj); err != nil {
+		if errors.Is(err, errQuotaExceeded) {
+			s.quotaError(w, obj.Username, obj.Size)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	uid, username, objectPath := obj.ID, obj.Username, obj.Path
+
+	url, err := s.presigner.PresignPut(r.Context(), objectPath, obj.Size, s.directTTL)
 	if err != nil {
+		if _, rerr := s.removeByID(username, uid); rerr != nil {
+			log.Printf("  failed to release reserved key %s: %v", uid, rerr)
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("  key: %s, path: %s; presigned upload url issued", uid, objectPath)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(api.UploadResponse{
-		Uid:  uid,
-		Path: path,
+		Uid:        uid,
+		Path:       obj.Filename,
+		Visibility: obj.Visibility,
+		UploadURL:  url,
+	})
+}
+
+// completeUpload confirms that the archive of a direct upload reached object storage,
+// after which the snippet can be pulled and is shared with its recipients
+// body: api.UploadCompleteRequest, key must be the uid of a pending upload the user can write to
+func (s *Service) completeUpload(w http.ResponseWriter, r *http.Request, username string) {
+	var data api.UploadCompleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/storage/upload/complete] user %s is completing the upload of %s", username, data.Key)
+
+	obj, err := s.get(data.Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if obj == nil || obj.PendingUntil == 0 {
+		http.Error(w, "pending upload not found", http.StatusNotFound)
+		return
+	}
+	if ok, err := s.canWrite(obj, username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "pending upload not found", http.StatusNotFound)
+		return
+	}
+
+	meta, err := s.objects.Stat(r.Context(), obj.Path)
+	if errors.Is(err, object.ErrNotFound) {
+		http.Error(w, "archive not uploaded yet", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The quota was checked against the declared size, not every backend enforces it on the PUT
+	if meta.Size > obj.Size {
+		log.Printf("  %s is %d bytes, %d were declared", obj.Path, meta.Size, obj.Size)
+		if err := s.opremove(r.Context(), obj.Path); err != nil {
+			log.Printf("  failed to delete %s: %v", obj.Path, err)
+		}
+		if _, err := s.removeByID(obj.Username, obj.ID); err != nil {
+			log.Printf("  failed to release reserved key %s: %v", obj.ID, err)
+		}
+		http.Error(w, "file larger than declared", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// A mirror copies the archive to its secondaries, it bypassed the mirror on the way in
+	if syncer, ok := s.objects.(object.Syncer); ok {
+		if err := syncer.Sync(r.Context(), obj.Path); err != nil {
+			log.Printf("  failed to sync %s: %v", obj.Path, err)
+		}
+	}
+	if ok, err := s.complete(obj.ID, meta.Size); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "pending upload not found", http.StatusNotFound)
+		return
+	}
+	if err := s.shareUploaded(r, obj.Username, username, obj.ID, obj.PendingTo); err != nil {
+		http.Error(w, "failed to share: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("  key: %s, path: %s; direct upload completed", obj.ID, obj.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.UploadResponse{
+		Uid:        obj.ID,
+		Path:       obj.Filename,
+		Visibility: obj.Visibility,
 	})
 }
 
 // download will return the archived file to user according to the key
 // key: <uid> || <username>/<uid> || <username>/<path>
-func download(w http.ResponseWriter, r *http.Request) {
+// sig: optional, with exp, v and max a share link that grants access without an account
+// direct: optional, "true" to be redirected to a presigned URL when enabled
+func (s *Service) download(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 	pwd := r.URL.Query().Get("password")
 	// If contains multiple slashes, it must be username/path/path
@@ -172,19 +624,20 @@ func download(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	log.Printf("[/storage/download] user %s is trying to download object, key: %s", r.Header.Get("X-Username"), key)
+	ip, _ := realip.FromRequest(r)
+	log.Printf("[/storage/download] user %s is trying to download object from %s, key: %s", identity.Username(r), ip, key)
 	log.Printf("  uid: %s, username: %s, path: %s", uid, username, path)
 
 	var obj *Object
 	var err error
-	if obj, err = get(uid); obj != nil || err != nil {
+	if obj, err = s.get(uid); obj != nil || err != nil {
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		log.Printf("  Object found by uid: %s", obj.ID)
 	} else {
-		obj, err = getByUsernamePath(username, path)
+		obj, err = s.getByUsernamePath(username, path)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -197,20 +650,128 @@ func download(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if obj.expired(time.Now()) {
+		log.Printf("  %s expired, waiting to be swept", obj.ID)
+		http.Error(w, "object not found", http.StatusNotFound)
+		return
+	}
+	if obj.PendingUntil > 0 {
+		log.Printf("  %s is a direct upload that was not completed", obj.ID)
+		http.Error(w, "object not found", http.StatusNotFound)
+		return
+	}
 
-	if obj.Password != "" && pwd != obj.Password {
-		log.Printf("Invalid password, returning StatusUnauthorized %d", http.StatusUnauthorized)
-		http.Error(w, "invalid password", http.StatusUnauthorized)
+	// Private snippets are only visible to their namespace and the users they are
+	// shared with, a share link stands in for an account that may read the snippet
+	var shareLink *link
+	if r.URL.Query().Has("sig") {
+		if shareLink, err = s.verifyLink(obj, r.URL.Query()); err != nil {
+			log.Printf("  rejected link to %s: %v", obj.ID, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	} else if ok, err := s.canRead(obj, identity.Username(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		log.Printf("  %s may not read %s", identity.Username(r), obj.ID)
+		http.Error(w, "object not found", http.StatusNotFound)
 		return
 	}
 
+	if obj.Password != "" {
+		// A locked snippet refuses the right password too, or guessing would go on
+		wait, err := s.limiter.Locked(r.Context(), "snippet:"+obj.ID)
+		if err != nil {
+			log.Printf("  failed to check the lockout of %s: %v", obj.ID, err)
+		}
+		if wait > 0 {
+			log.Printf("  snippet %s is locked for %s after wrong passwords", obj.ID, wait)
+			ratelimit.TooManyRequests(w, wait)
+			return
+		}
+		if pwd != obj.Password {
+			if _, err := s.limiter.Fail(r.Context(), "snippet:"+obj.ID, passwordLockout); err != nil {
+				log.Printf("  failed to record the wrong password for %s: %v", obj.ID, err)
+			}
+			log.Printf("Invalid password, returning StatusUnauthorized %d", http.StatusUnauthorized)
+			http.Error(w, "invalid password", http.StatusUnauthorized)
+			return
+		}
+		if err := s.limiter.Reset(r.Context(), "snippet:"+obj.ID); err != nil {
+			log.Printf("  failed to reset the lockout of %s: %v", obj.ID, err)
+		}
+	}
+
+	if shareLink != nil {
+		if ok, err := s.useLink(obj.ID, shareLink); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			log.Printf("  link to %s used up", obj.ID)
+			http.Error(w, "link download limit reached", http.StatusGone)
+			return
+		}
+	}
+
 	log.Printf("  resp: username: %s, filename: %s, path: %s, uid: %s", obj.Username, obj.Filename, obj.Path, obj.ID)
+	if username := identity.Username(r); username != "" {
+		if _, err := s.markRead(username, []string{obj.ID}); err != nil {
+			log.Printf("  failed to mark %s read: %v", obj.ID, err)
+		}
+	}
+
+	if r.URL.Query().Get("direct") == "true" && s.presigner != nil {
+		url, err := s.presigner.PresignGet(r.Context(), obj.Path, s.directTTL)
+		if err == nil {
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			return
+		}
+		log.Printf("  presign failed, falling back to proxy: %v", err)
+	}
 
-	// ============================
-	// Download from Object Storage
-	// ============================
+	s.serveObject(w, r, obj.Path)
+}
 
-	meta, body, err := objectStorage.Get(r.Context(), obj.Path, nil)
+// blobGet streams an object for a URL issued by blobSigner
+func (s *Service) blobGet(w http.ResponseWriter, r *http.Request) {
+	key, err := s.blobSigner.verify("GET", r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	s.serveObject(w, r, key)
+}
+
+// blobPut stores the request body for a URL issued by blobSigner
+func (s *Service) blobPut(w http.ResponseWriter, r *http.Request) {
+	key, err := s.blobSigner.verify("PUT", r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// The quota was checked against the size declared when the upload was reserved
+	size, err := s.sizeOf(key)
+	if err != nil {
+		http.Error(w, "object not found: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	if r.ContentLength > size {
+		http.Error(w, "file larger than declared", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, size)
+	if err := s.opput(r.Context(), key, body, r.ContentLength); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveObject streams the object at path in object storage as an attachment
+func (s *Service) serveObject(w http.ResponseWriter, r *http.Request, path string) {
+	meta, body, err := s.objects.Get(r.Context(), path, nil)
 	if err != nil {
 		status := http.StatusInternalServerError
 		if errors.Is(err, object.ErrNotFound) {
@@ -221,7 +782,7 @@ func download(w http.ResponseWriter, r *http.Request) {
 	}
 	defer body.Close()
 
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", sanitizeFilename(obj.Path)))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", sanitizeFilename(path)))
 	if meta.ContentType != "" {
 		w.Header().Set("Content-Type", meta.ContentType)
 	} else {
@@ -236,12 +797,19 @@ func download(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func remove(w http.ResponseWriter, r *http.Request, username string, keys []string) {
+func (s *Service) remove(w http.ResponseWriter, r *http.Request, username string, keys []string) {
 	log.Printf("[/storage/remove] user %s is trying to remove objects, including key %s", username, keys)
 	resp := api.RemoveResponse{Results: make(map[string]string)}
 	for _, key := range keys {
+		// Writers and owners of an organization remove its snippets too
+		owner, err := s.writableOwner(key, username)
+		if err != nil {
+			resp.Results[key] = "error looking up the owner: " + err.Error()
+			continue
+		}
+
 		// First, remove from indexdb
-		path, err := removeByID(username, key)
+		path, err := s.removeByID(owner, key)
 		if err != nil {
 			resp.Results[key] = "error removing from indexdb: " + err.Error()
 			log.Printf("  key: %s, path: %s; error removing from indexdb: %v", key, path, err)
@@ -251,7 +819,7 @@ func remove(w http.ResponseWriter, r *http.Request, username string, keys []stri
 		}
 
 		// Then, remove from object storage
-		err = opremove(r.Context(), path)
+		err = s.opremove(r.Context(), path)
 		if err != nil {
 			resp.Results[key] = "error removing from object storage: " + err.Error()
 			log.Printf("  key: %s, path: %s; error removing from object storage: %v", key, path, err)
@@ -266,3 +834,76 @@ func remove(w http.ResponseWriter, r *http.Request, username string, keys []stri
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
+
+// move renames a snippet to a new path without re-uploading its content
+// body: api.MoveRequest, key must be the uid of an object owned by the user or
+// by an organization they can write to
+func (s *Service) move(w http.ResponseWriter, r *http.Request, username string) {
+	var data api.MoveRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path := strings.Trim(data.Path, "/")
+	if data.Key == "" || path == "" || path == "." { // path gaurd
+		http.Error(w, "key and path are required", http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/storage/move] user %s is trying to move object %s to path %s", username, data.Key, path)
+
+	obj, ok := s.writableObject(w, data.Key, username)
+	if !ok {
+		return
+	}
+
+	if obj.Filename != path {
+		taken, err := s.haveFile(obj.Username, path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, "path already in use: "+path, http.StatusConflict)
+			return
+		}
+
+		if err := s.opmove(r.Context(), obj, path); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, object.ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		log.Printf("  key: %s, path: %s -> %s; moved", obj.ID, obj.Filename, path)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.MoveResponse{
+		Uid:  obj.ID,
+		Path: path,
+	})
+}
+
+// DeleteUser removes every object of username from object storage and the index.
+// Objects are removed one by one, so a failure leaves the remaining ones listed and a retry picks them up.
+func (s *Service) DeleteUser(ctx context.Context, username string) error {
+	objs, err := s.namespace(username)
+	if err != nil {
+		return err
+	}
+	log.Printf("[DeleteUser] removing %d object(s) of user %s", len(objs), username)
+	for _, obj := range objs {
+		if err := s.objects.Delete(ctx, obj.Path); err != nil && !errors.Is(err, object.ErrNotFound) {
+			return fmt.Errorf("delete %s: %w", obj.Path, err)
+		}
+		if _, err := s.removeByID(username, obj.ID); err != nil {
+			return fmt.Errorf("remove %s from index: %w", obj.ID, err)
+		}
+	}
+	// Snippets others shared with the user stay with their owners
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM shares WHERE username = ?", username); err != nil {
+		return fmt.Errorf("remove shares: %w", err)
+	}
+	return nil
+}
@@ -27,49 +27,96 @@ func objPath(username, path string) string {
 	return fmt.Sprintf("%s/%s", username, strings.Trim(path, "/"))
 }
 
-// opupload will upload a file to object storage cloud and insert a record to database
-func opupload(ctx context.Context, file io.Reader, size int64, key, username, password, path string) (string, error) {
-	const multipartThreshold = 100 << 20 // 100 MB
-
-	if key == "" {
+// opreserve inserts the index record for a new object within the quota of its
+// namespace. obj.ID is generated if empty, obj.Path is set to the path in object storage.
+func (s *Service) opreserve(obj *Object) error {
+	if obj.ID == "" {
 		uid, err := generateID(4)
 		if err != nil {
-			return "", errors.New("[op upload] [generate uid] generate uid failed: " + err.Error())
+			return errors.New("[op upload] [generate uid] generate uid failed: " + err.Error())
 		}
-		key = uid
+		obj.ID = uid
 	}
 
-	objectPath := objPath(username, path)
+	obj.Path = objPath(obj.Username, obj.Filename)
 
-	err := insert(key, username, path, password, objectPath)
+	quota, err := s.quota(obj.Username)
+	if err != nil {
+		return errors.New("[op upload] [quota] quota lookup failed: " + err.Error())
+	}
+	err = s.insert(obj, quota)
+	if errors.Is(err, errQuotaExceeded) {
+		return err
+	}
 	if err != nil {
-		return "", errors.New("[op upload] [insert] insert failed: " + err.Error())
+		return errors.New("[op upload] [insert] insert failed: " + err.Error())
+	}
+	return nil
+}
+
+// opupload will upload a file to object storage cloud and insert a record to database
+func (s *Service) opupload(ctx context.Context, file io.Reader, obj *Object) error {
+	if err := s.opreserve(obj); err != nil {
+		return err
 	}
 
 	// Only upload after insert is successfull
+	if err := s.opput(ctx, obj.Path, file, obj.Size); err != nil {
+		if _, rerr := s.removeByID(obj.Username, obj.ID); rerr != nil {
+			log.Printf("[op upload] [rollback] failed to release key %s: %v", obj.ID, rerr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// opput writes the content to object storage, streaming via multipart for large files
+func (s *Service) opput(ctx context.Context, objectPath string, file io.Reader, size int64) error {
+	const multipartThreshold = 100 << 20 // 100 MB
+
 	if size > multipartThreshold {
 		log.Print("Stream via multipart")
-		if _, err := objectStorage.MultipartPut(ctx, objectPath, file, 8<<20, nil); err != nil {
-			return "", errors.New("[op upload] [multipart] multipart upload failed: " + err.Error())
+		if _, err := s.objects.MultipartPut(ctx, objectPath, file, 8<<20, nil); err != nil {
+			return errors.New("[op upload] [multipart] multipart upload failed: " + err.Error())
 		}
 	} else {
 		log.Print("Single PutObject")
-		if _, err := objectStorage.Put(ctx, objectPath, file, -1, "", nil); err != nil {
-			return "", errors.New("[op upload] [single putobject] upload failed: " + err.Error())
+		if _, err := s.objects.Put(ctx, objectPath, file, -1, "", nil); err != nil {
+			return errors.New("[op upload] [single putobject] upload failed: " + err.Error())
 		}
 	}
-
-	return key, nil
+	return nil
 }
 
-func opremove(ctx context.Context, path string) error {
-	err := objectStorage.Delete(ctx, path)
+func (s *Service) opremove(ctx context.Context, path string) error {
+	err := s.objects.Delete(ctx, path)
 	if err != nil {
 		return errors.New("[op remove] [delete] delete failed: " + err.Error())
 	}
 	return nil
 }
 
+// opmove renames an object in object storage and keeps its index record in sync
+func (s *Service) opmove(ctx context.Context, obj *Object, filename string) error {
+	objectPath := objPath(obj.Username, filename)
+
+	err := s.rename(obj.Username, obj.ID, filename, objectPath)
+	if err != nil {
+		return errors.New("[op move] [rename] rename failed: " + err.Error())
+	}
+
+	// Only move after the index accepted the new path
+	if _, err := s.objects.Move(ctx, obj.Path, objectPath); err != nil {
+		if rerr := s.rename(obj.Username, obj.ID, obj.Filename, obj.Path); rerr != nil {
+			log.Printf("[op move] [rollback] failed to restore index for %s: %v", obj.ID, rerr)
+		}
+		return fmt.Errorf("[op move] [move] move failed: %w", err)
+	}
+
+	return nil
+}
+
 // sanitizeFilename extracts the base filename (safe for headers).
 func sanitizeFilename(path string) string {
 	parts := strings.Split(path, "/")
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"codesfer/pkg/api"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// canRead reports whether username, "" for anonymous requests, may download obj.
+// Members of its namespace always may, anyone else if it is not private or it
+// was shared with them.
+func (s *Service) canRead(obj *Object, username string) (bool, error) {
+	role, _, err := s.access(obj.Username, username)
+	if err != nil || role != "" {
+		return role != "", err
+	}
+	if obj.Visibility != api.VisibilityPrivate {
+		return true, nil
+	}
+	if username == "" {
+		return false, nil
+	}
+	recipients, err := s.recipients(obj.ID)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(recipients, username), nil
+}
+
+// chmod changes the visibility of a snippet
+// body: api.ChmodRequest, key must be the uid of an object the user can write to
+func (s *Service) chmod(w http.ResponseWriter, r *http.Request, username string) {
+	var data api.ChmodRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(api.Visibilities, data.Visibility) {
+		http.Error(w, "unknown visibility: "+data.Visibility, http.StatusBadRequest)
+		return
+	}
+	log.Printf("[/storage/chmod] user %s is trying to make object %s %s", username, data.Key, data.Visibility)
+
+	obj, ok := s.writableObject(w, data.Key, username)
+	if !ok {
+		return
+	}
+
+	if err := s.setVisibility(obj.ID, data.Visibility); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.ChmodResponse{Uid: obj.ID, Visibility: data.Visibility})
+}
+
+// profile lists the public snippets of a user or organization to anyone.
+// Passwords are left out, protected snippets still need theirs to be pulled.
+func (s *Service) profile(w http.ResponseWriter, r *http.Request) {
+	namespace := r.PathValue("username")
+	log.Printf("[/storage/profile] listing public objects of %s", namespace)
+	objs, err := s.showPublic(namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := api.ListResponse{}
+	for _, obj := range objs {
+		response = append(response, api.SingleObject{
+			Key:        obj.ID,
+			Path:       obj.Path,
+			CreatedAt:  obj.CreatedAt,
+			Visibility: obj.Visibility,
+			Protected:  obj.Password != "",
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -2,6 +2,7 @@ package api
 
 // Endpoint: /auth/me
 type AccountSession struct {
+	ID        string `json:"id"` // Public identifier, used to revoke the session
 	Location  string `json:"location"`
 	Agent     string `json:"agent"`
 	LastSeen  string `json:"last_seen"`
@@ -9,9 +10,11 @@ type AccountSession struct {
 	Current   bool   `json:"current"`
 }
 type AccountResponse struct {
-	Email    string           `json:"email"`
-	Username string           `json:"username"`
-	Sessions []AccountSession `json:"sessions"`
+	Email     string           `json:"email"`
+	Username  string           `json:"username"`
+	Verified  bool             `json:"verified"`
+	TwoFactor bool             `json:"two_factor"`
+	Sessions  []AccountSession `json:"sessions"`
 }
 
 // Endpoint: /auth/register
@@ -22,23 +25,326 @@ type RegisterRequest struct {
 }
 type RegisterResponse string
 
+// Endpoint: /auth/login answers 202 with a challenge when two-factor authentication is enabled,
+// which /auth/login/2fa exchanges together with a code for a session
+type LoginChallenge struct {
+	Challenge string `json:"challenge"`
+}
+type TwoFactorLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"` // TOTP or recovery code
+}
+
+// Endpoint: /auth/sso/start creates a single sign-on login request. The user opens URL
+// in any browser, which shows UserCode, while the client polls /auth/sso/poll.
+type SSOStartResponse struct {
+	URL       string `json:"url"`
+	UserCode  string `json:"user_code"`
+	PollToken string `json:"poll_token"`
+	Interval  int    `json:"interval"`   // Seconds between polls
+	ExpiresIn int    `json:"expires_in"` // Seconds until the request expires
+}
+type SSOPollRequest struct {
+	PollToken string `json:"poll_token"`
+}
+
+// Endpoint: /auth/device/code starts a device login (RFC 8628). The device polls
+// /auth/device/token with DeviceCode while the user approves UserCode elsewhere.
+type DeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"` // Seconds until the codes expire
+	Interval                int    `json:"interval"`   // Minimum seconds between polls
+}
+type DeviceTokenRequest struct {
+	DeviceCode string `json:"device_code"`
+}
+
+// DeviceTokenError is the 400 body of /auth/device/token: authorization_pending,
+// slow_down, access_denied or expired_token
+type DeviceTokenError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// Endpoint: /auth/device/requests/{code} and /auth/device/approve
+type DeviceRequestInfo struct {
+	UserCode  string `json:"user_code"`
+	Agent     string `json:"agent"`
+	Location  string `json:"location"`
+	CreatedAt string `json:"created_at"`
+}
+type DeviceApproveRequest struct {
+	UserCode string `json:"user_code"`
+	Deny     bool   `json:"deny,omitempty"`
+}
+
+// Endpoint: /auth/login/ssh/challenge returns a challenge for the first registered key
+// among PublicKeys (authorized_keys lines); /auth/login/ssh exchanges its signature for a session
+type SSHChallengeRequest struct {
+	PublicKeys []string `json:"public_keys"`
+}
+type SSHChallengeResponse struct {
+	Challenge   string `json:"challenge"`
+	Fingerprint string `json:"fingerprint"` // Of the key to sign with
+}
+type SSHLoginRequest struct {
+	Challenge string `json:"challenge"`
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"` // Base64 of the SSH wire format signature over SSHLoginMessage
+}
+
+// SSHLoginMessage is the data signed to log in with an ssh key. host is the
+// server's host[:port] as the client addresses it.
+func SSHLoginMessage(host, challenge string) []byte {
+	return []byte("codesfer-ssh-login\x00" + host + "\x00" + challenge)
+}
+
+// Endpoint: /auth/ssh-keys
+type SSHKey struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint"`
+	Type        string `json:"type"`
+	CreatedAt   string `json:"created_at"`
+	LastUsed    string `json:"last_used,omitempty"`
+}
+type SSHKeyAddRequest struct {
+	PublicKey string `json:"public_key"`     // authorized_keys format, e.g. the contents of id_ed25519.pub
+	Name      string `json:"name,omitempty"` // Defaults to the key comment
+}
+type SSHKeyListResponse []SSHKey
+
+// Endpoint: /auth/2fa/enroll, /auth/2fa/enable and /auth/2fa/disable
+type TwoFactorEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth:// URI for authenticator apps
+}
+type TwoFactorRequest struct {
+	Code     string `json:"code"`
+	Password string `json:"password,omitempty"` // Required to disable
+}
+type TwoFactorEnableResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// Endpoint: /auth/passwd
+type PasswordChangeRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// Endpoint: /auth/reset/request and /auth/reset/confirm
+type ResetRequest struct {
+	Email string `json:"email"`
+}
+type ResetConfirmRequest struct {
+	Code        string `json:"code"`
+	NewPassword string `json:"new_password"`
+}
+
+// Endpoint: /auth/verify, /auth/verify/resend takes a ResetRequest
+type VerifyRequest struct {
+	Code string `json:"code"`
+}
+
+// Endpoint: DELETE /auth/account
+type AccountDeleteRequest struct {
+	Password string `json:"password"`
+}
+
 // Endpoint: /storage/list
 type SingleObject struct {
-	Key       string            `json:"key,omitempty"`
-	Path      string            `json:"path"`
-	Password  string            `json:"password,omitempty"`
-	CreatedAt string            `json:"created_at"`
-	Meta      map[string]string `json:"meta,omitempty"`
+	Key        string            `json:"key,omitempty"`
+	Path       string            `json:"path"`
+	Password   string            `json:"password,omitempty"`
+	CreatedAt  string            `json:"created_at"`
+	Meta       map[string]string `json:"meta,omitempty"`
+	To         []string          `json:"to,omitempty"` // Users the snippet is shared with
+	Visibility string            `json:"visibility,omitempty"`
+	Protected  bool              `json:"protected,omitempty"` // Needs a password, set where the password is not shown
+	Size       int64             `json:"size,omitempty"`      // Bytes
 }
 type ListResponse []SingleObject
 
 // Endpoint: /storage/upload
 type UploadResponse struct {
-	Uid  string `json:"uid"`
-	Path string `json:"path"`
+	Uid        string `json:"uid"`
+	Path       string `json:"path"`
+	Visibility string `json:"visibility"`
+	ExpiresAt  string `json:"expires_at,omitempty"` // Set for snippets that are deleted after a while
+	UploadURL  string `json:"upload_url,omitempty"` // Set for direct uploads, PUT the archive here
+}
+
+// Endpoint: /storage/upload/complete, after PUTting a direct upload to its UploadURL
+type UploadCompleteRequest struct {
+	Key string `json:"key"`
 }
 
 // Endpoint: /storage/remove
 type RemoveResponse struct {
 	Results map[string]string `json:"results"`
 }
+
+// Endpoint: /storage/share
+type ShareRequest struct {
+	Key string   `json:"key"`
+	To  []string `json:"to"` // Usernames
+}
+type ShareResponse struct {
+	Uid string   `json:"uid"`
+	To  []string `json:"to"` // Everyone the snippet is shared with
+}
+
+// Endpoint: /storage/inbox
+type InboxItem struct {
+	Key      string `json:"key"`
+	Path     string `json:"path"`
+	From     string `json:"from"`
+	SharedAt string `json:"shared_at"`
+	ReadAt   string `json:"read_at,omitempty"` // Empty until pulled or marked read
+}
+type InboxResponse []InboxItem
+
+// Endpoint: /storage/inbox/read
+type InboxReadRequest struct {
+	Keys []string `json:"keys,omitempty"` // Empty marks everything read
+}
+
+// Endpoint: /storage/move
+type MoveRequest struct {
+	Key  string `json:"key"`
+	Path string `json:"path"`
+}
+type MoveResponse struct {
+	Uid  string `json:"uid"`
+	Path string `json:"path"`
+}
+
+// Snippet visibilities. Private snippets are pulled by their owner, members of
+// their organization and the users they are shared with, unlisted ones by anyone
+// with the code, public ones are also listed on the owner's profile.
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
+// Visibilities lists every visibility a snippet can have
+var Visibilities = []string{VisibilityPrivate, VisibilityUnlisted, VisibilityPublic}
+
+// Endpoint: /storage/chmod
+type ChmodRequest struct {
+	Key        string `json:"key"`
+	Visibility string `json:"visibility"`
+}
+type ChmodResponse struct {
+	Uid        string `json:"uid"`
+	Visibility string `json:"visibility"`
+}
+
+// Endpoint: /storage/link
+type LinkRequest struct {
+	Key          string `json:"key"`
+	ExpiresIn    int64  `json:"expires_in"`              // Seconds
+	MaxDownloads int    `json:"max_downloads,omitempty"` // 0 for no limit
+}
+type LinkResponse struct {
+	URL          string `json:"url"` // Relative to the server
+	ExpiresAt    string `json:"expires_at"`
+	MaxDownloads int    `json:"max_downloads,omitempty"`
+	Protected    bool   `json:"protected,omitempty"` // The password is still needed to download
+}
+
+// Endpoint: /storage/link/revoke
+type LinkRevokeRequest struct {
+	Key string `json:"key"`
+}
+
+// Endpoint: /storage/usage
+type UsageResponse struct {
+	Namespace  string `json:"namespace"`
+	Bytes      int64  `json:"bytes"`
+	Objects    int64  `json:"objects"`
+	MaxBytes   int64  `json:"max_bytes,omitempty"`   // 0 for no limit
+	MaxObjects int64  `json:"max_objects,omitempty"` // 0 for no limit
+}
+
+// Access token scopes, a session carries all of them
+const (
+	ScopePush   = "push"
+	ScopePull   = "pull"
+	ScopeList   = "list"
+	ScopeRemove = "remove"
+	ScopeMove   = "move"
+)
+
+// Scopes lists every scope an access token can be granted
+var Scopes = []string{ScopePush, ScopePull, ScopeList, ScopeRemove, ScopeMove}
+
+// Endpoint: /auth/tokens
+type AccessToken struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt string   `json:"created_at"`
+	ExpiresAt string   `json:"expires_at,omitempty"` // Empty if the token never expires
+	LastUsed  string   `json:"last_used,omitempty"`
+	Token     string   `json:"token,omitempty"` // Only returned once, when the token is created
+}
+type TokenCreateRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int64    `json:"expires_in,omitempty"` // Seconds, 0 for a token that never expires
+}
+type TokenListResponse []AccessToken
+
+// Organization member roles. Owners manage members, writers push, move and
+// remove snippets, readers list and pull them.
+const (
+	RoleOwner  = "owner"
+	RoleWriter = "writer"
+	RoleReader = "reader"
+)
+
+// Roles lists every role an organization member can have
+var Roles = []string{RoleOwner, RoleWriter, RoleReader}
+
+// Endpoint: /auth/orgs
+type Org struct {
+	Name      string `json:"name"`
+	Role      string `json:"role"` // Role of the logged in user
+	CreatedAt string `json:"created_at"`
+}
+type OrgCreateRequest struct {
+	Name string `json:"name"`
+}
+type OrgListResponse []Org
+
+// Endpoint: /auth/orgs/{org}/members
+type OrgMember struct {
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	AddedBy   string `json:"added_by,omitempty"`
+	CreatedAt string `json:"created_at"`
+	Pending   bool   `json:"pending,omitempty"` // Invited, but not accepted yet
+}
+type OrgMemberRequest struct {
+	Role string `json:"role"`
+}
+type OrgMembersResponse []OrgMember
+
+// Endpoint: /auth/orgs/invites lists the invitations of the logged in user,
+// /auth/orgs/invites/{org} accepts or declines one
+type OrgInvite struct {
+	Org       string `json:"org"`
+	Role      string `json:"role"`
+	InvitedBy string `json:"invited_by"`
+	CreatedAt string `json:"created_at"`
+}
+type OrgInvitesResponse []OrgInvite
+type OrgInviteAnswer struct {
+	Decline bool `json:"decline,omitempty"`
+}
@@ -0,0 +1,397 @@
+// Package cache implements a read-through object.ObjectStorage decorator that
+// keeps hot objects on local disk, bounded by a least-recently-used size budget.
+package cache
+
+import (
+	"codesfer/pkg/object"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Config describes the cache and the backend it fronts.
+type Config struct {
+	// Backend is an initialized storage whose reads are cached.
+	Backend object.ObjectStorage
+	// Dir holds cached bodies; created if missing. Cache files left by previous runs are
+	// removed, other files are left alone.
+	Dir string
+	// MaxBytes bounds the total size of cached bodies. Larger objects are never cached.
+	MaxBytes int64
+}
+
+// Storage wraps another object.ObjectStorage. Every Get is validated against the
+// backend's ETag from Stat, so a stale body is never served; writes invalidate eagerly.
+type Storage struct {
+	backend  object.ObjectStorage
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used entry
+	size    int64
+}
+
+type entry struct {
+	key  string
+	file string
+	obj  object.Object
+}
+
+const (
+	bodySuffix = ".obj"
+	tempSuffix = ".tmp"
+)
+
+// Init validates the configuration and prepares the cache directory.
+func (s *Storage) Init(_ context.Context, param any) error {
+	cfg, ok := param.(Config)
+	if !ok {
+		if p, ok := param.(*Config); ok && p != nil {
+			cfg = *p
+		} else {
+			return fmt.Errorf("cache: unexpected config type %T", param)
+		}
+	}
+
+	if cfg.Backend == nil {
+		return errors.New("cache: Backend is required")
+	}
+	if cfg.Dir == "" {
+		return errors.New("cache: Dir is required")
+	}
+	if cfg.MaxBytes <= 0 {
+		return errors.New("cache: MaxBytes must be positive")
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return fmt.Errorf("cache: create dir: %w", err)
+	}
+	// The index lives in memory, so bodies from a previous run are unknown and dropped.
+	files, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("cache: read dir: %w", err)
+	}
+	// Only files named by fileName or Get are removed; anything else in Dir is not ours.
+	for _, f := range files {
+		if f.Type().IsRegular() && ownFile(f.Name()) {
+			_ = os.Remove(filepath.Join(cfg.Dir, f.Name()))
+		}
+	}
+
+	s.backend = cfg.Backend
+	s.dir = cfg.Dir
+	s.maxBytes = cfg.MaxBytes
+	s.entries = make(map[string]*list.Element)
+	s.lru = list.New()
+	s.size = 0
+	return nil
+}
+
+// Close closes the wrapped backend; cached bodies stay on disk until the next Init.
+func (s *Storage) Close(ctx context.Context) error {
+	if s.backend == nil {
+		return nil
+	}
+	return s.backend.Close(ctx)
+}
+
+// Get serves the body from disk when the cached ETag still matches the backend,
+// otherwise it streams from the backend and fills the cache as the caller reads.
+func (s *Storage) Get(ctx context.Context, key string, rng *object.Range) (object.Object, io.ReadCloser, error) {
+	if err := s.ensureBackend(); err != nil {
+		return object.Object{}, nil, err
+	}
+
+	current, err := s.backend.Stat(ctx, key)
+	if err != nil {
+		return object.Object{}, nil, err
+	}
+
+	if obj, rc, ok := s.open(key, current.ETag, rng); ok {
+		return obj, rc, nil
+	}
+
+	obj, body, err := s.backend.Get(ctx, key, rng)
+	if err != nil {
+		return object.Object{}, nil, err
+	}
+	// Only whole, versioned bodies that fit the budget are worth keeping.
+	if rng != nil || current.ETag == "" || obj.ETag != current.ETag || obj.Size > s.maxBytes {
+		return obj, body, nil
+	}
+
+	tmp, err := os.CreateTemp(s.dir, keyHash(key)+"-*"+tempSuffix)
+	if err != nil {
+		return obj, body, nil
+	}
+	return obj, &filler{cache: s, key: key, obj: obj, src: body, tmp: tmp}, nil
+}
+
+// List is served by the backend.
+func (s *Storage) List(ctx context.Context, prefix string) ([]object.Object, error) {
+	if err := s.ensureBackend(); err != nil {
+		return nil, err
+	}
+	return s.backend.List(ctx, prefix)
+}
+
+// Stat is served by the backend.
+func (s *Storage) Stat(ctx context.Context, key string) (object.Object, error) {
+	if err := s.ensureBackend(); err != nil {
+		return object.Object{}, err
+	}
+	return s.backend.Stat(ctx, key)
+}
+
+// Put writes through to the backend and drops any cached body for key.
+func (s *Storage) Put(ctx context.Context, key string, r io.Reader, sizeHint int64, contentType string, meta map[string]string) (object.Object, error) {
+	if err := s.ensureBackend(); err != nil {
+		return object.Object{}, err
+	}
+	defer s.invalidate(key)
+	return s.backend.Put(ctx, key, r, sizeHint, contentType, meta)
+}
+
+// MultipartPut writes through to the backend and drops any cached body for key.
+func (s *Storage) MultipartPut(ctx context.Context, key string, r io.Reader, partSize int64, meta map[string]string) (object.Object, error) {
+	if err := s.ensureBackend(); err != nil {
+		return object.Object{}, err
+	}
+	defer s.invalidate(key)
+	return s.backend.MultipartPut(ctx, key, r, partSize, meta)
+}
+
+// Delete removes the object from the backend and the cache.
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	if err := s.ensureBackend(); err != nil {
+		return err
+	}
+	defer s.invalidate(key)
+	return s.backend.Delete(ctx, key)
+}
+
+// Copy is delegated to the backend; dst is invalidated.
+func (s *Storage) Copy(ctx context.Context, src, dst string) (object.Object, error) {
+	if err := s.ensureBackend(); err != nil {
+		return object.Object{}, err
+	}
+	defer s.invalidate(dst)
+	return s.backend.Copy(ctx, src, dst)
+}
+
+// Move is delegated to the backend; src and dst are invalidated.
+func (s *Storage) Move(ctx context.Context, src, dst string) (object.Object, error) {
+	if err := s.ensureBackend(); err != nil {
+		return object.Object{}, err
+	}
+	defer s.invalidate(src)
+	defer s.invalidate(dst)
+	return s.backend.Move(ctx, src, dst)
+}
+
+// Unwrap returns the backend, presigned URLs are issued by it and bypass the cache.
+// Stale bodies are still never served, every Get checks the backend's ETag.
+func (s *Storage) Unwrap() object.ObjectStorage {
+	return s.backend
+}
+
+// Sync drops any cached body for key and passes the call on to a backend that
+// needs it, such as a mirror.
+func (s *Storage) Sync(ctx context.Context, key string) error {
+	if err := s.ensureBackend(); err != nil {
+		return err
+	}
+	s.invalidate(key)
+	if syncer, ok := s.backend.(object.Syncer); ok {
+		return syncer.Sync(ctx, key)
+	}
+	return nil
+}
+
+func (s *Storage) ensureBackend() error {
+	if s.backend == nil {
+		return errors.New("cache: storage not initialized")
+	}
+	return nil
+}
+
+// open returns the cached body for key if its ETag matches and marks it as recently used.
+func (s *Storage) open(key, etag string, rng *object.Range) (object.Object, io.ReadCloser, bool) {
+	s.mu.Lock()
+	el, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
+		return object.Object{}, nil, false
+	}
+	e := el.Value.(*entry)
+	if e.obj.ETag != etag {
+		s.remove(el)
+		s.mu.Unlock()
+		return object.Object{}, nil, false
+	}
+	s.lru.MoveToFront(el)
+	obj, file := e.obj, e.file
+	s.mu.Unlock()
+
+	// Eviction may unlink the file concurrently; an open handle keeps it readable.
+	f, err := os.Open(file)
+	if err != nil {
+		s.invalidate(key)
+		return object.Object{}, nil, false
+	}
+	if rng == nil {
+		return cloneObject(obj), f, true
+	}
+
+	end := rng.End
+	if end < 0 || end >= obj.Size {
+		end = obj.Size - 1
+	}
+	if rng.Start < 0 || rng.Start > end {
+		f.Close()
+		return object.Object{}, nil, false // let the backend report the invalid range
+	}
+	section := io.NewSectionReader(f, rng.Start, end-rng.Start+1)
+	return cloneObject(obj), readCloser{Reader: section, Closer: f}, true
+}
+
+// commit moves a fully read temp file into the cache and evicts down to the budget.
+func (s *Storage) commit(key, tmp string, obj object.Object) {
+	file := filepath.Join(s.dir, fileName(key))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[key]; ok {
+		s.remove(el)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		_ = os.Remove(tmp)
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(&entry{key: key, file: file, obj: obj})
+	s.size += obj.Size
+	for s.size > s.maxBytes {
+		oldest := s.lru.Back()
+		if oldest == nil {
+			break
+		}
+		s.remove(oldest)
+	}
+}
+
+// invalidate drops the cached body for key, if any.
+func (s *Storage) invalidate(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok {
+		s.remove(el)
+	}
+}
+
+// remove unlinks an entry; callers must hold s.mu.
+func (s *Storage) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	s.lru.Remove(el)
+	delete(s.entries, e.key)
+	s.size -= e.obj.Size
+	_ = os.Remove(e.file)
+}
+
+// filler tees the backend stream into a temp file and commits it once fully read.
+type filler struct {
+	cache   *Storage
+	key     string
+	obj     object.Object
+	src     io.ReadCloser
+	tmp     *os.File
+	written int64
+	failed  bool
+	done    bool
+}
+
+func (f *filler) Read(p []byte) (int, error) {
+	n, err := f.src.Read(p)
+	if n > 0 && !f.failed {
+		if _, werr := f.tmp.Write(p[:n]); werr != nil {
+			f.failed = true
+		}
+		f.written += int64(n)
+	}
+	if err == io.EOF {
+		f.done = true
+	}
+	return n, err
+}
+
+func (f *filler) Close() error {
+	err := f.src.Close()
+	cerr := f.tmp.Close()
+
+	if f.done && !f.failed && cerr == nil && f.written == f.obj.Size {
+		f.cache.commit(f.key, f.tmp.Name(), f.obj)
+	} else {
+		_ = os.Remove(f.tmp.Name())
+	}
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func fileName(key string) string {
+	return keyHash(key) + bodySuffix
+}
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ownFile reports whether name is a body written by fileName or a temporary file
+// created by Get, that is 64 lowercase hex digits followed by ".obj" or "-<n>.tmp".
+func ownFile(name string) bool {
+	const hashLen = 2 * sha256.Size
+	if len(name) < hashLen {
+		return false
+	}
+	hash, rest := name[:hashLen], name[hashLen:]
+	if strings.Trim(hash, "0123456789abcdef") != "" {
+		return false
+	}
+	if rest == bodySuffix {
+		return true
+	}
+	random, ok := strings.CutPrefix(rest, "-")
+	if !ok {
+		return false
+	}
+	random, ok = strings.CutSuffix(random, tempSuffix)
+	return ok && random != "" && strings.Trim(random, "0123456789") == ""
+}
+
+func cloneObject(obj object.Object) object.Object {
+	obj.CustomMeta = maps.Clone(obj.CustomMeta)
+	return obj
+}
+
+// Ensure Storage implements ObjectStorage, Unwrapper and Syncer interfaces.
+var (
+	_ object.ObjectStorage = (*Storage)(nil)
+	_ object.Unwrapper     = (*Storage)(nil)
+	_ object.Syncer        = (*Storage)(nil)
+)
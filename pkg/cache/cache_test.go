@@ -0,0 +1,239 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"codesfer/pkg/object"
+	"codesfer/pkg/sqlite"
+)
+
+// countingBackend records how many bodies were streamed from the backend.
+type countingBackend struct {
+	*sqlite.Storage
+	gets int
+}
+
+func (c *countingBackend) Get(ctx context.Context, key string, rng *object.Range) (object.Object, io.ReadCloser, error) {
+	c.gets++
+	return c.Storage.Get(ctx, key, rng)
+}
+
+func newTestCache(t *testing.T, maxBytes int64) (*Storage, *countingBackend) {
+	t.Helper()
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	backend := &countingBackend{Storage: &sqlite.Storage{}}
+	if err := backend.Init(ctx, sqlite.Config{
+		Source:         fmt.Sprintf("file:%s?cache=shared&mode=rwc", filepath.Join(dir, "objects.db")),
+		AllowOverwrite: true,
+	}); err != nil {
+		t.Fatalf("init backend: %v", err)
+	}
+
+	st := &Storage{}
+	if err := st.Init(ctx, Config{Backend: backend, Dir: filepath.Join(dir, "cache"), MaxBytes: maxBytes}); err != nil {
+		t.Fatalf("init cache: %v", err)
+	}
+	t.Cleanup(func() { _ = st.Close(ctx) })
+	return st, backend
+}
+
+func readAll(t *testing.T, st object.ObjectStorage, key string, rng *object.Range) string {
+	t.Helper()
+	_, rc, err := st.Get(context.Background(), key, rng)
+	if err != nil {
+		t.Fatalf("Get %s: %v", key, err)
+	}
+	defer rc.Close()
+	body, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Get %s read: %v", key, err)
+	}
+	return string(body)
+}
+
+func TestCacheReadThrough(t *testing.T) {
+	ctx := context.Background()
+	st, backend := newTestCache(t, 1<<20)
+
+	if _, err := st.Put(ctx, "k", bytes.NewReader([]byte("hello cache")), -1, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	for i := range 3 {
+		if got := readAll(t, st, "k", nil); got != "hello cache" {
+			t.Fatalf("Get #%d: got %q", i, got)
+		}
+	}
+	if backend.gets != 1 {
+		t.Fatalf("expected 1 backend Get, got %d", backend.gets)
+	}
+
+	if got := readAll(t, st, "k", &object.Range{Start: 6, End: -1}); got != "cache" {
+		t.Fatalf("cached range: got %q", got)
+	}
+	if backend.gets != 1 {
+		t.Fatalf("range should be served from cache, got %d backend Gets", backend.gets)
+	}
+
+	// Put through the cache invalidates the entry
+	if _, err := st.Put(ctx, "k", bytes.NewReader([]byte("updated")), -1, "", nil); err != nil {
+		t.Fatalf("Put update: %v", err)
+	}
+	if got := readAll(t, st, "k", nil); got != "updated" {
+		t.Fatalf("Get after Put: got %q", got)
+	}
+
+	// A write that bypasses the cache is caught by the ETag check
+	if _, err := backend.Put(ctx, "k", bytes.NewReader([]byte("behind your back")), -1, "", nil); err != nil {
+		t.Fatalf("backend Put: %v", err)
+	}
+	if got := readAll(t, st, "k", nil); got != "behind your back" {
+		t.Fatalf("Get after backend Put: got %q", got)
+	}
+
+	if err := st.Delete(ctx, "k"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, _, err := st.Get(ctx, "k", nil); !errors.Is(err, object.ErrNotFound) {
+		t.Fatalf("Get after Delete: expected ErrNotFound got %v", err)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	st, backend := newTestCache(t, 10)
+
+	for _, k := range []string{"a", "b", "c"} {
+		if _, err := st.Put(ctx, k, bytes.NewReader([]byte("12345")), -1, "", nil); err != nil {
+			t.Fatalf("Put %s: %v", k, err)
+		}
+	}
+
+	readAll(t, st, "a", nil)
+	readAll(t, st, "b", nil)
+	readAll(t, st, "a", nil) // a is now the most recent
+	readAll(t, st, "c", nil) // evicts b
+	if backend.gets != 3 {
+		t.Fatalf("expected 3 backend Gets, got %d", backend.gets)
+	}
+
+	readAll(t, st, "a", nil)
+	if backend.gets != 3 {
+		t.Fatalf("a should still be cached, got %d backend Gets", backend.gets)
+	}
+	readAll(t, st, "b", nil)
+	if backend.gets != 4 {
+		t.Fatalf("b should have been evicted, got %d backend Gets", backend.gets)
+	}
+
+	files, err := os.ReadDir(st.dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 cached files, got %d", len(files))
+	}
+}
+
+func TestCachePartialReadNotCommitted(t *testing.T) {
+	ctx := context.Background()
+	st, backend := newTestCache(t, 1<<20)
+
+	if _, err := st.Put(ctx, "k", bytes.NewReader(bytes.Repeat([]byte("x"), 4096)), -1, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	_, rc, err := st.Get(ctx, "k", nil)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if _, err := rc.Read(make([]byte, 10)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	rc.Close()
+
+	readAll(t, st, "k", nil)
+	if backend.gets != 2 {
+		t.Fatalf("abandoned read must not be cached, got %d backend Gets", backend.gets)
+	}
+}
+
+func TestCacheInitKeepsForeignFiles(t *testing.T) {
+	ctx := context.Background()
+	st, backend := newTestCache(t, 1<<20)
+
+	if _, err := st.Put(ctx, "k", bytes.NewReader([]byte("cached")), -1, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	readAll(t, st, "k", nil)
+	leftover, err := os.CreateTemp(st.dir, keyHash("k")+"-*"+tempSuffix)
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	leftover.Close()
+	foreign := []string{"notes.obj", "backup.tmp", keyHash("k") + ".obj.bak", "-1.tmp"}
+	for _, name := range foreign {
+		if err := os.WriteFile(filepath.Join(st.dir, name), []byte("keep"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	restarted := &Storage{}
+	if err := restarted.Init(ctx, Config{Backend: backend, Dir: st.dir, MaxBytes: 1 << 20}); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	files, err := os.ReadDir(st.dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if len(names) != len(foreign) {
+		t.Fatalf("expected only the foreign files to survive Init, got %v", names)
+	}
+}
+
+// presigningBackend is a backend that hands out presigned URLs.
+type presigningBackend struct {
+	*countingBackend
+}
+
+func (p presigningBackend) PresignGet(_ context.Context, key string, _ time.Duration) (string, error) {
+	return "https://bucket.example/" + key, nil
+}
+
+func (p presigningBackend) PresignPut(_ context.Context, key string, _ int64, _ time.Duration) (string, error) {
+	return "https://bucket.example/" + key, nil
+}
+
+func TestCachePresignsThroughBackend(t *testing.T) {
+	st, backend := newTestCache(t, 1<<20)
+	if _, ok := object.AsPresigner(st); ok {
+		t.Fatal("cache over a backend without presigning reported a presigner")
+	}
+
+	cached := &Storage{}
+	if err := cached.Init(context.Background(), Config{Backend: presigningBackend{backend}, Dir: t.TempDir(), MaxBytes: 1 << 20}); err != nil {
+		t.Fatalf("init cache: %v", err)
+	}
+	p, ok := object.AsPresigner(cached)
+	if !ok {
+		t.Fatal("cache hides the presigner of its backend")
+	}
+	url, err := p.PresignGet(context.Background(), "k", time.Minute)
+	if err != nil || url != "https://bucket.example/k" {
+		t.Fatalf("PresignGet: %q, %v", url, err)
+	}
+}
@@ -0,0 +1,153 @@
+// Package geo turns IP addresses into human readable locations, such as
+// "Zurich, Zurich, CH", to show where sessions were created.
+package geo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// ErrUnknown is returned when an address has no known location.
+var ErrUnknown = errors.New("geo: location unknown")
+
+// Geolocator looks up the location of an address.
+type Geolocator interface {
+	Locate(ctx context.Context, ip netip.Addr) (string, error)
+}
+
+// Local reports whether ip is a loopback, private or otherwise non-routable
+// address, which has no location worth looking up.
+func Local(ip netip.Addr) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// join formats the non-empty parts of a location, most specific first
+func join(parts ...string) (string, error) {
+	var out []string
+	for _, p := range parts {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	if len(out) == 0 {
+		return "", ErrUnknown
+	}
+	return strings.Join(out, ", "), nil
+}
+
+// Disabled never looks anything up.
+type Disabled struct{}
+
+// Locate implements Geolocator.
+func (Disabled) Locate(context.Context, netip.Addr) (string, error) {
+	return "", ErrUnknown
+}
+
+// MMDB looks addresses up in a local MaxMind-format database, such as
+// GeoLite2-City or GeoLite2-Country, without any network access.
+type MMDB struct {
+	reader *maxminddb.Reader
+}
+
+// OpenMMDB opens the database file at path. Close it when done.
+func OpenMMDB(path string) (*MMDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("geo: open %s: %w", path, err)
+	}
+	return &MMDB{reader: reader}, nil
+}
+
+// Close releases the database file.
+func (m *MMDB) Close() error {
+	return m.reader.Close()
+}
+
+// mmdbRecord is the part of a GeoIP2/GeoLite2 City or Country record we show
+type mmdbRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// Locate implements Geolocator.
+func (m *MMDB) Locate(_ context.Context, ip netip.Addr) (string, error) {
+	var record mmdbRecord
+	result := m.reader.Lookup(ip.Unmap())
+	if err := result.Decode(&record); err != nil {
+		return "", fmt.Errorf("geo: lookup %s: %w", ip, err)
+	}
+	if !result.Found() {
+		return "", ErrUnknown
+	}
+	region := ""
+	if len(record.Subdivisions) > 0 {
+		region = record.Subdivisions[0].Names["en"]
+	}
+	return join(record.City.Names["en"], region, record.Country.ISOCode)
+}
+
+// DefaultIPInfoURL is the ipinfo.io lookup endpoint, %s is replaced by the address.
+const DefaultIPInfoURL = "https://ipinfo.io/%s/json"
+
+// IPInfo looks addresses up with the ipinfo.io API. Every lookup sends the
+// address to a third party and takes a network round trip.
+type IPInfo struct {
+	// URL is the lookup endpoint, DefaultIPInfoURL if empty.
+	URL string
+	// Client defaults to a client with a 5 second timeout.
+	Client *http.Client
+}
+
+var ipinfoClient = &http.Client{Timeout: 5 * time.Second}
+
+// Locate implements Geolocator.
+func (g *IPInfo) Locate(ctx context.Context, ip netip.Addr) (string, error) {
+	url, client := g.URL, g.Client
+	if url == "" {
+		url = DefaultIPInfoURL
+	}
+	if client == nil {
+		client = ipinfoClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(url, ip), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("geo: ipinfo lookup: status code %d", resp.StatusCode)
+	}
+
+	var data struct {
+		City    string `json:"city"`
+		Region  string `json:"region"`
+		Country string `json:"country"`
+		Bogon   bool   `json:"bogon"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", err
+	}
+	if data.Bogon {
+		return "", ErrUnknown
+	}
+	return join(data.City, data.Region, data.Country)
+}
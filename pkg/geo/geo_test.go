@@ -0,0 +1,147 @@
+package geo
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbEncoder writes the subset of the MaxMind DB data format the tests need
+type mmdbEncoder []byte
+
+func (e *mmdbEncoder) control(typ, size int) {
+	if typ > 7 {
+		*e = append(*e, byte(size), byte(typ-7))
+		return
+	}
+	*e = append(*e, byte(typ<<5|size))
+}
+
+func (e *mmdbEncoder) value(v any) {
+	switch v := v.(type) {
+	case string:
+		e.control(2, len(v))
+		*e = append(*e, v...)
+	case uint16:
+		e.control(5, 2)
+		*e = binary.BigEndian.AppendUint16(*e, v)
+	case uint32:
+		e.control(6, 4)
+		*e = binary.BigEndian.AppendUint32(*e, v)
+	case []any:
+		e.control(11, len(v))
+		for _, item := range v {
+			e.value(item)
+		}
+	case map[string]any:
+		e.control(7, len(v))
+		for key, item := range v {
+			e.value(key)
+			e.value(item)
+		}
+	default:
+		panic("unsupported type")
+	}
+}
+
+// writeMMDB writes an IPv4 database with a single network and record
+func writeMMDB(t *testing.T, network netip.Prefix, record map[string]any) string {
+	t.Helper()
+	// One node per bit of the prefix, the last one points at the record
+	nodeCount := network.Bits()
+	ip := network.Addr().As4()
+	var tree []byte
+	for i := range nodeCount {
+		next := uint32(i + 1)
+		if i == nodeCount-1 {
+			next = uint32(nodeCount) + 16 // the first byte of the data section
+		}
+		records := [2]uint32{uint32(nodeCount), uint32(nodeCount)}
+		records[ip[i/8]>>(7-i%8)&1] = next
+		for _, r := range records {
+			tree = append(tree, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+
+	var data mmdbEncoder
+	data.value(record)
+	var metadata mmdbEncoder
+	metadata.value(map[string]any{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               "Test-City",
+		"languages":                   []any{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint32(1700000000),
+		"description":                 map[string]any{"en": "test"},
+	})
+
+	file := append(tree, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, "\xab\xcd\xefMaxMind.com"...)
+	file = append(file, metadata...)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMMDB(t *testing.T) {
+	path := writeMMDB(t, netip.MustParsePrefix("81.2.69.0/24"), map[string]any{
+		"city":         map[string]any{"names": map[string]any{"en": "London"}},
+		"subdivisions": []any{map[string]any{"names": map[string]any{"en": "England"}}},
+		"country":      map[string]any{"iso_code": "GB"},
+	})
+	db, err := OpenMMDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	location, err := db.Locate(ctx, netip.MustParseAddr("81.2.69.160"))
+	if err != nil || location != "London, England, GB" {
+		t.Fatalf("got %q, %v", location, err)
+	}
+	if _, err := db.Locate(ctx, netip.MustParseAddr("::ffff:81.2.69.1")); err != nil {
+		t.Fatalf("IPv4-mapped address: %v", err)
+	}
+	if _, err := db.Locate(ctx, netip.MustParseAddr("81.2.70.1")); !errors.Is(err, ErrUnknown) {
+		t.Fatalf("address outside the database: want ErrUnknown, got %v", err)
+	}
+}
+
+func TestIPInfo(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/8.8.8.8/json":
+			w.Write([]byte(`{"city": "Mountain View", "region": "California", "country": "US"}`))
+		case "/10.0.0.1/json":
+			w.Write([]byte(`{"bogon": true}`))
+		default:
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+		}
+	}))
+	defer api.Close()
+
+	g := &IPInfo{URL: api.URL + "/%s/json"}
+	ctx := context.Background()
+	if location, err := g.Locate(ctx, netip.MustParseAddr("8.8.8.8")); err != nil || location != "Mountain View, California, US" {
+		t.Fatalf("got %q, %v", location, err)
+	}
+	if _, err := g.Locate(ctx, netip.MustParseAddr("10.0.0.1")); !errors.Is(err, ErrUnknown) {
+		t.Fatalf("bogon: want ErrUnknown, got %v", err)
+	}
+	if _, err := g.Locate(ctx, netip.MustParseAddr("1.1.1.1")); err == nil {
+		t.Fatal("failed lookup returned no error")
+	}
+}
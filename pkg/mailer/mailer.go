@@ -0,0 +1,134 @@
+// Package mailer delivers transactional emails such as password reset codes.
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTP sends mail through an SMTP relay, upgrading to TLS when the server offers STARTTLS.
+type SMTP struct {
+	// Addr is the host:port of the relay.
+	Addr string
+	// From is the envelope and header sender.
+	From string
+	// Username and Password enable PLAIN auth, which net/smtp only allows over TLS or to localhost.
+	Username string
+	Password string
+}
+
+// Send delivers msg, honoring ctx for the connection and the whole exchange.
+func (m *SMTP) Send(ctx context.Context, msg Message) error {
+	if m.Addr == "" || m.From == "" {
+		return errors.New("mailer: Addr and From are required")
+	}
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return errors.New("mailer: invalid header value")
+	}
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return fmt.Errorf("mailer: invalid address: %w", err)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return fmt.Errorf("mailer: dial: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("mailer: handshake: %w", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("mailer: starttls: %w", err)
+		}
+	}
+	if m.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return fmt.Errorf("mailer: auth: %w", err)
+		}
+	}
+
+	if err := c.Mail(m.From); err != nil {
+		return fmt.Errorf("mailer: mail from: %w", err)
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("mailer: rcpt to: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("mailer: data: %w", err)
+	}
+	if _, err := w.Write(m.format(msg)); err != nil {
+		return fmt.Errorf("mailer: write: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("mailer: data: %w", err)
+	}
+	return c.Quit()
+}
+
+// format renders the headers and body with CRLF line endings.
+func (m *SMTP) format(msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	body := strings.ReplaceAll(msg.Body, "\r\n", "\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Log writes messages to a logger instead of sending them, for development and
+// self-hosted setups without a mail relay.
+type Log struct {
+	// Logger defaults to the standard logger.
+	Logger *log.Logger
+}
+
+// Send logs msg, including its body.
+func (m *Log) Send(_ context.Context, msg Message) error {
+	logger := m.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf("[mailer] to: %s; subject: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// Ensure implementations satisfy Mailer.
+var (
+	_ Mailer = (*SMTP)(nil)
+	_ Mailer = (*Log)(nil)
+)
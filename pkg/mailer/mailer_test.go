@@ -0,0 +1,124 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts a single session on a local port and records what it receives.
+type fakeSMTP struct {
+	addr string
+	from string
+	rcpt string
+	data string
+	done chan struct{}
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeSMTP{addr: ln.Addr().String(), done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 fake ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				tp.PrintfLine("250 fake")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				f.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+				tp.PrintfLine("250 ok")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				f.rcpt = strings.Trim(line[len("RCPT TO:"):], "<> ")
+				tp.PrintfLine("250 ok")
+			case cmd == "DATA":
+				tp.PrintfLine("354 go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				f.data = string(data)
+				tp.PrintfLine("250 queued")
+			case cmd == "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("502 unsupported")
+			}
+		}
+	}()
+	return f
+}
+
+func TestSMTPSend(t *testing.T) {
+	srv := newFakeSMTP(t)
+	m := &SMTP{Addr: srv.addr, From: "noreply@codesfer.test"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.Send(ctx, Message{
+		To:      "user@example.com",
+		Subject: "Reset your password",
+		Body:    "Your code: 1234\nIt expires in 1 hour.",
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	<-srv.done
+
+	if srv.from != "noreply@codesfer.test" || srv.rcpt != "user@example.com" {
+		t.Fatalf("unexpected envelope: from %q rcpt %q", srv.from, srv.rcpt)
+	}
+	for _, want := range []string{"Subject: Reset your password", "To: user@example.com", "Your code: 1234\nIt expires in 1 hour."} {
+		if !strings.Contains(srv.data, want) {
+			t.Fatalf("message missing %q:\n%s", want, srv.data)
+		}
+	}
+}
+
+func TestSMTPRejectsHeaderInjection(t *testing.T) {
+	m := &SMTP{Addr: "127.0.0.1:1", From: "noreply@codesfer.test"}
+	err := m.Send(context.Background(), Message{To: "a@example.com\r\nBcc: b@example.com", Subject: "x"})
+	if err == nil {
+		t.Fatal("expected an error for a header with a line break")
+	}
+}
+
+func TestLogSend(t *testing.T) {
+	var buf bytes.Buffer
+	m := &Log{Logger: log.New(&buf, "", 0)}
+	if err := m.Send(context.Background(), Message{To: "user@example.com", Subject: "Hi", Body: "code 42"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	sc := bufio.NewScanner(&buf)
+	var lines []string
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if len(lines) != 2 || !strings.Contains(lines[0], "user@example.com") || lines[1] != "code 42" {
+		t.Fatalf("unexpected log output: %q", lines)
+	}
+}
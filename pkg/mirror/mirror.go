@@ -0,0 +1,514 @@
+// Package mirror implements an object.ObjectStorage that replicates every write
+// from a primary backend to one or more secondaries.
+package mirror
+
+import (
+	"codesfer/pkg/object"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config describes the replica set. All backends must be initialized by the caller.
+type Config struct {
+	Primary     object.ObjectStorage
+	Secondaries []object.ObjectStorage
+	// Async replicates through a background queue instead of inside the write call.
+	Async bool
+	// QueueSize bounds pending async jobs (default 1024). Writers block when it is full.
+	QueueSize int
+	// MaxRetries is how often a failed async job is retried before it is dropped (default 5).
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled on every attempt (default 1s).
+	RetryBackoff time.Duration
+}
+
+// Storage writes to the primary first, then to every secondary. Reads are served by the
+// primary and fall back to the secondaries in order when the primary fails, but not
+// when it reports the key missing: a secondary may not have caught up with a delete yet.
+type Storage struct {
+	primary     object.ObjectStorage
+	secondaries []object.ObjectStorage
+	async       bool
+	maxRetries  int
+	backoff     time.Duration
+
+	queue   chan job
+	pending atomic.Int64
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+type op int
+
+const (
+	opSync   op = iota // make the replica match the primary's current content for key
+	opDelete           // remove key from the replica
+	opCopy             // copy src to key on the replica
+	opMove             // move src to key on the replica
+)
+
+type job struct {
+	op        op
+	key       string
+	src       string
+	secondary int
+	attempt   int
+}
+
+// Init validates the configuration and starts the async worker when enabled.
+func (s *Storage) Init(_ context.Context, param any) error {
+	cfg, ok := param.(Config)
+	if !ok {
+		if p, ok := param.(*Config); ok && p != nil {
+			cfg = *p
+		} else {
+			return fmt.Errorf("mirror: unexpected config type %T", param)
+		}
+	}
+
+	if cfg.Primary == nil {
+		return errors.New("mirror: Primary is required")
+	}
+	if len(cfg.Secondaries) == 0 {
+		return errors.New("mirror: at least one secondary is required")
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1024
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 5
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = time.Second
+	}
+
+	s.primary = cfg.Primary
+	s.secondaries = cfg.Secondaries
+	s.async = cfg.Async
+	s.maxRetries = cfg.MaxRetries
+	s.backoff = cfg.RetryBackoff
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	if s.async {
+		s.queue = make(chan job, cfg.QueueSize)
+		s.wg.Add(1)
+		go s.worker()
+	}
+	return nil
+}
+
+// Close stops the async worker, dropping queued jobs, and closes every backend.
+func (s *Storage) Close(ctx context.Context) error {
+	if s.cancel == nil {
+		return nil
+	}
+	s.cancel()
+	s.wg.Wait()
+
+	errs := []error{s.primary.Close(ctx)}
+	for _, sec := range s.secondaries {
+		errs = append(errs, sec.Close(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Put writes to the primary and replicates the stored object. If it cannot be
+// replicated the write is undone, so a failed Put leaves no object behind.
+func (s *Storage) Put(ctx context.Context, key string, r io.Reader, sizeHint int64, contentType string, meta map[string]string) (object.Object, error) {
+	if err := s.ensureInit(); err != nil {
+		return object.Object{}, err
+	}
+	obj, err := s.primary.Put(ctx, key, r, sizeHint, contentType, meta)
+	if err != nil {
+		return object.Object{}, err
+	}
+	return obj, s.replicateWrite(ctx, key)
+}
+
+// MultipartPut writes to the primary and replicates the stored object. If it
+// cannot be replicated the write is undone, like with Put.
+func (s *Storage) MultipartPut(ctx context.Context, key string, r io.Reader, partSize int64, meta map[string]string) (object.Object, error) {
+	if err := s.ensureInit(); err != nil {
+		return object.Object{}, err
+	}
+	obj, err := s.primary.MultipartPut(ctx, key, r, partSize, meta)
+	if err != nil {
+		return object.Object{}, err
+	}
+	return obj, s.replicateWrite(ctx, key)
+}
+
+// replicateWrite replicates key after it was written to the primary. When that
+// fails, key is deleted from the primary and the secondaries again: callers undo
+// their own state on error and would otherwise leave an object nobody tracks.
+func (s *Storage) replicateWrite(ctx context.Context, key string) error {
+	err := s.replicate(ctx, job{op: opSync, key: key})
+	if err == nil {
+		return nil
+	}
+	ctx = context.WithoutCancel(ctx)
+	if derr := s.primary.Delete(ctx, key); derr != nil && !errors.Is(derr, object.ErrNotFound) {
+		log.Printf("mirror: failed to undo the write of %s on the primary: %v", key, derr)
+	}
+	for i := range s.secondaries {
+		if derr := s.apply(ctx, job{op: opDelete, key: key, secondary: i}); derr != nil {
+			log.Printf("mirror: failed to undo the write of %s on secondary %d: %v", key, i, derr)
+		}
+	}
+	return err
+}
+
+// Delete removes key from the primary and every secondary.
+// A key missing on the primary is still removed from the secondaries.
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	if err := s.ensureInit(); err != nil {
+		return err
+	}
+	err := s.primary.Delete(ctx, key)
+	if err != nil && !errors.Is(err, object.ErrNotFound) {
+		return err
+	}
+	if rerr := s.replicate(ctx, job{op: opDelete, key: key}); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// Copy copies on the primary, then on each secondary.
+func (s *Storage) Copy(ctx context.Context, src, dst string) (object.Object, error) {
+	if err := s.ensureInit(); err != nil {
+		return object.Object{}, err
+	}
+	obj, err := s.primary.Copy(ctx, src, dst)
+	if err != nil {
+		return object.Object{}, err
+	}
+	return obj, s.replicate(ctx, job{op: opCopy, key: dst, src: src})
+}
+
+// Move moves on the primary, then on each secondary.
+func (s *Storage) Move(ctx context.Context, src, dst string) (object.Object, error) {
+	if err := s.ensureInit(); err != nil {
+		return object.Object{}, err
+	}
+	obj, err := s.primary.Move(ctx, src, dst)
+	if err != nil {
+		return object.Object{}, err
+	}
+	return obj, s.replicate(ctx, job{op: opMove, key: dst, src: src})
+}
+
+// Get reads from the primary, falling back to the secondaries unless the key is missing.
+func (s *Storage) Get(ctx context.Context, key string, rng *object.Range) (object.Object, io.ReadCloser, error) {
+	if err := s.ensureInit(); err != nil {
+		return object.Object{}, nil, err
+	}
+	obj, rc, err := s.primary.Get(ctx, key, rng)
+	if err == nil || errors.Is(err, object.ErrNotFound) {
+		return obj, rc, err
+	}
+	for i, sec := range s.secondaries {
+		if obj, rc, serr := sec.Get(ctx, key, rng); serr == nil {
+			log.Printf("mirror: primary get %s failed (%v), served by secondary %d", key, err, i)
+			return obj, rc, nil
+		}
+	}
+	return object.Object{}, nil, err
+}
+
+// List reads from the primary, falling back to the secondaries unless the prefix is missing.
+func (s *Storage) List(ctx context.Context, prefix string) ([]object.Object, error) {
+	if err := s.ensureInit(); err != nil {
+		return nil, err
+	}
+	objs, err := s.primary.List(ctx, prefix)
+	if err == nil || errors.Is(err, object.ErrNotFound) {
+		return objs, err
+	}
+	for i, sec := range s.secondaries {
+		if objs, serr := sec.List(ctx, prefix); serr == nil {
+			log.Printf("mirror: primary list %s failed (%v), served by secondary %d", prefix, err, i)
+			return objs, nil
+		}
+	}
+	return nil, err
+}
+
+// Stat reads from the primary, falling back to the secondaries unless the key is missing.
+func (s *Storage) Stat(ctx context.Context, key string) (object.Object, error) {
+	if err := s.ensureInit(); err != nil {
+		return object.Object{}, err
+	}
+	obj, err := s.primary.Stat(ctx, key)
+	if err == nil || errors.Is(err, object.ErrNotFound) {
+		return obj, err
+	}
+	for _, sec := range s.secondaries {
+		if obj, serr := sec.Stat(ctx, key); serr == nil {
+			return obj, nil
+		}
+	}
+	return object.Object{}, err
+}
+
+// Unwrap returns the primary, presigned URLs are issued by it. Call Sync once an
+// object was written through one, so the secondaries receive it too.
+func (s *Storage) Unwrap() object.ObjectStorage {
+	return s.primary
+}
+
+// Sync replicates the primary's current content for key, written without the mirror.
+func (s *Storage) Sync(ctx context.Context, key string) error {
+	if err := s.ensureInit(); err != nil {
+		return err
+	}
+	return s.replicate(ctx, job{op: opSync, key: key})
+}
+
+// Pending returns the number of queued or retrying async jobs.
+func (s *Storage) Pending() int64 {
+	return s.pending.Load()
+}
+
+// Drain blocks until the async queue is empty or ctx is done.
+func (s *Storage) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for s.pending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// DiscrepancyKind classifies how a replica differs from the primary.
+type DiscrepancyKind string
+
+const (
+	Missing      DiscrepancyKind = "missing"       // on the primary, not on the secondary
+	Extra        DiscrepancyKind = "extra"         // on the secondary, not on the primary
+	SizeMismatch DiscrepancyKind = "size mismatch" // on both, with different sizes
+)
+
+// Discrepancy is a key whose state on a secondary differs from the primary.
+type Discrepancy struct {
+	Key       string
+	Secondary int
+	Kind      DiscrepancyKind
+}
+
+// Check lists prefix on the primary and every secondary and reports the differences.
+// Sizes are compared rather than ETags, which are not portable across backends.
+func (s *Storage) Check(ctx context.Context, prefix string) ([]Discrepancy, error) {
+	if err := s.ensureInit(); err != nil {
+		return nil, err
+	}
+
+	primaryObjs, err := s.primary.List(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("mirror: list primary: %w", err)
+	}
+	want := make(map[string]int64, len(primaryObjs))
+	for _, o := range primaryObjs {
+		want[o.Key] = o.Size
+	}
+
+	var out []Discrepancy
+	for i, sec := range s.secondaries {
+		objs, err := sec.List(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("mirror: list secondary %d: %w", i, err)
+		}
+		have := make(map[string]int64, len(objs))
+		for _, o := range objs {
+			have[o.Key] = o.Size
+			size, ok := want[o.Key]
+			switch {
+			case !ok:
+				out = append(out, Discrepancy{Key: o.Key, Secondary: i, Kind: Extra})
+			case size != o.Size:
+				out = append(out, Discrepancy{Key: o.Key, Secondary: i, Kind: SizeMismatch})
+			}
+		}
+		for _, o := range primaryObjs {
+			if _, ok := have[o.Key]; !ok {
+				out = append(out, Discrepancy{Key: o.Key, Secondary: i, Kind: Missing})
+			}
+		}
+	}
+	return out, nil
+}
+
+// Repair makes each reported replica match the primary again, synchronously.
+func (s *Storage) Repair(ctx context.Context, ds []Discrepancy) error {
+	if err := s.ensureInit(); err != nil {
+		return err
+	}
+	var errs []error
+	for _, d := range ds {
+		if d.Secondary < 0 || d.Secondary >= len(s.secondaries) {
+			errs = append(errs, fmt.Errorf("mirror: unknown secondary %d", d.Secondary))
+			continue
+		}
+		j := job{op: opSync, key: d.Key, secondary: d.Secondary}
+		if err := s.apply(ctx, j); err != nil {
+			errs = append(errs, fmt.Errorf("mirror: repair %s on secondary %d: %w", d.Key, d.Secondary, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Storage) ensureInit() error {
+	if s.primary == nil {
+		return errors.New("mirror: storage not initialized")
+	}
+	return nil
+}
+
+// replicate applies j to every secondary, inline or through the queue.
+func (s *Storage) replicate(ctx context.Context, j job) error {
+	var errs []error
+	for i := range s.secondaries {
+		j.secondary = i
+		if s.async {
+			if err := s.enqueue(ctx, j); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := s.apply(ctx, j); err != nil {
+			errs = append(errs, fmt.Errorf("mirror: replicate %s to secondary %d: %w", j.key, i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Storage) enqueue(ctx context.Context, j job) error {
+	s.pending.Add(1)
+	select {
+	case s.queue <- j:
+		return nil
+	case <-ctx.Done():
+		s.pending.Add(-1)
+		return fmt.Errorf("mirror: enqueue %s: %w", j.key, ctx.Err())
+	case <-s.ctx.Done():
+		s.pending.Add(-1)
+		return errors.New("mirror: storage closed")
+	}
+}
+
+func (s *Storage) worker() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case j := <-s.queue:
+			s.run(j)
+		}
+	}
+}
+
+// run executes an async job, scheduling a retry with exponential backoff on failure.
+func (s *Storage) run(j job) {
+	err := s.apply(s.ctx, j)
+	if err == nil || s.ctx.Err() != nil {
+		s.pending.Add(-1)
+		return
+	}
+	if j.attempt >= s.maxRetries {
+		log.Printf("mirror: giving up on %s for secondary %d after %d attempts: %v", j.key, j.secondary, j.attempt+1, err)
+		s.pending.Add(-1)
+		return
+	}
+
+	delay := s.backoff << j.attempt
+	j.attempt++
+	log.Printf("mirror: replicate %s to secondary %d failed, retrying in %s: %v", j.key, j.secondary, delay, err)
+	time.AfterFunc(delay, func() {
+		select {
+		case s.queue <- j:
+		case <-s.ctx.Done():
+			s.pending.Add(-1)
+		}
+	})
+}
+
+// apply performs a single replication step against one secondary.
+func (s *Storage) apply(ctx context.Context, j job) error {
+	sec := s.secondaries[j.secondary]
+	switch j.op {
+	case opDelete:
+		if err := sec.Delete(ctx, j.key); err != nil && !errors.Is(err, object.ErrNotFound) {
+			return err
+		}
+		return nil
+	case opCopy:
+		if _, err := sec.Copy(ctx, j.src, j.key); err == nil {
+			return nil
+		}
+		return s.syncKey(ctx, sec, j.key)
+	case opMove:
+		if _, err := sec.Move(ctx, j.src, j.key); err == nil {
+			return nil
+		}
+		if err := s.syncKey(ctx, sec, j.key); err != nil {
+			return err
+		}
+		if err := sec.Delete(ctx, j.src); err != nil && !errors.Is(err, object.ErrNotFound) {
+			return err
+		}
+		return nil
+	default:
+		return s.syncKey(ctx, sec, j.key)
+	}
+}
+
+// syncKey copies the primary's current content for key to sec, or deletes it from sec
+// when the primary no longer has it.
+func (s *Storage) syncKey(ctx context.Context, sec object.ObjectStorage, key string) error {
+	err := s.putFromPrimary(ctx, sec, key)
+	if errors.Is(err, object.ErrNotFound) {
+		if err := sec.Delete(ctx, key); err != nil && !errors.Is(err, object.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	if !errors.Is(err, object.ErrConflict) {
+		return err
+	}
+
+	// Backends without overwrite need the stale replica removed first.
+	if err := sec.Delete(ctx, key); err != nil && !errors.Is(err, object.ErrNotFound) {
+		return err
+	}
+	return s.putFromPrimary(ctx, sec, key)
+}
+
+func (s *Storage) putFromPrimary(ctx context.Context, sec object.ObjectStorage, key string) error {
+	obj, body, err := s.primary.Get(ctx, key, nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	_, err = sec.Put(ctx, key, body, obj.Size, obj.ContentType, obj.CustomMeta)
+	return err
+}
+
+// Ensure Storage implements ObjectStorage, Unwrapper and Syncer interfaces.
+var (
+	_ object.ObjectStorage = (*Storage)(nil)
+	_ object.Unwrapper     = (*Storage)(nil)
+	_ object.Syncer        = (*Storage)(nil)
+)
@@ -0,0 +1,274 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"codesfer/pkg/object"
+	"codesfer/pkg/sqlite"
+)
+
+func newSQLite(t *testing.T, name string) *sqlite.Storage {
+	t.Helper()
+	st := &sqlite.Storage{}
+	if err := st.Init(context.Background(), sqlite.Config{
+		Source: fmt.Sprintf("file:%s?cache=shared&mode=rwc", filepath.Join(t.TempDir(), name+".db")),
+	}); err != nil {
+		t.Fatalf("init %s: %v", name, err)
+	}
+	return st
+}
+
+func newMirror(t *testing.T, cfg Config) *Storage {
+	t.Helper()
+	ctx := context.Background()
+	st := &Storage{}
+	if err := st.Init(ctx, cfg); err != nil {
+		t.Fatalf("init mirror: %v", err)
+	}
+	t.Cleanup(func() { _ = st.Close(ctx) })
+	return st
+}
+
+func content(t *testing.T, st object.ObjectStorage, key string) string {
+	t.Helper()
+	_, rc, err := st.Get(context.Background(), key, nil)
+	if err != nil {
+		t.Fatalf("Get %s: %v", key, err)
+	}
+	defer rc.Close()
+	body, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Get %s read: %v", key, err)
+	}
+	return string(body)
+}
+
+// flaky fails the first n writes, then behaves like the wrapped storage.
+type flaky struct {
+	*sqlite.Storage
+	failures atomic.Int32
+}
+
+func (f *flaky) Put(ctx context.Context, key string, r io.Reader, sizeHint int64, contentType string, meta map[string]string) (object.Object, error) {
+	if f.failures.Add(-1) >= 0 {
+		return object.Object{}, errors.New("unavailable")
+	}
+	return f.Storage.Put(ctx, key, r, sizeHint, contentType, meta)
+}
+
+func TestMirrorSync(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := newSQLite(t, "primary"), newSQLite(t, "secondary")
+	st := newMirror(t, Config{Primary: primary, Secondaries: []object.ObjectStorage{secondary}})
+
+	if _, err := st.Put(ctx, "a", bytes.NewReader([]byte("first")), -1, "text/plain", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := content(t, secondary, "a"); got != "first" {
+		t.Fatalf("secondary after Put: got %q", got)
+	}
+
+	// Overwrite must replace the replica even though the backend refuses overwrites
+	if err := primary.Delete(ctx, "a"); err != nil {
+		t.Fatalf("primary Delete: %v", err)
+	}
+	if _, err := st.Put(ctx, "a", bytes.NewReader([]byte("second")), -1, "", nil); err != nil {
+		t.Fatalf("Put overwrite: %v", err)
+	}
+	if got := content(t, secondary, "a"); got != "second" {
+		t.Fatalf("secondary after overwrite: got %q", got)
+	}
+
+	if _, err := st.Move(ctx, "a", "b"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if _, err := secondary.Stat(ctx, "a"); !errors.Is(err, object.ErrNotFound) {
+		t.Fatalf("secondary Stat a after Move: expected ErrNotFound got %v", err)
+	}
+	if _, err := st.Copy(ctx, "b", "c"); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if got := content(t, secondary, "c"); got != "second" {
+		t.Fatalf("secondary after Copy: got %q", got)
+	}
+
+	if err := st.Delete(ctx, "b"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := secondary.Stat(ctx, "b"); !errors.Is(err, object.ErrNotFound) {
+		t.Fatalf("secondary Stat after Delete: expected ErrNotFound got %v", err)
+	}
+
+	// A key missing on the primary is missing, even if a secondary still has it
+	if err := primary.Delete(ctx, "c"); err != nil {
+		t.Fatalf("primary Delete: %v", err)
+	}
+	if _, _, err := st.Get(ctx, "c", nil); !errors.Is(err, object.ErrNotFound) {
+		t.Fatalf("Get of a key deleted on the primary: expected ErrNotFound got %v", err)
+	}
+	if _, err := st.Stat(ctx, "c"); !errors.Is(err, object.ErrNotFound) {
+		t.Fatalf("Stat of a key deleted on the primary: expected ErrNotFound got %v", err)
+	}
+}
+
+// down fails every read, like a primary that is unreachable.
+type down struct {
+	*sqlite.Storage
+}
+
+func (d down) Get(context.Context, string, *object.Range) (object.Object, io.ReadCloser, error) {
+	return object.Object{}, nil, errors.New("unavailable")
+}
+
+func (d down) Stat(context.Context, string) (object.Object, error) {
+	return object.Object{}, errors.New("unavailable")
+}
+
+func TestMirrorReadFallback(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := newSQLite(t, "primary"), newSQLite(t, "secondary")
+	if _, err := secondary.Put(ctx, "a", bytes.NewReader([]byte("replica")), -1, "", nil); err != nil {
+		t.Fatalf("secondary Put: %v", err)
+	}
+	st := newMirror(t, Config{Primary: down{primary}, Secondaries: []object.ObjectStorage{secondary}})
+
+	if got := content(t, st, "a"); got != "replica" {
+		t.Fatalf("fallback Get: got %q", got)
+	}
+	if _, err := st.Stat(ctx, "a"); err != nil {
+		t.Fatalf("fallback Stat: %v", err)
+	}
+}
+
+func TestMirrorSyncPutFailure(t *testing.T) {
+	ctx := context.Background()
+	primary := newSQLite(t, "primary")
+	secondary := &flaky{Storage: newSQLite(t, "secondary")}
+	secondary.failures.Store(1)
+	st := newMirror(t, Config{Primary: primary, Secondaries: []object.ObjectStorage{secondary}})
+
+	if _, err := st.Put(ctx, "k", bytes.NewReader([]byte("payload")), -1, "", nil); err == nil {
+		t.Fatal("Put succeeded although the secondary failed")
+	}
+	if _, err := primary.Stat(ctx, "k"); !errors.Is(err, object.ErrNotFound) {
+		t.Fatalf("primary kept the object of a failed Put: %v", err)
+	}
+	if _, err := st.Put(ctx, "k", bytes.NewReader([]byte("payload")), -1, "", nil); err != nil {
+		t.Fatalf("retried Put: %v", err)
+	}
+}
+
+func TestMirrorAsyncRetry(t *testing.T) {
+	ctx := context.Background()
+	primary := newSQLite(t, "primary")
+	secondary := &flaky{Storage: newSQLite(t, "secondary")}
+	secondary.failures.Store(2)
+	st := newMirror(t, Config{
+		Primary:      primary,
+		Secondaries:  []object.ObjectStorage{secondary},
+		Async:        true,
+		RetryBackoff: time.Millisecond,
+	})
+
+	if _, err := st.Put(ctx, "k", bytes.NewReader([]byte("payload")), -1, "", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	drainCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := st.Drain(drainCtx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if got := content(t, secondary, "k"); got != "payload" {
+		t.Fatalf("secondary after retries: got %q", got)
+	}
+}
+
+func TestMirrorCheckRepair(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := newSQLite(t, "primary"), newSQLite(t, "secondary")
+	st := newMirror(t, Config{Primary: primary, Secondaries: []object.ObjectStorage{secondary}})
+
+	put := func(s object.ObjectStorage, key, body string) {
+		t.Helper()
+		if _, err := s.Put(ctx, key, bytes.NewReader([]byte(body)), -1, "", nil); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+	put(st, "same", "x")
+	put(primary, "missing", "x")
+	put(secondary, "extra", "x")
+	put(primary, "size", "long")
+	put(secondary, "size", "s")
+
+	ds, err := st.Check(ctx, "")
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	got := map[string]DiscrepancyKind{}
+	for _, d := range ds {
+		got[d.Key] = d.Kind
+	}
+	want := map[string]DiscrepancyKind{"missing": Missing, "extra": Extra, "size": SizeMismatch}
+	if len(got) != len(want) {
+		t.Fatalf("Check: got %v want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("Check %s: got %q want %q", k, got[k], v)
+		}
+	}
+
+	if err := st.Repair(ctx, ds); err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+	if ds, err := st.Check(ctx, ""); err != nil || len(ds) != 0 {
+		t.Fatalf("Check after Repair: %v %v", ds, err)
+	}
+}
+
+// presigning is a primary that hands out presigned URLs.
+type presigning struct {
+	*sqlite.Storage
+}
+
+func (p presigning) PresignGet(_ context.Context, key string, _ time.Duration) (string, error) {
+	return "https://primary.example/" + key, nil
+}
+
+func (p presigning) PresignPut(_ context.Context, key string, _ int64, _ time.Duration) (string, error) {
+	return "https://primary.example/" + key, nil
+}
+
+func TestMirrorPresignedUpload(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := newSQLite(t, "primary"), newSQLite(t, "secondary")
+	st := newMirror(t, Config{Primary: presigning{primary}, Secondaries: []object.ObjectStorage{secondary}})
+
+	p, ok := object.AsPresigner(st)
+	if !ok {
+		t.Fatal("mirror hides the presigner of its primary")
+	}
+	if url, err := p.PresignPut(ctx, "a", 6, time.Minute); err != nil || url != "https://primary.example/a" {
+		t.Fatalf("PresignPut: %q, %v", url, err)
+	}
+
+	// The upload through the URL reaches the primary only, until Sync
+	if _, err := primary.Put(ctx, "a", bytes.NewReader([]byte("direct")), -1, "", nil); err != nil {
+		t.Fatalf("primary Put: %v", err)
+	}
+	if err := st.Sync(ctx, "a"); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if got := content(t, secondary, "a"); got != "direct" {
+		t.Fatalf("secondary after Sync: got %q", got)
+	}
+}
@@ -59,12 +59,59 @@ type Deleter interface {
 	Delete(ctx context.Context, key string) error
 }
 
+// Mover exposes server-side copy and rename without streaming the body through the caller.
+type Mover interface {
+	// Copy duplicates src to dst and returns the metadata of dst.
+	Copy(ctx context.Context, src, dst string) (Object, error)
+	// Move renames src to dst; src no longer exists afterwards.
+	Move(ctx context.Context, src, dst string) (Object, error)
+}
+
+// Presigner is optionally implemented by backends that can hand out short-lived URLs,
+// letting clients transfer bytes directly without proxying them through the server.
+type Presigner interface {
+	// PresignGet returns a URL that downloads key with a plain GET until ttl elapses.
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+	// PresignPut returns a URL that uploads key with a plain PUT until ttl elapses.
+	// Backends that can bind the upload size only accept a body of size bytes.
+	PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error)
+}
+
+// Unwrapper is implemented by decorators around another backend, such as a cache.
+type Unwrapper interface {
+	// Unwrap returns the backend that holds the objects of the decorator.
+	Unwrap() ObjectStorage
+}
+
+// AsPresigner returns the Presigner of s or, following Unwrap, of the backend it decorates.
+func AsPresigner(s ObjectStorage) (Presigner, bool) {
+	for s != nil {
+		if p, ok := s.(Presigner); ok {
+			return p, true
+		}
+		u, ok := s.(Unwrapper)
+		if !ok {
+			break
+		}
+		s = u.Unwrap()
+	}
+	return nil, false
+}
+
+// Syncer is optionally implemented by decorators that must learn about objects
+// written around them, e.g. through a URL presigned by the backend they wrap.
+type Syncer interface {
+	// Sync picks up the current content of key from the wrapped backend.
+	Sync(ctx context.Context, key string) error
+}
+
 // ObjectStorage aggregates the full contract for object backends.
 type ObjectStorage interface {
 	Lifecycle
 	Reader
 	Writer
 	Deleter
+	Mover
 	// Stat returns metadata without streaming the body.
 	Stat(ctx context.Context, key string) (Object, error)
 }
@@ -0,0 +1,389 @@
+// Package oidc is a small OpenID Connect relying party: provider discovery, the
+// authorization code flow with PKCE, and ID token validation. Only RS256 signed
+// ID tokens are accepted, which every mainstream provider supports.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Leeway tolerates clock drift between us and the provider when checking token times.
+const Leeway = time.Minute
+
+// Config describes a client registered with an OpenID provider.
+type Config struct {
+	// Issuer is the provider URL, discovery is read from Issuer/.well-known/openid-configuration.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes are requested in addition to "openid".
+	Scopes []string
+	// HTTPClient is used to talk to the provider, defaults to a client with a 10s timeout.
+	HTTPClient *http.Client
+}
+
+// Metadata is the subset of the discovery document this package uses.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims are the ID token claims relevant to logging a user in.
+type Claims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     *boolish `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+	Name              string   `json:"name"`
+
+	// Raw holds every claim, for mapping custom claims.
+	Raw map[string]any `json:"-"`
+}
+
+// EmailTrusted reports whether the provider marked the email as verified. A
+// missing email_verified claim is not trusted, anyone may have typed the address.
+func (c *Claims) EmailTrusted() bool {
+	return c.EmailVerified != nil && bool(*c.EmailVerified)
+}
+
+// EmailUnverified reports whether the provider explicitly marked the email as unverified.
+func (c *Claims) EmailUnverified() bool {
+	return c.EmailVerified != nil && !bool(*c.EmailVerified)
+}
+
+// String returns a string claim by name, or "" if it is missing or not a string.
+func (c *Claims) String(name string) string {
+	s, _ := c.Raw[name].(string)
+	return s
+}
+
+// audience accepts both forms of the aud claim: a string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// boolish accepts true and "true", some providers send booleans as strings.
+type boolish bool
+
+func (b *boolish) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	*b = boolish(s == "true")
+	return nil
+}
+
+// Client talks to one provider. Discovery and signing keys are fetched on first
+// use and cached, so a provider that is down at startup does not keep us down.
+type Client struct {
+	cfg Config
+
+	mu       sync.Mutex
+	metadata *Metadata
+	keys     map[string]*rsa.PublicKey
+	keysAt   time.Time
+}
+
+// New returns a client for the provider in cfg.
+func New(cfg Config) (*Client, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errors.New("oidc: issuer and client id are required")
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{cfg: cfg}, nil
+}
+
+// ClientID returns the client id the ID tokens must be issued for.
+func (c *Client) ClientID() string {
+	return c.cfg.ClientID
+}
+
+// Discover returns the provider metadata, fetching it on first use.
+func (c *Client) Discover(ctx context.Context) (*Metadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.metadata != nil {
+		return c.metadata, nil
+	}
+
+	var metadata Metadata
+	if err := c.getJSON(ctx, c.cfg.Issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+	// The issuer in the document must be the one we were configured with (OIDC Discovery 4.3)
+	if strings.TrimSuffix(metadata.Issuer, "/") != c.cfg.Issuer {
+		return nil, fmt.Errorf("oidc: discovery returned issuer %q, want %q", metadata.Issuer, c.cfg.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing endpoints")
+	}
+	c.metadata = &metadata
+	return c.metadata, nil
+}
+
+// AuthCodeURL returns the URL to send the browser to. The provider redirects back to
+// redirectURL with a code for Exchange and the given state.
+func (c *Client) AuthCodeURL(ctx context.Context, redirectURL, state, nonce, verifier string) (string, error) {
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.cfg.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, c.cfg.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return metadata.AuthorizationEndpoint + sep + query.Encode(), nil
+}
+
+// Exchange trades an authorization code for an ID token and validates it against nonce.
+func (c *Client) Exchange(ctx context.Context, redirectURL, code, verifier, nonce string) (*Claims, error) {
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("oidc: token response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return nil, fmt.Errorf("oidc: token request failed: %s %s", token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("oidc: token response has no id_token")
+	}
+	return c.Verify(ctx, token.IDToken, nonce)
+}
+
+// Verify checks the signature, issuer, audience, lifetime and nonce of an ID token.
+func (c *Client) Verify(ctx context.Context, rawIDToken, nonce string) (*Claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("oidc: id token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("oidc: unsupported id token algorithm %q", header.Alg)
+	}
+	key, err := c.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("oidc: malformed id token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("oidc: invalid id token signature")
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, fmt.Errorf("oidc: id token claims: %w", err)
+	}
+	if err := decodeSegment(parts[1], &claims.Raw); err != nil {
+		return nil, fmt.Errorf("oidc: id token claims: %w", err)
+	}
+
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != c.cfg.Issuer:
+		return nil, fmt.Errorf("oidc: id token issued by %q", claims.Issuer)
+	case !claims.Audience.contains(c.cfg.ClientID):
+		return nil, errors.New("oidc: id token was issued for another client")
+	case claims.Subject == "":
+		return nil, errors.New("oidc: id token has no subject")
+	case now.After(time.Unix(claims.Expiry, 0).Add(Leeway)):
+		return nil, errors.New("oidc: id token expired")
+	case claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(Leeway)):
+		return nil, errors.New("oidc: id token issued in the future")
+	case claims.Nonce != nonce:
+		return nil, errors.New("oidc: id token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// key returns the signing key kid, refetching the key set when kid is unknown
+// (providers rotate keys) but at most once a minute.
+func (c *Client) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(c.keysAt) < time.Minute && c.keys != nil {
+		return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := c.getJSON(ctx, metadata.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc: fetch signing keys: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	c.keys, c.keysAt = keys, time.Now()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	// A single key without kid in the token is unambiguous
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("oidc: unknown signing key %q", kid)
+}
+
+func (c *Client) getJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func decodeSegment(segment string, out any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// RandomString returns a URL safe random string, suitable for state, nonce and PKCE verifiers.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Challenge returns the S256 PKCE code challenge for verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
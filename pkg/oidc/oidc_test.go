@@ -0,0 +1,135 @@
+package oidc_test
+
+import (
+	"codesfer/pkg/oidc"
+	"codesfer/pkg/oidc/oidctest"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newClient(t *testing.T) (*oidc.Client, *oidctest.Provider) {
+	t.Helper()
+	provider := oidctest.NewProvider("codesfer", "s3cret")
+	t.Cleanup(provider.Close)
+	client, err := oidc.New(oidc.Config{Issuer: provider.Issuer(), ClientID: "codesfer", ClientSecret: "s3cret", Scopes: []string{"email"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, provider
+}
+
+// authorize follows the authorization URL and returns the code and state the provider redirected with
+func authorize(t *testing.T, authURL string) (code, state string) {
+	t.Helper()
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d", resp.StatusCode)
+	}
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	client, provider := newClient(t)
+	verified := true
+	provider.SetUser(oidctest.User{Subject: "42", Email: "ada@example.com", EmailVerified: &verified, PreferredUsername: "ada"})
+	ctx := context.Background()
+	const redirect = "http://localhost/callback"
+
+	verifier, _ := oidc.RandomString()
+	authURL, err := client.AuthCodeURL(ctx, redirect, "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(authURL, "scope=openid+email") || !strings.Contains(authURL, "code_challenge="+oidc.Challenge(verifier)) {
+		t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+
+	code, state := authorize(t, authURL)
+	if state != "state-1" {
+		t.Fatalf("state: got %q", state)
+	}
+	if _, err := client.Exchange(ctx, redirect, code, "wrong verifier", "nonce-1"); err == nil {
+		t.Fatal("exchange with wrong PKCE verifier succeeded")
+	}
+
+	code, _ = authorize(t, authURL)
+	claims, err := client.Exchange(ctx, redirect, code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "42" || claims.Email != "ada@example.com" || claims.String("preferred_username") != "ada" || !claims.EmailTrusted() {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+}
+
+func TestVerifyRejectsBadTokens(t *testing.T) {
+	client, provider := newClient(t)
+	ctx := context.Background()
+	now := time.Now()
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss": provider.Issuer(), "sub": "1", "aud": "codesfer", "nonce": "n",
+			"iat": now.Unix(), "exp": now.Add(time.Minute).Unix(),
+		}
+	}
+	if _, err := client.Verify(ctx, provider.Sign(valid()), "n"); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	tests := map[string]func(claims map[string]any){
+		"wrong nonce":    func(c map[string]any) { c["nonce"] = "other" },
+		"wrong audience": func(c map[string]any) { c["aud"] = []string{"someone-else"} },
+		"wrong issuer":   func(c map[string]any) { c["iss"] = "https://evil.example.com" },
+		"expired":        func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() },
+		"no subject":     func(c map[string]any) { delete(c, "sub") },
+	}
+	for name, mutate := range tests {
+		claims := valid()
+		mutate(claims)
+		if _, err := client.Verify(ctx, provider.Sign(claims), "n"); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	token := provider.Sign(valid())
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + strings.TrimRight(parts[1], "=") + "x." + parts[2]
+	if _, err := client.Verify(ctx, tampered, "n"); err == nil {
+		t.Error("tampered token accepted")
+	}
+	// alg "none" must never be accepted
+	unsigned := "eyJhbGciOiJub25lIn0." + parts[1] + "."
+	if _, err := client.Verify(ctx, unsigned, "n"); err == nil {
+		t.Error("unsigned token accepted")
+	}
+}
+
+func TestEmailVerifiedClaim(t *testing.T) {
+	client, provider := newClient(t)
+	unverified := false
+	claims, err := client.Verify(context.Background(), provider.IDToken(oidctest.User{Subject: "1", EmailVerified: &unverified}, ""), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.EmailTrusted() || !claims.EmailUnverified() {
+		t.Fatal("email_verified=false must not be trusted")
+	}
+
+	claims, err = client.Verify(context.Background(), provider.IDToken(oidctest.User{Subject: "1"}, ""), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.EmailTrusted() || claims.EmailUnverified() {
+		t.Fatal("a missing email_verified must be neither trusted nor unverified")
+	}
+}
@@ -10,7 +10,9 @@ import (
 	"io"
 	"maps"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -271,6 +273,73 @@ func (s *Storage) Delete(ctx context.Context, key string) error {
 	return mapError(err)
 }
 
+// Copy duplicates src to dst server-side via CopyObject.
+func (s *Storage) Copy(ctx context.Context, src, dst string) (object.Object, error) {
+	if err := s.ensureClient(); err != nil {
+		return object.Object{}, err
+	}
+
+	if _, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(dst),
+		CopySource: aws.String(s.bucket + "/" + url.PathEscape(src)),
+	}); err != nil {
+		return object.Object{}, mapError(err)
+	}
+
+	return s.Stat(ctx, dst)
+}
+
+// Move copies src to dst and removes src; R2 has no native rename.
+func (s *Storage) Move(ctx context.Context, src, dst string) (object.Object, error) {
+	if src == dst {
+		return s.Stat(ctx, src)
+	}
+
+	obj, err := s.Copy(ctx, src, dst)
+	if err != nil {
+		return object.Object{}, err
+	}
+	if err := s.Delete(ctx, src); err != nil {
+		return object.Object{}, err
+	}
+	return obj, nil
+}
+
+// PresignGet returns a SigV4 presigned GET URL valid for ttl.
+func (s *Storage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if err := s.ensureClient(); err != nil {
+		return "", err
+	}
+
+	req, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", fmt.Errorf("r2: presign get: %w", err)
+	}
+	return req.URL, nil
+}
+
+// PresignPut returns a SigV4 presigned PUT URL valid for ttl. The content length is
+// signed, so the URL only accepts a body of exactly size bytes.
+func (s *Storage) PresignPut(ctx context.Context, key string, size int64, ttl time.Duration) (string, error) {
+	if err := s.ensureClient(); err != nil {
+		return "", err
+	}
+
+	req, err := s3.NewPresignClient(s.client).PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		ContentLength: aws.Int64(size),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", fmt.Errorf("r2: presign put: %w", err)
+	}
+	return req.URL, nil
+}
+
 func (s *Storage) ensureClient() error {
 	if s.client == nil {
 		return errors.New("r2: client not initialized")
@@ -351,5 +420,8 @@ func mapError(err error) error {
 	return err
 }
 
-// Ensure Storage implements ObjectStorage interface.
-var _ object.ObjectStorage = (*Storage)(nil)
+// Ensure Storage implements ObjectStorage and Presigner interfaces.
+var (
+	_ object.ObjectStorage = (*Storage)(nil)
+	_ object.Presigner     = (*Storage)(nil)
+)
@@ -93,6 +93,26 @@ func ObjectImplements(t *testing.T, ctx context.Context, obj object.ObjectStorag
 		t.Fatalf("Get: expected size %d got %d", len(content), gotObj.Size)
 	}
 
+	copyKey := key + ".copy"
+	copyObj, err := obj.Copy(ctx, key, copyKey)
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if copyObj.Key != copyKey || copyObj.Size != int64(len(content)) {
+		t.Fatalf("Copy: unexpected metadata %+v", copyObj)
+	}
+
+	movedKey := key + ".moved"
+	if _, err := obj.Move(ctx, copyKey, movedKey); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if _, err := obj.Stat(ctx, copyKey); !errors.Is(err, object.ErrNotFound) {
+		t.Fatalf("Stat after move: expected ErrNotFound, got %v", err)
+	}
+	if err := obj.Delete(ctx, movedKey); err != nil {
+		t.Fatalf("Delete moved: %v", err)
+	}
+
 	if err := obj.Delete(ctx, key); err != nil {
 		t.Fatalf("Delete: %v", err)
 	}
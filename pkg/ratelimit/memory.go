@@ -0,0 +1,44 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory is a Store for a single process.
+type Memory struct {
+	mu     sync.Mutex
+	states map[string]State
+}
+
+// NewMemory returns an empty in-memory Store.
+func NewMemory() *Memory {
+	return &Memory{states: make(map[string]State)}
+}
+
+// Update implements Store.
+func (m *Memory) Update(_ context.Context, key string, fn func(*State)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.states[key]
+	fn(&st)
+	if st == (State{}) {
+		delete(m.states, key)
+	} else {
+		m.states[key] = st
+	}
+	return nil
+}
+
+// Prune implements Store.
+func (m *Memory) Prune(_ context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, st := range m.states {
+		if st.Updated.Before(before) {
+			delete(m.states, key)
+		}
+	}
+	return nil
+}
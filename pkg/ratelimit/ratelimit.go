@@ -0,0 +1,183 @@
+// Package ratelimit throttles requests with token buckets and locks keys out
+// after repeated failures. The state lives in a Store: in memory for a single
+// process, or in a SQL database shared by several processes.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// idleExpiry is how long an untouched state is kept. A bucket idle this long is
+// full again and old failures are forgiven.
+const idleExpiry = 24 * time.Hour
+
+// Rate allows Limit requests per Window, in bursts of up to Limit.
+type Rate struct {
+	Limit  int
+	Window time.Duration
+}
+
+// Lockout locks a key out after Threshold failures, for Base at first and
+// twice as long for every further failure, up to Max.
+type Lockout struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+}
+
+// State is what a Store keeps per key.
+type State struct {
+	// Tokens left in the bucket, as of Updated.
+	Tokens float64
+	// Failures counts consecutive failures.
+	Failures    int
+	LockedUntil time.Time
+	Updated     time.Time
+}
+
+// Store persists limiter states.
+type Store interface {
+	// Update atomically applies fn to the state of key. A missing key starts from
+	// the zero State, and a key left with the zero State is deleted.
+	Update(ctx context.Context, key string, fn func(*State)) error
+	// Prune deletes the states last updated before the given time.
+	Prune(ctx context.Context, before time.Time) error
+}
+
+// Limiter applies rates and lockouts on top of a Store. A nil Limiter never limits.
+type Limiter struct {
+	store Store
+	now   func() time.Time
+
+	mu     sync.Mutex
+	pruned time.Time
+}
+
+// New returns a Limiter keeping its state in store.
+func New(store Store) *Limiter {
+	return &Limiter{store: store, now: time.Now}
+}
+
+// update loads the state of key, forgetting it once idle, and prunes the store
+// about once an hour
+func (l *Limiter) update(ctx context.Context, key string, fn func(now time.Time, st *State)) error {
+	now := l.now()
+	l.mu.Lock()
+	prune := now.Sub(l.pruned) > time.Hour
+	if prune {
+		l.pruned = now
+	}
+	l.mu.Unlock()
+	if prune {
+		if err := l.store.Prune(ctx, now.Add(-idleExpiry)); err != nil {
+			log.Printf("ratelimit: prune: %v", err)
+		}
+	}
+
+	return l.store.Update(ctx, key, func(st *State) {
+		if !st.Updated.IsZero() && now.Sub(st.Updated) > idleExpiry {
+			*st = State{}
+		}
+		fn(now, st)
+	})
+}
+
+// Allow takes a token from the bucket of key. It returns zero if the request may
+// proceed and otherwise how long until the next token.
+func (l *Limiter) Allow(ctx context.Context, key string, rate Rate) (time.Duration, error) {
+	if l == nil || rate.Limit <= 0 {
+		return 0, nil
+	}
+	perToken := rate.Window / time.Duration(rate.Limit)
+	var wait time.Duration
+	err := l.update(ctx, "rate:"+key, func(now time.Time, st *State) {
+		tokens := float64(rate.Limit)
+		if !st.Updated.IsZero() {
+			tokens = min(tokens, st.Tokens+float64(now.Sub(st.Updated))/float64(perToken))
+		}
+		if tokens < 1 {
+			wait = time.Duration((1 - tokens) * float64(perToken))
+			return
+		}
+		st.Tokens, st.Updated = tokens-1, now
+	})
+	return wait, err
+}
+
+// Locked returns how long key stays locked out, zero if it is not.
+func (l *Limiter) Locked(ctx context.Context, key string) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+	var wait time.Duration
+	err := l.update(ctx, "lock:"+key, func(now time.Time, st *State) {
+		wait = max(st.LockedUntil.Sub(now), 0)
+	})
+	return wait, err
+}
+
+// Fail records a failure for key and returns how long it is now locked out.
+func (l *Limiter) Fail(ctx context.Context, key string, lockout Lockout) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+	var wait time.Duration
+	err := l.update(ctx, "lock:"+key, func(now time.Time, st *State) {
+		st.Failures++
+		st.Updated = now
+		if st.Failures < lockout.Threshold {
+			return
+		}
+		wait = lockout.Base << min(st.Failures-lockout.Threshold, 30)
+		if wait > lockout.Max || wait <= 0 {
+			wait = lockout.Max
+		}
+		st.LockedUntil = now.Add(wait)
+	})
+	return wait, err
+}
+
+// Reset forgets the failures of key, e.g. after a successful login.
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	if l == nil {
+		return nil
+	}
+	return l.store.Update(ctx, "lock:"+key, func(st *State) { *st = State{} })
+}
+
+// Limit is a middleware allowing rate requests per key. Requests with an empty key pass.
+func (l *Limiter) Limit(rate Rate, key func(r *http.Request) string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k := key(r)
+			if k == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wait, err := l.Allow(r.Context(), k, rate)
+			if err != nil {
+				// A broken store should not take the API down with it
+				log.Printf("ratelimit: %s: %v", k, err)
+			}
+			if wait > 0 {
+				TooManyRequests(w, wait)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// TooManyRequests rejects a request with 429 and a Retry-After header.
+func TooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("too many attempts, try again in %s", time.Duration(seconds)*time.Second), http.StatusTooManyRequests)
+}
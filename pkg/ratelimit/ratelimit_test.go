@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// stores returns a fresh instance of every Store implementation
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "limits.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sqlStore, err := NewSQL(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{"memory": NewMemory(), "sql": sqlStore}
+}
+
+// clock is a manually advanced time source
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newLimiter(store Store) (*Limiter, *clock) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	l := New(store)
+	l.now = c.now
+	return l, c
+}
+
+func TestTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	rate := Rate{Limit: 3, Window: 3 * time.Second}
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			l, c := newLimiter(store)
+			for i := range 3 {
+				if wait, err := l.Allow(ctx, "ip", rate); err != nil || wait != 0 {
+					t.Fatalf("request %d: wait %v, err %v", i, wait, err)
+				}
+			}
+			if wait, _ := l.Allow(ctx, "ip", rate); wait != time.Second {
+				t.Fatalf("burst exhausted: want wait 1s, got %v", wait)
+			}
+			if wait, _ := l.Allow(ctx, "other", rate); wait != 0 {
+				t.Fatal("keys must not share a bucket")
+			}
+
+			c.advance(500 * time.Millisecond)
+			if wait, _ := l.Allow(ctx, "ip", rate); wait != 500*time.Millisecond {
+				t.Fatalf("half refilled: want wait 500ms, got %v", wait)
+			}
+			c.advance(500 * time.Millisecond)
+			if wait, _ := l.Allow(ctx, "ip", rate); wait != 0 {
+				t.Fatalf("refilled token denied, wait %v", wait)
+			}
+		})
+	}
+}
+
+func TestLockout(t *testing.T) {
+	ctx := context.Background()
+	lockout := Lockout{Threshold: 3, Base: time.Minute, Max: 3 * time.Minute}
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			l, c := newLimiter(store)
+			for range 2 {
+				if wait, _ := l.Fail(ctx, "alice", lockout); wait != 0 {
+					t.Fatalf("locked before the threshold for %v", wait)
+				}
+			}
+			if wait, _ := l.Locked(ctx, "alice"); wait != 0 {
+				t.Fatal("locked before the threshold")
+			}
+
+			// Every failure past the threshold doubles the lockout, up to Max
+			for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+				if wait, _ := l.Fail(ctx, "alice", lockout); wait != want {
+					t.Fatalf("want lockout %v, got %v", want, wait)
+				}
+			}
+			c.advance(time.Minute)
+			if wait, _ := l.Locked(ctx, "alice"); wait != 2*time.Minute {
+				t.Fatalf("want 2m left, got %v", wait)
+			}
+			if wait, _ := l.Locked(ctx, "bob"); wait != 0 {
+				t.Fatal("lockout leaked to another key")
+			}
+
+			if err := l.Reset(ctx, "alice"); err != nil {
+				t.Fatal(err)
+			}
+			if wait, _ := l.Locked(ctx, "alice"); wait != 0 {
+				t.Fatal("still locked after reset")
+			}
+			if wait, _ := l.Fail(ctx, "alice", lockout); wait != 0 {
+				t.Fatal("reset did not forget the failures")
+			}
+
+			// Failures are forgiven once idle
+			l.Fail(ctx, "alice", lockout)
+			c.advance(idleExpiry + time.Second)
+			if wait, _ := l.Fail(ctx, "alice", lockout); wait != 0 {
+				t.Fatal("old failures were not forgiven")
+			}
+		})
+	}
+}
+
+func TestSQLConcurrentUpdates(t *testing.T) {
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "limits.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := NewSQL(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := New(store)
+	lockout := Lockout{Threshold: 1000, Base: time.Minute, Max: time.Hour}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if _, err := l.Fail(context.Background(), "key", lockout); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failures int
+	db.QueryRow("SELECT failures FROM rate_limits WHERE key = 'lock:key'").Scan(&failures)
+	if failures != 40 {
+		t.Fatalf("lost updates: want 40 failures, got %d", failures)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	l := New(NewMemory())
+	handler := l.Limit(Rate{Limit: 1, Window: time.Minute}, func(r *http.Request) string {
+		return r.Header.Get("X-Key")
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Key", key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := serve("a"); rec.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", rec.Code)
+	}
+	rec := serve("a")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("second request: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := serve(""); rec.Code != http.StatusOK {
+		t.Fatal("requests without a key must pass")
+	}
+
+	var nilLimiter *Limiter
+	if wait, err := nilLimiter.Allow(context.Background(), "a", Rate{Limit: 1, Window: time.Hour}); wait != 0 || err != nil {
+		t.Fatal("a nil limiter must not limit")
+	}
+}
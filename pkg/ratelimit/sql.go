@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxRetries bounds how often SQL.Update retries after losing a race with another process
+const maxRetries = 10
+
+// SQL is a Store in a SQLite (or libSQL) database, so processes sharing the
+// database share their limits. Updates are optimistic: a row is only written if
+// its version did not change since it was read.
+type SQL struct {
+	db *sql.DB
+}
+
+// NewSQL creates the rate_limits table in db if needed.
+func NewSQL(db *sql.DB) (*SQL, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS rate_limits (
+		key VARCHAR(255) PRIMARY KEY,
+		tokens REAL NOT NULL,
+		failures INTEGER NOT NULL,
+		locked_until INTEGER NOT NULL,
+		updated INTEGER NOT NULL,
+		version INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit: create table: %w", err)
+	}
+	return &SQL{db: db}, nil
+}
+
+// Update implements Store.
+func (s *SQL) Update(ctx context.Context, key string, fn func(*State)) error {
+	for range maxRetries {
+		var (
+			st                         State
+			lockedUntil, updated, vers int64
+		)
+		err := s.db.QueryRowContext(ctx,
+			"SELECT tokens, failures, locked_until, updated, version FROM rate_limits WHERE key = ?", key,
+		).Scan(&st.Tokens, &st.Failures, &lockedUntil, &updated, &vers)
+		exists := err == nil
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("ratelimit: read %s: %w", key, err)
+		}
+		if exists {
+			st.LockedUntil, st.Updated = fromUnix(lockedUntil), fromUnix(updated)
+		}
+
+		before := st
+		fn(&st)
+		if st == before {
+			return nil
+		}
+
+		var result sql.Result
+		switch {
+		case st == (State{}):
+			result, err = s.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE key = ? AND version = ?", key, vers)
+		case exists:
+			result, err = s.db.ExecContext(ctx,
+				"UPDATE rate_limits SET tokens = ?, failures = ?, locked_until = ?, updated = ?, version = version + 1 WHERE key = ? AND version = ?",
+				st.Tokens, st.Failures, toUnix(st.LockedUntil), toUnix(st.Updated), key, vers,
+			)
+		default:
+			result, err = s.db.ExecContext(ctx,
+				"INSERT INTO rate_limits (key, tokens, failures, locked_until, updated, version) VALUES (?, ?, ?, ?, ?, 0) ON CONFLICT (key) DO NOTHING",
+				key, st.Tokens, st.Failures, toUnix(st.LockedUntil), toUnix(st.Updated),
+			)
+		}
+		if err != nil {
+			return fmt.Errorf("ratelimit: write %s: %w", key, err)
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			return nil
+		}
+		// Another process changed the row in the meantime, start over
+	}
+	return fmt.Errorf("ratelimit: update %s: too much contention", key)
+}
+
+// Prune implements Store.
+func (s *SQL) Prune(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE updated < ?", toUnix(before))
+	return err
+}
+
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnix(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
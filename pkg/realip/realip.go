@@ -0,0 +1,217 @@
+// Package realip finds the address of a client behind reverse proxies.
+// Forwarding headers are only believed when they come from a trusted proxy,
+// so a client talking to the server directly cannot spoof its address.
+package realip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// DefaultTrusted trusts proxies on loopback and private networks, where a
+// reverse proxy in front of the server usually runs.
+var DefaultTrusted = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+}
+
+// Cloudflare are the networks of Cloudflare's edge, as published on
+// https://www.cloudflare.com/ips/.
+var Cloudflare = []netip.Prefix{
+	netip.MustParsePrefix("173.245.48.0/20"),
+	netip.MustParsePrefix("103.21.244.0/22"),
+	netip.MustParsePrefix("103.22.200.0/22"),
+	netip.MustParsePrefix("103.31.4.0/22"),
+	netip.MustParsePrefix("141.101.64.0/18"),
+	netip.MustParsePrefix("108.162.192.0/18"),
+	netip.MustParsePrefix("190.93.240.0/20"),
+	netip.MustParsePrefix("188.114.96.0/20"),
+	netip.MustParsePrefix("197.234.240.0/22"),
+	netip.MustParsePrefix("198.41.128.0/17"),
+	netip.MustParsePrefix("162.158.0.0/15"),
+	netip.MustParsePrefix("104.16.0.0/13"),
+	netip.MustParsePrefix("104.24.0.0/14"),
+	netip.MustParsePrefix("172.64.0.0/13"),
+	netip.MustParsePrefix("131.0.72.0/22"),
+	netip.MustParsePrefix("2400:cb00::/32"),
+	netip.MustParsePrefix("2606:4700::/32"),
+	netip.MustParsePrefix("2803:f800::/32"),
+	netip.MustParsePrefix("2405:b500::/32"),
+	netip.MustParsePrefix("2405:8100::/32"),
+	netip.MustParsePrefix("2a06:98c0::/29"),
+	netip.MustParsePrefix("2c0f:f248::/32"),
+}
+
+// ParseTrusted parses a comma separated list of networks and addresses. The
+// keywords "private" and "cloudflare" stand for DefaultTrusted and Cloudflare.
+func ParseTrusted(list string) ([]netip.Prefix, error) {
+	var trusted []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		switch strings.ToLower(entry) {
+		case "":
+			continue
+		case "private":
+			trusted = append(trusted, DefaultTrusted...)
+			continue
+		case "cloudflare":
+			trusted = append(trusted, Cloudflare...)
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			trusted = append(trusted, prefix.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("realip: invalid trusted proxy %q", entry)
+		}
+		trusted = append(trusted, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+	}
+	return trusted, nil
+}
+
+// Resolver computes client addresses. The zero Resolver trusts no proxy and
+// always returns the address of the connection.
+type Resolver struct {
+	// Trusted are the networks of proxies whose forwarding headers are believed.
+	Trusted []netip.Prefix
+	// Headers are consulted in order and the first one holding an address wins.
+	// X-Forwarded-For is walked back past trusted proxies, any other header, such
+	// as CF-Connecting-IP or X-Real-IP, holds the client address as set by the
+	// proxy in front of the server. Defaults to X-Forwarded-For.
+	Headers []string
+}
+
+// IsTrusted reports whether ip belongs to a trusted proxy.
+func (r Resolver) IsTrusted(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range r.Trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent req. Headers are only
+// believed when the connection comes from a trusted proxy. In X-Forwarded-For
+// the client is the first hop that is not a trusted proxy, counting from the
+// server: hops further left were added by the client and could be anything.
+func (r Resolver) ClientIP(req *http.Request) (netip.Addr, error) {
+	peer, err := RemoteAddr(req)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if !r.IsTrusted(peer) {
+		return peer, nil
+	}
+
+	headers := r.Headers
+	if len(headers) == 0 {
+		headers = []string{"X-Forwarded-For"}
+	}
+	for _, header := range headers {
+		if http.CanonicalHeaderKey(header) != "X-Forwarded-For" {
+			if ip, ok := parseHop(strings.TrimSpace(req.Header.Get(header))); ok {
+				return ip, nil
+			}
+			continue
+		}
+		hops := ParseForwardedFor(req.Header.Values("X-Forwarded-For"))
+		for i := len(hops) - 1; i >= 0; i-- {
+			if !r.IsTrusted(hops[i]) {
+				return hops[i], nil
+			}
+		}
+		// Every hop is a proxy we trust, so the first one is the client
+		if len(hops) > 0 {
+			return hops[0], nil
+		}
+	}
+	return peer, nil
+}
+
+type contextKey struct{}
+
+// Middleware computes the client address of every request once and stores it in
+// the request context for FromRequest. Requests whose address cannot be
+// determined are rejected.
+func (r Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip, err := r.ClientIP(req)
+		if err != nil {
+			http.Error(w, "bad request, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, ip)))
+	})
+}
+
+// FromRequest returns the client address stored by Middleware, or the address
+// of the connection if the request did not pass through it.
+func FromRequest(req *http.Request) (netip.Addr, error) {
+	if ip, ok := req.Context().Value(contextKey{}).(netip.Addr); ok {
+		return ip, nil
+	}
+	return RemoteAddr(req)
+}
+
+// RemoteAddr returns the address of the peer that opened the connection.
+func RemoteAddr(req *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, errors.New("realip: invalid remote address " + req.RemoteAddr)
+	}
+	return ip.Unmap(), nil
+}
+
+// ParseForwardedFor returns the hops in X-Forwarded-For header values, client
+// first. Repeated headers are concatenated, ports and brackets are stripped.
+// A malformed entry drops the hops before it: whoever wrote it could have
+// written those too, only the hops after it were appended by proxies.
+func ParseForwardedFor(values []string) []netip.Addr {
+	var hops []netip.Addr
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			ip, ok := parseHop(entry)
+			if !ok {
+				hops = hops[:0]
+				continue
+			}
+			hops = append(hops, ip)
+		}
+	}
+	return hops
+}
+
+// parseHop parses "1.2.3.4", "1.2.3.4:5678", "2001:db8::1", "[2001:db8::1]" or "[2001:db8::1]:5678"
+func parseHop(entry string) (netip.Addr, bool) {
+	if ip, err := netip.ParseAddr(entry); err == nil {
+		return ip.Unmap(), true
+	}
+	if addrPort, err := netip.ParseAddrPort(entry); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	if strings.HasPrefix(entry, "[") && strings.HasSuffix(entry, "]") {
+		return parseHop(entry[1 : len(entry)-1])
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,141 @@
+package realip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParseForwardedFor(t *testing.T) {
+	tests := map[string]struct {
+		values []string
+		want   []string
+	}{
+		"single":         {[]string{"203.0.113.7"}, []string{"203.0.113.7"}},
+		"chain":          {[]string{"203.0.113.7, 10.0.0.2 ,10.0.0.1"}, []string{"203.0.113.7", "10.0.0.2", "10.0.0.1"}},
+		"repeated":       {[]string{"203.0.113.7", "10.0.0.1"}, []string{"203.0.113.7", "10.0.0.1"}},
+		"ports":          {[]string{"203.0.113.7:4711, [2001:db8::1]:443, [2001:db8::2]"}, []string{"203.0.113.7", "2001:db8::1", "2001:db8::2"}},
+		"mapped":         {[]string{"::ffff:203.0.113.7"}, []string{"203.0.113.7"}},
+		"garbage before": {[]string{"1.1.1.1, nonsense, 203.0.113.7"}, []string{"203.0.113.7"}},
+		"empty entries":  {[]string{" , 203.0.113.7,"}, []string{"203.0.113.7"}},
+	}
+	for name, tt := range tests {
+		var got []string
+		for _, ip := range ParseForwardedFor(tt.values) {
+			got = append(got, ip.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	resolver := Resolver{Trusted: DefaultTrusted}
+	tests := map[string]struct {
+		remote string
+		xff    string
+		want   string
+	}{
+		"direct":                     {"203.0.113.7:5000", "", "203.0.113.7"},
+		"untrusted peer is believed": {"203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		"behind a proxy":             {"127.0.0.1:5000", "198.51.100.1", "198.51.100.1"},
+		"spoofed first hop":          {"127.0.0.1:5000", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		"two proxies":                {"10.0.0.1:5000", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		"only proxies":               {"10.0.0.1:5000", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		"proxy without header":       {"[::1]:5000", "", "::1"},
+	}
+	for name, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		got, err := resolver.ClientIP(req)
+		if err != nil || got != netip.MustParseAddr(tt.want) {
+			t.Errorf("%s: got %v, %v, want %s", name, got, err, tt.want)
+		}
+	}
+}
+
+func TestHeaderPrecedence(t *testing.T) {
+	// Cloudflare in front of an internal nginx
+	trusted, err := ParseTrusted("cloudflare, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(remote string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return req
+	}
+
+	forwarded := Resolver{Trusted: trusted}
+	req := request("10.0.0.5:80", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 104.16.0.1"})
+	if ip, _ := forwarded.ClientIP(req); ip != netip.MustParseAddr("198.51.100.1") {
+		t.Fatalf("X-Forwarded-For through cloudflare and nginx: got %v", ip)
+	}
+
+	cf := Resolver{Trusted: trusted, Headers: []string{"CF-Connecting-IP", "X-Forwarded-For"}}
+	req = request("10.0.0.5:80", map[string]string{"Cf-Connecting-Ip": "198.51.100.2", "X-Forwarded-For": "198.51.100.1"})
+	if ip, _ := cf.ClientIP(req); ip != netip.MustParseAddr("198.51.100.2") {
+		t.Fatalf("CF-Connecting-IP first: got %v", ip)
+	}
+	req = request("10.0.0.5:80", map[string]string{"X-Forwarded-For": "198.51.100.1"})
+	if ip, _ := cf.ClientIP(req); ip != netip.MustParseAddr("198.51.100.1") {
+		t.Fatalf("falling back to X-Forwarded-For: got %v", ip)
+	}
+	req = request("203.0.113.9:80", map[string]string{"Cf-Connecting-Ip": "198.51.100.2"})
+	if ip, _ := cf.ClientIP(req); ip != netip.MustParseAddr("203.0.113.9") {
+		t.Fatalf("header from an untrusted peer: got %v", ip)
+	}
+
+	var none Resolver
+	req = request("127.0.0.1:80", map[string]string{"X-Forwarded-For": "198.51.100.1"})
+	if ip, _ := none.ClientIP(req); ip != netip.MustParseAddr("127.0.0.1") {
+		t.Fatalf("zero resolver believed a header: got %v", ip)
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	trusted, err := ParseTrusted("192.0.2.1, 10.1.2.3/8, ::1, private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]netip.Prefix{
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+	}, DefaultTrusted...)
+	if !slices.Equal(trusted, want) {
+		t.Fatalf("got %v", trusted)
+	}
+	if _, err := ParseTrusted("10.0.0.0/8, nginx"); err == nil {
+		t.Fatal("invalid entry accepted")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	resolver := Resolver{Trusted: DefaultTrusted}
+	var got netip.Addr
+	handler := resolver.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = FromRequest(r)
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:80"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != netip.MustParseAddr("198.51.100.1") {
+		t.Fatalf("got %v", got)
+	}
+
+	// Without the middleware only the connection counts
+	if ip, _ := FromRequest(req); ip != netip.MustParseAddr("127.0.0.1") {
+		t.Fatalf("got %v", ip)
+	}
+}
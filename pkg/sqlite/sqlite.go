@@ -242,6 +242,71 @@ func (s *Storage) Delete(ctx context.Context, key string) error {
 	return err
 }
 
+// Copy duplicates src to dst with a single INSERT ... SELECT, so the blob never leaves SQLite.
+func (s *Storage) Copy(ctx context.Context, src, dst string) (object.Object, error) {
+	if err := s.ensureDB(); err != nil {
+		return object.Object{}, err
+	}
+
+	query := fmt.Sprintf(`INSERT INTO %s (key, data, size, etag, content_type, last_modified, meta) SELECT ?, data, size, etag, content_type, ?, meta FROM %s WHERE key = ?`, s.table, s.table)
+	if s.allowOverwrite {
+		query += ` ON CONFLICT(key) DO UPDATE SET data=excluded.data, size=excluded.size, etag=excluded.etag, content_type=excluded.content_type, last_modified=excluded.last_modified, meta=excluded.meta`
+	}
+
+	res, err := s.db.ExecContext(ctx, query, dst, time.Now().UTC().Format(time.RFC3339Nano), src)
+	if err != nil {
+		if isConflict(err) {
+			return object.Object{}, object.ErrConflict
+		}
+		return object.Object{}, fmt.Errorf("sqlite: copy object: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return object.Object{}, object.ErrNotFound
+	}
+
+	return s.Stat(ctx, dst)
+}
+
+// Move renames src to dst by rewriting the primary key in place.
+func (s *Storage) Move(ctx context.Context, src, dst string) (object.Object, error) {
+	if err := s.ensureDB(); err != nil {
+		return object.Object{}, err
+	}
+	if src == dst {
+		return s.Stat(ctx, src)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return object.Object{}, fmt.Errorf("sqlite: begin move: %w", err)
+	}
+	defer tx.Rollback()
+
+	if s.allowOverwrite {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE key = ? AND EXISTS (SELECT 1 FROM %s WHERE key = ?)`, s.table, s.table), dst, src); err != nil {
+			return object.Object{}, fmt.Errorf("sqlite: move object: %w", err)
+		}
+	}
+
+	query := fmt.Sprintf(`UPDATE %s SET key = ?, last_modified = ? WHERE key = ?`, s.table)
+	res, err := tx.ExecContext(ctx, query, dst, time.Now().UTC().Format(time.RFC3339Nano), src)
+	if err != nil {
+		if isConflict(err) {
+			return object.Object{}, object.ErrConflict
+		}
+		return object.Object{}, fmt.Errorf("sqlite: move object: %w", err)
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		return object.Object{}, object.ErrNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return object.Object{}, fmt.Errorf("sqlite: commit move: %w", err)
+	}
+
+	return s.Stat(ctx, dst)
+}
+
 func (s *Storage) save(ctx context.Context, key string, r io.Reader, contentType string, meta map[string]string) (object.Object, error) {
 	if err := s.ensureDB(); err != nil {
 		return object.Object{}, err
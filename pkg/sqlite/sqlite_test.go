@@ -189,3 +189,60 @@ func TestSQLiteList(t *testing.T) {
 		}
 	}
 }
+
+func TestSQLiteCopyMove(t *testing.T) {
+	ctx := context.Background()
+	st := newTestStorage(t, false)
+
+	content := []byte("copy me")
+	if _, err := st.Put(ctx, "src", bytes.NewReader(content), int64(len(content)), "text/plain", map[string]string{"k": "v"}); err != nil {
+		t.Fatalf("setup Put: %v", err)
+	}
+
+	copied, err := st.Copy(ctx, "src", "dst")
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if copied.Key != "dst" || copied.Size != int64(len(content)) || copied.ContentType != "text/plain" || copied.CustomMeta["k"] != "v" {
+		t.Fatalf("Copy: unexpected metadata %+v", copied)
+	}
+	if _, err := st.Stat(ctx, "src"); err != nil {
+		t.Fatalf("Stat src after copy: %v", err)
+	}
+	if _, err := st.Copy(ctx, "src", "dst"); !errors.Is(err, object.ErrConflict) {
+		t.Fatalf("Copy onto existing key: expected ErrConflict got %v", err)
+	}
+	if _, err := st.Copy(ctx, "missing", "other"); !errors.Is(err, object.ErrNotFound) {
+		t.Fatalf("Copy missing: expected ErrNotFound got %v", err)
+	}
+
+	moved, err := st.Move(ctx, "src", "renamed/src")
+	if err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if moved.Key != "renamed/src" || moved.ETag != copied.ETag {
+		t.Fatalf("Move: unexpected metadata %+v", moved)
+	}
+	if _, err := st.Stat(ctx, "src"); !errors.Is(err, object.ErrNotFound) {
+		t.Fatalf("Stat src after move: expected ErrNotFound got %v", err)
+	}
+	if _, err := st.Move(ctx, "renamed/src", "dst"); !errors.Is(err, object.ErrConflict) {
+		t.Fatalf("Move onto existing key: expected ErrConflict got %v", err)
+	}
+	if _, err := st.Move(ctx, "missing", "other"); !errors.Is(err, object.ErrNotFound) {
+		t.Fatalf("Move missing: expected ErrNotFound got %v", err)
+	}
+
+	_, rc, err := st.Get(ctx, "renamed/src", nil)
+	if err != nil {
+		t.Fatalf("Get after move: %v", err)
+	}
+	defer rc.Close()
+	body, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Get read after move: %v", err)
+	}
+	if string(body) != string(content) {
+		t.Fatalf("Get after move: content mismatch, got %q want %q", string(body), string(content))
+	}
+}
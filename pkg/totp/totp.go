@@ -0,0 +1,107 @@
+// Package totp implements time-based one-time passwords (RFC 6238) compatible
+// with common authenticator apps: HMAC-SHA1, 6 digits, 30 second steps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Period is the lifetime of a code.
+	Period = 30 * time.Second
+	// Digits is the length of a code.
+	Digits = 6
+	// Skew is how many steps before and after the current one are accepted, to
+	// tolerate clock drift and typing time.
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random 160-bit secret, base32 encoded as authenticator apps expect.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Step returns the time step t falls into.
+func Step(t time.Time) uint64 {
+	return uint64(t.Unix() / int64(Period/time.Second))
+}
+
+// Code returns the code for secret at time t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decode(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, Step(t), Digits), nil
+}
+
+// Validate checks code against secret around time t and returns the matching
+// step. Callers should reject steps at or before the last one accepted, so a
+// code cannot be replayed.
+func Validate(secret, code string, t time.Time) (uint64, bool) {
+	key, err := decode(secret)
+	if err != nil || len(code) != Digits {
+		return 0, false
+	}
+	now := Step(t)
+	for i := -Skew; i <= Skew; i++ {
+		step := now + uint64(i)
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step, Digits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth:// URI authenticator apps import, usually through a QR code.
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Period/time.Second)))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func decode(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := encoding.DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, fmt.Errorf("totp: invalid secret: %w", err)
+	}
+	return key, nil
+}
+
+// hotp is the HMAC-based one-time password of RFC 4226.
+func hotp(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for range digits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
@@ -0,0 +1,81 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// SHA1 test vectors from RFC 6238 appendix B.
+func TestRFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		if got := hotp(key, Step(time.Unix(v.unix, 0)), 8); got != v.code {
+			t.Errorf("t=%d: got %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+// HOTP test vectors from RFC 4226 appendix D.
+func TestRFC4226Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for i, code := range want {
+		if got := hotp(key, uint64(i), 6); got != code {
+			t.Errorf("counter %d: got %s, want %s", i, got, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(59, 0)
+
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatalf("code: %v", err)
+	}
+	if code != "287082" {
+		t.Fatalf("got %s, want the last 6 digits of the RFC vector", code)
+	}
+
+	if step, ok := Validate(secret, code, now.Add(Period)); !ok || step != Step(now) {
+		t.Fatalf("code from the previous step rejected: %d %v", step, ok)
+	}
+	if _, ok := Validate(secret, code, now.Add(3*Period)); ok {
+		t.Fatal("stale code accepted")
+	}
+	if _, ok := Validate(secret, "000000", now); ok {
+		t.Fatal("wrong code accepted")
+	}
+	// Apps show secrets in lowercase groups, both must decode
+	if _, ok := Validate(strings.ToLower(secret[:4])+" "+secret[4:], code, now); !ok {
+		t.Fatal("formatted secret rejected")
+	}
+}
+
+func TestGenerateSecretAndURI(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if len(secret) != 32 {
+		t.Fatalf("unexpected secret length %d", len(secret))
+	}
+	uri := URI("codesfer", "me@example.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/codesfer:me@example.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Fatalf("unexpected uri %s", uri)
+	}
+}